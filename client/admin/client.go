@@ -1350,9 +1350,13 @@ type GetAdminAuditResponse struct {
 			// - factor_unenrolled
 			// - challenge_created
 			// - verification_attempted
+			// - factor_verified
 			// - factor_deleted
 			// - recovery_codes_deleted
+			// - recovery_code_verified
 			// - factor_updated
+			// - factor_imported
+			// - mfa_reset_by_admin
 			// - mfa_code_login
 			Action        *string `json:"action,omitempty"`
 			ActorId       *string `json:"actor_id,omitempty"`
@@ -1973,9 +1977,13 @@ func ParseGetAdminAuditResponse(rsp *http.Response) (*GetAdminAuditResponse, err
 				// - factor_unenrolled
 				// - challenge_created
 				// - verification_attempted
+				// - factor_verified
 				// - factor_deleted
 				// - recovery_codes_deleted
+				// - recovery_code_verified
 				// - factor_updated
+				// - factor_imported
+				// - mfa_reset_by_admin
 				// - mfa_code_login
 				Action        *string `json:"action,omitempty"`
 				ActorId       *string `json:"actor_id,omitempty"`
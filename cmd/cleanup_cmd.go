@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/supabase/auth/internal/conf"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+var cleanupDryRun bool
+var cleanupRecoveryCodeRetention time.Duration
+
+func cleanupCmd() *cobra.Command {
+	var cleanupCmd = &cobra.Command{
+		Use:  "cleanup",
+		Long: "Delete expired MFA challenges, abandoned MFA enrollments and, optionally, used MFA recovery codes.",
+		Run: func(cmd *cobra.Command, args []string) {
+			execWithConfigAndArgs(cmd, cleanup, args)
+		},
+	}
+
+	cleanupCmd.Flags().BoolVar(&cleanupDryRun, "dry-run", false, "Report the number of rows that would be deleted without deleting them")
+	cleanupCmd.Flags().DurationVar(&cleanupRecoveryCodeRetention, "recovery-code-retention", 0, "Also delete recovery codes used longer ago than this duration, e.g. 720h")
+
+	return cleanupCmd
+}
+
+type cleanupResult struct {
+	table string
+	rows  int
+}
+
+func cleanup(config *conf.GlobalConfiguration, args []string) {
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	var results []cleanupResult
+	err = db.Transaction(func(tx *storage.Connection) error {
+		var rows int
+		var terr error
+		if cleanupDryRun {
+			rows, terr = models.CountExpiredChallenges(tx, config.MFA.ChallengeExpiryDuration)
+		} else {
+			rows, terr = models.DeleteExpiredChallenges(tx, config.MFA.ChallengeExpiryDuration)
+		}
+		if terr != nil {
+			return terr
+		}
+		results = append(results, cleanupResult{table: models.Challenge{}.TableName(), rows: rows})
+
+		if cleanupDryRun {
+			rows, terr = models.CountExpiredEnrollments(tx, config.MFA.EnrollmentExpiry)
+		} else {
+			rows, terr = models.DeleteExpiredEnrollments(tx, config.MFA.EnrollmentExpiry)
+		}
+		if terr != nil {
+			return terr
+		}
+		results = append(results, cleanupResult{table: models.Factor{}.TableName(), rows: rows})
+
+		if cleanupRecoveryCodeRetention > 0 {
+			if cleanupDryRun {
+				rows, terr = models.CountUsedRecoveryCodes(tx, cleanupRecoveryCodeRetention)
+			} else {
+				rows, terr = models.DeleteUsedRecoveryCodes(tx, cleanupRecoveryCodeRetention)
+			}
+			if terr != nil {
+				return terr
+			}
+			results = append(results, cleanupResult{table: models.RecoveryCode{}.TableName(), rows: rows})
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Fatalf("Error cleaning up: %+v", err)
+	}
+
+	action := "Deleted"
+	if cleanupDryRun {
+		action = "Would Delete"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', tabwriter.TabIndent)
+	fmt.Fprintf(w, "Table\t%s\n", action)
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%d\n", result.table, result.rows)
+	}
+	if err := w.Flush(); err != nil {
+		logrus.Fatalf("Error writing cleanup summary: %+v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/supabase/auth/internal/conf"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+func mfaCmd() *cobra.Command {
+	var mfaCmd = &cobra.Command{
+		Use: "mfa",
+	}
+
+	mfaCmd.AddCommand(&mfaEncryptSecretsCmd, &mfaHashRecoveryCodesCmd)
+
+	return mfaCmd
+}
+
+var mfaEncryptSecretsCmd = cobra.Command{
+	Use:   "encrypt-secrets",
+	Short: "Encrypt MFA factor secrets that are still stored in plaintext",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfigAndArgs(cmd, mfaEncryptSecrets, args)
+	},
+}
+
+var mfaHashRecoveryCodesCmd = cobra.Command{
+	Use:   "hash-recovery-codes",
+	Short: "Hash MFA recovery codes that are still stored in plaintext",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfigAndArgs(cmd, mfaHashRecoveryCodes, args)
+	},
+}
+
+func mfaEncryptSecrets(config *conf.GlobalConfiguration, args []string) {
+	if !config.Security.DBEncryption.Encrypt {
+		logrus.Fatal("Database encryption is not enabled, set GOTRUE_SECURITY_DB_ENCRYPTION_ENCRYPT to encrypt MFA secrets")
+	}
+
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	var updated int
+	err = db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		updated, terr = models.EncryptPlaintextFactorSecrets(tx, config.Security.DBEncryption.EncryptionKeyID, config.Security.DBEncryption.EncryptionKey)
+		return terr
+	})
+	if err != nil {
+		logrus.Fatalf("Error encrypting MFA secrets: %+v", err)
+	}
+
+	logrus.Infof("Encrypted %d MFA factor secrets", updated)
+}
+
+func mfaHashRecoveryCodes(config *conf.GlobalConfiguration, args []string) {
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	var updated int
+	err = db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		updated, terr = models.HashPlaintextRecoveryCodes(tx)
+		return terr
+	})
+	if err != nil {
+		logrus.Fatalf("Error hashing MFA recovery codes: %+v", err)
+	}
+
+	logrus.Infof("Hashed %d MFA recovery codes", updated)
+}
@@ -1,15 +1,20 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/pop/v6/logging"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/supabase/auth/internal/conf"
+	"github.com/supabase/auth/internal/storage"
 )
 
 var migrateCmd = cobra.Command{
@@ -18,7 +23,77 @@ var migrateCmd = cobra.Command{
 	Run:  migrate,
 }
 
+// migrateOutput selects how the migration status is reported, either as the
+// human readable table logged at debug level or as json on stdout
+var migrateOutput = "table"
+
+// migrationStatus is the state of a migration in the json output. AppliedAt
+// is unset for pending migrations and for those applied before the migration
+// table recorded it.
+type migrationStatus struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Migrated  bool       `json:"migrated"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// appliedMigration is a row of the migration table
+type appliedMigration struct {
+	Version   string     `db:"version"`
+	AppliedAt *time.Time `db:"applied_at"`
+}
+
 func migrate(cmd *cobra.Command, args []string) {
+	if migrateOutput != "table" && migrateOutput != "json" {
+		logrus.Fatalf("Unsupported output %q, must be table or json", migrateOutput)
+	}
+
+	log, db, mig := openMigrator(cmd)
+	defer db.Close()
+
+	log.Debugf("before status")
+
+	if log.Level == logrus.DebugLevel && migrateOutput == "table" {
+		if err := printMigrationStatus(os.Stdout, mig, migrateOutput); err != nil {
+			log.Fatalf("%+v", errors.Wrap(err, "migration status"))
+		}
+	}
+
+	// turn off schema dump
+	mig.SchemaPath = ""
+
+	err := mig.Up()
+	if err != nil {
+		log.Fatalf("%v", errors.Wrap(err, "running db migrations"))
+	} else {
+		log.Infof("GoTrue migrations applied successfully")
+	}
+
+	log.Debugf("after status")
+
+	if migrateOutput == "json" || log.Level == logrus.DebugLevel {
+		if err := printMigrationStatus(os.Stdout, mig, migrateOutput); err != nil {
+			log.Fatalf("%+v", errors.Wrap(err, "migration status"))
+		}
+	}
+}
+
+// printMigrationStatus writes the status of every migration in the given
+// output format, table or json
+func printMigrationStatus(out io.Writer, mig pop.FileMigrator, output string) error {
+	if output != "json" {
+		return mig.Status(out)
+	}
+	statuses, err := migrationStatuses(mig)
+	if err != nil {
+		return err
+	}
+	return writeMigrationStatus(out, statuses)
+}
+
+// openMigrator connects to the database and reads the migrations, exiting
+// on errors. The caller closes the returned connection.
+func openMigrator(cmd *cobra.Command) (*logrus.Logger, *pop.Connection, pop.FileMigrator) {
 	globalConfig := loadGlobalConfig(cmd.Context())
 
 	if globalConfig.DB.Driver == "" && globalConfig.DB.URL != "" {
@@ -28,6 +103,7 @@ func migrate(cmd *cobra.Command, args []string) {
 		}
 		globalConfig.DB.Driver = u.Scheme
 	}
+	globalConfig.DB.Driver = storage.NormalizeDriver(globalConfig.DB.Driver)
 
 	log := logrus.StandardLogger()
 
@@ -50,6 +126,17 @@ func migrate(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	db, mig, err := newMigrator(globalConfig)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	return log, db, mig
+}
+
+// newMigrator connects to the database and reads the migrations from the
+// configured migrations path
+func newMigrator(globalConfig *conf.GlobalConfiguration) (*pop.Connection, pop.FileMigrator, error) {
 	u, _ := url.Parse(globalConfig.DB.URL)
 	processedUrl := globalConfig.DB.URL
 	if len(u.Query()) != 0 {
@@ -68,44 +155,66 @@ func migrate(cmd *cobra.Command, args []string) {
 
 	db, err := pop.NewConnection(deets)
 	if err != nil {
-		log.Fatalf("%+v", errors.Wrap(err, "opening db connection"))
+		return nil, pop.FileMigrator{}, errors.Wrap(err, "opening db connection")
 	}
-	defer db.Close()
-
 	if err := db.Open(); err != nil {
-		log.Fatalf("%+v", errors.Wrap(err, "checking database connection"))
+		return nil, pop.FileMigrator{}, errors.Wrap(err, "checking database connection")
 	}
 
-	log.Debugf("Reading migrations from %s", globalConfig.DB.MigrationsPath)
+	logrus.Debugf("Reading migrations from %s", globalConfig.DB.MigrationsPath)
 	mig, err := pop.NewFileMigrator(globalConfig.DB.MigrationsPath, db)
 	if err != nil {
-		log.Fatalf("%+v", errors.Wrap(err, "creating db migrator"))
+		db.Close()
+		return nil, pop.FileMigrator{}, errors.Wrap(err, "creating db migrator")
 	}
-	log.Debugf("before status")
 
-	if log.Level == logrus.DebugLevel {
-		err = mig.Status(os.Stdout)
-		if err != nil {
-			log.Fatalf("%+v", errors.Wrap(err, "migration status"))
-		}
-	}
+	return db, mig, nil
+}
 
-	// turn off schema dump
-	mig.SchemaPath = ""
+// migrationStatuses checks which of the migrations have been applied, and
+// when, from the migration table
+func migrationStatuses(mig pop.FileMigrator) ([]migrationStatus, error) {
+	c := mig.Connection
+	mtn := c.MigrationTableName()
 
-	err = mig.Up()
+	// the applied_at column is only added by a migration, so it is missing
+	// until the database has been migrated
+	hasAppliedAt, err := c.Where("table_name = ? and column_name = 'applied_at' and table_schema = any(current_schemas(false))", mtn).Exists("information_schema.columns")
 	if err != nil {
-		log.Fatalf("%v", errors.Wrap(err, "running db migrations"))
-	} else {
-		log.Infof("GoTrue migrations applied successfully")
+		return nil, errors.Wrap(err, "checking migration table columns")
+	}
+	appliedAt := "null::timestamptz"
+	if hasAppliedAt {
+		appliedAt = "applied_at"
 	}
 
-	log.Debugf("after status")
+	var rows []appliedMigration
+	if err := c.RawQuery(fmt.Sprintf("select version, %s as applied_at from %s", appliedAt, mtn)).All(&rows); err != nil {
+		return nil, errors.Wrap(err, "reading migration table")
+	}
+	applied := make(map[string]*appliedMigration, len(rows))
+	for i := range rows {
+		applied[rows[i].Version] = &rows[i]
+	}
 
-	if log.Level == logrus.DebugLevel {
-		err = mig.Status(os.Stdout)
-		if err != nil {
-			log.Fatalf("%+v", errors.Wrap(err, "migration status"))
+	statuses := make([]migrationStatus, 0, len(mig.UpMigrations.Migrations))
+	for _, mf := range mig.UpMigrations.Migrations {
+		status := migrationStatus{
+			ID:   mf.Version,
+			Name: mf.Name,
 		}
+		if row, ok := applied[mf.Version]; ok {
+			status.Migrated = true
+			status.AppliedAt = row.AppliedAt
+		}
+		statuses = append(statuses, status)
 	}
+	return statuses, nil
+}
+
+// writeMigrationStatus writes the statuses as a json array
+func writeMigrationStatus(out io.Writer, statuses []migrationStatus) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(statuses)
 }
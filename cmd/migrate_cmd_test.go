@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/auth/internal/conf"
+)
+
+func TestWriteMigrationStatus(t *testing.T) {
+	appliedAt := time.Date(2024, 8, 1, 9, 0, 0, 0, time.UTC)
+	statuses := []migrationStatus{
+		{ID: "20240801090000", Name: "add_mfa_enroll_idempotency_keys", Migrated: true, AppliedAt: &appliedAt},
+		{ID: "20240802090000", Name: "add_mfa_challenges_first_totp_step", Migrated: false},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, writeMigrationStatus(&out, statuses))
+
+	var decoded []map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	require.Len(t, decoded, 2)
+	require.Equal(t, "20240801090000", decoded[0]["id"])
+	require.Equal(t, true, decoded[0]["migrated"])
+	require.Equal(t, "2024-08-01T09:00:00Z", decoded[0]["applied_at"])
+	require.Equal(t, false, decoded[1]["migrated"])
+	require.NotContains(t, decoded[1], "applied_at")
+
+	// an empty status is still an array
+	out.Reset()
+	require.NoError(t, writeMigrationStatus(&out, []migrationStatus{}))
+	require.JSONEq(t, "[]", out.String())
+}
+
+func TestRollbackPlan(t *testing.T) {
+	statuses := []migrationStatus{
+		{ID: "20240801090000", Name: "add_mfa_enroll_idempotency_keys", Migrated: true},
+		{ID: "20240802090000", Name: "add_mfa_challenges_first_totp_step", Migrated: true},
+		{ID: "20240803090000", Name: "add_mfa_challenges_force_reauth", Migrated: false},
+	}
+	down := map[string]bool{
+		"20240802090000": true,
+		"20240803090000": true,
+	}
+
+	// pending migrations are skipped, the latest applied one is rolled back
+	versions, err := rollbackPlan(statuses, down, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"20240802090000"}, versions)
+
+	// a migration without a down file stops the rollback
+	_, err = rollbackPlan(statuses, down, 2)
+	require.ErrorContains(t, err, "20240801090000_add_mfa_enroll_idempotency_keys has no down migration")
+
+	down["20240801090000"] = true
+	versions, err = rollbackPlan(statuses, down, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"20240802090000", "20240801090000"}, versions)
+
+	_, err = rollbackPlan(statuses, down, 3)
+	require.ErrorContains(t, err, "only 2 have been applied")
+}
+
+func TestConfirmRollback(t *testing.T) {
+	for answer, expected := range map[string]bool{
+		"y\n":   true,
+		"YES\n": true,
+		"n\n":   false,
+		"\n":    false,
+		"":      false,
+	} {
+		var out bytes.Buffer
+		ok, err := confirmRollback(strings.NewReader(answer), &out, []string{"20240803090000"})
+		require.NoError(t, err)
+		require.Equal(t, expected, ok, answer)
+		require.Contains(t, out.String(), "20240803090000")
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	statuses := []migrationStatus{
+		{ID: "20240801090000", Name: "add_mfa_enroll_idempotency_keys", Migrated: true},
+		{ID: "20240802090000", Name: "add_mfa_challenges_first_totp_step", Migrated: false},
+		{ID: "20240803090000", Name: "add_mfa_challenges_force_reauth", Migrated: false},
+	}
+
+	pending := pendingMigrations(statuses)
+	require.Len(t, pending, 2)
+	require.Equal(t, "20240802090000", pending[0].ID)
+	require.Equal(t, "20240803090000", pending[1].ID)
+
+	// listing pending migrations leaves the statuses as they were
+	require.False(t, statuses[2].Migrated)
+	require.Empty(t, pendingMigrations(statuses[:1]))
+}
+
+func TestRollbackMigrations(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal("../hack/test.env")
+	require.NoError(t, err)
+	globalConfig.DB.MigrationsPath = "../migrations"
+
+	db, mig, err := newMigrator(globalConfig)
+	require.NoError(t, err)
+	defer db.Close()
+	mig.SchemaPath = ""
+
+	require.NoError(t, mig.Up())
+	// leave the database fully migrated for the other tests
+	defer func() {
+		require.NoError(t, mig.Up())
+	}()
+
+	migrated := func(version string) bool {
+		statuses, err := migrationStatuses(mig)
+		require.NoError(t, err)
+		for _, status := range statuses {
+			if status.ID == version {
+				return status.Migrated
+			}
+		}
+		require.FailNow(t, "unknown migration", version)
+		return false
+	}
+
+	statuses, err := migrationStatuses(mig)
+	require.NoError(t, err)
+	latest := statuses[len(statuses)-1].ID
+	previous := statuses[len(statuses)-2].ID
+
+	versions, err := rollbackPlan(statuses, downVersions(mig), 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{latest, previous}, versions)
+	require.NoError(t, rollbackMigrations(mig, versions))
+	require.False(t, migrated(latest))
+	require.False(t, migrated(previous))
+
+	// with the latest migration pending only the applied one is rolled back
+	_, err = mig.UpTo(1)
+	require.NoError(t, err)
+	require.True(t, migrated(previous))
+	require.False(t, migrated(latest))
+
+	statuses, err = migrationStatuses(mig)
+	require.NoError(t, err)
+	versions, err = rollbackPlan(statuses, downVersions(mig), 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{previous}, versions)
+	require.NoError(t, rollbackMigrations(mig, versions))
+	require.False(t, migrated(previous))
+
+	// a version that is not applied is not rolled back again
+	require.Error(t, rollbackMigrations(mig, versions))
+
+	// the rolled back migrations apply again
+	require.NoError(t, mig.Up())
+	require.True(t, migrated(previous))
+	require.True(t, migrated(latest))
+
+	// the latest migration adds applied_at, so only it records when it ran
+	statuses, err = migrationStatuses(mig)
+	require.NoError(t, err)
+	require.NotNil(t, statuses[len(statuses)-1].AppliedAt)
+	require.Nil(t, statuses[len(statuses)-2].AppliedAt)
+
+	// migrations without a down file are refused before anything runs
+	_, err = rollbackPlan(statuses, map[string]bool{}, 1)
+	require.ErrorContains(t, err, "has no down migration")
+}
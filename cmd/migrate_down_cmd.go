@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var migrateDownSteps int
+var migrateDownYes bool
+
+func migrateDownCmd() *cobra.Command {
+	var downCmd = &cobra.Command{
+		Use:  "down",
+		Long: "Roll back the most recently applied migrations. Only migrations with a .down.sql file can be rolled back, the rollback is refused before anything runs if one of them has none.",
+		Run:  migrateDown,
+	}
+
+	downCmd.Flags().IntVar(&migrateDownSteps, "steps", 1, "Number of migrations to roll back")
+	downCmd.Flags().BoolVar(&migrateDownYes, "yes", false, "Roll back without asking for confirmation")
+
+	return downCmd
+}
+
+func migrateDown(cmd *cobra.Command, args []string) {
+	if migrateDownSteps < 1 {
+		logrus.Fatalf("--steps must be at least 1")
+	}
+
+	log, db, mig := openMigrator(cmd)
+	defer db.Close()
+
+	statuses, err := migrationStatuses(mig)
+	if err != nil {
+		log.Fatalf("%+v", errors.Wrap(err, "migration status"))
+	}
+
+	versions, err := rollbackPlan(statuses, downVersions(mig), migrateDownSteps)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	if !migrateDownYes {
+		ok, err := confirmRollback(os.Stdin, os.Stdout, versions)
+		if err != nil {
+			log.Fatalf("%+v", errors.Wrap(err, "reading confirmation"))
+		}
+		if !ok {
+			log.Infof("Rollback cancelled")
+			return
+		}
+	}
+
+	if err := rollbackMigrations(mig, versions); err != nil {
+		log.Fatalf("%v", errors.Wrap(err, "rolling back db migrations"))
+	}
+
+	for _, version := range versions {
+		fmt.Fprintln(os.Stdout, version)
+	}
+	log.Infof("Rolled back %d GoTrue migrations", len(versions))
+}
+
+// downVersions returns the versions of the migrations that have a down file
+func downVersions(mig pop.FileMigrator) map[string]bool {
+	versions := make(map[string]bool, len(mig.DownMigrations.Migrations))
+	for _, mf := range mig.DownMigrations.Migrations {
+		versions[mf.Version] = true
+	}
+	return versions
+}
+
+// rollbackMigrations runs the down files of exactly the given versions in
+// order, each in its own transaction together with removing the version from
+// the migration table. pop's Migrator.Down is not used as it picks the down
+// files by position and could roll back a pending migration.
+func rollbackMigrations(mig pop.FileMigrator, versions []string) error {
+	down := make(map[string]pop.Migration, len(mig.DownMigrations.Migrations))
+	for _, mf := range mig.DownMigrations.Migrations {
+		down[mf.Version] = mf
+	}
+
+	c := mig.Connection
+	mtn := c.MigrationTableName()
+	for _, version := range versions {
+		mf, ok := down[version]
+		if !ok {
+			return errors.Errorf("migration %s has no down migration and cannot be rolled back", version)
+		}
+		err := c.Transaction(func(tx *pop.Connection) error {
+			if err := mf.Run(tx); err != nil {
+				return err
+			}
+			count, err := tx.RawQuery(fmt.Sprintf("delete from %s where version = ?", mtn), version).ExecWithCount()
+			if err != nil {
+				return errors.Wrapf(err, "deleting migration version %s", version)
+			}
+			if count == 0 {
+				return errors.Errorf("migration %s has not been applied", version)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "rolling back migration %s_%s", version, mf.Name)
+		}
+	}
+	return nil
+}
+
+// rollbackPlan returns the versions of the latest steps applied migrations,
+// newest first. Every one of them needs a down file, otherwise pop would
+// skip it and roll back an older migration instead.
+func rollbackPlan(statuses []migrationStatus, down map[string]bool, steps int) ([]string, error) {
+	var versions []string
+	for i := len(statuses) - 1; i >= 0 && len(versions) < steps; i-- {
+		if !statuses[i].Migrated {
+			continue
+		}
+		if !down[statuses[i].ID] {
+			return nil, errors.Errorf("migration %s_%s has no down migration and cannot be rolled back", statuses[i].ID, statuses[i].Name)
+		}
+		versions = append(versions, statuses[i].ID)
+	}
+	if len(versions) < steps {
+		return nil, errors.Errorf("cannot roll back %d migrations, only %d have been applied", steps, len(versions))
+	}
+	return versions, nil
+}
+
+// confirmRollback asks whether the migrations should be rolled back
+func confirmRollback(in io.Reader, out io.Writer, versions []string) (bool, error) {
+	fmt.Fprintf(out, "Roll back migrations %s? [y/N] ", strings.Join(versions, ", "))
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
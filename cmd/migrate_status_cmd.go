@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func migrateStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:  "status",
+		Long: "Show which migrations have been applied and which are pending, without applying any.",
+		Run:  migrateStatus,
+	}
+}
+
+func migrateStatus(cmd *cobra.Command, args []string) {
+	if migrateOutput != "table" && migrateOutput != "json" {
+		logrus.Fatalf("Unsupported output %q, must be table or json", migrateOutput)
+	}
+
+	log, db, mig := openMigrator(cmd)
+	defer db.Close()
+
+	if err := printMigrationStatus(os.Stdout, mig, migrateOutput); err != nil {
+		log.Fatalf("%+v", errors.Wrap(err, "migration status"))
+	}
+
+	statuses, err := migrationStatuses(mig)
+	if err != nil {
+		log.Fatalf("%+v", errors.Wrap(err, "migration status"))
+	}
+	log.Infof("%d GoTrue migrations pending", len(pendingMigrations(statuses)))
+}
+
+// pendingMigrations returns the migrations that have not been applied yet
+func pendingMigrations(statuses []migrationStatus) []migrationStatus {
+	var pending []migrationStatus
+	for _, status := range statuses {
+		if !status.Migrated {
+			pending = append(pending, status)
+		}
+	}
+	return pending
+}
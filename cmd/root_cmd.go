@@ -21,8 +21,11 @@ var rootCmd = cobra.Command{
 
 // RootCommand will setup and return the root command
 func RootCommand() *cobra.Command {
-	rootCmd.AddCommand(&serveCmd, &migrateCmd, &versionCmd, adminCmd())
+	rootCmd.AddCommand(&serveCmd, &migrateCmd, &versionCmd, adminCmd(), mfaCmd(), cleanupCmd())
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "the config file to use")
+	migrateCmd.AddCommand(migrateDownCmd())
+	migrateCmd.AddCommand(migrateStatusCmd())
+	migrateCmd.PersistentFlags().StringVar(&migrateOutput, "output", "table", "Migration status output, table (logged at debug level when migrating) or json")
 
 	return &rootCmd
 }
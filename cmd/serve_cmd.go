@@ -25,6 +25,9 @@ func serve(ctx context.Context) {
 	if err != nil {
 		logrus.WithError(err).Fatal("unable to load config")
 	}
+	if config.MFA.FactorExpiryDuration > 0 {
+		logrus.Warn("GOTRUE_MFA_FACTOR_EXPIRY_DURATION is deprecated, use GOTRUE_MFA_ENROLLMENT_EXPIRY instead")
+	}
 
 	db, err := storage.Dial(config)
 	if err != nil {
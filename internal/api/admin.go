@@ -2,8 +2,11 @@ package api
 
 import (
 	"context"
+	"encoding/base32"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/fatih/structs"
@@ -14,6 +17,7 @@ import (
 	"github.com/supabase/auth/internal/models"
 	"github.com/supabase/auth/internal/observability"
 	"github.com/supabase/auth/internal/storage"
+	"github.com/supabase/auth/internal/utilities"
 )
 
 type AdminUserParams struct {
@@ -40,6 +44,25 @@ type adminUserUpdateFactorParams struct {
 	FactorType   string `json:"factor_type"`
 }
 
+type adminUserImportFactorParams struct {
+	FactorType   string `json:"factor_type"`
+	Secret       string `json:"secret"`
+	FriendlyName string `json:"friendly_name"`
+}
+
+type adminMFABulkParams struct {
+	Role   string `json:"role"`
+	Action string `json:"action"`
+}
+
+type AdminMFABulkResponse struct {
+	AffectedUsers int `json:"affected_users"`
+}
+
+// adminMFABulkBatchSize is the number of users updated per transaction by
+// adminMFABulk
+const adminMFABulkBatchSize = 500
+
 type AdminListUsersResponse struct {
 	Users []*models.User `json:"users"`
 	Aud   string         `json:"aud"`
@@ -204,6 +227,11 @@ func (a *API) adminUserUpdate(w http.ResponseWriter, r *http.Request) error {
 			if terr := user.UpdatePassword(tx, nil); terr != nil {
 				return terr
 			}
+			// a password reset by an admin suggests the account was
+			// compromised, recovery codes are invalidated along with it
+			if terr := models.InvalidateRecoveryCodesByUser(tx, user); terr != nil {
+				return terr
+			}
 		}
 
 		var identities []models.Identity
@@ -569,26 +597,209 @@ func (a *API) adminUserDeleteFactor(w http.ResponseWriter, r *http.Request) erro
 
 	err := a.db.Transaction(func(tx *storage.Connection) error {
 		if terr := models.NewAuditLogEntry(r, tx, user, models.DeleteFactorAction, r.RemoteAddr, map[string]interface{}{
-			"user_id":   user.ID,
-			"factor_id": factor.ID,
+			"user_id":     user.ID,
+			"factor_id":   factor.ID,
+			"factor_type": factor.FactorType,
 		}); terr != nil {
 			return terr
 		}
-		if terr := tx.Destroy(factor); terr != nil {
+		if terr := factor.SoftDelete(tx); terr != nil {
 			return internalServerError("Database error deleting factor").WithInternalError(terr)
 		}
+		if a.config.MFA.FactorDeleteRevokesSessions {
+			if terr := models.LogoutSessionsByFactorID(tx, factor.ID); terr != nil {
+				return internalServerError("Database error revoking sessions").WithInternalError(terr)
+			}
+		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+	a.triggerMFAEvent(r, MFAEventFactorDeleted, user, factor)
 	return sendJSON(w, http.StatusOK, factor)
 }
 
+// adminMFAStats reports aggregate counts of factors, challenges and recovery
+// codes across all users for capacity planning
+func (a *API) adminMFAStats(w http.ResponseWriter, r *http.Request) error {
+	db := a.db.WithContext(r.Context())
+
+	stats, err := models.GetMFAStats(db, a.config.MFA.ChallengeExpiryDuration)
+	if err != nil {
+		return internalServerError("Database error computing MFA stats").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, stats)
+}
+
+// adminMFABulk requires or stops requiring MFA from all users of a role.
+// Users are updated in batches, each in its own transaction, so that large
+// roles don't lock the users table for long.
+func (a *API) adminMFABulk(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.db.WithContext(ctx)
+	adminUser := getAdminUser(ctx)
+
+	params := &adminMFABulkParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+	if params.Role == "" {
+		return badRequestError(ErrorCodeValidationFailed, "role is required")
+	}
+	var required bool
+	switch params.Action {
+	case "enable":
+		required = true
+	case "disable":
+		required = false
+	default:
+		return badRequestError(ErrorCodeValidationFailed, "action must be enable or disable")
+	}
+
+	affected := 0
+	for {
+		var count int
+		err := db.Transaction(func(tx *storage.Connection) error {
+			var terr error
+			count, terr = models.SetMFARequiredByRole(tx, params.Role, required, adminMFABulkBatchSize)
+			return terr
+		})
+		if err != nil {
+			return internalServerError("Database error updating users").WithInternalError(err)
+		}
+		affected += count
+		if count < adminMFABulkBatchSize {
+			break
+		}
+	}
+
+	if err := models.NewAuditLogEntry(r, db, adminUser, models.BulkUpdateMFAAction, "", map[string]interface{}{
+		"role":           params.Role,
+		"action":         params.Action,
+		"affected_users": affected,
+	}); err != nil {
+		return internalServerError("Error recording audit log entry").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, &AdminMFABulkResponse{
+		AffectedUsers: affected,
+	})
+}
+
+// adminUserResetMFA removes all of the user's factors, challenges and recovery
+// codes, e.g. for a user who lost access to their factors. The user's sessions
+// are downgraded to AAL1.
+func (a *API) adminUserResetMFA(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	factors := user.Factors
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(r, tx, adminUser, models.ResetMFAAction, "", map[string]interface{}{
+			"user_id":      user.ID,
+			"factor_count": len(factors),
+		}); terr != nil {
+			return terr
+		}
+		for i := range factors {
+			if terr := factors[i].DowngradeSessionsToAAL1(tx); terr != nil {
+				return terr
+			}
+		}
+		if terr := models.DeleteChallengesByUserID(tx, user.ID); terr != nil {
+			return terr
+		}
+		if terr := models.SoftDeleteFactorsByUserID(tx, user.ID); terr != nil {
+			return terr
+		}
+		if terr := models.DeleteRecoveryCodesByUser(tx, user); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return internalServerError("Database error resetting MFA").WithInternalError(err)
+	}
+	for i := range factors {
+		a.triggerMFAEvent(r, MFAEventFactorDeleted, user, &factors[i])
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// adminUserRevokeTrustedDevices revokes all of the user's trusted devices, e.g.
+// when signing the user out everywhere. Sign ins from these devices have to
+// complete MFA again.
+func (a *API) adminUserRevokeTrustedDevices(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(r, tx, adminUser, models.RevokeTrustedDevicesAction, "", map[string]interface{}{
+			"user_id": user.ID,
+		}); terr != nil {
+			return terr
+		}
+		return user.RevokeTrustedDevices(tx)
+	})
+	if err != nil {
+		return internalServerError("Database error revoking trusted devices").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// UsedRecoveryCode describes when and where a recovery code was used, never
+// the code itself
+type UsedRecoveryCode struct {
+	ID         uuid.UUID `json:"id"`
+	BatchID    uuid.UUID `json:"batch_id"`
+	VerifiedAt time.Time `json:"verified_at"`
+	IP         *string   `json:"ip,omitempty"`
+}
+
+// UsedRecoveryCodesResponse lists the user's used recovery codes
+type UsedRecoveryCodesResponse struct {
+	RecoveryCodes []UsedRecoveryCode `json:"recovery_codes"`
+	LastUsedAt    *time.Time         `json:"last_used_at,omitempty"`
+}
+
+// adminUserUsedRecoveryCodes lists the user's used recovery codes, most
+// recently used first, for reviewing incidents
+func (a *API) adminUserUsedRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	db := a.db.WithContext(ctx)
+
+	codes, err := models.FindUsedRecoveryCodesByUser(db, user)
+	if err != nil {
+		return internalServerError("Database error finding recovery codes").WithInternalError(err)
+	}
+
+	response := &UsedRecoveryCodesResponse{
+		RecoveryCodes: make([]UsedRecoveryCode, 0, len(codes)),
+	}
+	for _, code := range codes {
+		response.RecoveryCodes = append(response.RecoveryCodes, UsedRecoveryCode{
+			ID:         code.ID,
+			BatchID:    code.BatchID,
+			VerifiedAt: *code.VerifiedAt,
+			IP:         code.VerifiedIP,
+		})
+	}
+	if len(codes) > 0 {
+		response.LastUsedAt = codes[0].VerifiedAt
+	}
+	return sendJSON(w, http.StatusOK, response)
+}
+
 func (a *API) adminUserGetFactors(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	user := getUser(ctx)
-	return sendJSON(w, http.StatusOK, user.Factors)
+	return a.listFactors(w, r, user)
 }
 
 // adminUserUpdate updates a single factor object
@@ -633,3 +844,103 @@ func (a *API) adminUserUpdateFactor(w http.ResponseWriter, r *http.Request) erro
 
 	return sendJSON(w, http.StatusOK, factor)
 }
+
+// minImportedTOTPSecretLength is the minimum decoded length in bytes of an
+// imported TOTP secret, matching the 80 bit minimum of RFC 4226.
+const minImportedTOTPSecretLength = 10
+
+// isWeakTOTPSecret reports whether a decoded TOTP secret is obviously not
+// random: a single repeated byte, a run of increasing or decreasing bytes,
+// or fewer distinct bytes than half its length
+func isWeakTOTPSecret(secret []byte) bool {
+	increasing, decreasing := true, true
+	for i := 1; i < len(secret); i++ {
+		if secret[i] != secret[i-1]+1 {
+			increasing = false
+		}
+		if secret[i] != secret[i-1]-1 {
+			decreasing = false
+		}
+	}
+	if increasing || decreasing {
+		return true
+	}
+
+	distinct := make(map[byte]bool, len(secret))
+	for _, b := range secret {
+		distinct[b] = true
+	}
+	return len(distinct) < len(secret)/2
+}
+
+// adminUserImportFactor creates a verified TOTP factor from a secret that was
+// issued by another system, so that migrated users keep their authenticator.
+func (a *API) adminUserImportFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.config
+	user := getUser(ctx)
+	adminUser := getAdminUser(ctx)
+	params := &adminUserImportFactorParams{}
+
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+
+	factorType, err := parseFactorType(params.FactorType)
+	if err != nil {
+		return err
+	}
+	if factorType != models.TOTP {
+		return unprocessableEntityError(ErrorCodeMFAUnsupportedFactorType, "Only totp factors can be imported")
+	}
+
+	secret := strings.TrimRight(strings.ToUpper(strings.ReplaceAll(params.Secret, " ", "")), "=")
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return badRequestError(ErrorCodeValidationFailed, "secret must be base32 encoded")
+	}
+	if len(decoded) < minImportedTOTPSecretLength {
+		return badRequestError(ErrorCodeValidationFailed, "secret must be at least %d bytes long", minImportedTOTPSecretLength)
+	}
+	if isWeakTOTPSecret(decoded) {
+		return unprocessableEntityError(ErrorCodeMFAWeakSecret, "secret is too weak, import a randomly generated secret")
+	}
+
+	numVerifiedFactors := 0
+	for _, factor := range user.Factors {
+		if factor.IsVerified() {
+			numVerifiedFactors += 1
+		}
+	}
+	if numVerifiedFactors >= config.MFA.MaxVerifiedFactors {
+		return forbiddenError(ErrorCodeTooManyEnrolledMFAFactors, "Maximum number of verified factors reached, unenroll to continue")
+	}
+
+	factor := models.NewFactor(user, params.FriendlyName, models.TOTP, models.FactorStateVerified)
+	if err := factor.SetSecret(secret, config.Security.DBEncryption.Encrypt, config.Security.DBEncryption.EncryptionKeyID, config.Security.DBEncryption.EncryptionKey); err != nil {
+		return err
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		if terr := tx.Create(factor); terr != nil {
+			pgErr := utilities.NewPostgresError(terr)
+			if pgErr.IsUniqueConstraintViolated() {
+				return unprocessableEntityError(ErrorCodeMFAFactorNameConflict, fmt.Sprintf("A factor with the friendly name %q for this user likely already exists", factor.FriendlyName))
+			}
+			return terr
+		}
+		if terr := models.NewAuditLogEntry(r, tx, adminUser, models.ImportFactorAction, "", map[string]interface{}{
+			"user_id":     user.ID,
+			"factor_id":   factor.ID,
+			"factor_type": factor.FactorType,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, factor)
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/gofrs/uuid"
 	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -862,6 +863,312 @@ func (ts *AdminTestSuite) TestAdminUserUpdateFactor() {
 	}
 }
 
+func (ts *AdminTestSuite) TestAdminUserImportFactor() {
+	u, err := models.NewUser("123456789", "test-import@example.com", "test", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	nonAdminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		Role: "authenticated",
+	}).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "legacy.example.com",
+		AccountName: "test-import@example.com",
+	})
+	require.NoError(ts.T(), err)
+
+	var cases = []struct {
+		Desc         string
+		Token        string
+		FactorData   map[string]interface{}
+		ExpectedCode int
+	}{
+		{
+			Desc:  "Non-admin token",
+			Token: nonAdminToken,
+			FactorData: map[string]interface{}{
+				"factor_type": models.TOTP,
+				"secret":      key.Secret(),
+			},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Desc:  "Non-base32 secret",
+			Token: ts.token,
+			FactorData: map[string]interface{}{
+				"factor_type": models.TOTP,
+				"secret":      "not-a-base32-secret!",
+			},
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Desc:  "Short secret",
+			Token: ts.token,
+			FactorData: map[string]interface{}{
+				"factor_type": models.TOTP,
+				"secret":      "JBSWY3DP",
+			},
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Desc:  "All-zero secret",
+			Token: ts.token,
+			FactorData: map[string]interface{}{
+				"factor_type": models.TOTP,
+				"secret":      "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
+			},
+			ExpectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			Desc:  "Sequential secret",
+			Token: ts.token,
+			FactorData: map[string]interface{}{
+				"factor_type": models.TOTP,
+				"secret":      "AEBAGBAFAYDQQCIKBMGA2DQPCAIREEYU",
+			},
+			ExpectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			Desc:  "Unsupported factor type",
+			Token: ts.token,
+			FactorData: map[string]interface{}{
+				"factor_type": models.SMS,
+				"secret":      key.Secret(),
+			},
+			ExpectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			Desc:  "Valid secret",
+			Token: ts.token,
+			FactorData: map[string]interface{}{
+				"factor_type":   models.TOTP,
+				"secret":        key.Secret(),
+				"friendly_name": "legacy",
+			},
+			ExpectedCode: http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.Desc, func() {
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(c.FactorData))
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/users/%s/factors/import", u.ID), &buffer)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), c.ExpectedCode, w.Code)
+		})
+	}
+
+	factors, err := FindFactorsByUser(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), factors, 1)
+	require.Equal(ts.T(), "legacy", factors[0].FriendlyName)
+	require.True(ts.T(), factors[0].IsVerified())
+
+	secret, _, err := factors[0].GetSecret(ts.Config.Security.DBEncryption.DecryptionKeys, ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), key.Secret(), secret)
+}
+
+func (ts *AdminTestSuite) TestAdminUserResetMFA() {
+	u, err := models.NewUser("123456789", "test-reset@example.com", "test", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	f := models.NewFactor(u, "testSimpleName", models.TOTP, models.FactorStateVerified)
+	require.NoError(ts.T(), f.SetSecret("secretkey", ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+	require.NoError(ts.T(), ts.API.db.Create(f), "Error saving new test factor")
+	require.NoError(ts.T(), ts.API.db.Create(models.NewChallenge(f, "127.0.0.1")), "Error saving new test challenge")
+
+	recoveryCode := models.NewRecoveryCode(u, uuid.Must(uuid.NewV4()), "abcde12345")
+	require.NoError(ts.T(), ts.API.db.Create(recoveryCode), "Error saving new recovery code")
+
+	session, err := models.NewSession(u.ID, &f.ID)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(session), "Error saving test session")
+	require.NoError(ts.T(), session.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &f.ID))
+
+	nonAdminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		Role: "authenticated",
+	}).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	var cases = []struct {
+		Desc         string
+		Token        string
+		ExpectedCode int
+	}{
+		{
+			Desc:         "Non-admin token",
+			Token:        nonAdminToken,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Desc:         "Admin token",
+			Token:        ts.token,
+			ExpectedCode: http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		ts.Run(c.Desc, func() {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/admin/mfa/%s", u.ID), nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), c.ExpectedCode, w.Code)
+		})
+	}
+
+	factors, err := FindFactorsByUser(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), factors)
+
+	total, _, err := models.CountRecoveryCodesByUser(ts.API.db, u)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 0, total)
+
+	challengeCount, err := ts.API.db.Q().Where("factor_id = ?", f.ID).Count(&models.Challenge{})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 0, challengeCount)
+
+	session, err = models.FindSessionByID(ts.API.db, session.ID, false)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.AAL1.String(), session.GetAAL())
+	require.Nil(ts.T(), session.FactorID)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/admin/mfa/%s", uuid.Must(uuid.NewV4())), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusNotFound, w.Code)
+}
+
+func (ts *AdminTestSuite) TestAdminMFAStats() {
+	u, err := models.NewUser("123456789", "test-stats@example.com", "test", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err, "Error making new user")
+	require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+
+	totpFactor := models.NewFactor(u, "totp", models.TOTP, models.FactorStateVerified)
+	webAuthnFactor := models.NewFactor(u, "webauthn", models.WebAuthn, models.FactorStateUnverified)
+	deletedFactor := models.NewFactor(u, "sms", models.SMS, models.FactorStateVerified)
+	for _, f := range []*models.Factor{totpFactor, webAuthnFactor, deletedFactor} {
+		require.NoError(ts.T(), ts.API.db.Create(f), "Error saving new test factor")
+	}
+	require.NoError(ts.T(), deletedFactor.SoftDelete(ts.API.db))
+	require.NoError(ts.T(), totpFactor.UpdateLastTOTPStep(ts.API.db, 1, 2))
+
+	active := models.NewChallenge(totpFactor, "127.0.0.1")
+	expired := models.NewChallenge(totpFactor, "127.0.0.1")
+	verified := models.NewChallenge(webAuthnFactor, "127.0.0.1")
+	for _, c := range []*models.Challenge{active, expired, verified} {
+		require.NoError(ts.T(), ts.API.db.Create(c), "Error saving new test challenge")
+	}
+	expiredAt := time.Now().Add(-time.Second * time.Duration(ts.Config.MFA.ChallengeExpiryDuration+1))
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_challenges SET created_at = ? WHERE id = ?", expiredAt, expired.ID).Exec())
+	require.NoError(ts.T(), verified.Verify(ts.API.db))
+
+	batchID := uuid.Must(uuid.NewV4())
+	codes := make([]*models.RecoveryCode, 0, 4)
+	for _, plaintext := range []string{"abcde12345", "fghij67890", "klmno12345", "pqrst67890"} {
+		code := models.NewRecoveryCode(u, batchID, plaintext)
+		require.NoError(ts.T(), ts.API.db.Create(code), "Error saving new recovery code")
+		codes = append(codes, code)
+	}
+	require.NoError(ts.T(), codes[0].Consume(ts.API.db, "127.0.0.1"))
+	codes[1].Valid = false
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(codes[1], "valid"))
+
+	nonAdminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		Role: "authenticated",
+	}).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/mfa/stats", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", nonAdminToken))
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/admin/mfa/stats", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.token))
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	stats := models.MFAStats{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&stats))
+	require.Equal(ts.T(), map[string]int{models.TOTP: 1, models.WebAuthn: 1}, stats.FactorsByType)
+	require.Equal(ts.T(), map[string]int{
+		models.FactorStateVerified.String():   1,
+		models.FactorStateUnverified.String(): 1,
+	}, stats.FactorsByStatus)
+	require.Equal(ts.T(), 1, stats.ActiveChallenges)
+	require.Equal(ts.T(), 2, stats.OutstandingRecoveryCodes)
+	require.Equal(ts.T(), map[string]int{"2": 1}, stats.TOTPSkews)
+}
+
+func (ts *AdminTestSuite) TestAdminMFABulk() {
+	users := map[string]*models.User{}
+	for _, email := range []string{"staff1@example.com", "staff2@example.com", "member@example.com"} {
+		u, err := models.NewUser("", email, "test", ts.Config.JWT.Aud, nil)
+		require.NoError(ts.T(), err, "Error making new user")
+		u.Role = "authenticated"
+		if email != "member@example.com" {
+			u.Role = "staff"
+		}
+		require.NoError(ts.T(), ts.API.db.Create(u), "Error creating user")
+		users[email] = u
+	}
+
+	nonAdminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		Role: "authenticated",
+	}).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	bulk := func(token string, params map[string]interface{}, expectedCode int) *AdminMFABulkResponse {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(params))
+		req := httptest.NewRequest(http.MethodPost, "/admin/mfa/bulk", &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), expectedCode, w.Code)
+
+		resp := &AdminMFABulkResponse{}
+		if expectedCode == http.StatusOK {
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(resp))
+		}
+		return resp
+	}
+
+	bulk(nonAdminToken, map[string]interface{}{"role": "staff", "action": "enable"}, http.StatusForbidden)
+	bulk(ts.token, map[string]interface{}{"role": "staff", "action": "toggle"}, http.StatusBadRequest)
+	bulk(ts.token, map[string]interface{}{"action": "enable"}, http.StatusBadRequest)
+
+	resp := bulk(ts.token, map[string]interface{}{"role": "staff", "action": "enable"}, http.StatusOK)
+	require.Equal(ts.T(), 2, resp.AffectedUsers)
+	for email, u := range users {
+		found, err := models.FindUserByID(ts.API.db, u.ID)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), email != "member@example.com", found.MFARequired, email)
+	}
+
+	// users that already require MFA are not counted again
+	resp = bulk(ts.token, map[string]interface{}{"role": "staff", "action": "enable"}, http.StatusOK)
+	require.Equal(ts.T(), 0, resp.AffectedUsers)
+
+	resp = bulk(ts.token, map[string]interface{}{"role": "staff", "action": "disable"}, http.StatusOK)
+	require.Equal(ts.T(), 2, resp.AffectedUsers)
+	found, err := models.FindUserByID(ts.API.db, users["staff1@example.com"].ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), found.MFARequired)
+}
+
 func (ts *AdminTestSuite) TestAdminUserCreateValidationErrors() {
 	cases := []struct {
 		desc   string
@@ -10,6 +10,7 @@ import (
 	"github.com/rs/cors"
 	"github.com/sebest/xff"
 	"github.com/sirupsen/logrus"
+	"github.com/supabase/auth/internal/api/sms_provider"
 	"github.com/supabase/auth/internal/conf"
 	"github.com/supabase/auth/internal/mailer"
 	"github.com/supabase/auth/internal/models"
@@ -37,6 +38,15 @@ type API struct {
 
 	// overrideTime can be used to override the clock used by handlers. Should only be used in tests!
 	overrideTime func() time.Time
+
+	// overrideSmsProvider replaces the configured SMS provider for MFA challenges. Should only be used in tests!
+	overrideSmsProvider sms_provider.SmsProvider
+
+	// overrideMailer replaces the mailer built from the configuration. Should only be used in tests!
+	overrideMailer mailer.Mailer
+
+	// overrideRecoveryCodeGenerator replaces crypto.GenerateRecoveryCode. Should only be used in tests!
+	overrideRecoveryCodeGenerator func(length int) (string, error)
 }
 
 func (a *API) Now() time.Time {
@@ -47,6 +57,14 @@ func (a *API) Now() time.Time {
 	return time.Now()
 }
 
+func (a *API) getSmsProvider() (sms_provider.SmsProvider, error) {
+	if a.overrideSmsProvider != nil {
+		return a.overrideSmsProvider, nil
+	}
+
+	return sms_provider.GetSmsProvider(*a.config)
+}
+
 // NewAPI instantiates a new REST API
 func NewAPI(globalConfig *conf.GlobalConfiguration, db *storage.Connection) *API {
 	return NewAPIWithVersion(globalConfig, db, defaultVersion)
@@ -217,11 +235,12 @@ func NewAPIWithVersion(globalConfig *conf.GlobalConfiguration, db *storage.Conne
 
 		r.With(api.requireAuthentication).Post("/logout", api.Logout)
 
-		r.With(api.requireAuthentication).Route("/reauthenticate", func(r *router) {
+		r.With(api.requireAuthentication).With(api.requireMFAIfEnforced).Route("/reauthenticate", func(r *router) {
 			r.Get("/", api.Reauthenticate)
 		})
 
 		r.With(api.requireAuthentication).Route("/user", func(r *router) {
+			r.Use(api.requireMFAIfEnforced)
 			r.Get("/", api.UserGet)
 			r.With(api.limitHandler(
 				// Allow requests at the specified rate per 5 minutes
@@ -229,6 +248,8 @@ func NewAPIWithVersion(globalConfig *conf.GlobalConfiguration, db *storage.Conne
 					DefaultExpirationTTL: time.Hour,
 				}).SetBurst(30),
 			)).With(sharedLimiter).Put("/", api.UserUpdate)
+			r.Get("/sessions", api.UserSessions)
+			r.Delete("/sessions/{session_id}", api.UserRevokeSession)
 
 			r.Route("/identities", func(r *router) {
 				r.Use(api.requireManualLinkingEnabled)
@@ -239,8 +260,32 @@ func NewAPIWithVersion(globalConfig *conf.GlobalConfiguration, db *storage.Conne
 
 		r.With(api.requireAuthentication).Route("/factors", func(r *router) {
 			r.Use(api.requireNotAnonymous)
+			r.Get("/", api.ListFactors)
 			r.Post("/", api.EnrollFactor)
+			r.Put("/order", api.OrderFactors)
+			r.Post("/disable", api.DisableMFA)
+			r.With(api.limitHandler(
+				tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
+					DefaultExpirationTTL: time.Minute,
+				}).SetBurst(30))).With(api.loadPrimaryFactor).Post("/challenge", api.ChallengeFactor)
+			r.Route("/recovery_codes", func(r *router) {
+				r.Post("/", api.GenerateRecoveryCodes)
+				r.Get("/status", api.RecoveryCodesStatus)
+				r.Post("/bundle", api.GenerateRecoveryCodesBundle)
+				r.Post("/bundle/verify", api.VerifyRecoveryCodesBundle)
+				r.With(api.limitHandler(
+					tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
+						DefaultExpirationTTL: time.Minute,
+					}).SetBurst(30))).WithBypass(api.delayFailedResponses).Post("/verify", api.VerifyRecoveryCode)
+			})
+			r.With(api.limitHandler(
+				tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
+					DefaultExpirationTTL: time.Minute,
+				}).SetBurst(30))).WithBypass(api.delayFailedResponses).Post("/verify_any", api.VerifyAnyFactor)
 			r.Route("/{factor_id}", func(r *router) {
+				// delay failures before the factor is loaded so that an
+				// unknown factor fails as slowly as a wrong code
+				r.UseBypass(api.delayFailedResponses)
 				r.Use(api.loadFactor)
 
 				r.With(api.limitHandler(
@@ -251,7 +296,18 @@ func NewAPIWithVersion(globalConfig *conf.GlobalConfiguration, db *storage.Conne
 					tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
 						DefaultExpirationTTL: time.Minute,
 					}).SetBurst(30))).Post("/challenge", api.ChallengeFactor)
+				r.With(api.limitHandler(
+					tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
+						DefaultExpirationTTL: time.Minute,
+					}).SetBurst(30))).Post("/enroll/challenge", api.EnrollChallengeFactor)
+				r.With(api.limitHandler(
+					tollbooth.NewLimiter(api.config.MFA.RateLimitChallengeAndVerify/60, &limiter.ExpirableOptions{
+						DefaultExpirationTTL: time.Minute,
+					}).SetBurst(30))).Post("/challenge/{challenge_id}/refresh", api.RefreshChallenge)
+				r.Get("/", api.GetFactor)
 				r.Delete("/", api.UnenrollFactor)
+				r.Patch("/", api.UpdateFactor)
+				r.Put("/primary", api.SetPrimaryFactor)
 
 			})
 		})
@@ -292,6 +348,7 @@ func NewAPIWithVersion(globalConfig *conf.GlobalConfiguration, db *storage.Conne
 					r.Use(api.loadUser)
 					r.Route("/factors", func(r *router) {
 						r.Get("/", api.adminUserGetFactors)
+						r.Post("/import", api.adminUserImportFactor)
 						r.Route("/{factor_id}", func(r *router) {
 							r.Use(api.loadFactor)
 							r.Delete("/", api.adminUserDeleteFactor)
@@ -305,6 +362,15 @@ func NewAPIWithVersion(globalConfig *conf.GlobalConfiguration, db *storage.Conne
 				})
 			})
 
+			r.Get("/mfa/stats", api.adminMFAStats)
+			r.Post("/mfa/bulk", api.adminMFABulk)
+			r.Route("/mfa/{user_id}", func(r *router) {
+				r.Use(api.loadUser)
+				r.Delete("/", api.adminUserResetMFA)
+				r.Delete("/trusted_devices", api.adminUserRevokeTrustedDevices)
+				r.Get("/recovery_codes/used", api.adminUserUsedRecoveryCodes)
+			})
+
 			r.Post("/generate_link", api.adminGenerateLink)
 
 			r.Route("/sso", func(r *router) {
@@ -353,6 +419,9 @@ func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) error {
 
 // Mailer returns NewMailer with the current tenant config
 func (a *API) Mailer() mailer.Mailer {
+	if a.overrideMailer != nil {
+		return a.overrideMailer
+	}
 	config := a.config
 	return mailer.NewMailer(config)
 }
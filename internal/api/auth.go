@@ -44,6 +44,28 @@ func (a *API) requireNotAnonymous(w http.ResponseWriter, r *http.Request) (conte
 	return ctx, nil
 }
 
+// requireMFAIfEnforced rejects AAL1 sessions of users that are required to
+// use MFA by the configured enforcement mode or by an admin. Users whose factors were all
+// verified within the new factor grace period are still let through, so
+// that a mis-scanned QR code does not immediately lock them out.
+func (a *API) requireMFAIfEnforced(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	claims := getClaims(ctx)
+	user := getUser(ctx)
+	config := a.config
+	userRequiresMFA := user != nil && user.MFARequired
+	if !userRequiresMFA && !config.MFA.IsRequiredFor(claims.Role, user != nil && user.HasVerifiedFactor()) {
+		return ctx, nil
+	}
+	if config.MFA.NewFactorGracePeriod > 0 && user != nil && user.HasOnlyNewVerifiedFactors(config.MFA.NewFactorGracePeriod) {
+		return ctx, nil
+	}
+	if claims.AuthenticatorAssuranceLevel != models.AAL2.String() {
+		return nil, forbiddenError(ErrorCodeMFARequired, "MFA is required, verify a factor to continue")
+	}
+	return ctx, nil
+}
+
 func (a *API) requireAdmin(ctx context.Context) (context.Context, error) {
 	// Find the administrative user
 	claims := getClaims(ctx)
@@ -82,6 +104,9 @@ func (a *API) parseJWTClaims(bearer string, r *http.Request) (context.Context, e
 	if err != nil {
 		return nil, forbiddenError(ErrorCodeBadJWT, "invalid JWT: unable to parse or verify signature, %v", err).WithInternalError(err)
 	}
+	if claims, ok := token.Claims.(*AccessTokenClaims); ok && claims.Purpose != "" {
+		return nil, forbiddenError(ErrorCodeBadJWT, "invalid JWT: %s tokens cannot be used as access tokens", claims.Purpose)
+	}
 
 	return withToken(ctx, token), nil
 }
@@ -71,6 +71,24 @@ func (ts *AuthTestSuite) TestParseJWTClaims() {
 	require.Equal(ts.T(), userJwt, token.Raw)
 }
 
+func (ts *AuthTestSuite) TestParseJWTClaimsRejectsPurpose() {
+	userClaims := &AccessTokenClaims{
+		Role:    "authenticated",
+		Purpose: models.ChallengePurposeStepUp,
+	}
+	userJwt, err := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims).SignedString([]byte(ts.Config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("Authorization", "Bearer "+userJwt)
+	_, err = ts.API.parseJWTClaims(userJwt, req)
+	require.Error(ts.T(), err)
+	httpErr, ok := err.(*HTTPError)
+	require.True(ts.T(), ok)
+	require.Equal(ts.T(), http.StatusForbidden, httpErr.HTTPStatus)
+	require.Equal(ts.T(), string(ErrorCodeBadJWT), httpErr.ErrorCode)
+}
+
 func (ts *AuthTestSuite) TestMaybeLoadUserOrSession() {
 	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
 	require.NoError(ts.T(), err)
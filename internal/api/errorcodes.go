@@ -36,10 +36,23 @@ const (
 	ErrorCodeTooManyEnrolledMFAFactors         ErrorCode = "too_many_enrolled_mfa_factors"
 	ErrorCodeMFAFactorNameConflict             ErrorCode = "mfa_factor_name_conflict"
 	ErrorCodeMFAFactorNotFound                 ErrorCode = "mfa_factor_not_found"
+	ErrorCodeMFAFactorNotOwned                 ErrorCode = "mfa_factor_not_owned"
+	ErrorCodeMFAUnsupportedFactorType          ErrorCode = "mfa_unsupported_factor_type"
 	ErrorCodeMFAIPAddressMismatch              ErrorCode = "mfa_ip_address_mismatch"
+	ErrorCodeMFAChallengeClientMismatch        ErrorCode = "mfa_challenge_client_mismatch"
 	ErrorCodeMFAChallengeExpired               ErrorCode = "mfa_challenge_expired"
+	ErrorCodeMFAChallengeRefreshLimit          ErrorCode = "mfa_challenge_refresh_limit"
 	ErrorCodeMFAVerificationFailed             ErrorCode = "mfa_verification_failed"
 	ErrorCodeMFAVerificationRejected           ErrorCode = "mfa_verification_rejected"
+	ErrorCodeMFAFactorLocked                   ErrorCode = "mfa_factor_locked"
+	ErrorCodeMFARecoveryCodeInvalid            ErrorCode = "mfa_recovery_code_invalid"
+	ErrorCodeMFARecoveryCodesRequired          ErrorCode = "mfa_recovery_codes_required"
+	ErrorCodeMFARequired                       ErrorCode = "mfa_required"
+	ErrorCodeMFADisabledForInstance            ErrorCode = "mfa_disabled_for_instance"
+	ErrorCodeMFAWeakSecret                     ErrorCode = "mfa_weak_secret"
+	ErrorCodeMFAFactorNotVerified              ErrorCode = "mfa_factor_not_verified"
+	ErrorCodeMFARecoveryCodesBundleInvalid     ErrorCode = "mfa_recovery_codes_bundle_invalid"
+	ErrorCodeMFAFactorLimitExceeded            ErrorCode = "mfa_factor_limit_exceeded"
 	ErrorCodeInsufficientAAL                   ErrorCode = "insufficient_aal"
 	ErrorCodeCaptchaFailed                     ErrorCode = "captcha_failed"
 	ErrorCodeSAMLProviderDisabled              ErrorCode = "saml_provider_disabled"
@@ -231,6 +231,34 @@ func HandleResponseError(err error, w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+	case *MFAVerificationError:
+		log.WithError(e.Cause()).Info(e.Error())
+
+		if e.HTTPStatus == http.StatusTooManyRequests && e.LockedUntil != nil {
+			setRetryAfter(w, time.Until(*e.LockedUntil))
+		}
+
+		if apiVersion.Compare(APIVersion20240101) >= 0 {
+			var output struct {
+				HTTPErrorResponse20240101
+				AttemptsRemaining *int       `json:"attempts_remaining,omitempty"`
+				LockedUntil       *time.Time `json:"locked_until,omitempty"`
+			}
+
+			output.Code = e.ErrorCode
+			output.Message = e.Message
+			output.AttemptsRemaining = e.AttemptsRemaining
+			output.LockedUntil = e.LockedUntil
+
+			if jsonErr := sendJSON(w, e.HTTPStatus, output); jsonErr != nil && jsonErr != context.DeadlineExceeded {
+				log.WithError(jsonErr).Warn("Failed to send JSON on ResponseWriter")
+			}
+		} else {
+			if jsonErr := sendJSON(w, e.HTTPStatus, e); jsonErr != nil && jsonErr != context.DeadlineExceeded {
+				log.WithError(jsonErr).Warn("Failed to send JSON on ResponseWriter")
+			}
+		}
+
 	case *HTTPError:
 		if e.HTTPStatus >= http.StatusInternalServerError {
 			e.ErrorID = errorID
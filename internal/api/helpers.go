@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/supabase/auth/internal/conf"
@@ -23,6 +26,16 @@ func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	return err
 }
 
+// setRetryAfter tells a rate limited client how many seconds to wait before
+// trying again, rounded up to at least one second
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
 func isAdmin(u *models.User, config *conf.GlobalConfiguration) bool {
 	return config.JWT.Aud == u.Aud && u.HasRole(config.JWT.AdminGroupName)
 }
@@ -71,6 +84,7 @@ type RequestParams interface {
 		InviteParams |
 		OtpParams |
 		PKCEGrantParams |
+		MFAVerificationTokenGrantParams |
 		PasswordGrantParams |
 		RecoverParams |
 		RefreshTokenGrantParams |
@@ -78,10 +92,17 @@ type RequestParams interface {
 		SignupParams |
 		SingleSignOnParams |
 		SmsParams |
+		UpdateFactorParams |
+		OrderFactorsParams |
 		UserUpdateParams |
 		VerifyFactorParams |
 		VerifyParams |
+		VerifyRecoveryCodeParams |
+		VerifyRecoveryCodesBundleParams |
+		VerifyAnyFactorParams |
+		adminUserImportFactorParams |
 		adminUserUpdateFactorParams |
+		adminMFABulkParams |
 		struct {
 			Email string `json:"email"`
 			Phone string `json:"phone"`
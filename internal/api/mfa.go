@@ -2,65 +2,174 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"image/png"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/aaronarduino/goqrsvg"
-	svg "github.com/ajstarks/svgo"
-	"github.com/boombuler/barcode/qr"
+	"github.com/go-chi/chi/v5"
 	"github.com/gofrs/uuid"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
-	"github.com/supabase/auth/internal/crypto"
+	"github.com/sirupsen/logrus"
 	"github.com/supabase/auth/internal/hooks"
 	"github.com/supabase/auth/internal/metering"
 	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/observability"
 	"github.com/supabase/auth/internal/storage"
 	"github.com/supabase/auth/internal/utilities"
 )
 
-const DefaultQRSize = 3
-
 type EnrollFactorParams struct {
 	FriendlyName string `json:"friendly_name"`
 	FactorType   string `json:"factor_type"`
 	Issuer       string `json:"issuer"`
+	Phone        string `json:"phone"`
+	DeviceName   string `json:"device_name"`
+	Platform     string `json:"platform"`
+
+	// GenerateRecoveryCodes creates a new set of recovery codes in the same
+	// transaction as the factor, so that neither is saved without the other
+	GenerateRecoveryCodes bool `json:"generate_recovery_codes"`
+
+	// IdempotencyKey is read from the Idempotency-Key header
+	IdempotencyKey string `json:"-"`
 }
 
 type TOTPObject struct {
 	QRCode string `json:"qr_code"`
 	Secret string `json:"secret"`
-	URI    string `json:"uri"`
+	// SecretFormatted is the secret split into space separated groups for
+	// manual entry into authenticator apps
+	SecretFormatted string `json:"secret_formatted"`
+	URI             string `json:"uri"`
 }
 
 type EnrollFactorResponse struct {
-	ID           uuid.UUID  `json:"id"`
-	Type         string     `json:"type"`
-	FriendlyName string     `json:"friendly_name"`
-	TOTP         TOTPObject `json:"totp,omitempty"`
+	// ID is the id of the created factor, which clients pass to the
+	// challenge and verify endpoints to complete the enrollment
+	ID           uuid.UUID       `json:"id"`
+	Type         string          `json:"type"`
+	FriendlyName string          `json:"friendly_name"`
+	TOTP         *TOTPObject     `json:"totp,omitempty"`
+	WebAuthn     *WebAuthnObject `json:"web_authn,omitempty"`
+	Phone        string          `json:"phone,omitempty"`
+
+	// RecoveryCodes is only set when generate_recovery_codes was requested
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
 type VerifyFactorParams struct {
-	ChallengeID uuid.UUID `json:"challenge_id"`
-	Code        string    `json:"code"`
+	ChallengeID  uuid.UUID             `json:"challenge_id"`
+	Code         string                `json:"code"`
+	WebAuthn     *WebAuthnVerifyParams `json:"web_authn,omitempty"`
+	RecoveryCode string                `json:"recovery_code"`
+	// TrustDevice asks for the device to skip the MFA challenge on sign ins
+	// until the trusted device duration passes
+	TrustDevice bool `json:"trust_device"`
+	// ReturnVerificationToken asks for a single use verification token in
+	// place of the upgraded session, see MFAVerificationTokenGrant
+	ReturnVerificationToken bool `json:"return_verification_token"`
+}
+
+// VerifyFactorPendingResponse is returned when the first of two consecutive
+// TOTP codes required to verify a new factor has been accepted
+type VerifyFactorPendingResponse struct {
+	ChallengeID      uuid.UUID `json:"challenge_id"`
+	NextCodeRequired bool      `json:"next_code_required"`
 }
 
 type ChallengeFactorResponse struct {
-	ID        uuid.UUID `json:"id"`
-	ExpiresAt int64     `json:"expires_at"`
+	ID         uuid.UUID         `json:"id"`
+	ExpiresAt  int64             `json:"expires_at"`
+	FactorType string            `json:"factor_type"`
+	FactorHint *FactorHint       `json:"factor_hint"`
+	Payload    *ChallengePayload `json:"payload,omitempty"`
+	// WebAuthn duplicates Payload.WebAuthn for clients that predate the
+	// payload
+	WebAuthn *WebAuthnObject `json:"web_authn,omitempty"`
+}
+
+// FactorHint tells the user which of their factors is being challenged. It
+// never holds the full phone number or any secret of the factor.
+type FactorHint struct {
+	FriendlyName string `json:"friendly_name,omitempty"`
+	// Identifier is the masked phone number of sms factors
+	Identifier string `json:"identifier,omitempty"`
+}
+
+// ChallengePayload holds the fields of a challenge specific to the type of
+// its factor. TOTP challenges have none.
+type ChallengePayload struct {
+	// Phone is the masked number an sms challenge was sent to
+	Phone    string          `json:"phone,omitempty"`
+	WebAuthn *WebAuthnObject `json:"web_authn,omitempty"`
 }
 
 type UnenrollFactorResponse struct {
 	ID uuid.UUID `json:"id"`
 }
 
+// GetFactorResponse is a factor with, while its enrollment is pending, when
+// it expires and the number of seconds left to verify it
+type GetFactorResponse struct {
+	*models.Factor
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn *int64     `json:"expires_in,omitempty"`
+}
+
+type UpdateFactorParams struct {
+	FriendlyName string `json:"friendly_name"`
+}
+
+type SetPrimaryFactorResponse struct {
+	ID        uuid.UUID `json:"id"`
+	IsPrimary bool      `json:"is_primary"`
+}
+
 const (
 	InvalidFactorOwnerErrorMessage = "Factor does not belong to user"
 	QRCodeGenerationErrorMessage   = "Error generating QR Code"
 )
 
+const (
+	maxFriendlyNameLength   = 100
+	maxFactorMetadataLength = 100
+)
+
+// parseFactorType validates a factor type sent by a client
+func parseFactorType(factorType string) (string, error) {
+	parsed, err := models.ParseFactorType(factorType)
+	if err != nil {
+		return "", unprocessableEntityError(ErrorCodeMFAUnsupportedFactorType, "factor_type needs to be totp, webauthn or sms")
+	}
+	return parsed, nil
+}
+
+// sanitizeFactorMetadata strips control characters and surrounding whitespace
+// from client supplied factor metadata and enforces its maximum length
+func sanitizeFactorMetadata(name, value string) (string, error) {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value))
+	if utf8.RuneCountInString(value) > maxFactorMetadataLength {
+		return "", badRequestError(ErrorCodeValidationFailed, "%s must be at most %d characters long", name, maxFactorMetadataLength)
+	}
+	return value, nil
+}
+
 func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	user := getUser(ctx)
@@ -71,77 +180,107 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 	if session == nil || user == nil {
 		return internalServerError("A valid session and a registered user are required to enroll a factor")
 	}
+	if !config.MFA.Enabled {
+		return forbiddenError(ErrorCodeMFADisabledForInstance, "MFA is disabled for this project, new factors cannot be enrolled")
+	}
 
 	params := &EnrollFactorParams{}
 	if err := retrieveRequestParams(r, params); err != nil {
 		return err
 	}
 
-	if params.FactorType != models.TOTP {
-		return badRequestError(ErrorCodeValidationFailed, "factor_type needs to be totp")
+	var err error
+	if params.FactorType, err = parseFactorType(params.FactorType); err != nil {
+		return err
+	}
+	if params.DeviceName, err = sanitizeFactorMetadata("device_name", params.DeviceName); err != nil {
+		return err
+	}
+	if params.Platform, err = sanitizeFactorMetadata("platform", params.Platform); err != nil {
+		return err
 	}
 
-	issuer := ""
-	if params.Issuer == "" {
+	issuer := params.Issuer
+	if issuer == "" {
+		issuer = config.MFA.Issuer
+	}
+	if issuer == "" {
 		u, err := url.ParseRequestURI(config.SiteURL)
 		if err != nil {
 			return internalServerError("site url is improperly formatted")
 		}
 		issuer = u.Host
-	} else {
-		issuer = params.Issuer
 	}
 
-	factors := user.Factors
-
-	factorCount := len(factors)
-	numVerifiedFactors := 0
-	if err := models.DeleteExpiredFactors(db, config.MFA.FactorExpiryDuration); err != nil {
+	if err := models.DeleteExpiredFactors(db, config.MFA.EnrollmentExpiry); err != nil {
 		return err
 	}
 
-	for _, factor := range factors {
-		if factor.IsVerified() {
-			numVerifiedFactors += 1
+	if params.IdempotencyKey = r.Header.Get(EnrollIdempotencyKeyHeader); params.IdempotencyKey != "" {
+		if len(params.IdempotencyKey) > maxEnrollIdempotencyKeyLength {
+			return badRequestError(ErrorCodeValidationFailed, "Idempotency-Key must be at most %d characters", maxEnrollIdempotencyKeyLength)
+		}
+		// a retried request returns the factor created by the first one
+		factor, err := models.FindFactorByEnrollIdempotencyKey(db, user.ID, params.IdempotencyKey, config.MFA.EnrollIdempotencyKeyTTL)
+		if err == nil {
+			return a.replayEnrollFactor(w, r, user, session, factor, issuer)
+		} else if !models.IsNotFoundError(err) {
+			return internalServerError("Database error finding factor").WithInternalError(err)
 		}
 	}
 
-	if factorCount >= int(config.MFA.MaxEnrolledFactors) {
-		return forbiddenError(ErrorCodeTooManyEnrolledMFAFactors, "Maximum number of verified factors reached, unenroll to continue")
-	}
-
-	if numVerifiedFactors >= config.MFA.MaxVerifiedFactors {
-		return forbiddenError(ErrorCodeTooManyEnrolledMFAFactors, "Maximum number of verified factors reached, unenroll to continue")
+	// count after the cleanup so that expired factors don't count towards the limit
+	numVerifiedFactors, err := a.checkFactorLimits(db, user)
+	if err != nil {
+		return err
 	}
 
 	if numVerifiedFactors > 0 && !session.IsAAL2() {
 		return forbiddenError(ErrorCodeInsufficientAAL, "AAL2 required to enroll a new factor")
 	}
 
+	switch params.FactorType {
+	case models.WebAuthn:
+		return a.enrollWebAuthnFactor(w, r, user, params)
+	case models.SMS:
+		return a.enrollSMSFactor(w, r, user, params)
+	}
+
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      issuer,
 		AccountName: user.GetEmail(),
+		Period:      config.MFA.TOTPPeriod,
+		Digits:      otp.Digits(config.MFA.TOTPDigits),
+		Algorithm:   totpAlgorithm(config.MFA.TOTPAlgorithm),
+		SecretSize:  config.MFA.SecretSize,
 	})
 	if err != nil {
 		return internalServerError(QRCodeGenerationErrorMessage).WithInternalError(err)
 	}
 
-	var buf bytes.Buffer
-	svgData := svg.New(&buf)
-	qrCode, _ := qr.Encode(key.String(), qr.H, qr.Auto)
-	qs := goqrsvg.NewQrSVG(qrCode, DefaultQRSize)
-	qs.StartQrSVG(svgData)
-	if err = qs.WriteQrSVG(svgData); err != nil {
-		return internalServerError(QRCodeGenerationErrorMessage).WithInternalError(err)
+	totpObject, err := newTOTPObject(key, config.MFA.QRCodeSize, config.MFA.SecretChunkSize)
+	if err != nil {
+		return err
 	}
-	svgData.End()
 
 	factor := models.NewFactor(user, params.FriendlyName, params.FactorType, models.FactorStateUnverified)
+	factor.SetDeviceMetadata(params.DeviceName, params.Platform)
+	totpAlgorithmName, totpDigits, totpPeriod := config.MFA.TOTPAlgorithm, config.MFA.TOTPDigits, int(config.MFA.TOTPPeriod)
+	factor.TOTPAlgorithm = &totpAlgorithmName
+	factor.TOTPDigits = &totpDigits
+	factor.TOTPPeriod = &totpPeriod
 	if err := factor.SetSecret(key.Secret(), config.Security.DBEncryption.Encrypt, config.Security.DBEncryption.EncryptionKeyID, config.Security.DBEncryption.EncryptionKey); err != nil {
 		return err
 	}
 
+	var recoveryCodes []string
 	err = db.Transaction(func(tx *storage.Connection) error {
+		if terr := a.lockFactorLimits(tx, user); terr != nil {
+			return terr
+		}
+		if terr := assignDefaultFriendlyName(tx, user, factor); terr != nil {
+			return terr
+		}
 		if terr := tx.Create(factor); terr != nil {
 			pgErr := utilities.NewPostgresError(terr)
 			if pgErr.IsUniqueConstraintViolated() {
@@ -150,8 +289,186 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 			return terr
 
 		}
+		if terr := saveEnrollIdempotencyKey(tx, user, params, factor); terr != nil {
+			return terr
+		}
+		if params.GenerateRecoveryCodes {
+			codes, terr := a.createRecoveryCodes(r, tx, user)
+			if terr != nil {
+				return terr
+			}
+			recoveryCodes = codes
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.EnrollFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":   factor.ID,
+			"factor_type": factor.FactorType,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a.triggerMFAEvent(r, MFAEventFactorEnrolled, user, factor)
+	recordMFAEnroll(ctx, factor.FactorType)
+
+	if recoveryCodes != nil {
+		preventCaching(w)
+	}
+	return sendJSON(w, http.StatusOK, &EnrollFactorResponse{
+		ID:            factor.ID,
+		Type:          models.TOTP,
+		FriendlyName:  factor.FriendlyName,
+		TOTP:          totpObject,
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// newTOTPObject describes the TOTP key together with a QR code of its URI
+func newTOTPObject(key *otp.Key, qrCodeSize, secretChunkSize int) (*TOTPObject, error) {
+	qrImage, err := key.Image(qrCodeSize, qrCodeSize)
+	if err != nil {
+		return nil, internalServerError(QRCodeGenerationErrorMessage).WithInternalError(err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, qrImage); err != nil {
+		return nil, internalServerError(QRCodeGenerationErrorMessage).WithInternalError(err)
+	}
+	return &TOTPObject{
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		Secret:          key.Secret(),
+		SecretFormatted: chunkSecret(key.Secret(), secretChunkSize),
+		URI:             key.URL(),
+	}, nil
+}
+
+// chunkSecret splits the secret into space separated groups of size
+// characters, the last group may be shorter
+func chunkSecret(secret string, size int) string {
+	if size <= 0 || len(secret) <= size {
+		return secret
+	}
+	chunks := make([]string, 0, (len(secret)+size-1)/size)
+	for len(secret) > size {
+		chunks = append(chunks, secret[:size])
+		secret = secret[size:]
+	}
+	return strings.Join(append(chunks, secret), " ")
+}
+
+// checkFactorLimits rejects enrolling another factor once the user has
+// reached the configured limits, returning the number of verified factors
+func (a *API) checkFactorLimits(tx *storage.Connection, user *models.User) (int, error) {
+	config := a.config
+	factors, err := models.FindFactorsByUserID(tx, user.ID, models.FactorFilter{}, nil)
+	if err != nil {
+		return 0, internalServerError("Database error finding factors").WithInternalError(err)
+	}
+
+	numVerifiedFactors := 0
+	for _, factor := range factors {
+		if factor.IsVerified() {
+			numVerifiedFactors += 1
+		}
+	}
+
+	// factors lists only factors that have not been unenrolled
+	if len(factors) >= int(config.MFA.MaxEnrolledFactors) {
+		return 0, unprocessableEntityError(ErrorCodeMFAFactorLimitExceeded, "Maximum number of %d enrolled factors reached, unenroll to continue", int(config.MFA.MaxEnrolledFactors))
+	}
+
+	if numVerifiedFactors >= config.MFA.MaxVerifiedFactors {
+		return 0, forbiddenError(ErrorCodeTooManyEnrolledMFAFactors, "Maximum number of verified factors reached, unenroll to continue")
+	}
+
+	return numVerifiedFactors, nil
+}
+
+// assignDefaultFriendlyName names a factor enrolled without a friendly name
+// after the number of factors the user already has, skipping names in use.
+// It is called after lockFactorLimits so that concurrent enrollments do not
+// pick the same name.
+func assignDefaultFriendlyName(tx *storage.Connection, user *models.User, factor *models.Factor) error {
+	if strings.TrimSpace(factor.FriendlyName) != "" {
+		return nil
+	}
+	factors, err := models.FindFactorsByUserID(tx, user.ID, models.FactorFilter{}, nil)
+	if err != nil {
+		return internalServerError("Database error finding factors").WithInternalError(err)
+	}
+	names := make(map[string]bool, len(factors))
+	for _, f := range factors {
+		names[f.FriendlyName] = true
+	}
+	for i := len(factors) + 1; ; i++ {
+		name := fmt.Sprintf("Authenticator %d", i)
+		if !names[name] {
+			factor.FriendlyName = name
+			return nil
+		}
+	}
+}
+
+// lockFactorLimits locks the user and checks the factor limits again, so that
+// concurrent enrollments that each passed the earlier check cannot together
+// exceed them
+func (a *API) lockFactorLimits(tx *storage.Connection, user *models.User) error {
+	if err := models.LockUserForUpdate(tx, user.ID); err != nil {
+		return internalServerError("Database error locking user").WithInternalError(err)
+	}
+	_, err := a.checkFactorLimits(tx, user)
+	return err
+}
+
+func (a *API) enrollWebAuthnFactor(w http.ResponseWriter, r *http.Request, user *models.User, params *EnrollFactorParams) error {
+	db := a.db.WithContext(r.Context())
+
+	webAuthnChallenge, err := generateWebAuthnChallenge()
+	if err != nil {
+		return internalServerError("Error generating WebAuthn challenge").WithInternalError(err)
+	}
+
+	factor := models.NewFactor(user, params.FriendlyName, params.FactorType, models.FactorStateUnverified)
+	factor.SetDeviceMetadata(params.DeviceName, params.Platform)
+	challenge := models.NewChallengeWithIDVersion(factor, utilities.GetIPAddress(r), a.config.MFA.ChallengeIDVersion)
+	challenge.WebAuthnChallenge = &webAuthnChallenge
+	if a.config.MFA.BindChallengeToClient {
+		challenge.BindToClient(r.UserAgent())
+	}
+
+	var recoveryCodes []string
+	err = db.Transaction(func(tx *storage.Connection) error {
+		if terr := a.lockFactorLimits(tx, user); terr != nil {
+			return terr
+		}
+		if terr := assignDefaultFriendlyName(tx, user, factor); terr != nil {
+			return terr
+		}
+		if terr := tx.Create(factor); terr != nil {
+			pgErr := utilities.NewPostgresError(terr)
+			if pgErr.IsUniqueConstraintViolated() {
+				return unprocessableEntityError(ErrorCodeMFAFactorNameConflict, fmt.Sprintf("A factor with the friendly name %q for this user likely already exists", factor.FriendlyName))
+			}
+			return terr
+		}
+		if terr := saveEnrollIdempotencyKey(tx, user, params, factor); terr != nil {
+			return terr
+		}
+		if params.GenerateRecoveryCodes {
+			codes, terr := a.createRecoveryCodes(r, tx, user)
+			if terr != nil {
+				return terr
+			}
+			recoveryCodes = codes
+		}
+		if terr := tx.Create(challenge); terr != nil {
+			return terr
+		}
 		if terr := models.NewAuditLogEntry(r, tx, user, models.EnrollFactorAction, r.RemoteAddr, map[string]interface{}{
-			"factor_id": factor.ID,
+			"factor_id":   factor.ID,
+			"factor_type": factor.FactorType,
 		}); terr != nil {
 			return terr
 		}
@@ -161,36 +478,169 @@ func (a *API) EnrollFactor(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	a.triggerMFAEvent(r, MFAEventFactorEnrolled, user, factor)
+	recordMFAEnroll(r.Context(), factor.FactorType)
+
+	if recoveryCodes != nil {
+		preventCaching(w)
+	}
 	return sendJSON(w, http.StatusOK, &EnrollFactorResponse{
-		ID:           factor.ID,
-		Type:         models.TOTP,
-		FriendlyName: factor.FriendlyName,
-		TOTP: TOTPObject{
-			// See: https://css-tricks.com/probably-dont-base64-svg/
-			QRCode: buf.String(),
-			Secret: key.Secret(),
-			URI:    key.URL(),
-		},
+		ID:            factor.ID,
+		Type:          models.WebAuthn,
+		FriendlyName:  factor.FriendlyName,
+		WebAuthn:      a.newWebAuthnObject(user, factor, challenge),
+		RecoveryCodes: recoveryCodes,
 	})
 }
 
+// ListFactors returns the factors of the authenticated user
+func (a *API) ListFactors(w http.ResponseWriter, r *http.Request) error {
+	user := getUser(r.Context())
+	return a.listFactors(w, r, user)
+}
+
+func (a *API) listFactors(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	db := a.db.WithContext(r.Context())
+	query := r.URL.Query()
+
+	filter := models.FactorFilter{
+		Status:     query.Get("status"),
+		FactorType: query.Get("factor_type"),
+	}
+	if filter.Status != "" && filter.Status != models.FactorStateVerified.String() && filter.Status != models.FactorStateUnverified.String() {
+		return badRequestError(ErrorCodeValidationFailed, "status needs to be verified or unverified")
+	}
+	if filter.FactorType != "" && filter.FactorType != models.TOTP && filter.FactorType != models.WebAuthn && filter.FactorType != models.SMS {
+		return badRequestError(ErrorCodeValidationFailed, "factor_type needs to be totp, webauthn or sms")
+	}
+
+	pageParams, err := paginate(r)
+	if err != nil {
+		return badRequestError(ErrorCodeValidationFailed, "Bad Pagination Parameters: %v", err).WithInternalError(err)
+	}
+	if pageParams.Page == 0 || pageParams.PerPage == 0 {
+		return badRequestError(ErrorCodeValidationFailed, "Bad Pagination Parameters: page and per_page must be greater than 0")
+	}
+	if pageParams.PerPage > a.config.MFA.MaxFactorsPerPage {
+		pageParams.PerPage = a.config.MFA.MaxFactorsPerPage
+	}
+
+	factors, err := models.FindFactorsByUserID(db, user.ID, filter, pageParams)
+	if err != nil {
+		return internalServerError("Database error finding factors").WithInternalError(err)
+	}
+	addPaginationHeaders(w, r, pageParams)
+
+	return sendJSON(w, http.StatusOK, factors)
+}
+
+// newChallengeFactorResponse describes the challenge together with the
+// payload specific to the type of the factor
+func (a *API) newChallengeFactorResponse(user *models.User, factor *models.Factor, challenge *models.Challenge) *ChallengeFactorResponse {
+	response := &ChallengeFactorResponse{
+		ID:         challenge.ID,
+		ExpiresAt:  challenge.GetExpiryTime(a.config.MFA.ChallengeExpiryDuration).Unix(),
+		FactorType: factor.FactorType,
+		FactorHint: &FactorHint{FriendlyName: factor.FriendlyName},
+	}
+	switch factor.FactorType {
+	case models.WebAuthn:
+		webAuthn := a.newWebAuthnObject(user, factor, challenge)
+		response.Payload = &ChallengePayload{WebAuthn: webAuthn}
+		response.WebAuthn = webAuthn
+	case models.SMS:
+		if factor.Phone != nil {
+			response.FactorHint.Identifier = maskPhone(*factor.Phone)
+			response.Payload = &ChallengePayload{Phone: response.FactorHint.Identifier}
+		}
+	}
+	return response
+}
+
 func (a *API) ChallengeFactor(w http.ResponseWriter, r *http.Request) error {
+	return a.challengeFactor(w, r, false)
+}
+
+// EnrollChallengeFactor creates a challenge for a factor that is still being
+// enrolled, whose verification completes the enrollment
+func (a *API) EnrollChallengeFactor(w http.ResponseWriter, r *http.Request) error {
+	return a.challengeFactor(w, r, true)
+}
+
+func (a *API) challengeFactor(w http.ResponseWriter, r *http.Request, enrolling bool) error {
 	ctx := r.Context()
 	config := a.config
 	db := a.db.WithContext(ctx)
 
 	user := getUser(ctx)
 	factor := getFactor(ctx)
+	if !factor.IsOwnedBy(user) {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
+	if enrolling && factor.IsVerified() {
+		return unprocessableEntityError(ErrorCodeValidationFailed, "Factor is already verified")
+	}
+	if !enrolling && !factor.IsVerified() && config.MFA.ChallengeVerifiedOnly {
+		return unprocessableEntityError(ErrorCodeMFAFactorNotVerified, "Factor is not verified, challenge it through the enroll challenge endpoint to finish enrolling it")
+	}
+
 	ipAddress := utilities.GetIPAddress(r)
-	challenge := models.NewChallenge(factor, ipAddress)
+	challenge := models.NewChallengeWithIDVersion(factor, ipAddress, config.MFA.ChallengeIDVersion)
+	if config.MFA.BindChallengeToClient {
+		challenge.BindToClient(r.UserAgent())
+	}
+
+	if purpose := r.URL.Query().Get("purpose"); purpose != "" {
+		if !models.IsValidChallengePurpose(purpose) {
+			return badRequestError(ErrorCodeValidationFailed, "Unsupported challenge purpose %q", purpose)
+		}
+		if !factor.IsVerified() {
+			return unprocessableEntityError(ErrorCodeValidationFailed, "Only verified factors can be used for step up challenges")
+		}
+		challenge.Purpose = &purpose
+	}
+
+	if forceReauth := r.URL.Query().Get("force_reauth"); forceReauth != "" {
+		var err error
+		if challenge.ForceReauth, err = strconv.ParseBool(forceReauth); err != nil {
+			return badRequestError(ErrorCodeValidationFailed, "force_reauth must be a boolean")
+		}
+	}
+
+	if limit := config.MFA.ChallengeRateLimitPerUser; limit > 0 {
+		// bound the challenges a user can create across all of their
+		// factors, before any SMS for the challenge is sent
+		var allowedAt *time.Time
+		if err := db.Transaction(func(tx *storage.Connection) error {
+			var terr error
+			allowedAt, terr = models.RecordChallengeRequest(tx, user.ID, limit, config.MFA.ChallengeRateLimitWindow)
+			return terr
+		}); err != nil {
+			return internalServerError("Database error recording challenge request").WithInternalError(err)
+		}
+		if allowedAt != nil {
+			setRetryAfter(w, time.Until(*allowedAt))
+			return tooManyRequestsError(ErrorCodeOverRequestRateLimit, "Too many challenges were created, try again later")
+		}
+	}
+
+	if err := a.prepareChallenge(ctx, db, factor, challenge); err != nil {
+		return err
+	}
 
 	if err := db.Transaction(func(tx *storage.Connection) error {
 		if terr := tx.Create(challenge); terr != nil {
 			return terr
 		}
+		// bound the challenges a client can pile up by challenging repeatedly
+		if terr := models.PruneOpenChallenges(tx, factor.ID, config.MFA.MaxOpenChallenges); terr != nil {
+			return terr
+		}
 		if terr := models.NewAuditLogEntry(r, tx, user, models.CreateChallengeAction, r.RemoteAddr, map[string]interface{}{
 			"factor_id":     factor.ID,
+			"factor_type":   factor.FactorType,
 			"factor_status": factor.Status,
+			"purpose":       challenge.Purpose,
 		}); terr != nil {
 			return terr
 		}
@@ -199,17 +649,142 @@ func (a *API) ChallengeFactor(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	return sendJSON(w, http.StatusOK, &ChallengeFactorResponse{
-		ID:        challenge.ID,
-		ExpiresAt: challenge.GetExpiryTime(config.MFA.ChallengeExpiryDuration).Unix(),
-	})
+	return sendJSON(w, http.StatusOK, a.newChallengeFactorResponse(user, factor, challenge))
+}
+
+// prepareChallenge sets up the factor type specific parts of a new challenge,
+// such as sending the SMS code
+func (a *API) prepareChallenge(ctx context.Context, db *storage.Connection, factor *models.Factor, challenge *models.Challenge) error {
+	verifier, err := a.factorVerifier(db, factor)
+	if err != nil {
+		return err
+	}
+	return verifier.Challenge(ctx, factor, challenge)
+}
+
+// RefreshChallenge replaces a challenge that is about to expire, or expired
+// less than the refresh grace period ago, with a new one so that slow users
+// don't have to start over.
+func (a *API) RefreshChallenge(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	user := getUser(ctx)
+	factor := getFactor(ctx)
+	if !factor.IsOwnedBy(user) {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
+
+	challengeID, err := uuid.FromString(chi.URLParam(r, "challenge_id"))
+	if err != nil {
+		return notFoundError(ErrorCodeValidationFailed, "challenge_id must be an UUID")
+	}
+
+	oldChallenge, err := models.FindChallengeByID(db, challengeID)
+	if err != nil && models.IsNotFoundError(err) {
+		return notFoundError(ErrorCodeMFAFactorNotFound, "MFA factor with the provided challenge ID not found")
+	} else if err != nil {
+		return internalServerError("Database error finding Challenge").WithInternalError(err)
+	}
+	if oldChallenge.FactorID != factor.ID {
+		return notFoundError(ErrorCodeMFAFactorNotFound, "MFA factor with the provided challenge ID not found")
+	}
+
+	if oldChallenge.VerifiedAt != nil {
+		return unprocessableEntityError(ErrorCodeValidationFailed, "MFA challenge %v has already been verified", oldChallenge.ID)
+	}
+
+	ipAddress := utilities.GetIPAddress(r)
+	if oldChallenge.IPAddress != ipAddress {
+		return unprocessableEntityError(ErrorCodeMFAIPAddressMismatch, "Challenge and refresh IP addresses mismatch")
+	}
+	if config.MFA.BindChallengeToClient && !oldChallenge.IsBoundToClient(r.UserAgent()) {
+		return httpError(http.StatusUnauthorized, ErrorCodeMFAChallengeClientMismatch, "Challenge and refresh clients mismatch")
+	}
+
+	if !oldChallenge.IsWithinRefreshGracePeriod(config.MFA.ChallengeExpiryDuration, config.MFA.ChallengeRefreshGracePeriod) {
+		return unprocessableEntityError(ErrorCodeMFAChallengeExpired, "MFA challenge %v has expired, create a new challenge.", oldChallenge.ID)
+	}
+
+	if oldChallenge.RefreshCount >= config.MFA.MaxChallengeRefreshes {
+		return unprocessableEntityError(ErrorCodeMFAChallengeRefreshLimit, "MFA challenge %v can't be refreshed any further, create a new challenge.", oldChallenge.ID)
+	}
+
+	challenge := oldChallenge.Refresh(factor, ipAddress)
+	if config.MFA.BindChallengeToClient {
+		challenge.BindToClient(r.UserAgent())
+	}
+	if err := a.prepareChallenge(ctx, db, factor, challenge); err != nil {
+		return err
+	}
+
+	if err := db.Transaction(func(tx *storage.Connection) error {
+		if terr := tx.Destroy(oldChallenge); terr != nil {
+			return terr
+		}
+		if terr := tx.Create(challenge); terr != nil {
+			return terr
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.CreateChallengeAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":      factor.ID,
+			"factor_type":    factor.FactorType,
+			"factor_status":  factor.Status,
+			"purpose":        challenge.Purpose,
+			"refreshed_from": oldChallenge.ID,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, a.newChallengeFactorResponse(user, factor, challenge))
+}
+
+// MFAVerificationError is returned when a factor fails to verify. It tells the
+// client how many attempts remain and, once the factor is locked, until when.
+type MFAVerificationError struct {
+	*HTTPError
+	AttemptsRemaining *int       `json:"attempts_remaining,omitempty"`
+	LockedUntil       *time.Time `json:"locked_until,omitempty"`
+}
+
+// WithInternalError adds internal error information to the error
+func (e *MFAVerificationError) WithInternalError(err error) *MFAVerificationError {
+	e.HTTPError.WithInternalError(err)
+	return e
+}
+
+// newMFAVerificationError builds the error for a failed verification from the
+// factor's recorded failed attempts. No attempts are reported if lockout is
+// disabled.
+func newMFAVerificationError(factor *models.Factor, maxAttempts int, message string) *MFAVerificationError {
+	e := &MFAVerificationError{
+		HTTPError: unprocessableEntityError(ErrorCodeMFAVerificationFailed, message),
+	}
+	if maxAttempts > 0 {
+		remaining := maxAttempts - factor.FailedAttempts
+		if remaining < 0 {
+			remaining = 0
+		}
+		e.AttemptsRemaining = &remaining
+	}
+	if factor.IsLocked() {
+		e.ErrorCode = ErrorCodeMFAFactorLocked
+		e.LockedUntil = factor.LockedUntil
+	}
+	return e
 }
 
 func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 	var err error
+	start := time.Now()
 	ctx := r.Context()
 	user := getUser(ctx)
 	factor := getFactor(ctx)
+	session := getSession(ctx)
 	config := a.config
 	db := a.db.WithContext(ctx)
 
@@ -220,7 +795,31 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 	currentIP := utilities.GetIPAddress(r)
 
 	if !factor.IsOwnedBy(user) {
-		return internalServerError(InvalidFactorOwnerErrorMessage)
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
+
+	if params.RecoveryCode != "" {
+		if params.ChallengeID != uuid.Nil || params.Code != "" || params.WebAuthn != nil {
+			return badRequestError(ErrorCodeValidationFailed, "recovery_code cannot be combined with challenge_id, code or web_authn")
+		}
+		if params.ReturnVerificationToken {
+			return badRequestError(ErrorCodeValidationFailed, "recovery_code cannot be combined with return_verification_token")
+		}
+		return a.verifyRecoveryCode(w, r, params.RecoveryCode)
+	}
+
+	if params.TrustDevice && config.MFA.TrustedDeviceDuration <= 0 {
+		return badRequestError(ErrorCodeValidationFailed, "Trusted devices are disabled")
+	}
+	if params.ReturnVerificationToken && session == nil {
+		return internalServerError("A valid session is required to return a verification token")
+	}
+
+	if factor.IsLocked() {
+		return &MFAVerificationError{
+			HTTPError:   tooManyRequestsError(ErrorCodeMFAFactorLocked, "Too many failed verification attempts for this factor, try again later"),
+			LockedUntil: factor.LockedUntil,
+		}
 	}
 
 	challenge, err := models.FindChallengeByID(db, params.ChallengeID)
@@ -229,11 +828,27 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 	} else if err != nil {
 		return internalServerError("Database error finding Challenge").WithInternalError(err)
 	}
+	if challenge.FactorID != factor.ID {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, "Challenge does not belong to factor")
+	}
+
+	if challenge.VerifiedAt != nil {
+		return httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "MFA challenge %v has already been verified", challenge.ID)
+	}
 
-	if challenge.VerifiedAt != nil || challenge.IPAddress != currentIP {
+	if challenge.IPAddress != currentIP {
 		return unprocessableEntityError(ErrorCodeMFAIPAddressMismatch, "Challenge and verify IP addresses mismatch")
 	}
 
+	if params.ReturnVerificationToken && challenge.IsStepUp() {
+		return badRequestError(ErrorCodeValidationFailed, "Step up challenges cannot return a verification token")
+	}
+
+	if config.MFA.BindChallengeToClient && !challenge.IsBoundToClient(r.UserAgent()) {
+		return httpError(http.StatusUnauthorized, ErrorCodeMFAChallengeClientMismatch, "Challenge and verify clients mismatch")
+	}
+
+	logChallengeExpiry(r, challenge, config.MFA.ChallengeExpiryDuration, config.MFA.TOTPSkew)
 	if challenge.HasExpired(config.MFA.ChallengeExpiryDuration) {
 		if err := db.Destroy(challenge); err != nil {
 			return internalServerError("Database error deleting challenge").WithInternalError(err)
@@ -241,82 +856,118 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 		return unprocessableEntityError(ErrorCodeMFAChallengeExpired, "MFA challenge %v has expired, verify against another challenge or create a new challenge.", challenge.ID)
 	}
 
-	secret, shouldReEncrypt, err := factor.GetSecret(config.Security.DBEncryption.DecryptionKeys, config.Security.DBEncryption.Encrypt, config.Security.DBEncryption.EncryptionKeyID)
-	if err != nil {
-		return internalServerError("Database error verifying MFA TOTP secret").WithInternalError(err)
+	if !factor.IsVerified() && config.MFA.MinRecoveryCodes > 0 && !user.HasVerifiedFactor() {
+		codes, err := models.FindValidRecoveryCodesByUser(db, user)
+		if err != nil {
+			return internalServerError("Database error finding recovery codes").WithInternalError(err)
+		}
+		if len(codes) < config.MFA.MinRecoveryCodes {
+			return unprocessableEntityError(ErrorCodeMFARecoveryCodesRequired, "At least %d recovery codes must be generated before verifying the first factor", config.MFA.MinRecoveryCodes)
+		}
 	}
 
-	valid, verr := totp.ValidateCustom(params.Code, secret, time.Now().UTC(), totp.ValidateOpts{
-		Period:    30,
-		Skew:      1,
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA1,
-	})
+	verifier, err := a.factorVerifier(db, factor)
+	if err != nil {
+		return err
+	}
+	verification, err := verifier.Verify(ctx, factor, challenge, params)
+	if err != nil {
+		return err
+	}
+	valid := verification.Valid
 
-	if config.Hook.MFAVerificationAttempt.Enabled {
-		input := hooks.MFAVerificationAttemptInput{
-			UserID:   user.ID,
-			FactorID: factor.ID,
-			Valid:    valid,
-		}
+	if err := a.runMFAVerificationAttemptHook(r, db, user, factor, valid); err != nil {
+		return err
+	}
 
-		output := hooks.MFAVerificationAttemptOutput{}
-		err := a.invokeHook(nil, r, &input, &output, a.config.Hook.MFAVerificationAttempt.URI)
+	if !valid {
+		locked, err := factor.RecordFailedAttempt(db, config.MFA.MaxVerifyAttempts, config.MFA.VerifyAttemptWindow, config.MFA.LockoutBackoffBase, config.MFA.LockoutBackoffCap)
 		if err != nil {
-			return err
+			return internalServerError("Database error recording failed verification attempt").WithInternalError(err)
 		}
-
-		if output.Decision == hooks.HookRejection {
-			if err := models.Logout(db, user.ID); err != nil {
-				return err
-			}
-
-			if output.Message == "" {
-				output.Message = hooks.DefaultMFAHookRejectionMessage
-			}
-
-			return forbiddenError(ErrorCodeMFAVerificationRejected, output.Message)
+		if locked {
+			a.notifyFactorLocked(r, user, factor)
 		}
+		if err := models.NewAuditLogEntry(r, db, user, models.VerifyFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":    factor.ID,
+			"factor_type":  factor.FactorType,
+			"challenge_id": challenge.ID,
+			"outcome":      models.AuditOutcomeFailure,
+		}); err != nil {
+			return err
+		}
+		recordMFAVerify(ctx, factor.FactorType, false, start)
+		return newMFAVerificationError(factor, config.MFA.MaxVerifyAttempts, verification.Message).WithInternalError(verification.Err)
 	}
 
-	if !valid {
-		if shouldReEncrypt && config.Security.DBEncryption.Encrypt {
-			if err := factor.SetSecret(secret, true, config.Security.DBEncryption.EncryptionKeyID, config.Security.DBEncryption.EncryptionKey); err != nil {
-				return err
-			}
-
-			if err := db.UpdateOnly(factor, "secret"); err != nil {
-				return err
-			}
+	if verification.Pending {
+		if err := verification.Save(db); err != nil {
+			return internalServerError("Database error updating challenge").WithInternalError(err)
 		}
-		return unprocessableEntityError(ErrorCodeMFAVerificationFailed, "Invalid TOTP code entered").WithInternalError(verr)
+		return sendJSON(w, http.StatusAccepted, &VerifyFactorPendingResponse{
+			ChallengeID:      challenge.ID,
+			NextCodeRequired: true,
+		})
 	}
 
 	var token *AccessTokenResponse
+	var stepUpToken *StepUpTokenResponse
+	var verificationToken *VerificationTokenResponse
+	var trustedDevice *models.TrustedDevice
+	var trustedDeviceToken string
+	newlyVerified := !factor.IsVerified()
 	err = db.Transaction(func(tx *storage.Connection) error {
 		var terr error
-		if terr = models.NewAuditLogEntry(r, tx, user, models.VerifyFactorAction, r.RemoteAddr, map[string]interface{}{
+		if terr = models.NewAuditLogEntry(r, tx, user, models.FactorVerifiedAction, r.RemoteAddr, map[string]interface{}{
 			"factor_id":    factor.ID,
+			"factor_type":  factor.FactorType,
 			"challenge_id": challenge.ID,
+			"purpose":      challenge.Purpose,
+			"outcome":      models.AuditOutcomeSuccess,
 		}); terr != nil {
 			return terr
 		}
 		if terr = challenge.Verify(tx); terr != nil {
+			if _, ok := terr.(models.ChallengeAlreadyVerifiedError); ok {
+				return httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "MFA challenge %v has already been verified", challenge.ID)
+			}
 			return terr
 		}
-		if !factor.IsVerified() {
-			if terr = factor.UpdateStatus(tx, models.FactorStateVerified); terr != nil {
+		// older challenges of the factor can no longer be verified
+		if terr = models.DeleteOpenChallengesByFactorID(tx, factor.ID); terr != nil {
+			return terr
+		}
+		if terr = factor.UpdateLastUsedAt(tx); terr != nil {
+			return terr
+		}
+		if verification.Save != nil {
+			if terr = verification.Save(tx); terr != nil {
 				return terr
 			}
 		}
-		if shouldReEncrypt && config.Security.DBEncryption.Encrypt {
-			es, terr := crypto.NewEncryptedString(factor.ID.String(), []byte(secret), config.Security.DBEncryption.EncryptionKeyID, config.Security.DBEncryption.EncryptionKey)
-			if terr != nil {
+		if factor.FailedAttempts > 0 {
+			if terr = factor.ResetFailedAttempts(tx); terr != nil {
 				return terr
 			}
-
-			factor.Secret = es.String()
-			if terr := tx.UpdateOnly(factor, "secret"); terr != nil {
+		}
+		// only the first successful verification moves a factor from
+		// unverified to verified, later ones leave its status alone
+		if !factor.IsVerified() {
+			if terr = factor.UpdateStatus(tx, models.FactorStateVerified); terr != nil {
+				return terr
+			}
+			if _, terr = models.FindPrimaryFactorByUserID(tx, user.ID); terr != nil {
+				if !models.IsNotFoundError(terr) {
+					return terr
+				}
+				// the first verified factor becomes the user's primary factor
+				if terr = factor.SetPrimary(tx); terr != nil {
+					return terr
+				}
+			}
+		}
+		if challenge.IsStepUp() {
+			if stepUpToken, terr = a.generateStepUpToken(user, session, factor); terr != nil {
 				return terr
 			}
 		}
@@ -324,7 +975,22 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 		if terr != nil {
 			return terr
 		}
-		token, terr = a.updateMFASessionAndClaims(r, tx, user, models.TOTPSignIn, models.GrantParams{
+		if params.TrustDevice {
+			if trustedDevice, trustedDeviceToken, terr = a.issueTrustedDevice(r, tx, user, factor); terr != nil {
+				return terr
+			}
+		}
+		if params.ReturnVerificationToken {
+			// the session is upgraded once the token is exchanged
+			if verificationToken, terr = a.issueVerificationToken(tx, user, session, factor); terr != nil {
+				return terr
+			}
+			if terr = models.DeleteUnverifiedFactors(tx, user); terr != nil {
+				return internalServerError("Error removing unverified factors. %s", terr)
+			}
+			return nil
+		}
+		token, terr = a.updateMFASessionAndClaims(r, tx, user, factor.AuthenticationMethod(), models.GrantParams{
 			FactorID: &factor.ID,
 		})
 		if terr != nil {
@@ -344,7 +1010,24 @@ func (a *API) VerifyFactor(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	recordMFAVerify(ctx, factor.FactorType, true, start)
+	if trustedDevice != nil {
+		a.setTrustedDeviceCookie(w, trustedDevice, trustedDeviceToken)
+	}
+	if newlyVerified {
+		a.triggerMFAEvent(r, MFAEventFactorVerified, user, factor)
+		a.notifyFactorEnrolled(r, user, factor)
+	}
+	if verificationToken != nil {
+		return sendJSON(w, http.StatusOK, verificationToken)
+	}
 	metering.RecordLogin(string(models.MFACodeLoginAction), user.ID)
+	if stepUpToken != nil {
+		// the client replaces its credentials with the rotated ones in the
+		// same response that carries the step up token
+		stepUpToken.Session = token
+		return sendJSON(w, http.StatusOK, stepUpToken)
+	}
 
 	return sendJSON(w, http.StatusOK, token)
 
@@ -356,31 +1039,57 @@ func (a *API) UnenrollFactor(w http.ResponseWriter, r *http.Request) error {
 	user := getUser(ctx)
 	factor := getFactor(ctx)
 	session := getSession(ctx)
+	config := a.config
 	db := a.db.WithContext(ctx)
 
 	if factor == nil || session == nil || user == nil {
 		return internalServerError("A valid session and factor are required to unenroll a factor")
 	}
 
+	if !factor.IsOwnedBy(user) {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
 	if factor.IsVerified() && !session.IsAAL2() {
 		return unprocessableEntityError(ErrorCodeInsufficientAAL, "AAL2 required to unenroll verified factor")
 	}
-	if !factor.IsOwnedBy(user) {
-		return internalServerError(InvalidFactorOwnerErrorMessage)
+
+	if factor.IsVerified() && config.MFA.MinVerifiedFactors > 0 && r.URL.Query().Get("force") != "true" {
+		numVerifiedFactors := 0
+		for _, f := range user.Factors {
+			if f.IsVerified() {
+				numVerifiedFactors += 1
+			}
+		}
+		if numVerifiedFactors-1 < config.MFA.MinVerifiedFactors {
+			return badRequestError(ErrorCodeValidationFailed, "At least %d verified factors are required, pass force=true to unenroll this factor anyway", config.MFA.MinVerifiedFactors)
+		}
 	}
 
 	err = db.Transaction(func(tx *storage.Connection) error {
 		var terr error
-		if terr := tx.Destroy(factor); terr != nil {
+		// the factor is retained for auditing, its challenges can no longer
+		// be verified as deleted factors are not found
+		if terr := factor.SoftDelete(tx); terr != nil {
 			return terr
 		}
 		if terr = models.NewAuditLogEntry(r, tx, user, models.UnenrollFactorAction, r.RemoteAddr, map[string]interface{}{
 			"factor_id":     factor.ID,
+			"factor_type":   factor.FactorType,
 			"factor_status": factor.Status,
 			"session_id":    session.ID,
 		}); terr != nil {
 			return terr
 		}
+		if factor.IsVerified() {
+			// devices trusted after verifying any factor stop skipping
+			// MFA once the user changes their factors
+			if terr = models.DeleteTrustedDevicesByUserID(tx, user.ID); terr != nil {
+				return terr
+			}
+		}
+		if config.MFA.FactorDeleteRevokesSessions {
+			return models.LogoutSessionsByFactorID(tx, factor.ID)
+		}
 		if terr = factor.DowngradeSessionsToAAL1(tx); terr != nil {
 			return terr
 		}
@@ -390,7 +1099,283 @@ func (a *API) UnenrollFactor(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	a.triggerMFAEvent(r, MFAEventFactorDeleted, user, factor)
+
 	return sendJSON(w, http.StatusOK, &UnenrollFactorResponse{
 		ID: factor.ID,
 	})
 }
+
+// GetFactor returns one of the user's factors. Unverified factors are
+// pending enrollments, which are pruned once the enrollment expiry passes.
+func (a *API) GetFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	factor := getFactor(ctx)
+
+	if factor == nil || user == nil {
+		return internalServerError("A valid user and factor are required to get a factor")
+	}
+	if !factor.IsOwnedBy(user) {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
+
+	resp := &GetFactorResponse{Factor: factor}
+	if !factor.IsVerified() {
+		expiresAt := factor.EnrollmentExpiresAt(a.config.MFA.EnrollmentExpiry)
+		expiresIn := int64(math.Max(0, time.Until(expiresAt).Seconds()))
+		resp.ExpiresAt = &expiresAt
+		resp.ExpiresIn = &expiresIn
+	}
+	return sendJSON(w, http.StatusOK, resp)
+}
+
+// UpdateFactor renames one of the user's factors
+func (a *API) UpdateFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	factor := getFactor(ctx)
+	session := getSession(ctx)
+	db := a.db.WithContext(ctx)
+
+	if factor == nil || session == nil || user == nil {
+		return internalServerError("A valid session and factor are required to update a factor")
+	}
+
+	if !factor.IsOwnedBy(user) {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
+	if factor.IsVerified() && !session.IsAAL2() {
+		return forbiddenError(ErrorCodeInsufficientAAL, "AAL2 required to update a verified factor")
+	}
+
+	params := &UpdateFactorParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+
+	friendlyName := strings.TrimSpace(params.FriendlyName)
+	if friendlyName == "" {
+		return badRequestError(ErrorCodeValidationFailed, "friendly_name is required")
+	}
+	if utf8.RuneCountInString(friendlyName) > maxFriendlyNameLength {
+		return badRequestError(ErrorCodeValidationFailed, "friendly_name must be at most %d characters long", maxFriendlyNameLength)
+	}
+
+	for _, f := range user.Factors {
+		if f.ID != factor.ID && f.FriendlyName == friendlyName {
+			return httpError(http.StatusConflict, ErrorCodeMFAFactorNameConflict, "A factor with the friendly name %q for this user already exists", friendlyName)
+		}
+	}
+
+	err := db.Transaction(func(tx *storage.Connection) error {
+		if terr := factor.UpdateFriendlyName(tx, friendlyName); terr != nil {
+			pgErr := utilities.NewPostgresError(terr)
+			if pgErr.IsUniqueConstraintViolated() {
+				return httpError(http.StatusConflict, ErrorCodeMFAFactorNameConflict, "A factor with the friendly name %q for this user already exists", friendlyName)
+			}
+			return terr
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.UpdateFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":     factor.ID,
+			"factor_type":   factor.FactorType,
+			"friendly_name": friendlyName,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, factor)
+}
+
+func (a *API) SetPrimaryFactor(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	factor := getFactor(ctx)
+	session := getSession(ctx)
+	db := a.db.WithContext(ctx)
+
+	if factor == nil || session == nil || user == nil {
+		return internalServerError("A valid session and factor are required to update the primary factor")
+	}
+
+	if !factor.IsOwnedBy(user) {
+		return forbiddenError(ErrorCodeMFAFactorNotOwned, InvalidFactorOwnerErrorMessage)
+	}
+	if !factor.IsVerified() {
+		return unprocessableEntityError(ErrorCodeValidationFailed, "Only verified factors can be set as primary")
+	}
+	if !session.IsAAL2() {
+		return forbiddenError(ErrorCodeInsufficientAAL, "AAL2 required to update the primary factor")
+	}
+
+	err := db.Transaction(func(tx *storage.Connection) error {
+		if terr := factor.SetPrimary(tx); terr != nil {
+			return terr
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.UpdateFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":   factor.ID,
+			"factor_type": factor.FactorType,
+			"is_primary":  true,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &SetPrimaryFactorResponse{
+		ID:        factor.ID,
+		IsPrimary: factor.IsPrimary,
+	})
+}
+
+// loadPrimaryFactor is used when a challenge is requested without a factor
+// ID, in which case the user's primary factor is challenged.
+func (a *API) loadPrimaryFactor(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	user := getUser(ctx)
+	db := a.db.WithContext(ctx)
+
+	factor, err := models.FindPrimaryFactorByUserID(db, user.ID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, unprocessableEntityError(ErrorCodeMFAFactorNotFound, "No primary factor found, provide a factor ID to challenge")
+		}
+		return nil, internalServerError("Database error loading factor").WithInternalError(err)
+	}
+
+	observability.LogEntrySetField(r, "factor_id", factor.ID)
+
+	return withFactor(ctx, factor), nil
+}
+
+// logChallengeExpiry logs at debug level the times the challenge expiry is
+// computed from, to help debug reports of challenges expiring early
+func logChallengeExpiry(r *http.Request, challenge *models.Challenge, expiryDuration float64, skew uint) {
+	log := observability.GetLogEntry(r).Entry
+	if !log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"challenge_id":         challenge.ID,
+		"challenge_created_at": challenge.CreatedAt,
+		"challenge_expires_at": challenge.GetExpiryTime(expiryDuration),
+		"now":                  time.Now(),
+		"totp_skew":            skew,
+	}).Debug("mfa challenge expiry computed")
+}
+
+// notifyFactorEnrolled emails the user about a factor that was just verified
+// for the first time. Failing to send the email does not fail the verification.
+func (a *API) notifyFactorEnrolled(r *http.Request, user *models.User, factor *models.Factor) {
+	if !a.config.MFA.NotifyOnEnroll || user.GetEmail() == "" {
+		return
+	}
+	if err := a.Mailer().FactorEnrolledMail(r, user, factor); err != nil {
+		observability.GetLogEntry(r).Entry.WithError(err).WithField("factor_id", factor.ID).Warn("failed to send factor enrolled email")
+	}
+}
+
+// notifyFactorLocked emails the user about a factor that was just locked by
+// too many failed verification attempts. It is only called when the lock is
+// first set, so further failures while locked don't send more emails.
+func (a *API) notifyFactorLocked(r *http.Request, user *models.User, factor *models.Factor) {
+	if !a.config.MFA.NotifyOnLockout || user.GetEmail() == "" {
+		return
+	}
+	if err := a.Mailer().FactorLockedMail(r, user, factor); err != nil {
+		observability.GetLogEntry(r).Entry.WithError(err).WithField("factor_id", factor.ID).Warn("failed to send factor locked email")
+	}
+}
+
+// totpValidateOpts returns the options to validate codes for the factor with,
+// using the parameters it was enrolled with
+func totpValidateOpts(factor *models.Factor, skew uint) totp.ValidateOpts {
+	opts := totp.ValidateOpts{
+		Period:    30,
+		Skew:      skew,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	if factor.TOTPAlgorithm != nil {
+		opts.Algorithm = totpAlgorithm(*factor.TOTPAlgorithm)
+	}
+	if factor.TOTPDigits != nil {
+		opts.Digits = otp.Digits(*factor.TOTPDigits)
+	}
+	if factor.TOTPPeriod != nil {
+		opts.Period = uint(*factor.TOTPPeriod)
+	}
+	return opts
+}
+
+// runMFAVerificationAttemptHook lets the MFA verification attempt hook, if
+// enabled, reject a verification. A rejection signs the user out.
+func (a *API) runMFAVerificationAttemptHook(r *http.Request, db *storage.Connection, user *models.User, factor *models.Factor, valid bool) error {
+	if !a.config.Hook.MFAVerificationAttempt.Enabled {
+		return nil
+	}
+
+	input := hooks.MFAVerificationAttemptInput{
+		UserID:   user.ID,
+		FactorID: factor.ID,
+		Valid:    valid,
+	}
+
+	output := hooks.MFAVerificationAttemptOutput{}
+	if err := a.invokeHook(nil, r, &input, &output, a.config.Hook.MFAVerificationAttempt.URI); err != nil {
+		return err
+	}
+
+	if output.Decision == hooks.HookRejection {
+		if err := models.Logout(db, user.ID); err != nil {
+			return err
+		}
+
+		if output.Message == "" {
+			output.Message = hooks.DefaultMFAHookRejectionMessage
+		}
+
+		return forbiddenError(ErrorCodeMFAVerificationRejected, output.Message)
+	}
+	return nil
+}
+
+// matchTOTPStep returns the time step within the allowed skew that produced
+// the code.
+func matchTOTPStep(code, secret string, t time.Time, opts totp.ValidateOpts) (int64, bool) {
+	period := int64(opts.Period)
+	counter := t.Unix() / period
+	for i := -int64(opts.Skew); i <= int64(opts.Skew); i++ {
+		step := counter + i
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0).UTC(), opts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpAlgorithm maps a configured algorithm name to the otp algorithm
+func totpAlgorithm(name string) otp.Algorithm {
+	switch name {
+	case "SHA256":
+		return otp.AlgorithmSHA256
+	case "SHA512":
+		return otp.AlgorithmSHA512
+	}
+	return otp.AlgorithmSHA1
+}
+
+// totpSkew returns the number of time steps a matched TOTP code was ahead of
+// or behind the current one, a consistent offset points to a drifting clock
+func totpSkew(step int64, t time.Time, opts totp.ValidateOpts) int {
+	return int(step - t.Unix()/int64(opts.Period))
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// DisableMFA turns MFA off for the user by removing all of their factors,
+// recovery codes and trusted devices. A factor has to have been verified in
+// the session within the disable reauthentication window, so that a stolen
+// AAL2 session cannot be used to strip the user's factors later on.
+func (a *API) DisableMFA(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	session := getSession(ctx)
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	if session == nil || user == nil {
+		return internalServerError("A valid session is required to disable MFA")
+	}
+	if !user.HasVerifiedFactor() {
+		return badRequestError(ErrorCodeValidationFailed, "MFA is not enabled")
+	}
+
+	verifiedAt := session.LastMFAVerifiedAt()
+	if verifiedAt == nil || a.Now().Sub(*verifiedAt) > config.MFA.DisableReauthWindow {
+		return forbiddenError(ErrorCodeReauthenticationNeeded, "Verify a factor again to disable MFA")
+	}
+
+	factors := user.Factors
+	err := db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.NewAuditLogEntry(r, tx, user, models.DisableMFAAction, r.RemoteAddr, map[string]interface{}{
+			"factor_count": len(factors),
+			"session_id":   session.ID,
+		}); terr != nil {
+			return terr
+		}
+		for i := range factors {
+			if terr := factors[i].DowngradeSessionsToAAL1(tx); terr != nil {
+				return terr
+			}
+		}
+		if terr := models.DeleteChallengesByUserID(tx, user.ID); terr != nil {
+			return terr
+		}
+		if terr := models.SoftDeleteFactorsByUserID(tx, user.ID); terr != nil {
+			return terr
+		}
+		if terr := models.DeleteRecoveryCodesByUser(tx, user); terr != nil {
+			return terr
+		}
+		return models.DeleteTrustedDevicesByUserID(tx, user.ID)
+	})
+	if err != nil {
+		return internalServerError("Database error disabling MFA").WithInternalError(err)
+	}
+	for i := range factors {
+		a.triggerMFAEvent(r, MFAEventFactorDeleted, user, &factors[i])
+	}
+
+	return sendJSON(w, http.StatusOK, map[string]interface{}{})
+}
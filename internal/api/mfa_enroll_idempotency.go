@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/base32"
+	"net/http"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// EnrollIdempotencyKeyHeader lets clients retry an enroll request without
+// creating another factor
+const EnrollIdempotencyKeyHeader = "Idempotency-Key"
+
+const maxEnrollIdempotencyKeyLength = 255
+
+// saveEnrollIdempotencyKey associates the idempotency key of the request, if
+// any, with the factor it created
+func saveEnrollIdempotencyKey(tx *storage.Connection, user *models.User, params *EnrollFactorParams, factor *models.Factor) error {
+	if params.IdempotencyKey == "" {
+		return nil
+	}
+	return models.SaveEnrollIdempotencyKey(tx, user.ID, params.IdempotencyKey, factor.ID)
+}
+
+// replayEnrollFactor responds to a retried enroll request with the factor
+// created by the first request, as it was returned then. Only factors that
+// have not been verified yet are replayed, so that the key cannot be used to
+// read the secret of a factor in use.
+func (a *API) replayEnrollFactor(w http.ResponseWriter, r *http.Request, user *models.User, session *models.Session, factor *models.Factor, issuer string) error {
+	config := a.config
+	db := a.db.WithContext(r.Context())
+
+	if user.HasVerifiedFactor() && !session.IsAAL2() {
+		return forbiddenError(ErrorCodeInsufficientAAL, "AAL2 required to enroll a new factor")
+	}
+	if factor.IsVerified() {
+		return unprocessableEntityError(ErrorCodeValidationFailed, "Idempotency-Key was used for a factor that has already been verified")
+	}
+
+	response := &EnrollFactorResponse{
+		ID:           factor.ID,
+		Type:         factor.FactorType,
+		FriendlyName: factor.FriendlyName,
+	}
+
+	switch factor.FactorType {
+	case models.TOTP:
+		secret, _, err := factor.GetSecret(config.Security.DBEncryption.DecryptionKeys, config.Security.DBEncryption.Encrypt, config.Security.DBEncryption.EncryptionKeyID)
+		if err != nil {
+			return internalServerError("Database error verifying MFA TOTP secret").WithInternalError(err)
+		}
+		rawSecret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+		if err != nil {
+			return internalServerError("Error decoding MFA TOTP secret").WithInternalError(err)
+		}
+		opts := totpValidateOpts(factor, 0)
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      issuer,
+			AccountName: user.GetEmail(),
+			Period:      opts.Period,
+			Digits:      opts.Digits,
+			Algorithm:   opts.Algorithm,
+			Secret:      rawSecret,
+		})
+		if err != nil {
+			return internalServerError(QRCodeGenerationErrorMessage).WithInternalError(err)
+		}
+		if response.TOTP, err = newTOTPObject(key, config.MFA.QRCodeSize, config.MFA.SecretChunkSize); err != nil {
+			return err
+		}
+	case models.WebAuthn:
+		challenge, err := models.FindLatestChallengeByFactorID(db, factor.ID)
+		if err != nil {
+			return internalServerError("Database error finding challenge").WithInternalError(err)
+		}
+		response.WebAuthn = a.newWebAuthnObject(user, factor, challenge)
+	case models.SMS:
+		if factor.Phone != nil {
+			response.Phone = *factor.Phone
+		}
+	}
+
+	return sendJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// OrderFactorsParams lists factor ids in the order the factors should be
+// listed in
+type OrderFactorsParams struct {
+	FactorIDs []uuid.UUID `json:"factor_ids"`
+}
+
+// OrderFactors sets the order the user's factors are listed in. Factors that
+// are left out are listed after the ordered ones.
+func (a *API) OrderFactors(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	session := getSession(ctx)
+	db := a.db.WithContext(ctx)
+
+	if session == nil || user == nil {
+		return internalServerError("A valid session is required to order factors")
+	}
+	if user.HasVerifiedFactor() && !session.IsAAL2() {
+		return forbiddenError(ErrorCodeInsufficientAAL, "AAL2 required to order factors")
+	}
+
+	params := &OrderFactorsParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+	if len(params.FactorIDs) == 0 {
+		return badRequestError(ErrorCodeValidationFailed, "factor_ids is required")
+	}
+
+	factors, err := models.FindFactorsByUserID(db, user.ID, models.FactorFilter{}, nil)
+	if err != nil {
+		return internalServerError("Database error finding factors").WithInternalError(err)
+	}
+	owned := make(map[uuid.UUID]bool, len(factors))
+	for _, f := range factors {
+		owned[f.ID] = true
+	}
+	seen := make(map[uuid.UUID]bool, len(params.FactorIDs))
+	for _, id := range params.FactorIDs {
+		if !owned[id] {
+			return notFoundError(ErrorCodeMFAFactorNotFound, "Factor %s not found", id)
+		}
+		if seen[id] {
+			return badRequestError(ErrorCodeValidationFailed, "Factor %s is listed more than once", id)
+		}
+		seen[id] = true
+	}
+
+	err = db.Transaction(func(tx *storage.Connection) error {
+		if terr := models.SetFactorOrder(tx, user.ID, params.FactorIDs); terr != nil {
+			return terr
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.UpdateFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_ids": params.FactorIDs,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	factors, err = models.FindFactorsByUserID(db, user.ID, models.FactorFilter{}, nil)
+	if err != nil {
+		return internalServerError("Database error finding factors").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, factors)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/supabase/auth/internal/observability"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	mfaVerifyCounter  = observability.ObtainMetricCounter("gotrue_mfa_verify", "Number of MFA factor verifications by result")
+	mfaVerifyDuration = observability.ObtainMetricHistogram("gotrue_mfa_verify_duration", "Duration of MFA factor verifications", "s")
+	mfaEnrollCounter  = observability.ObtainMetricCounter("gotrue_mfa_enroll", "Number of enrolled MFA factors by factor type")
+)
+
+// recordMFAVerify records the result and duration of a factor verification
+// that started at start
+func recordMFAVerify(ctx context.Context, factorType string, success bool, start time.Time) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	attributes := metric.WithAttributes(
+		attribute.String("result", result),
+		attribute.String("factor_type", factorType),
+	)
+	mfaVerifyCounter.Add(ctx, 1, attributes)
+	mfaVerifyDuration.Record(ctx, time.Since(start).Seconds(), attributes)
+}
+
+func recordMFAEnroll(ctx context.Context, factorType string) {
+	mfaEnrollCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("factor_type", factorType)))
+}
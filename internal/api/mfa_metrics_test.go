@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/auth/internal/models"
+	"go.opentelemetry.io/otel"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+var (
+	metricsRegistryOnce sync.Once
+	metricsRegistry     *prometheus.Registry
+)
+
+// testMetricsHandler installs a Prometheus backed meter provider once per
+// test binary, as only the first provider receives the delegated instruments,
+// and returns a handler serving its metrics
+func testMetricsHandler(t *testing.T) http.Handler {
+	metricsRegistryOnce.Do(func() {
+		metricsRegistry = prometheus.NewRegistry()
+		exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(metricsRegistry))
+		require.NoError(t, err)
+		otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter)))
+	})
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// scrapeMetric sums the values of all series of the metric whose labels
+// contain every one of the given label pairs
+func scrapeMetric(t *testing.T, handler http.Handler, name string, labels ...string) float64 {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var total float64
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name+"{") {
+			continue
+		}
+		matches := true
+		for _, label := range labels {
+			if !strings.Contains(line, label) {
+				matches = false
+			}
+		}
+		if !matches {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+		require.NoError(t, err)
+		total += value
+	}
+	require.NoError(t, scanner.Err())
+	return total
+}
+
+func (ts *MFATestSuite) TestMFAMetrics() {
+	handler := testMetricsHandler(ts.T())
+
+	verified := scrapeMetric(ts.T(), handler, "gotrue_mfa_verify_total", `result="success"`)
+	enrolled := scrapeMetric(ts.T(), handler, "gotrue_mfa_enroll_total", `factor_type="totp"`)
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	performEnrollAndVerify(ts, token, true)
+
+	require.Equal(ts.T(), verified+1, scrapeMetric(ts.T(), handler, "gotrue_mfa_verify_total", `result="success"`))
+	require.Equal(ts.T(), enrolled+1, scrapeMetric(ts.T(), handler, "gotrue_mfa_enroll_total", `factor_type="totp"`))
+	require.NotZero(ts.T(), scrapeMetric(ts.T(), handler, "gotrue_mfa_verify_duration_seconds_count", `result="success"`))
+}
+
+func (ts *MFATestSuite) TestMFAMetricsSMSEnroll() {
+	handler := testMetricsHandler(ts.T())
+
+	enrolled := scrapeMetric(ts.T(), handler, "gotrue_mfa_enroll_total", `factor_type="sms"`)
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FriendlyName: "phone", FactorType: models.SMS, Phone: "+1 555 0100 123"}))
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	require.Equal(ts.T(), enrolled+1, scrapeMetric(ts.T(), handler, "gotrue_mfa_enroll_total", `factor_type="sms"`))
+}
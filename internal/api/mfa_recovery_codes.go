@@ -0,0 +1,300 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/metering"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+	"github.com/supabase/auth/internal/utilities"
+)
+
+// Formats recovery codes can be downloaded in, selected by the Accept header
+const (
+	recoveryCodesFormatJSON = "application/json"
+	recoveryCodesFormatText = "text/plain"
+	recoveryCodesFormatCSV  = "text/csv"
+)
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type RecoveryCodesStatusResponse struct {
+	Total       int        `json:"total"`
+	Used        int        `json:"used"`
+	Remaining   int        `json:"remaining"`
+	Low         bool       `json:"low"`
+	GeneratedAt *time.Time `json:"generated_at,omitempty"`
+}
+
+type VerifyRecoveryCodeParams struct {
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type VerifyRecoveryCodeResponse struct {
+	*AccessTokenResponse
+	RemainingRecoveryCodes int `json:"remaining_recovery_codes"`
+}
+
+// GenerateRecoveryCodes creates a new set of recovery codes for the user,
+// invalidating any unused codes from a previous set. Users without a verified
+// factor may generate codes from an AAL1 session so that they can do so before
+// verifying their first factor.
+func (a *API) GenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	codes, err := a.regenerateRecoveryCodes(r)
+	if err != nil {
+		return err
+	}
+
+	preventCaching(w)
+	switch negotiateRecoveryCodesFormat(r.Header.Get("Accept")) {
+	case recoveryCodesFormatText:
+		return sendRecoveryCodesFile(w, recoveryCodesFormatText, "recovery-codes.txt", []byte(strings.Join(codes, "\n")+"\n"))
+	case recoveryCodesFormatCSV:
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		if err := writer.Write([]string{"recovery_code"}); err != nil {
+			return internalServerError("Error encoding recovery codes").WithInternalError(err)
+		}
+		for _, code := range codes {
+			if err := writer.Write([]string{code}); err != nil {
+				return internalServerError("Error encoding recovery codes").WithInternalError(err)
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return internalServerError("Error encoding recovery codes").WithInternalError(err)
+		}
+		return sendRecoveryCodesFile(w, recoveryCodesFormatCSV, "recovery-codes.csv", buf.Bytes())
+	}
+
+	return sendJSON(w, http.StatusOK, &RecoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+// regenerateRecoveryCodes replaces the recovery codes of the user of the
+// session with a new set and returns the plaintext codes
+func (a *API) regenerateRecoveryCodes(r *http.Request) ([]string, error) {
+	ctx := r.Context()
+	user := getUser(ctx)
+	session := getSession(ctx)
+	db := a.db.WithContext(ctx)
+
+	if session == nil || user == nil {
+		return nil, internalServerError("A valid session and a registered user are required to generate recovery codes")
+	}
+
+	if user.HasVerifiedFactor() && !session.IsAAL2() {
+		return nil, forbiddenError(ErrorCodeInsufficientAAL, "AAL2 required to generate recovery codes")
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		codes, terr = a.createRecoveryCodes(r, tx, user)
+		return terr
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// createRecoveryCodes saves a new set of recovery codes for the user in the
+// transaction, invalidating any unused codes from a previous set, and returns
+// the plaintext codes
+func (a *API) createRecoveryCodes(r *http.Request, tx *storage.Connection, user *models.User) ([]string, error) {
+	config := a.config
+	generate := func(length int) (string, error) {
+		return crypto.GenerateRecoveryCode(length, config.MFA.RecoveryCodeAlphabet)
+	}
+	if a.overrideRecoveryCodeGenerator != nil {
+		generate = a.overrideRecoveryCodeGenerator
+	}
+
+	codes := make([]string, 0, config.MFA.RecoveryCodeCount)
+	for i := 0; i < config.MFA.RecoveryCodeCount; i++ {
+		code, err := generate(config.MFA.RecoveryCodeLength)
+		if err != nil {
+			return nil, internalServerError("Error generating recovery codes").WithInternalError(err)
+		}
+		codes = append(codes, code)
+	}
+
+	batchID := uuid.Must(uuid.NewV4())
+	recoveryCodes := make([]*models.RecoveryCode, 0, len(codes))
+	for _, code := range codes {
+		recoveryCodes = append(recoveryCodes, models.NewRecoveryCode(user, batchID, code))
+	}
+
+	if err := models.InvalidateRecoveryCodesByUser(tx, user); err != nil {
+		return nil, err
+	}
+	for _, recoveryCode := range recoveryCodes {
+		if err := tx.Create(recoveryCode); err != nil {
+			return nil, err
+		}
+	}
+	if err := models.NewAuditLogEntry(r, tx, user, models.GenerateRecoveryCodesAction, r.RemoteAddr, map[string]interface{}{
+		"count":    len(codes),
+		"batch_id": batchID,
+	}); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// negotiateRecoveryCodesFormat returns the first supported format listed in
+// the Accept header, falling back to JSON
+func negotiateRecoveryCodesFormat(accept string) string {
+	for _, mediaType := range strings.Split(accept, ",") {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]))
+		switch mediaType {
+		case recoveryCodesFormatJSON, recoveryCodesFormatText, recoveryCodesFormatCSV:
+			return mediaType
+		}
+	}
+	return recoveryCodesFormatJSON
+}
+
+// preventCaching keeps a response with plaintext recovery codes out of
+// browser and proxy caches. Only hashes of the codes are stored, so this is the
+// only response that ever contains them.
+func preventCaching(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// sendRecoveryCodesFile sends the recovery codes as a file to be downloaded
+func sendRecoveryCodesFile(w http.ResponseWriter, contentType, filename string, body []byte) error {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(body)
+	return err
+}
+
+// RecoveryCodesStatus reports how many codes of the user's current set of
+// recovery codes are left
+func (a *API) RecoveryCodesStatus(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	total, used, err := models.CountRecoveryCodesByUser(db, user)
+	if err != nil {
+		return internalServerError("Database error counting recovery codes").WithInternalError(err)
+	}
+	remaining := total - used
+
+	response := &RecoveryCodesStatusResponse{
+		Total:     total,
+		Used:      used,
+		Remaining: remaining,
+		Low:       remaining < config.MFA.LowRecoveryCodeThreshold,
+	}
+	if total > 0 {
+		batch, err := models.FindLatestRecoveryCodeBatch(db, user)
+		if err != nil && !models.IsNotFoundError(err) {
+			return internalServerError("Database error finding recovery codes").WithInternalError(err)
+		} else if err == nil {
+			response.GeneratedAt = &batch.CreatedAt
+		}
+	}
+
+	return sendJSON(w, http.StatusOK, response)
+}
+
+// VerifyRecoveryCode consumes one of the user's recovery codes and upgrades
+// the session to AAL2 in place of a factor verification
+func (a *API) VerifyRecoveryCode(w http.ResponseWriter, r *http.Request) error {
+	params := &VerifyRecoveryCodeParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+
+	return a.verifyRecoveryCode(w, r, params.RecoveryCode)
+}
+
+// verifyRecoveryCode is shared by the recovery code and the factor verify
+// endpoints. It runs in a transaction of its own, separate from any factor
+// verification.
+func (a *API) verifyRecoveryCode(w http.ResponseWriter, r *http.Request, candidate string) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	recoveryCode := strings.ToLower(strings.TrimSpace(candidate))
+	if recoveryCode == "" {
+		return badRequestError(ErrorCodeValidationFailed, "recovery_code is required")
+	}
+
+	var token *AccessTokenResponse
+	var remaining int
+	var invalid bool
+	err := db.Transaction(func(tx *storage.Connection) error {
+		matched, terr := models.FindValidRecoveryCodeByUserForUpdate(ctx, tx, user, recoveryCode)
+		if terr != nil && models.IsNotFoundError(terr) {
+			// commit the audit entry for the failed attempt before rejecting the request
+			invalid = true
+			return models.NewAuditLogEntry(r, tx, user, models.VerifyRecoveryCodeAction, r.RemoteAddr, map[string]interface{}{
+				"outcome": models.AuditOutcomeFailure,
+			})
+		} else if terr != nil {
+			return terr
+		}
+
+		if terr = matched.Consume(tx, utilities.GetIPAddress(r)); terr != nil {
+			return terr
+		}
+		total, used, terr := models.CountRecoveryCodesByUser(tx, user)
+		if terr != nil {
+			return terr
+		}
+		remaining = total - used
+
+		if terr = models.NewAuditLogEntry(r, tx, user, models.VerifyRecoveryCodeAction, r.RemoteAddr, map[string]interface{}{
+			"recovery_code_id": matched.ID,
+			"outcome":          models.AuditOutcomeSuccess,
+		}); terr != nil {
+			return terr
+		}
+		user, terr = models.FindUserByID(tx, user.ID)
+		if terr != nil {
+			return terr
+		}
+		token, terr = a.updateMFASessionAndClaims(r, tx, user, models.RecoveryCodeSignIn, models.GrantParams{})
+		if terr != nil {
+			return terr
+		}
+		if terr = a.setCookieTokens(config, token, false, w); terr != nil {
+			return internalServerError("Failed to set JWT cookie. %s", terr)
+		}
+		if terr = models.InvalidateSessionsWithAALLessThan(tx, user.ID, models.AAL2.String()); terr != nil {
+			return internalServerError("Failed to update sessions. %s", terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if invalid {
+		return httpError(http.StatusUnauthorized, ErrorCodeMFARecoveryCodeInvalid, "Invalid or already used recovery code")
+	}
+	a.triggerMFAEvent(r, MFAEventRecoveryCodeConsumed, user, nil)
+	metering.RecordLogin(string(models.MFACodeLoginAction), user.ID)
+
+	return sendJSON(w, http.StatusOK, &VerifyRecoveryCodeResponse{
+		AccessTokenResponse:    token,
+		RemainingRecoveryCodes: remaining,
+	})
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/supabase/auth/internal/crypto"
+)
+
+const recoveryCodesBundleVersion = 1
+
+// RecoveryCodesBundle holds a set of recovery codes encrypted and signed with
+// the database encryption key, so that it can be kept in a password manager
+// and checked for authenticity later on.
+type RecoveryCodesBundle struct {
+	Version   int                     `json:"version"`
+	UserID    uuid.UUID               `json:"user_id"`
+	CreatedAt time.Time               `json:"created_at"`
+	Checksum  string                  `json:"checksum"`
+	Payload   *crypto.EncryptedString `json:"payload"`
+	Signature string                  `json:"signature"`
+}
+
+type VerifyRecoveryCodesBundleParams struct {
+	Bundle *RecoveryCodesBundle `json:"bundle"`
+}
+
+type VerifyRecoveryCodesBundleResponse struct {
+	Valid             bool      `json:"valid"`
+	Version           int       `json:"version"`
+	CreatedAt         time.Time `json:"created_at"`
+	RecoveryCodeCount int       `json:"recovery_code_count"`
+}
+
+// recoveryCodesBundleKeyIDs returns the IDs the encryption and the signing
+// keys of a user's bundles are derived with, so that the two never share a key
+func recoveryCodesBundleKeyIDs(userID uuid.UUID) (string, string) {
+	return userID.String() + ":recovery_codes_bundle", userID.String() + ":recovery_codes_bundle_signature"
+}
+
+// signedContent is the part of the bundle covered by the signature
+func (b *RecoveryCodesBundle) signedContent() []byte {
+	return []byte(fmt.Sprintf("%d.%s.%d.%s.%s", b.Version, b.UserID, b.CreatedAt.Unix(), b.Checksum, b.Payload.String()))
+}
+
+func recoveryCodesChecksum(plaintext []byte) string {
+	sum := sha256.Sum256(plaintext)
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateRecoveryCodesBundle creates a new set of recovery codes for the user
+// like GenerateRecoveryCodes, but returns them as an encrypted and signed
+// bundle instead of in plaintext.
+func (a *API) GenerateRecoveryCodesBundle(w http.ResponseWriter, r *http.Request) error {
+	config := a.config
+	user := getUser(r.Context())
+
+	if !config.Security.DBEncryption.Encrypt {
+		return unprocessableEntityError(ErrorCodeValidationFailed, "Recovery code bundles require database encryption to be enabled")
+	}
+
+	codes, err := a.regenerateRecoveryCodes(r)
+	if err != nil {
+		return err
+	}
+
+	keyID := config.Security.DBEncryption.EncryptionKeyID
+	key := config.Security.DBEncryption.EncryptionKey
+	encryptionID, signingID := recoveryCodesBundleKeyIDs(user.ID)
+
+	plaintext := []byte(strings.Join(codes, "\n"))
+	payload, err := crypto.NewEncryptedString(encryptionID, plaintext, keyID, key)
+	if err != nil {
+		return internalServerError("Error encrypting recovery codes").WithInternalError(err)
+	}
+
+	bundle := &RecoveryCodesBundle{
+		Version:   recoveryCodesBundleVersion,
+		UserID:    user.ID,
+		CreatedAt: a.Now().UTC().Truncate(time.Second),
+		Checksum:  recoveryCodesChecksum(plaintext),
+		Payload:   payload,
+	}
+	signature, err := crypto.GenerateHMAC(signingID, keyID, key, bundle.signedContent())
+	if err != nil {
+		return internalServerError("Error signing recovery codes").WithInternalError(err)
+	}
+	bundle.Signature = base64.RawURLEncoding.EncodeToString(signature)
+
+	preventCaching(w)
+	return sendJSON(w, http.StatusOK, bundle)
+}
+
+// VerifyRecoveryCodesBundle checks that a bundle was issued to the user by
+// this instance and has not been tampered with. The codes themselves are not
+// returned.
+func (a *API) VerifyRecoveryCodesBundle(w http.ResponseWriter, r *http.Request) error {
+	config := a.config
+	user := getUser(r.Context())
+
+	params := &VerifyRecoveryCodesBundleParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+
+	bundle := params.Bundle
+	if bundle == nil || bundle.Payload == nil || !bundle.Payload.IsValid() {
+		return badRequestError(ErrorCodeValidationFailed, "A recovery code bundle is required")
+	}
+	if bundle.Version != recoveryCodesBundleVersion {
+		return unprocessableEntityError(ErrorCodeMFARecoveryCodesBundleInvalid, "Unsupported recovery code bundle version %d", bundle.Version)
+	}
+	if bundle.UserID != user.ID {
+		return unprocessableEntityError(ErrorCodeMFARecoveryCodesBundleInvalid, "Recovery code bundle was not issued to this user")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(bundle.Signature)
+	if err != nil {
+		return unprocessableEntityError(ErrorCodeMFARecoveryCodesBundleInvalid, "Invalid recovery code bundle signature")
+	}
+
+	decryptionKeys := config.Security.DBEncryption.DecryptionKeys
+	encryptionID, signingID := recoveryCodesBundleKeyIDs(user.ID)
+
+	valid, err := crypto.VerifyHMAC(signingID, bundle.Payload.KeyID, decryptionKeys, bundle.signedContent(), signature)
+	if err != nil || !valid {
+		return unprocessableEntityError(ErrorCodeMFARecoveryCodesBundleInvalid, "Invalid recovery code bundle signature")
+	}
+
+	plaintext, err := bundle.Payload.Decrypt(encryptionID, decryptionKeys)
+	if err != nil {
+		return unprocessableEntityError(ErrorCodeMFARecoveryCodesBundleInvalid, "Recovery code bundle could not be decrypted")
+	}
+	if !crypto.ConstantTimeEqual(recoveryCodesChecksum(plaintext), bundle.Checksum) {
+		return unprocessableEntityError(ErrorCodeMFARecoveryCodesBundleInvalid, "Recovery code bundle checksum does not match")
+	}
+
+	return sendJSON(w, http.StatusOK, &VerifyRecoveryCodesBundleResponse{
+		Valid:             true,
+		Version:           bundle.Version,
+		CreatedAt:         bundle.CreatedAt,
+		RecoveryCodeCount: len(strings.Split(string(plaintext), "\n")),
+	})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	mathRand "math/rand"
+	"net/http"
+	"time"
+)
+
+// delayFailedResponses holds back error responses of MFA routes until the
+// configured verify response jitter has passed since the request started,
+// plus a random part of the same length. Failures then take about as long
+// whether the factor was not found or the code was wrong.
+func (a *API) delayFailedResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jitter := a.config.MFA.VerifyResponseJitter
+		if jitter <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&delayedFailureWriter{
+			ResponseWriter: w,
+			ctx:            r.Context(),
+			notBefore:      time.Now().Add(jitter + time.Duration(mathRand.Int63n(int64(jitter)))), // #nosec
+		}, r)
+	})
+}
+
+// delayedFailureWriter delays writing error statuses until notBefore
+type delayedFailureWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	notBefore   time.Time
+	wroteHeader bool
+}
+
+func (w *delayedFailureWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= http.StatusBadRequest {
+		timer := time.NewTimer(time.Until(w.notBefore))
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			timer.Stop()
+		}
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *delayedFailureWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
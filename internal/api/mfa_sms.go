@@ -0,0 +1,134 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/api/sms_provider"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+	"github.com/supabase/auth/internal/utilities"
+)
+
+func (a *API) enrollSMSFactor(w http.ResponseWriter, r *http.Request, user *models.User, params *EnrollFactorParams) error {
+	db := a.db.WithContext(r.Context())
+
+	phone, err := validatePhone(params.Phone)
+	if err != nil {
+		return err
+	}
+
+	factor := models.NewFactor(user, params.FriendlyName, params.FactorType, models.FactorStateUnverified)
+	factor.SetDeviceMetadata(params.DeviceName, params.Platform)
+	factor.Phone = &phone
+
+	var recoveryCodes []string
+	err = db.Transaction(func(tx *storage.Connection) error {
+		if terr := a.lockFactorLimits(tx, user); terr != nil {
+			return terr
+		}
+		if terr := assignDefaultFriendlyName(tx, user, factor); terr != nil {
+			return terr
+		}
+		if terr := tx.Create(factor); terr != nil {
+			pgErr := utilities.NewPostgresError(terr)
+			if pgErr.IsUniqueConstraintViolated() {
+				return unprocessableEntityError(ErrorCodeMFAFactorNameConflict, fmt.Sprintf("A factor with the friendly name %q for this user likely already exists", factor.FriendlyName))
+			}
+			return terr
+		}
+		if terr := saveEnrollIdempotencyKey(tx, user, params, factor); terr != nil {
+			return terr
+		}
+		if params.GenerateRecoveryCodes {
+			codes, terr := a.createRecoveryCodes(r, tx, user)
+			if terr != nil {
+				return terr
+			}
+			recoveryCodes = codes
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.EnrollFactorAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":   factor.ID,
+			"factor_type": factor.FactorType,
+		}); terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a.triggerMFAEvent(r, MFAEventFactorEnrolled, user, factor)
+	recordMFAEnroll(r.Context(), factor.FactorType)
+
+	if recoveryCodes != nil {
+		preventCaching(w)
+	}
+	return sendJSON(w, http.StatusOK, &EnrollFactorResponse{
+		ID:            factor.ID,
+		Type:          models.SMS,
+		FriendlyName:  factor.FriendlyName,
+		Phone:         phone,
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// sendSMSChallenge generates a new code for the challenge, stores its hash and
+// sends the code to the factor's phone number.
+func (a *API) sendSMSChallenge(factor *models.Factor, challenge *models.Challenge) error {
+	config := a.config
+
+	if factor.Phone == nil {
+		return internalServerError("SMS factor has no phone number")
+	}
+
+	otp, err := crypto.GenerateOtp(config.Sms.OtpLength)
+	if err != nil {
+		return internalServerError("error generating otp").WithInternalError(err)
+	}
+	message, err := generateSMSFromTemplate(config.Sms.SMSTemplate, otp)
+	if err != nil {
+		return err
+	}
+
+	smsProvider, err := a.getSmsProvider()
+	if err != nil {
+		return internalServerError("Unable to get SMS provider").WithInternalError(err)
+	}
+	if _, err := smsProvider.SendMessage(*factor.Phone, message, sms_provider.SMSProvider, otp); err != nil {
+		return internalServerError("Error sending SMS challenge").WithInternalError(err)
+	}
+
+	otpHash := crypto.GenerateTokenHash(*factor.Phone, otp)
+	challenge.OtpCode = &otpHash
+
+	return nil
+}
+
+// maskPhone hides all but the last four digits of the phone number
+func maskPhone(phone string) string {
+	const visible = 4
+	if len(phone) <= visible {
+		return strings.Repeat("*", len(phone))
+	}
+	return strings.Repeat("*", len(phone)-visible) + phone[len(phone)-visible:]
+}
+
+// verifySMSCode checks the submitted code against the hash stored on the challenge
+func verifySMSCode(factor *models.Factor, challenge *models.Challenge, code string) error {
+	if factor.Phone == nil || challenge.OtpCode == nil {
+		return errors.New("challenge was not issued for an sms factor")
+	}
+
+	otpHash := crypto.GenerateTokenHash(*factor.Phone, code)
+	if subtle.ConstantTimeCompare([]byte(otpHash), []byte(*challenge.OtpCode)) != 1 {
+		return errors.New("invalid sms code")
+	}
+
+	return nil
+}
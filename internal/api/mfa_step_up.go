@@ -0,0 +1,74 @@
+package api
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/supabase/auth/internal/models"
+)
+
+// stepUpTokenAudience is the audience of step up tokens, so that services
+// accepting access tokens of the user's audience do not accept them
+const stepUpTokenAudience = "step_up"
+
+// StepUpTokenClaims are the claims of the token returned when a step up
+// challenge is verified. Unlike access tokens they only attest that the user
+// completed an MFA check for the session within the token's lifetime.
+type StepUpTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionId string `json:"session_id"`
+	FactorID  string `json:"factor_id"`
+	Purpose   string `json:"purpose"`
+}
+
+type StepUpTokenResponse struct {
+	Token     string `json:"step_up_token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int    `json:"expires_in"`
+	ExpiresAt int64  `json:"expires_at"`
+
+	// Session holds the access token and rotated refresh token of the session
+	// the step up challenge was verified from
+	Session *AccessTokenResponse `json:"session,omitempty"`
+}
+
+func (a *API) generateStepUpToken(user *models.User, session *models.Session, factor *models.Factor) (*StepUpTokenResponse, error) {
+	config := a.config
+
+	if session == nil {
+		return nil, internalServerError("Session is required to issue step up token")
+	}
+
+	issuedAt := time.Now().UTC()
+	expiresAt := issuedAt.Add(time.Second * time.Duration(config.MFA.StepUpTokenExp))
+
+	claims := &StepUpTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.String(),
+			Audience:  []string{stepUpTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			Issuer:    config.JWT.Issuer,
+		},
+		SessionId: session.ID.String(),
+		FactorID:  factor.ID.String(),
+		Purpose:   models.ChallengePurposeStepUp,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if config.JWT.KeyID != "" {
+		token.Header["kid"] = config.JWT.KeyID
+	}
+
+	signed, err := token.SignedString([]byte(config.JWT.Secret))
+	if err != nil {
+		return nil, internalServerError("Error signing step up token").WithInternalError(err)
+	}
+
+	return &StepUpTokenResponse{
+		Token:     signed,
+		TokenType: "bearer",
+		ExpiresIn: config.MFA.StepUpTokenExp,
+		ExpiresAt: expiresAt.Unix(),
+	}, nil
+}
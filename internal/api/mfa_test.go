@@ -2,22 +2,34 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt/v5"
 
 	"database/sql"
 
 	"github.com/pkg/errors"
 	"github.com/pquerna/otp"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/supabase/auth/internal/conf"
 	"github.com/supabase/auth/internal/crypto"
+	mail "github.com/supabase/auth/internal/mailer"
 	"github.com/supabase/auth/internal/models"
 	"github.com/supabase/auth/internal/storage"
 	"github.com/supabase/auth/internal/utilities"
@@ -68,6 +80,7 @@ func (ts *MFATestSuite) SetupTest() {
 	s, err := models.NewSession(u.ID, &f.ID)
 	require.NoError(ts.T(), err, "Error creating test session")
 	require.NoError(ts.T(), ts.API.db.Create(s), "Error saving test session")
+	require.NoError(ts.T(), ts.API.db.Create(&models.RefreshToken{UserID: u.ID, Token: crypto.SecureToken(), SessionId: &s.ID}), "Error saving test refresh token")
 
 	u, err = models.FindUserByEmailAndAudience(ts.API.db, ts.TestEmail, ts.Config.JWT.Aud)
 	ts.Require().NoError(err)
@@ -78,6 +91,7 @@ func (ts *MFATestSuite) SetupTest() {
 	secondarySession, err := models.NewSession(ts.TestUser.ID, &f.ID)
 	require.NoError(ts.T(), err, "Error creating test session")
 	require.NoError(ts.T(), ts.API.db.Create(secondarySession), "Error saving test session")
+	require.NoError(ts.T(), ts.API.db.Create(&models.RefreshToken{UserID: ts.TestUser.ID, Token: crypto.SecureToken(), SessionId: &secondarySession.ID}), "Error saving test refresh token")
 
 	ts.TestSecondarySession = secondarySession
 
@@ -127,7 +141,7 @@ func (ts *MFATestSuite) TestEnrollFactor() {
 			friendlyName: testFriendlyName,
 			factorType:   "invalid_factor",
 			issuer:       ts.TestDomain,
-			expectedCode: http.StatusBadRequest,
+			expectedCode: http.StatusUnprocessableEntity,
 		},
 		{
 			desc:         "TOTP: Factor has friendly name",
@@ -160,12 +174,544 @@ func (ts *MFATestSuite) TestEnrollFactor() {
 				enrollResp := EnrollFactorResponse{}
 				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
 				qrCode := enrollResp.TOTP.QRCode
-				hasSVGStartAndEnd := strings.Contains(qrCode, "<svg") && strings.Contains(qrCode, "</svg>")
-				require.True(ts.T(), hasSVGStartAndEnd)
-				require.Equal(ts.T(), c.friendlyName, enrollResp.FriendlyName)
+				require.True(ts.T(), strings.HasPrefix(qrCode, "data:image/png;base64,"))
+				pngData, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(qrCode, "data:image/png;base64,"))
+				require.NoError(ts.T(), err)
+				qrImage, err := png.Decode(bytes.NewReader(pngData))
+				require.NoError(ts.T(), err)
+				require.Equal(ts.T(), ts.API.config.MFA.QRCodeSize, qrImage.Bounds().Dx())
+
+				uri, err := url.Parse(enrollResp.TOTP.URI)
+				require.NoError(ts.T(), err)
+				require.Equal(ts.T(), "otpauth", uri.Scheme)
+				require.Contains(ts.T(), uri.Path, ts.TestEmail)
+				require.NotEmpty(ts.T(), uri.Query().Get("issuer"))
+				if c.issuer != "" {
+					require.Equal(ts.T(), c.issuer, uri.Query().Get("issuer"))
+				}
+				require.Equal(ts.T(), enrollResp.TOTP.Secret, uri.Query().Get("secret"))
+				if c.friendlyName != "" {
+					require.Equal(ts.T(), c.friendlyName, enrollResp.FriendlyName)
+				} else {
+					require.Equal(ts.T(), addedFactor.FriendlyName, enrollResp.FriendlyName)
+				}
+			}
+		})
+	}
+}
+
+func (ts *MFATestSuite) TestEnrollFactorDefaultFriendlyName() {
+	require.NoError(ts.T(), ts.API.db.Destroy(&ts.TestUser.Factors[0]))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	for _, expected := range []string{"Authenticator 1", "Authenticator 2"} {
+		w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+		enrollResp := EnrollFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+		require.Equal(ts.T(), expected, enrollResp.FriendlyName)
+	}
+
+	// names already in use are skipped
+	factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), factors[0].UpdateFriendlyName(ts.API.db, "Authenticator 3"))
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Equal(ts.T(), "Authenticator 4", enrollResp.FriendlyName)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorReturnsFactorID() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "returned id", models.TOTP, ts.TestDomain, http.StatusOK)
+
+	var raw map[string]interface{}
+	require.NoError(ts.T(), json.Unmarshal(w.Body.Bytes(), &raw))
+	require.Contains(ts.T(), raw, "id")
+
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.Unmarshal(w.Body.Bytes(), &enrollResp))
+
+	factors, err := models.FindFactorsByUserID(ts.API.db, ts.TestUser.ID, models.FactorFilter{}, nil)
+	require.NoError(ts.T(), err)
+	require.NotEmpty(ts.T(), factors)
+	latest := factors[len(factors)-1]
+	require.Equal(ts.T(), latest.ID, enrollResp.ID)
+	require.Equal(ts.T(), "returned id", latest.FriendlyName)
+
+	// the id can be used to challenge the factor right away
+	performChallengeFlow(ts, enrollResp.ID, token)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorMFADisabledForInstance() {
+	defer func(enabled bool) {
+		ts.API.config.MFA.Enabled = enabled
+	}(ts.API.config.MFA.Enabled)
+	ts.API.config.MFA.Enabled = false
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "disabled", models.TOTP, ts.TestDomain, http.StatusForbidden)
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), string(ErrorCodeMFADisabledForInstance), data.ErrorCode)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorSecretFormatted() {
+	defer func(size int) {
+		ts.API.config.MFA.SecretChunkSize = size
+	}(ts.API.config.MFA.SecretChunkSize)
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	for i, size := range []int{4, 5} {
+		ts.API.config.MFA.SecretChunkSize = size
+		w := performEnrollFlow(ts, token, fmt.Sprintf("formatted %d", i), models.TOTP, ts.TestDomain, http.StatusOK)
+		enrollResp := EnrollFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+		require.NotNil(ts.T(), enrollResp.TOTP)
+
+		require.Equal(ts.T(), enrollResp.TOTP.Secret, strings.ReplaceAll(enrollResp.TOTP.SecretFormatted, " ", ""))
+		chunks := strings.Split(enrollResp.TOTP.SecretFormatted, " ")
+		require.Greater(ts.T(), len(chunks), 1)
+		for _, chunk := range chunks[:len(chunks)-1] {
+			require.Len(ts.T(), chunk, size)
+		}
+		require.LessOrEqual(ts.T(), len(chunks[len(chunks)-1]), size)
+	}
+}
+
+func (ts *MFATestSuite) TestEnrollFactorGeneratesRecoveryCodes() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FriendlyName: "with codes", FactorType: models.TOTP, GenerateRecoveryCodes: true}))
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Len(ts.T(), enrollResp.RecoveryCodes, ts.Config.MFA.RecoveryCodeCount)
+
+	codes, err := models.FindValidRecoveryCodesByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, ts.Config.MFA.RecoveryCodeCount)
+
+	// a failure generating the codes rolls back the factor as well
+	factors, err := models.FindFactorsByUserID(ts.API.db, ts.TestUser.ID, models.FactorFilter{}, nil)
+	require.NoError(ts.T(), err)
+	ts.API.overrideRecoveryCodeGenerator = func(length int) (string, error) {
+		return "", errors.New("no entropy")
+	}
+	defer func() {
+		ts.API.overrideRecoveryCodeGenerator = nil
+	}()
+
+	buffer.Reset()
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FriendlyName: "failed codes", FactorType: models.TOTP, GenerateRecoveryCodes: true}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer)
+	require.Equal(ts.T(), http.StatusInternalServerError, w.Code)
+
+	after, err := models.FindFactorsByUserID(ts.API.db, ts.TestUser.ID, models.FactorFilter{}, nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), after, len(factors))
+	for _, factor := range after {
+		require.NotEqual(ts.T(), "failed codes", factor.FriendlyName)
+	}
+
+	// the previous codes are still valid
+	codes, err = models.FindValidRecoveryCodesByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, ts.Config.MFA.RecoveryCodeCount)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorIssuer() {
+	defer func() {
+		ts.API.config.MFA.Issuer = ""
+	}()
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	issuerOf := func(w *httptest.ResponseRecorder) string {
+		enrollResp := EnrollFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+		key, err := otp.NewKeyFromURL(enrollResp.TOTP.URI)
+		require.NoError(ts.T(), err)
+		return key.Issuer()
+	}
+
+	siteURL, err := url.ParseRequestURI(ts.Config.SiteURL)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), siteURL.Host, issuerOf(performEnrollFlow(ts, token, "site", models.TOTP, "", http.StatusOK)))
+
+	ts.API.config.MFA.Issuer = "Example App"
+	require.Equal(ts.T(), "Example App", issuerOf(performEnrollFlow(ts, token, "configured", models.TOTP, "", http.StatusOK)))
+
+	// an issuer sent by the client takes precedence
+	require.Equal(ts.T(), "Client", issuerOf(performEnrollFlow(ts, token, "client", models.TOTP, "Client", http.StatusOK)))
+}
+
+func (ts *MFATestSuite) TestEnrollFactorSecretSize() {
+	defer func(secretSize uint) {
+		ts.API.config.MFA.SecretSize = secretSize
+	}(ts.API.config.MFA.SecretSize)
+	ts.API.config.MFA.SecretSize = 32
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "large_secret", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollResp.TOTP.Secret)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), secret, 32)
+
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+}
+
+func (ts *MFATestSuite) TestConcurrentEnrollRespectsLimit() {
+	defer func(maxEnrolled float64) {
+		ts.API.config.MFA.MaxEnrolledFactors = maxEnrolled
+	}(ts.API.config.MFA.MaxEnrolledFactors)
+	// the test user already has one factor
+	ts.API.config.MFA.MaxEnrolledFactors = 3
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	const attempts = 5
+	codes := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var buffer bytes.Buffer
+			if err := json.NewEncoder(&buffer).Encode(EnrollFactorParams{FriendlyName: fmt.Sprintf("concurrent_%d", i), FactorType: models.TOTP}); err != nil {
+				return
+			}
+			codes[i] = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer).Code
+		}(i)
+	}
+	wg.Wait()
+
+	enrolled := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			enrolled++
+		} else {
+			require.Equal(ts.T(), http.StatusUnprocessableEntity, code)
+		}
+	}
+	require.Equal(ts.T(), 2, enrolled)
+
+	factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), factors, 3)
+}
+
+func (ts *MFATestSuite) TestConcurrentVerifySameChallenge() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	code := currentTOTPCode(ts, f.ID)
+
+	const attempts = 2
+	codes := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var buffer bytes.Buffer
+			if err := json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"challenge_id": challengeResp.ID,
+				"code":         code,
+			}); err != nil {
+				return
 			}
+			codes[i] = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer).Code
+		}(i)
+	}
+	wg.Wait()
+
+	verified := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			verified++
+		} else {
+			require.Equal(ts.T(), http.StatusUnauthorized, code)
+		}
+	}
+	require.Equal(ts.T(), 1, verified)
+
+	challenge, err := models.FindChallengeByID(ts.API.db, challengeResp.ID)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), challenge.VerifiedAt)
+}
+
+func (ts *MFATestSuite) TestVerifyResponseJitterDelaysFailures() {
+	defer func(jitter time.Duration) {
+		ts.API.config.MFA.VerifyResponseJitter = jitter
+	}(ts.API.config.MFA.VerifyResponseJitter)
+	ts.API.config.MFA.VerifyResponseJitter = 200 * time.Millisecond
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	f := ts.TestUser.Factors[0]
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	verify := func(factorID uuid.UUID) int {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         "000000",
+		}))
+		start := time.Now()
+		w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("http://localhost/factors/%s/verify", factorID), token, buffer)
+		require.GreaterOrEqual(ts.T(), time.Since(start), ts.API.config.MFA.VerifyResponseJitter)
+		return w.Code
+	}
+
+	// an unknown factor and a wrong code are both delayed
+	require.Equal(ts.T(), http.StatusNotFound, verify(uuid.Must(uuid.NewV4())))
+	require.NotEqual(ts.T(), http.StatusOK, verify(f.ID))
+}
+
+func (ts *MFATestSuite) TestVerifyFactorReturnsVerificationToken() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id":              challengeResp.ID,
+		"code":                      currentTOTPCode(ts, f.ID),
+		"return_verification_token": true,
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.NotContains(ts.T(), w.Body.String(), "access_token")
+
+	verificationResp := VerificationTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&verificationResp))
+	require.NotEmpty(ts.T(), verificationResp.VerificationToken)
+	require.Equal(ts.T(), int(ts.API.config.MFA.VerificationTokenExpiry.Seconds()), verificationResp.ExpiresIn)
+
+	// the session is only upgraded once the token is exchanged
+	session, err := models.FindSessionByID(ts.API.db, ts.TestSession.ID, false)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.AAL1.String(), session.GetAAL())
+
+	exchange := func(verificationToken string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(MFAVerificationTokenGrantParams{VerificationToken: verificationToken}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=mfa_verification_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	ts.Run("Exchange", func() {
+		w := exchange(verificationResp.VerificationToken)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		data := AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.NotEmpty(ts.T(), data.RefreshToken)
+
+		w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user", data.Token, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		userResp := UserResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&userResp))
+		require.Equal(ts.T(), models.AAL2.String(), userResp.AAL)
+
+		session, err := models.FindSessionByID(ts.API.db, ts.TestSession.ID, false)
+		require.NoError(ts.T(), err)
+		require.True(ts.T(), session.IsAAL2())
+	})
+
+	ts.Run("Reused token", func() {
+		w := exchange(verificationResp.VerificationToken)
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	})
+
+	ts.Run("Expired token", func() {
+		record, verificationToken := models.NewMFAVerificationToken(ts.TestUser, ts.TestSession, &f, -time.Minute)
+		require.NoError(ts.T(), ts.API.db.Create(record))
+
+		w := exchange(verificationToken)
+		require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+	})
+}
+
+func (ts *MFATestSuite) TestAccessTokenMFAVerifiedAt() {
+	defer func(clear bool) {
+		ts.API.config.MFA.ClearVerifiedAtOnRefresh = clear
+	}(ts.API.config.MFA.ClearVerifiedAtOnRefresh)
+
+	parseClaims := func(token string) *AccessTokenClaims {
+		claims := &AccessTokenClaims{}
+		_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte(ts.Config.JWT.Secret), nil
 		})
+		require.NoError(ts.T(), err)
+		return claims
+	}
+	refresh := func(refreshToken string) *AccessTokenResponse {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"refresh_token": refreshToken,
+		}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		resp := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(resp))
+		return resp
+	}
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	require.Nil(ts.T(), parseClaims(token).MFAVerifiedAt)
+
+	w := performEnrollAndVerify(ts, token, true)
+	verifyResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(verifyResp))
+	claims := parseClaims(verifyResp.Token)
+	require.NotNil(ts.T(), claims.MFAVerifiedAt)
+	require.WithinDuration(ts.T(), time.Now(), time.Unix(*claims.MFAVerifiedAt, 0), 5*time.Second)
+
+	// refreshed tokens keep the time of the verification
+	refreshed := refresh(verifyResp.RefreshToken)
+	require.Equal(ts.T(), claims.MFAVerifiedAt, parseClaims(refreshed.Token).MFAVerifiedAt)
+
+	ts.API.config.MFA.ClearVerifiedAtOnRefresh = true
+	refreshed = refresh(refreshed.RefreshToken)
+	require.Nil(ts.T(), parseClaims(refreshed.Token).MFAVerifiedAt)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorIdempotencyKey() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	enroll := func(idempotencyKey string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FactorType: models.TOTP, Issuer: ts.TestDomain}))
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/factors/", &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(EnrollIdempotencyKeyHeader, idempotencyKey)
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		return w
 	}
+
+	before, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+
+	first := enroll("enroll-request-1")
+	retry := enroll("enroll-request-1")
+	require.Equal(ts.T(), first.Body.String(), retry.Body.String())
+
+	factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), factors, len(before)+1)
+
+	other := enroll("enroll-request-2")
+	require.NotEqual(ts.T(), first.Body.String(), other.Body.String())
+	factors, err = FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), factors, len(before)+2)
+
+	// once the factor is verified its secret is no longer handed out
+	firstResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.Unmarshal(first.Body.Bytes(), &firstResp))
+	factor, err := models.FindFactorByFactorID(ts.API.db, firstResp.ID)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), factor.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	require.NoError(ts.T(), ts.TestSession.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &factor.ID))
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FactorType: models.TOTP, Issuer: ts.TestDomain}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/factors/", &buffer)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EnrollIdempotencyKeyHeader, "enroll-request-1")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorLimit() {
+	defer func(maxEnrolledFactors float64) {
+		ts.API.config.MFA.MaxEnrolledFactors = maxEnrolledFactors
+	}(ts.API.config.MFA.MaxEnrolledFactors)
+	ts.API.config.MFA.MaxEnrolledFactors = 3
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	// the user already has one unverified factor
+	performEnrollFlow(ts, token, "second", models.TOTP, ts.TestDomain, http.StatusOK)
+	performEnrollFlow(ts, token, "third", models.TOTP, ts.TestDomain, http.StatusOK)
+
+	w := performEnrollFlow(ts, token, "fourth", models.TOTP, ts.TestDomain, http.StatusUnprocessableEntity)
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFAFactorLimitExceeded, data.ErrorCode)
+
+	// expired unverified factors are cleaned up and no longer count
+	createdAt := time.Now().Add(-2 * ts.Config.MFA.EnrollmentExpiry)
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET created_at = ? WHERE id = ?", createdAt, ts.TestUser.Factors[0].ID).Exec())
+	performEnrollFlow(ts, token, "fourth", models.TOTP, ts.TestDomain, http.StatusOK)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorLimitIgnoresUnenrolledFactors() {
+	defer func(maxEnrolledFactors float64) {
+		ts.API.config.MFA.MaxEnrolledFactors = maxEnrolledFactors
+	}(ts.API.config.MFA.MaxEnrolledFactors)
+	ts.API.config.MFA.MaxEnrolledFactors = 3
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	// the user already has one unverified factor
+	performEnrollFlow(ts, token, "second", models.TOTP, ts.TestDomain, http.StatusOK)
+	performEnrollFlow(ts, token, "third", models.TOTP, ts.TestDomain, http.StatusOK)
+
+	w := performEnrollFlow(ts, token, "fourth", models.TOTP, ts.TestDomain, http.StatusUnprocessableEntity)
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFAFactorLimitExceeded, data.ErrorCode)
+
+	// unenrolled factors no longer count towards the limit
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET deleted_at = ? WHERE id = ?", time.Now(), ts.TestUser.Factors[0].ID).Exec())
+	performEnrollFlow(ts, token, "fourth", models.TOTP, ts.TestDomain, http.StatusOK)
+}
+
+func (ts *MFATestSuite) TestEnrolledSecretIsEncryptedAtRest() {
+	require.True(ts.T(), ts.API.config.Security.DBEncryption.Encrypt)
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := performEnrollFlow(ts, token, "encrypted", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.NotEqual(ts.T(), enrollResp.TOTP.Secret, factor.Secret)
+	require.NotContains(ts.T(), factor.Secret, enrollResp.TOTP.Secret)
+	require.NotNil(ts.T(), crypto.ParseEncryptedString(factor.Secret))
+
+	w = performChallengeFlow(ts, factor.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	performVerifyFlow(ts, challengeResp.ID, factor.ID, token, true)
 }
 
 func (ts *MFATestSuite) TestDuplicateEnrollsReturnExpectedMessage() {
@@ -186,7 +732,10 @@ func (ts *MFATestSuite) TestDuplicateEnrollsReturnExpectedMessage() {
 
 func (ts *MFATestSuite) TestMultipleEnrollsCleanupExpiredFactors() {
 	// All factors are deleted when a subsequent enroll is made
-	ts.API.config.MFA.FactorExpiryDuration = 0 * time.Second
+	defer func(enrollmentExpiry time.Duration) {
+		ts.API.config.MFA.EnrollmentExpiry = enrollmentExpiry
+	}(ts.API.config.MFA.EnrollmentExpiry)
+	ts.API.config.MFA.EnrollmentExpiry = 0 * time.Second
 	// Verified factor should not be deleted (Factor 1)
 	resp := performTestSignupAndVerify(ts, ts.TestEmail, ts.TestPassword, true /* <- requireStatusOK */)
 	numFactors := 5
@@ -212,96 +761,2481 @@ func (ts *MFATestSuite) TestMultipleEnrollsCleanupExpiredFactors() {
 	require.Equal(ts.T(), 3, len(factors))
 }
 
-func (ts *MFATestSuite) TestChallengeFactor() {
-	f := ts.TestUser.Factors[0]
+func (ts *MFATestSuite) TestEnrollWebAuthnFactor() {
 	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
-	w := performChallengeFlow(ts, f.ID, token)
-	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w := performEnrollFlow(ts, token, "yubikey", models.WebAuthn, "", http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Equal(ts.T(), models.WebAuthn, enrollResp.Type)
+	require.Nil(ts.T(), enrollResp.TOTP)
+	require.NotNil(ts.T(), enrollResp.WebAuthn)
+
+	options := enrollResp.WebAuthn.CredentialCreationOptions
+	require.NotNil(ts.T(), options)
+	require.NotEmpty(ts.T(), options.Challenge)
+	require.Equal(ts.T(), ts.API.config.MFA.WebAuthn.RPID, options.RP.ID)
+	require.Equal(ts.T(), "none", options.Attestation)
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), factor.IsVerified())
+	require.Nil(ts.T(), factor.WebAuthnCredentialID)
+
+	challenge, err := models.FindChallengeByID(ts.API.db, enrollResp.WebAuthn.ChallengeID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), options.Challenge, *challenge.WebAuthnChallenge)
+
+	// a response signed over a different challenge must be rejected
+	clientDataJSON := base64.RawURLEncoding.EncodeToString([]byte(`{"type":"webauthn.create","challenge":"invalid","origin":"http://localhost"}`))
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": challenge.ID,
+		"web_authn": map[string]interface{}{
+			"client_data_json": clientDataJSON,
+		},
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", factor.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
 }
 
-func (ts *MFATestSuite) TestMFAVerifyFactor() {
+func (ts *MFATestSuite) TestListFactors() {
+	verified := models.NewFactor(ts.TestUser, "verified_factor", models.TOTP, models.FactorStateVerified)
+	require.NoError(ts.T(), ts.API.db.Create(verified))
+
+	otherUser, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherUser))
+	otherFactor := models.NewFactor(otherUser, "other_factor", models.TOTP, models.FactorStateVerified)
+	require.NoError(ts.T(), ts.API.db.Create(otherFactor))
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
 	cases := []struct {
-		desc             string
-		validChallenge   bool
-		validCode        bool
-		expectedHTTPCode int
+		desc         string
+		query        string
+		expectedCode int
+		expectedIDs  []uuid.UUID
 	}{
 		{
-			desc:             "Invalid: Valid code and expired challenge",
-			validChallenge:   false,
-			validCode:        true,
-			expectedHTTPCode: http.StatusUnprocessableEntity,
+			desc:         "All factors",
+			query:        "",
+			expectedCode: http.StatusOK,
+			expectedIDs:  []uuid.UUID{ts.TestUser.Factors[0].ID, verified.ID},
 		},
 		{
-			desc:             "Invalid: Invalid code and valid challenge ",
-			validChallenge:   true,
-			validCode:        false,
-			expectedHTTPCode: http.StatusUnprocessableEntity,
+			desc:         "Verified factors",
+			query:        "?status=verified",
+			expectedCode: http.StatusOK,
+			expectedIDs:  []uuid.UUID{verified.ID},
 		},
 		{
-			desc:             "Valid /verify request",
-			validChallenge:   true,
-			validCode:        true,
-			expectedHTTPCode: http.StatusOK,
+			desc:         "Unverified TOTP factors",
+			query:        "?status=unverified&factor_type=totp",
+			expectedCode: http.StatusOK,
+			expectedIDs:  []uuid.UUID{ts.TestUser.Factors[0].ID},
+		},
+		{
+			desc:         "WebAuthn factors",
+			query:        "?factor_type=webauthn",
+			expectedCode: http.StatusOK,
+			expectedIDs:  []uuid.UUID{},
+		},
+		{
+			desc:         "Invalid status",
+			query:        "?status=invalid",
+			expectedCode: http.StatusBadRequest,
 		},
 	}
-	for _, v := range cases {
-		ts.Run(v.desc, func() {
-			// Authenticate users and set secret
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
 			var buffer bytes.Buffer
-			r, err := models.GrantAuthenticatedUser(ts.API.db, ts.TestUser, models.GrantParams{})
-			require.NoError(ts.T(), err)
+			w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors"+c.query, token, buffer)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+			if c.expectedCode != http.StatusOK {
+				return
+			}
 
-			sharedSecret := ts.TestOTPKey.Secret()
-			factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
-			f := factors[0]
-			f.Secret = sharedSecret
-			require.NoError(ts.T(), err)
-			require.NoError(ts.T(), ts.API.db.Update(f), "Error updating new test factor")
+			factors := []models.Factor{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factors))
+			ids := []uuid.UUID{}
+			for _, f := range factors {
+				ids = append(ids, f.ID)
+				require.Empty(ts.T(), f.Secret)
+			}
+			require.ElementsMatch(ts.T(), c.expectedIDs, ids)
+		})
+	}
 
-			token := ts.generateAAL1Token(ts.TestUser, r.SessionId)
-			w := httptest.NewRecorder()
-			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), &buffer)
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	// listing another user's factors requires an admin token
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodGet, fmt.Sprintf("http://localhost/admin/users/%s/factors", otherUser.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+}
 
-			testIPAddress := utilities.GetIPAddress(req)
-			c := models.NewChallenge(f, testIPAddress)
-			require.NoError(ts.T(), ts.API.db.Create(c), "Error saving new test challenge")
-			if !v.validChallenge {
-				// Set challenge creation so that it has expired in present time.
-				newCreatedAt := time.Now().UTC().Add(-1 * time.Second * time.Duration(ts.Config.MFA.ChallengeExpiryDuration+1))
-				// created_at is managed by buffalo(ORM) needs to be raw query to be updated
-				err := ts.API.db.RawQuery("UPDATE auth.mfa_challenges SET created_at = ? WHERE factor_id = ?", newCreatedAt, f.ID).Exec()
-				require.NoError(ts.T(), err, "Error updating new test challenge")
+func (ts *MFATestSuite) TestOrderFactors() {
+	second := models.NewFactor(ts.TestUser, "second_factor", models.TOTP, models.FactorStateUnverified)
+	require.NoError(ts.T(), ts.API.db.Create(second))
+	first := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	listIDs := func(body io.Reader) []uuid.UUID {
+		factors := []models.Factor{}
+		require.NoError(ts.T(), json.NewDecoder(body).Decode(&factors))
+		ids := []uuid.UUID{}
+		for _, f := range factors {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+	order := func(ids ...uuid.UUID) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(OrderFactorsParams{FactorIDs: ids}))
+		return ServeAuthenticatedRequest(ts, http.MethodPut, "http://localhost/factors/order", token, buffer)
+	}
+
+	w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors", token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Equal(ts.T(), []uuid.UUID{first.ID, second.ID}, listIDs(w.Body))
+
+	w = order(second.ID, first.ID)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Equal(ts.T(), []uuid.UUID{second.ID, first.ID}, listIDs(w.Body))
+
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors", token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Equal(ts.T(), []uuid.UUID{second.ID, first.ID}, listIDs(w.Body))
+
+	// factors left out are listed after the ordered ones
+	w = order(first.ID)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Equal(ts.T(), []uuid.UUID{first.ID, second.ID}, listIDs(w.Body))
+
+	require.Equal(ts.T(), http.StatusBadRequest, order(first.ID, first.ID).Code)
+	require.Equal(ts.T(), http.StatusNotFound, order(uuid.Must(uuid.NewV4())).Code)
+}
+
+func (ts *MFATestSuite) TestDisableMFA() {
+	disable := func(token string) *httptest.ResponseRecorder {
+		return ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/disable", token, bytes.Buffer{})
+	}
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	require.Equal(ts.T(), http.StatusBadRequest, disable(token).Code)
+
+	w := performEnrollAndVerify(ts, token, true)
+	verifyResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(verifyResp))
+
+	// the verification is no longer recent
+	ts.API.overrideTime = func() time.Time {
+		return time.Now().Add(ts.API.config.MFA.DisableReauthWindow + time.Minute)
+	}
+	w = disable(verifyResp.Token)
+	ts.API.overrideTime = nil
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), string(ErrorCodeReauthenticationNeeded), data.ErrorCode)
+
+	require.Equal(ts.T(), http.StatusOK, disable(verifyResp.Token).Code)
+
+	user, err := models.FindUserByID(ts.API.db, ts.TestUser.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), user.HasVerifiedFactor())
+	session, err := models.FindSessionByID(ts.API.db, ts.TestSession.ID, false)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), session.IsAAL2())
+}
+
+func (ts *MFATestSuite) TestDisableMFARequiresVerificationInSession() {
+	f := models.NewFactor(ts.TestUser, "verified_factor", models.TOTP, models.FactorStateVerified)
+	require.NoError(ts.T(), ts.API.db.Create(f))
+
+	// a session that reached AAL2 through a trusted device never verified a factor
+	require.NoError(ts.T(), ts.API.trustSessionDevice(ts.API.db, ts.TestSession.ID))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/disable", token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+}
+
+func (ts *MFATestSuite) TestListFactorsPagination() {
+	defer func(maxPerPage uint64) {
+		ts.API.config.MFA.MaxFactorsPerPage = maxPerPage
+	}(ts.API.config.MFA.MaxFactorsPerPage)
+	ts.API.config.MFA.MaxFactorsPerPage = 2
+
+	ids := []uuid.UUID{ts.TestUser.Factors[0].ID}
+	for i := 0; i < 4; i++ {
+		f := models.NewFactor(ts.TestUser, fmt.Sprintf("factor_%d", i), models.TOTP, models.FactorStateVerified)
+		f.CreatedAt = time.Now().Add(time.Duration(i+1) * time.Minute)
+		require.NoError(ts.T(), ts.API.db.Create(f))
+		ids = append(ids, f.ID)
+	}
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	cases := []struct {
+		desc        string
+		query       string
+		expectedIDs []uuid.UUID
+		hasNext     bool
+	}{
+		{
+			desc:        "First page",
+			query:       "?page=1&per_page=2",
+			expectedIDs: ids[0:2],
+			hasNext:     true,
+		},
+		{
+			desc:        "Second page",
+			query:       "?page=2&per_page=2",
+			expectedIDs: ids[2:4],
+			hasNext:     true,
+		},
+		{
+			desc:        "Last page",
+			query:       "?page=3&per_page=2",
+			expectedIDs: ids[4:5],
+			hasNext:     false,
+		},
+		{
+			desc:        "Per page above maximum",
+			query:       "?page=1&per_page=100",
+			expectedIDs: ids[0:2],
+			hasNext:     true,
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors"+c.query, token, buffer)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+			require.Equal(ts.T(), "5", w.Header().Get("X-Total-Count"))
+			require.Contains(ts.T(), w.Header().Get("Link"), `rel="last"`)
+			if c.hasNext {
+				require.Contains(ts.T(), w.Header().Get("Link"), `rel="next"`)
+			} else {
+				require.NotContains(ts.T(), w.Header().Get("Link"), `rel="next"`)
 			}
 
-			// Verify TOTP code
-			code, err := totp.GenerateCode(sharedSecret, time.Now().UTC())
-			if !v.validCode {
-				// Use an inaccurate time, resulting in an invalid code(usually)
-				code, err = totp.GenerateCode(sharedSecret, time.Now().UTC().Add(-1*time.Minute*time.Duration(1)))
+			factors := []models.Factor{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factors))
+			pageIDs := []uuid.UUID{}
+			for _, f := range factors {
+				pageIDs = append(pageIDs, f.ID)
 			}
+			require.Equal(ts.T(), c.expectedIDs, pageIDs)
+		})
+	}
+
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors?per_page=0", token, buffer)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *MFATestSuite) TestSMSFactor() {
+	provider := &TestSmsProvider{}
+	ts.API.overrideSmsProvider = provider
+	defer func() {
+		ts.API.overrideSmsProvider = nil
+	}()
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FriendlyName: "phone", FactorType: models.SMS, Phone: "+1 555 0100 123"}))
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Equal(ts.T(), models.SMS, enrollResp.Type)
+	require.Equal(ts.T(), "15550100123", enrollResp.Phone)
+
+	verify := func(challengeID uuid.UUID, code string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeID,
+			"code":         code,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", enrollResp.ID), token, buffer)
+	}
+
+	// expired code
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	require.Equal(ts.T(), 1, provider.SentMessages)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	require.Equal(ts.T(), models.SMS, challengeResp.FactorType)
+	require.NotNil(ts.T(), challengeResp.Payload)
+	require.Equal(ts.T(), "*******0123", challengeResp.Payload.Phone)
+
+	challenge, err := models.FindChallengeByID(ts.API.db, challengeResp.ID)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), challenge.OtpCode)
+	require.NotEqual(ts.T(), provider.LastOTP, *challenge.OtpCode)
+	challenge.CreatedAt = time.Now().Add(-time.Duration(ts.API.config.MFA.ChallengeExpiryDuration+1) * time.Second)
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(challenge, "created_at"))
+
+	w = verify(challengeResp.ID, provider.LastOTP)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	// happy path
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	require.Equal(ts.T(), 2, provider.SentMessages)
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	w = verify(challengeResp.ID, provider.LastOTP)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), factor.IsVerified())
+}
+
+func (ts *MFATestSuite) TestChallengeFactor() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performChallengeFlow(ts, f.ID, token)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	var body map[string]interface{}
+	require.NoError(ts.T(), json.Unmarshal(w.Body.Bytes(), &body))
+	require.NotContains(ts.T(), body, "payload")
+
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	require.NotEqual(ts.T(), uuid.Nil, challengeResp.ID)
+	require.Equal(ts.T(), models.TOTP, challengeResp.FactorType)
+	require.Nil(ts.T(), challengeResp.Payload)
+
+	expectedExpiry := time.Now().Add(time.Duration(ts.API.config.MFA.ChallengeExpiryDuration) * time.Second).Unix()
+	require.InDelta(ts.T(), expectedExpiry, challengeResp.ExpiresAt, 5)
+}
+
+func (ts *MFATestSuite) TestChallengeFactorHint() {
+	provider := &TestSmsProvider{}
+	ts.API.overrideSmsProvider = provider
+	defer func() {
+		ts.API.overrideSmsProvider = nil
+	}()
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	ts.Run("TOTP", func() {
+		f := ts.TestUser.Factors[0]
+		w := performChallengeFlow(ts, f.ID, token)
+		require.NotContains(ts.T(), w.Body.String(), f.Secret)
+
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		require.NotNil(ts.T(), challengeResp.FactorHint)
+		require.Equal(ts.T(), "test_factor", challengeResp.FactorHint.FriendlyName)
+		require.Empty(ts.T(), challengeResp.FactorHint.Identifier)
+	})
+
+	ts.Run("SMS", func() {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{FriendlyName: "work phone", FactorType: models.SMS, Phone: "+1 555 0100 123"}))
+		w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		enrollResp := EnrollFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+		w = performChallengeFlow(ts, enrollResp.ID, token)
+		require.NotContains(ts.T(), w.Body.String(), "15550100123")
+
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		require.NotNil(ts.T(), challengeResp.FactorHint)
+		require.Equal(ts.T(), "work phone", challengeResp.FactorHint.FriendlyName)
+		require.Equal(ts.T(), "*******0123", challengeResp.FactorHint.Identifier)
+	})
+}
+
+func (ts *MFATestSuite) TestChallengeFactorPrunesOpenChallenges() {
+	defer func(maxOpen int) {
+		ts.API.config.MFA.MaxOpenChallenges = maxOpen
+	}(ts.API.config.MFA.MaxOpenChallenges)
+	ts.API.config.MFA.MaxOpenChallenges = 2
+
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	challengeIDs := []uuid.UUID{}
+	for i := 0; i < 4; i++ {
+		w := performChallengeFlow(ts, f.ID, token)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		challengeIDs = append(challengeIDs, challengeResp.ID)
+	}
+
+	count, err := ts.API.db.Q().Where("factor_id = ?", f.ID).Count(&models.Challenge{})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 2, count)
+
+	for i, challengeID := range challengeIDs {
+		_, err := models.FindChallengeByID(ts.API.db, challengeID)
+		if i < 2 {
+			require.EqualError(ts.T(), err, models.ChallengeNotFoundError{}.Error())
+		} else {
+			require.NoError(ts.T(), err)
+		}
+	}
+}
+
+func (ts *MFATestSuite) TestChallengeVerifiedOnly() {
+	defer func(verifiedOnly bool) {
+		ts.API.config.MFA.ChallengeVerifiedOnly = verifiedOnly
+	}(ts.API.config.MFA.ChallengeVerifiedOnly)
+	ts.API.config.MFA.ChallengeVerifiedOnly = true
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	challenge := func(path string) *httptest.ResponseRecorder {
+		return ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("http://localhost/factors/%s/%s", enrollResp.ID, path), token, bytes.Buffer{})
+	}
+
+	// a normal challenge is rejected while the factor is being enrolled
+	w = challenge("challenge")
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), string(ErrorCodeMFAFactorNotVerified), data.ErrorCode)
+
+	w = challenge("enroll/challenge")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	w = performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+	verifyResp := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&verifyResp))
+	token = verifyResp.Token
+
+	// once verified only normal challenges are allowed
+	require.Equal(ts.T(), http.StatusOK, challenge("challenge").Code)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, challenge("enroll/challenge").Code)
+}
+
+func (ts *MFATestSuite) TestVerifyFactorDeletesOtherChallenges() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	challengeIDs := []uuid.UUID{}
+	for i := 0; i < 3; i++ {
+		w := performChallengeFlow(ts, enrollResp.ID, token)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		challengeIDs = append(challengeIDs, challengeResp.ID)
+	}
+	// challenges of other factors are left alone
+	w = performChallengeFlow(ts, ts.TestUser.Factors[0].ID, token)
+	otherResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&otherResp))
+
+	performVerifyFlow(ts, challengeIDs[1], enrollResp.ID, token, true)
+
+	for i, challengeID := range challengeIDs {
+		challenge, err := models.FindChallengeByID(ts.API.db, challengeID)
+		if i == 1 {
 			require.NoError(ts.T(), err)
+			require.NotNil(ts.T(), challenge.VerifiedAt)
+		} else {
+			require.True(ts.T(), models.IsNotFoundError(err))
+		}
+	}
+	_, err := models.FindChallengeByID(ts.API.db, otherResp.ID)
+	require.NoError(ts.T(), err)
+}
+
+func (ts *MFATestSuite) TestChallengeRateLimitPerUser() {
+	defer func(limit int) {
+		ts.API.config.MFA.ChallengeRateLimitPerUser = limit
+	}(ts.API.config.MFA.ChallengeRateLimitPerUser)
+	ts.API.config.MFA.ChallengeRateLimitPerUser = 3
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "second_factor", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	factorIDs := []uuid.UUID{ts.TestUser.Factors[0].ID, enrollResp.ID}
+
+	// the limit is shared by both factors
+	for i := 0; i < 3; i++ {
+		performChallengeFlow(ts, factorIDs[i%2], token)
+	}
+
+	var buffer bytes.Buffer
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("http://localhost/factors/%s/challenge", factorIDs[1]), token, buffer)
+	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(ts.T(), err)
+	require.Greater(ts.T(), retryAfter, 0)
+	require.LessOrEqual(ts.T(), retryAfter, int(ts.API.config.MFA.ChallengeRateLimitWindow.Seconds()))
+}
+
+func (ts *MFATestSuite) TestPrimaryFactor() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	// no verified factor yet, so there is no primary factor to fall back to
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/challenge", token, buffer)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	w = performEnrollAndVerify(ts, token, true)
+	tokenResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(tokenResp))
+
+	primary, err := models.FindPrimaryFactorByUserID(ts.API.db, ts.TestUser.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), primary.IsVerified())
+
+	// challenging without a factor ID uses the primary factor
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/challenge", tokenResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	challenge, err := models.FindChallengeByID(ts.API.db, challengeResp.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), primary.ID, challenge.FactorID)
+
+	w = ServeAuthenticatedRequest(ts, http.MethodPut, fmt.Sprintf("http://localhost/factors/%s/primary", primary.ID), tokenResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	// unverified factors cannot become primary
+	w = performEnrollFlow(ts, tokenResp.Token, "second", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	w = ServeAuthenticatedRequest(ts, http.MethodPut, fmt.Sprintf("http://localhost/factors/%s/primary", enrollResp.ID), tokenResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *MFATestSuite) TestRecoveryCodes() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	// recovery codes can be generated from an AAL1 session while the user has no verified factor
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	w = performEnrollAndVerify(ts, token, true)
+	tokenResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(tokenResp))
+
+	// once a factor is verified an AAL2 session is required
+	aal1Session, err := models.NewSession(ts.TestUser.ID, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(aal1Session))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", ts.generateAAL1Token(ts.TestUser, &aal1Session.ID), buffer)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", tokenResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+	require.Len(ts.T(), codesResp.RecoveryCodes, ts.API.config.MFA.RecoveryCodeCount)
+
+	var cases = []struct {
+		desc         string
+		recoveryCode string
+		expectedCode int
+	}{
+		{
+			desc:         "Valid recovery code",
+			recoveryCode: codesResp.RecoveryCodes[0],
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "Recovery code already used",
+			recoveryCode: codesResp.RecoveryCodes[0],
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			desc:         "Unknown recovery code",
+			recoveryCode: "invalidcode",
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
 			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
-				"challenge_id": c.ID,
-				"code":         code,
+				"recovery_code": c.recoveryCode,
 			}))
+			w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/verify", token, buffer)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+
+			if c.expectedCode == http.StatusOK {
+				resp := VerifyRecoveryCodeResponse{}
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&resp))
+				require.NotEmpty(ts.T(), resp.Token)
+				require.Equal(ts.T(), ts.API.config.MFA.RecoveryCodeCount-1, resp.RemainingRecoveryCodes)
+			}
+		})
+	}
+
+	codes, err := models.FindValidRecoveryCodesByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, ts.API.config.MFA.RecoveryCodeCount-1)
+
+	// only hashes of the codes are stored
+	for _, code := range codes {
+		require.True(ts.T(), code.IsHashed())
+		require.NotContains(ts.T(), codesResp.RecoveryCodes, code.RecoveryCode)
+	}
+}
+
+func (ts *MFATestSuite) TestVerifyFactorAcceptsRecoveryCode() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+
+	amrMethods := func(token string) []string {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/factors", nil)
+		ctx, err := ts.API.parseJWTClaims(token, req)
+		require.NoError(ts.T(), err)
+
+		methods := []string{}
+		for _, entry := range getClaims(ctx).AuthenticationMethodReference {
+			methods = append(methods, entry.Method)
+		}
+		return methods
+	}
+
+	// challenge_id and code verify the factor itself
+	w = performEnrollAndVerify(ts, token, true)
+	totpResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(totpResp))
+	require.Contains(ts.T(), amrMethods(totpResp.Token), models.TOTPSignIn.String())
+
+	factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	var factorID uuid.UUID
+	for _, factor := range factors {
+		if factor.IsVerified() {
+			factorID = factor.ID
+		}
+	}
+	require.NotEqual(ts.T(), uuid.Nil, factorID)
+
+	aal1Session, err := models.NewSession(ts.TestUser.ID, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(aal1Session))
+	require.NoError(ts.T(), ts.API.db.Create(&models.RefreshToken{UserID: ts.TestUser.ID, Token: crypto.SecureToken(), SessionId: &aal1Session.ID}))
+	aal1Token := ts.generateAAL1Token(ts.TestUser, &aal1Session.ID)
+	verifyURL := fmt.Sprintf("http://localhost/factors/%s/verify", factorID)
+
+	// a recovery code cannot be combined with a challenge
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id":  uuid.Must(uuid.NewV4()),
+		"code":          "123456",
+		"recovery_code": codesResp.RecoveryCodes[0],
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, verifyURL, aal1Token, buffer)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	// recovery_code alone is verified as a recovery code
+	buffer.Reset()
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"recovery_code": codesResp.RecoveryCodes[0],
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, verifyURL, aal1Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	recoveryResp := VerifyRecoveryCodeResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&recoveryResp))
+	require.Contains(ts.T(), amrMethods(recoveryResp.Token), models.RecoveryCodeSignIn.String())
+	require.Equal(ts.T(), ts.API.config.MFA.RecoveryCodeCount-1, recoveryResp.RemainingRecoveryCodes)
+
+	// the code was consumed
+	buffer.Reset()
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"recovery_code": codesResp.RecoveryCodes[0],
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, verifyURL, aal1Token, buffer)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+}
+
+func (ts *MFATestSuite) TestRecoveryCodesConfiguredLengthAndCount() {
+	defer func(length, count int) {
+		ts.API.config.MFA.RecoveryCodeLength = length
+		ts.API.config.MFA.RecoveryCodeCount = count
+	}(ts.API.config.MFA.RecoveryCodeLength, ts.API.config.MFA.RecoveryCodeCount)
+	ts.API.config.MFA.RecoveryCodeLength = 16
+	ts.API.config.MFA.RecoveryCodeCount = 12
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+	require.Len(ts.T(), codesResp.RecoveryCodes, 12)
+	for _, code := range codesResp.RecoveryCodes {
+		require.Len(ts.T(), code, 16)
+	}
+
+	total, used, err := models.CountRecoveryCodesByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 12, total)
+	require.Equal(ts.T(), 0, used)
+}
+
+func (ts *MFATestSuite) TestRecoveryCodesConfiguredAlphabet() {
+	defer func(alphabet string) {
+		ts.API.config.MFA.RecoveryCodeAlphabet = alphabet
+	}(ts.API.config.MFA.RecoveryCodeAlphabet)
+	ts.API.config.MFA.RecoveryCodeAlphabet = crypto.CrockfordRecoveryCodeAlphabet
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+	require.NotEmpty(ts.T(), codesResp.RecoveryCodes)
+	for _, code := range codesResp.RecoveryCodes {
+		require.Empty(ts.T(), strings.Trim(code, crypto.CrockfordRecoveryCodeAlphabet), "code %q has characters outside the alphabet", code)
+		require.NotContains(ts.T(), code, "i")
+		require.NotContains(ts.T(), code, "l")
+		require.NotContains(ts.T(), code, "o")
+		require.NotContains(ts.T(), code, "u")
+	}
+}
+
+func (ts *MFATestSuite) TestRecoveryCodesDownloadFormats() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	cases := []struct {
+		desc                string
+		accept              string
+		expectedContentType string
+		expectedFilename    string
+		parse               func(body string) []string
+	}{
+		{
+			desc:                "JSON",
+			accept:              "application/json",
+			expectedContentType: "application/json",
+			parse: func(body string) []string {
+				codesResp := RecoveryCodesResponse{}
+				require.NoError(ts.T(), json.Unmarshal([]byte(body), &codesResp))
+				return codesResp.RecoveryCodes
+			},
+		},
+		{
+			desc:                "Plain text",
+			accept:              "text/plain",
+			expectedContentType: "text/plain; charset=utf-8",
+			expectedFilename:    "recovery-codes.txt",
+			parse: func(body string) []string {
+				return strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+			},
+		},
+		{
+			desc:                "CSV",
+			accept:              "text/csv, application/json;q=0.5",
+			expectedContentType: "text/csv; charset=utf-8",
+			expectedFilename:    "recovery-codes.csv",
+			parse: func(body string) []string {
+				lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+				require.Equal(ts.T(), "recovery_code", lines[0])
+				return lines[1:]
+			},
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://localhost/factors/recovery_codes", nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			req.Header.Set("Accept", c.accept)
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+			require.Equal(ts.T(), c.expectedContentType, w.Header().Get("Content-Type"))
+			if c.expectedFilename == "" {
+				require.Empty(ts.T(), w.Header().Get("Content-Disposition"))
+			} else {
+				require.Equal(ts.T(), fmt.Sprintf("attachment; filename=\"%s\"", c.expectedFilename), w.Header().Get("Content-Disposition"))
+			}
+
+			codes := c.parse(w.Body.String())
+			require.Len(ts.T(), codes, ts.API.config.MFA.RecoveryCodeCount)
+			for _, code := range codes {
+				require.Len(ts.T(), code, ts.API.config.MFA.RecoveryCodeLength)
+			}
+		})
+	}
+}
+
+func (ts *MFATestSuite) TestRecoveryCodesStatus() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+
+	threshold := ts.API.config.MFA.LowRecoveryCodeThreshold
+	used := ts.API.config.MFA.RecoveryCodeCount - threshold
+	for _, code := range codesResp.RecoveryCodes[:used] {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"recovery_code": code,
+		}))
+		w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/verify", token, buffer)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+	}
+
+	status := func() RecoveryCodesStatusResponse {
+		var buffer bytes.Buffer
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors/recovery_codes/status", token, buffer)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		resp := RecoveryCodesStatusResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+
+	require.Equal(ts.T(), RecoveryCodesStatusResponse{
+		Total:     ts.API.config.MFA.RecoveryCodeCount,
+		Used:      used,
+		Remaining: threshold,
+		Low:       false,
+	}, status())
+
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"recovery_code": codesResp.RecoveryCodes[used],
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/verify", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	require.Equal(ts.T(), RecoveryCodesStatusResponse{
+		Total:     ts.API.config.MFA.RecoveryCodeCount,
+		Used:      used + 1,
+		Remaining: threshold - 1,
+		Low:       true,
+	}, status())
+}
+
+func (ts *MFATestSuite) TestRecoveryCodesOnlyReturnedOnGeneration() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Equal(ts.T(), "no-store", w.Header().Get("Cache-Control"))
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+	require.NotEmpty(ts.T(), codesResp.RecoveryCodes)
+
+	for _, path := range []string{
+		"http://localhost/factors/recovery_codes/status",
+		"http://localhost/factors",
+		fmt.Sprintf("http://localhost/factors/%s", ts.TestUser.Factors[0].ID),
+		"http://localhost/user",
+	} {
+		var buffer bytes.Buffer
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, path, token, buffer)
+		require.Equal(ts.T(), http.StatusOK, w.Code, path)
+		body := w.Body.String()
+		for _, code := range codesResp.RecoveryCodes {
+			require.NotContains(ts.T(), body, code, path)
+		}
+	}
+}
+
+func (ts *MFATestSuite) TestRecoveryCodesBundleRoundTrip() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/bundle", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.Equal(ts.T(), "no-store", w.Header().Get("Cache-Control"))
+	bundle := RecoveryCodesBundle{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&bundle))
+	require.Equal(ts.T(), recoveryCodesBundleVersion, bundle.Version)
+	require.Equal(ts.T(), ts.TestUser.ID, bundle.UserID)
+	require.NotEmpty(ts.T(), bundle.Checksum)
+	require.NotEmpty(ts.T(), bundle.Signature)
+
+	codes, err := models.FindValidRecoveryCodesByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, ts.API.config.MFA.RecoveryCodeCount)
+
+	verifyBundle := func(bundle RecoveryCodesBundle) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"bundle": bundle,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/bundle/verify", token, buffer)
+	}
+
+	w = verifyBundle(bundle)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	verifyResp := VerifyRecoveryCodesBundleResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&verifyResp))
+	require.True(ts.T(), verifyResp.Valid)
+	require.Equal(ts.T(), ts.API.config.MFA.RecoveryCodeCount, verifyResp.RecoveryCodeCount)
+	require.True(ts.T(), bundle.CreatedAt.Equal(verifyResp.CreatedAt))
+
+	tampered := bundle
+	tampered.CreatedAt = bundle.CreatedAt.Add(time.Hour)
+	w = verifyBundle(tampered)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), string(ErrorCodeMFARecoveryCodesBundleInvalid), data.ErrorCode)
+
+	tampered = bundle
+	tampered.Checksum = strings.Repeat("0", len(bundle.Checksum))
+	w = verifyBundle(tampered)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	payload := *bundle.Payload
+	payload.Data = append([]byte{}, payload.Data...)
+	payload.Data[0] ^= 0xff
+	tampered = bundle
+	tampered.Payload = &payload
+	w = verifyBundle(tampered)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *MFATestSuite) TestRegenerateRecoveryCodesInvalidatesPreviousSet() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollAndVerify(ts, token, true)
+	tokenResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(tokenResp))
+
+	var batches [2]RecoveryCodesResponse
+	for i := range batches {
+		var buffer bytes.Buffer
+		w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", tokenResp.Token, buffer)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&batches[i]))
+	}
+
+	codes, err := models.FindValidRecoveryCodesByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, ts.API.config.MFA.RecoveryCodeCount)
+	ctx := context.Background()
+	for _, code := range batches[1].RecoveryCodes {
+		_, err := models.FindValidRecoveryCodeByUserForUpdate(ctx, ts.API.db, ts.TestUser, code)
+		require.NoError(ts.T(), err)
+	}
+	for _, code := range batches[0].RecoveryCodes {
+		_, err := models.FindValidRecoveryCodeByUserForUpdate(ctx, ts.API.db, ts.TestUser, code)
+		require.True(ts.T(), models.IsNotFoundError(err))
+	}
+
+	// codes from the first batch can no longer be used
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"recovery_code": batches[0].RecoveryCodes[0],
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/verify", tokenResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+}
+
+func (ts *MFATestSuite) TestMFAVerifyFactor() {
+	cases := []struct {
+		desc              string
+		validChallenge    bool
+		validCode         bool
+		expectedHTTPCode  int
+		expectedErrorCode ErrorCode
+	}{
+		{
+			desc:              "Invalid: Valid code and expired challenge",
+			validChallenge:    false,
+			validCode:         true,
+			expectedHTTPCode:  http.StatusUnprocessableEntity,
+			expectedErrorCode: ErrorCodeMFAChallengeExpired,
+		},
+		{
+			desc:              "Invalid: Invalid code and valid challenge ",
+			validChallenge:    true,
+			validCode:         false,
+			expectedHTTPCode:  http.StatusUnprocessableEntity,
+			expectedErrorCode: ErrorCodeMFAVerificationFailed,
+		},
+		{
+			desc:             "Valid /verify request",
+			validChallenge:   true,
+			validCode:        true,
+			expectedHTTPCode: http.StatusOK,
+		},
+	}
+	for _, v := range cases {
+		ts.Run(v.desc, func() {
+			// Authenticate users and set secret
+			var buffer bytes.Buffer
+			r, err := models.GrantAuthenticatedUser(ts.API.db, ts.TestUser, models.GrantParams{})
+			require.NoError(ts.T(), err)
+
+			sharedSecret := ts.TestOTPKey.Secret()
+			factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+			f := factors[0]
+			f.Secret = sharedSecret
+			require.NoError(ts.T(), err)
+			require.NoError(ts.T(), ts.API.db.Update(f), "Error updating new test factor")
+
+			token := ts.generateAAL1Token(ts.TestUser, r.SessionId)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), &buffer)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+			testIPAddress := utilities.GetIPAddress(req)
+			c := models.NewChallenge(f, testIPAddress)
+			require.NoError(ts.T(), ts.API.db.Create(c), "Error saving new test challenge")
+			if !v.validChallenge {
+				// Set challenge creation so that it has expired in present time.
+				newCreatedAt := time.Now().UTC().Add(-1 * time.Second * time.Duration(ts.Config.MFA.ChallengeExpiryDuration+1))
+				// created_at is managed by buffalo(ORM) needs to be raw query to be updated
+				err := ts.API.db.RawQuery("UPDATE auth.mfa_challenges SET created_at = ? WHERE factor_id = ?", newCreatedAt, f.ID).Exec()
+				require.NoError(ts.T(), err, "Error updating new test challenge")
+			}
+
+			// Verify TOTP code
+			code, err := totp.GenerateCode(sharedSecret, time.Now().UTC())
+			if !v.validCode {
+				// Use an inaccurate time, resulting in an invalid code(usually)
+				code, err = totp.GenerateCode(sharedSecret, time.Now().UTC().Add(-1*time.Minute*time.Duration(1)))
+			}
+			require.NoError(ts.T(), err)
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"challenge_id": c.ID,
+				"code":         code,
+			}))
+
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), v.expectedHTTPCode, w.Code)
+
+			if v.expectedErrorCode != "" {
+				var data HTTPError
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+				require.Equal(ts.T(), v.expectedErrorCode, data.ErrorCode)
+				require.Equal(ts.T(), v.expectedHTTPCode, data.HTTPStatus)
+			}
+
+			if v.expectedHTTPCode == http.StatusOK {
+				// Ensure alternate session has been deleted
+				_, err = models.FindSessionByID(ts.API.db, ts.TestSecondarySession.ID, false)
+				require.EqualError(ts.T(), err, models.SessionNotFoundError{}.Error())
+			}
+			if !v.validChallenge {
+				// Ensure invalid challenges are deleted
+				_, err := models.FindChallengeByID(ts.API.db, c.ID)
+				require.EqualError(ts.T(), err, models.ChallengeNotFoundError{}.Error())
+			}
+		})
+	}
+}
+
+func (ts *MFATestSuite) TestVerifyLogsChallengeExpiry() {
+	logger := logrus.StandardLogger()
+	defer func(level logrus.Level, hooks logrus.LevelHooks) {
+		logger.SetLevel(level)
+		logger.ReplaceHooks(hooks)
+	}(logger.GetLevel(), logger.ReplaceHooks(make(logrus.LevelHooks)))
+	hook := logtest.NewLocal(logger)
+	logger.SetLevel(logrus.DebugLevel)
+
+	factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	f := factors[0]
+	f.Secret = ts.TestOTPKey.Secret()
+	require.NoError(ts.T(), ts.API.db.Update(f))
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), nil)
+	c := models.NewChallenge(f, utilities.GetIPAddress(req))
+	require.NoError(ts.T(), ts.API.db.Create(c))
+	createdAt := time.Now().UTC().Add(-1 * time.Second * time.Duration(ts.Config.MFA.ChallengeExpiryDuration+1))
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_challenges SET created_at = ? WHERE id = ?", createdAt, c.ID).Exec())
+
+	code, err := totp.GenerateCode(ts.TestOTPKey.Secret(), time.Now().UTC())
+	require.NoError(ts.T(), err)
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": c.ID,
+		"code":         code,
+	}))
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "mfa challenge expiry computed" {
+			entry = e
+		}
+	}
+	require.NotNil(ts.T(), entry)
+	require.Equal(ts.T(), logrus.DebugLevel, entry.Level)
+	require.Equal(ts.T(), c.ID, entry.Data["challenge_id"])
+	require.Contains(ts.T(), entry.Data, "challenge_created_at")
+	require.Contains(ts.T(), entry.Data, "now")
+	require.Equal(ts.T(), ts.API.config.MFA.TOTPSkew, entry.Data["totp_skew"])
+	expiresAt, ok := entry.Data["challenge_expires_at"].(time.Time)
+	require.True(ts.T(), ok)
+	require.True(ts.T(), expiresAt.Before(entry.Data["now"].(time.Time)))
+}
+
+func (ts *MFATestSuite) TestMFAErrorCodes() {
+	otherUser, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherUser))
+	otherFactor := models.NewFactor(otherUser, "other_factor", models.TOTP, models.FactorStateUnverified)
+	require.NoError(ts.T(), ts.API.db.Create(otherFactor))
+
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	cases := []struct {
+		desc              string
+		method            string
+		path              string
+		body              map[string]interface{}
+		expectedHTTPCode  int
+		expectedErrorCode ErrorCode
+	}{
+		{
+			desc:              "Enroll with unsupported factor type",
+			method:            http.MethodPost,
+			path:              "/factors",
+			body:              map[string]interface{}{"factor_type": "magic"},
+			expectedHTTPCode:  http.StatusUnprocessableEntity,
+			expectedErrorCode: ErrorCodeMFAUnsupportedFactorType,
+		},
+		{
+			desc:              "Challenge unknown factor",
+			method:            http.MethodPost,
+			path:              fmt.Sprintf("/factors/%s/challenge", uuid.Must(uuid.NewV4())),
+			expectedHTTPCode:  http.StatusNotFound,
+			expectedErrorCode: ErrorCodeMFAFactorNotFound,
+		},
+		{
+			desc:              "Challenge factor owned by another user",
+			method:            http.MethodPost,
+			path:              fmt.Sprintf("/factors/%s/challenge", otherFactor.ID),
+			expectedHTTPCode:  http.StatusForbidden,
+			expectedErrorCode: ErrorCodeMFAFactorNotOwned,
+		},
+		{
+			desc:              "Verify unknown challenge",
+			method:            http.MethodPost,
+			path:              fmt.Sprintf("/factors/%s/verify", f.ID),
+			body:              map[string]interface{}{"challenge_id": uuid.Must(uuid.NewV4()), "code": "123456"},
+			expectedHTTPCode:  http.StatusNotFound,
+			expectedErrorCode: ErrorCodeMFAFactorNotFound,
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			if c.body != nil {
+				require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(c.body))
+			}
+			w := ServeAuthenticatedRequest(ts, c.method, c.path, token, buffer)
+			require.Equal(ts.T(), c.expectedHTTPCode, w.Code)
+
+			var data HTTPError
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+			require.Equal(ts.T(), c.expectedErrorCode, data.ErrorCode)
+			require.Equal(ts.T(), c.expectedHTTPCode, data.HTTPStatus)
+			require.NotEmpty(ts.T(), data.Message)
+		})
+	}
+}
+
+func (ts *MFATestSuite) TestVerifyChallengeOfAnotherUser() {
+	otherUser, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherUser))
+	otherFactor := models.NewFactor(otherUser, "other_factor", models.TOTP, models.FactorStateUnverified)
+	require.NoError(ts.T(), ts.API.db.Create(otherFactor))
+	otherChallenge := models.NewChallenge(otherFactor, "")
+	require.NoError(ts.T(), ts.API.db.Create(otherChallenge))
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": otherChallenge.ID,
+		"code":         "123456",
+	}))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", ts.TestUser.Factors[0].ID), token, buffer)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFAFactorNotOwned, data.ErrorCode)
+
+	// the challenge is left untouched
+	c, err := models.FindChallengeByID(ts.API.db, otherChallenge.ID)
+	require.NoError(ts.T(), err)
+	require.Nil(ts.T(), c.VerifiedAt)
+}
+
+func (ts *MFATestSuite) TestVerifyRequiresConsecutiveCodesOnEnroll() {
+	defer func(require bool) {
+		ts.API.config.MFA.RequireDoubleVerifyOnEnroll = require
+	}(ts.API.config.MFA.RequireDoubleVerifyOnEnroll)
+	ts.API.config.MFA.RequireDoubleVerifyOnEnroll = true
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	secret, _, err := factor.GetSecret(ts.Config.Security.DBEncryption.DecryptionKeys, ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID)
+	require.NoError(ts.T(), err)
+
+	w = performChallengeFlow(ts, factor.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	verify := func(at time.Time) *httptest.ResponseRecorder {
+		code, err := totp.GenerateCodeCustom(secret, at, totpValidateOpts(factor, 0))
+		require.NoError(ts.T(), err)
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         code,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", factor.ID), token, buffer)
+	}
+
+	// the first code is accepted without verifying the factor
+	now := time.Now().UTC()
+	w = verify(now)
+	require.Equal(ts.T(), http.StatusAccepted, w.Code)
+	pendingResp := VerifyFactorPendingResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&pendingResp))
+	require.Equal(ts.T(), challengeResp.ID, pendingResp.ChallengeID)
+	require.True(ts.T(), pendingResp.NextCodeRequired)
+	factor, err = models.FindFactorByFactorID(ts.API.db, factor.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), factor.IsVerified())
+
+	// a second code from the same time step is rejected
+	w = verify(now)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	// a code from the next time step verifies the factor
+	w = verify(now.Add(time.Duration(totpValidateOpts(factor, 0).Period) * time.Second))
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	tokenResp := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&tokenResp))
+	require.NotEmpty(ts.T(), tokenResp.Token)
+	factor, err = models.FindFactorByFactorID(ts.API.db, factor.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), factor.IsVerified())
+}
+
+// factorEnrolledMailer records factor enrolled notifications instead of
+// sending them
+type factorEnrolledMailer struct {
+	mail.Mailer
+	factors []*models.Factor
+}
+
+func (m *factorEnrolledMailer) FactorEnrolledMail(r *http.Request, user *models.User, factor *models.Factor) error {
+	m.factors = append(m.factors, factor)
+	return nil
+}
+
+func (ts *MFATestSuite) TestNotifyOnEnroll() {
+	defer func(notify bool) {
+		ts.API.config.MFA.NotifyOnEnroll = notify
+		ts.API.overrideMailer = nil
+	}(ts.API.config.MFA.NotifyOnEnroll)
+	ts.API.config.MFA.NotifyOnEnroll = true
+	mailer := &factorEnrolledMailer{}
+	ts.API.overrideMailer = mailer
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "Work phone", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	require.Empty(ts.T(), mailer.factors)
+
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+
+	require.Len(ts.T(), mailer.factors, 1)
+	require.Equal(ts.T(), enrollResp.ID, mailer.factors[0].ID)
+	require.Equal(ts.T(), "Work phone", mailer.factors[0].FriendlyName)
+	require.NotNil(ts.T(), mailer.factors[0].VerifiedAt)
+}
+
+func (ts *MFATestSuite) TestRefreshChallenge() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	newChallenge := func(expiredFor time.Duration) uuid.UUID {
+		w := performChallengeFlow(ts, f.ID, token)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+		createdAt := time.Now().UTC().Add(-time.Second*time.Duration(ts.Config.MFA.ChallengeExpiryDuration) - expiredFor)
+		require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_challenges SET created_at = ? WHERE id = ?", createdAt, challengeResp.ID).Exec())
+		return challengeResp.ID
+	}
+	refresh := func(challengeID uuid.UUID) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		return ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("http://localhost/factors/%s/challenge/%s/refresh", f.ID, challengeID), token, buffer)
+	}
+
+	ts.Run("Refresh within grace period", func() {
+		challengeID := newChallenge(10 * time.Second)
+
+		w := refresh(challengeID)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		refreshResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&refreshResp))
+		require.NotEqual(ts.T(), challengeID, refreshResp.ID)
+		require.Greater(ts.T(), refreshResp.ExpiresAt, time.Now().Unix())
+
+		_, err := models.FindChallengeByID(ts.API.db, challengeID)
+		require.EqualError(ts.T(), err, models.ChallengeNotFoundError{}.Error())
+
+		refreshed, err := models.FindChallengeByID(ts.API.db, refreshResp.ID)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), 1, refreshed.RefreshCount)
+	})
+
+	ts.Run("Refresh after grace period", func() {
+		challengeID := newChallenge(time.Second * time.Duration(ts.Config.MFA.ChallengeRefreshGracePeriod+10))
+
+		w := refresh(challengeID)
+		require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+		var data HTTPError
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), ErrorCodeMFAChallengeExpired, data.ErrorCode)
+	})
+
+	ts.Run("Refresh limit", func() {
+		ts.API.config.MFA.MaxChallengeRefreshes = 1
+		defer func() {
+			ts.API.config.MFA.MaxChallengeRefreshes = 3
+		}()
+
+		w := refresh(newChallenge(0))
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		refreshResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&refreshResp))
+
+		w = refresh(refreshResp.ID)
+		require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+		var data HTTPError
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), ErrorCodeMFAChallengeRefreshLimit, data.ErrorCode)
+	})
+}
+
+func (ts *MFATestSuite) TestVerifyFactorUpdatesLastUsedAt() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.Nil(ts.T(), factor.LastUsedAt)
+
+	before := time.Now().Add(-time.Second)
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	w = performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+	verifyResp := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&verifyResp))
+
+	factor, err = models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), factor.LastUsedAt)
+	require.True(ts.T(), factor.LastUsedAt.After(before))
+
+	var buffer bytes.Buffer
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors", verifyResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	factors := []models.Factor{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factors))
+	require.Len(ts.T(), factors, 1)
+	require.NotNil(ts.T(), factors[0].LastUsedAt)
+}
+
+func (ts *MFATestSuite) TestVerifyFactorTOTPSkew() {
+	defer func() {
+		ts.API.config.MFA.TOTPSkew = 1
+	}()
+
+	cases := []struct {
+		desc         string
+		skew         uint
+		expectedCode int
+	}{
+		{
+			desc:         "Previous period rejected without skew",
+			skew:         0,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			desc:         "Previous period accepted with skew of one",
+			skew:         1,
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.API.config.MFA.TOTPSkew = c.skew
+
+			f := ts.TestUser.Factors[0]
+			require.NoError(ts.T(), f.SetSecret(ts.TestOTPKey.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+			require.NoError(ts.T(), ts.API.db.UpdateOnly(&f, "secret"))
+			token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+			w := performChallengeFlow(ts, f.ID, token)
+			challengeResp := ChallengeFactorResponse{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+			code, err := totp.GenerateCode(ts.TestOTPKey.Secret(), time.Now().UTC().Add(-30*time.Second))
+			require.NoError(ts.T(), err)
+
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"challenge_id": challengeResp.ID,
+				"code":         code,
+			}))
+			w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+		})
+	}
+}
+
+func (ts *MFATestSuite) TestVerifyFactorRecordsTOTPSkew() {
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.SetSecret(ts.TestOTPKey.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(&f, "secret"))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	// a code from the previous period, as generated by a clock running late
+	code, err := totp.GenerateCode(ts.TestOTPKey.Secret(), time.Now().UTC().Add(-30*time.Second))
+	require.NoError(ts.T(), err)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"code":         code,
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), factor.LastTOTPSkew)
+	require.Equal(ts.T(), -1, *factor.LastTOTPSkew)
+
+	stats, err := models.GetMFAStats(ts.API.db, ts.Config.MFA.ChallengeExpiryDuration)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, stats.TOTPSkews["-1"])
+}
+
+func (ts *MFATestSuite) TestVerifyFactorRejectsReplayedCode() {
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.SetSecret(ts.TestOTPKey.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(&f, "secret"))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	code, err := totp.GenerateCode(ts.TestOTPKey.Secret(), time.Now().UTC())
+	require.NoError(ts.T(), err)
+
+	verify := func(challengeID uuid.UUID) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeID,
+			"code":         code,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+	}
+
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	w = verify(challengeResp.ID)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	tokenResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(tokenResp))
+	token = tokenResp.Token
+
+	// replaying the same code against the same challenge
+	w = verify(challengeResp.ID)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+
+	// replaying the same code against a fresh challenge
+	w = performChallengeFlow(ts, f.ID, token)
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	w = verify(challengeResp.ID)
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+}
+
+func (ts *MFATestSuite) TestFactorStatusTransition() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "lifecycle", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	statusOf := func(token string) string {
+		var buffer bytes.Buffer
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors/", token, buffer)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		factors := []*models.Factor{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factors))
+		for _, f := range factors {
+			if f.ID == enrollResp.ID {
+				return f.Status
+			}
+		}
+		require.FailNow(ts.T(), "factor not listed")
+		return ""
+	}
+	require.Equal(ts.T(), models.FactorStateUnverified.String(), statusOf(token))
+
+	verify := func(token string) *AccessTokenResponse {
+		w := performChallengeFlow(ts, enrollResp.ID, token)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		w = performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+		tokenResp := &AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(tokenResp))
+		return tokenResp
+	}
+
+	// the first verification marks the factor verified
+	tokenResp := verify(token)
+	require.Equal(ts.T(), models.FactorStateVerified.String(), statusOf(tokenResp.Token))
+
+	// a later verification leaves the status alone, the TOTP step is reset so
+	// that the current code is accepted again
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET last_totp_step = NULL WHERE id = ?", enrollResp.ID).Exec())
+	tokenResp = verify(tokenResp.Token)
+	require.Equal(ts.T(), models.FactorStateVerified.String(), statusOf(tokenResp.Token))
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), factor.IsVerified())
+	require.True(ts.T(), factor.IsPrimary)
+}
+
+func (ts *MFATestSuite) TestUserSessionsReportAAL() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user/sessions", token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	sessionsResp := UserSessionsResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&sessionsResp))
+	require.Len(ts.T(), sessionsResp.Sessions, 2)
+	for _, session := range sessionsResp.Sessions {
+		require.Equal(ts.T(), models.AAL1.String(), session.AAL)
+		require.Equal(ts.T(), ts.TestSession.ID == session.ID, session.Current)
+	}
+
+	w = performEnrollAndVerify(ts, token, true)
+	tokenResp := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&tokenResp))
+
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user/sessions", tokenResp.Token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	sessionsResp = UserSessionsResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&sessionsResp))
+	var current *UserSession
+	for i := range sessionsResp.Sessions {
+		if sessionsResp.Sessions[i].Current {
+			current = &sessionsResp.Sessions[i]
+		}
+	}
+	require.NotNil(ts.T(), current)
+	require.Equal(ts.T(), ts.TestSession.ID, current.ID)
+	require.Equal(ts.T(), models.AAL2.String(), current.AAL)
+}
+
+func (ts *MFATestSuite) TestUserRevokeSession() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	path := fmt.Sprintf("http://localhost/user/sessions/%s", ts.TestSecondarySession.ID)
+	w := ServeAuthenticatedRequest(ts, http.MethodDelete, path, token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusNoContent, w.Code)
+
+	_, err := models.FindSessionByID(ts.API.db, ts.TestSecondarySession.ID, false)
+	require.True(ts.T(), models.IsNotFoundError(err))
+	_, err = models.FindSessionByID(ts.API.db, ts.TestSession.ID, false)
+	require.NoError(ts.T(), err)
+
+	w = ServeAuthenticatedRequest(ts, http.MethodDelete, path, token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusNotFound, w.Code)
+
+	// sessions of other users cannot be revoked
+	otherUser, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherUser))
+	otherSession, err := models.NewSession(otherUser.ID, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherSession))
+
+	w = ServeAuthenticatedRequest(ts, http.MethodDelete, fmt.Sprintf("http://localhost/user/sessions/%s", otherSession.ID), token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusNotFound, w.Code)
+	_, err = models.FindSessionByID(ts.API.db, otherSession.ID, false)
+	require.NoError(ts.T(), err)
+}
+
+func (ts *MFATestSuite) TestUnenrollRevokesFactorSessions() {
+	defer func(revoke bool) {
+		ts.API.config.MFA.FactorDeleteRevokesSessions = revoke
+	}(ts.API.config.MFA.FactorDeleteRevokesSessions)
+	ts.API.config.MFA.FactorDeleteRevokesSessions = true
+
+	factors, err := FindFactorsByUser(ts.API.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	f := factors[0]
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	require.NoError(ts.T(), ts.TestSession.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &f.ID))
+	require.NoError(ts.T(), ts.TestSecondarySession.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &f.ID))
+
+	// a session verified with another factor is left alone
+	otherFactor := models.NewFactor(ts.TestUser, "other_factor", models.TOTP, models.FactorStateVerified)
+	require.NoError(ts.T(), otherFactor.SetSecret("secretkey", ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+	require.NoError(ts.T(), ts.API.db.Create(otherFactor))
+	otherSession, err := models.NewSession(ts.TestUser.ID, &otherFactor.ID)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherSession))
+	require.NoError(ts.T(), otherSession.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &otherFactor.ID))
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := ServeAuthenticatedRequest(ts, http.MethodDelete, fmt.Sprintf("/factors/%s", f.ID), token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	for _, sessionID := range []uuid.UUID{ts.TestSession.ID, ts.TestSecondarySession.ID} {
+		_, err := models.FindSessionByID(ts.API.db, sessionID, false)
+		require.True(ts.T(), models.IsNotFoundError(err))
+	}
+	session, err := models.FindSessionByID(ts.API.db, otherSession.ID, false)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.AAL2.String(), session.GetAAL())
+}
+
+func (ts *MFATestSuite) TestChallengeBoundToClient() {
+	ts.API.config.MFA.BindChallengeToClient = true
+	defer func() {
+		ts.API.config.MFA.BindChallengeToClient = false
+	}()
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "bound", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	verifyFrom := func(userAgent string) *httptest.ResponseRecorder {
+		w := performChallengeFlow(ts, enrollResp.ID, token)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+		code, err := totp.GenerateCode(enrollResp.TOTP.Secret, time.Now().UTC())
+		require.NoError(ts.T(), err)
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         code,
+		}))
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/factors/%s/verify", enrollResp.ID), &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		ts.API.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// the challenge was created without a user agent
+	w = verifyFrom("other-client/1.0")
+	require.Equal(ts.T(), http.StatusUnauthorized, w.Code)
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFAChallengeClientMismatch, data.ErrorCode)
+
+	w = verifyFrom("")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+}
+
+func (ts *MFATestSuite) TestVerifyAnyFactor() {
+	keys := make([]*otp.Key, 0, 2)
+	factors := make([]*models.Factor, 0, 2)
+	for _, name := range []string{"first", "second"} {
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      ts.TestDomain,
+			AccountName: ts.TestEmail,
+		})
+		require.NoError(ts.T(), err)
+		f := models.NewFactor(ts.TestUser, name, models.TOTP, models.FactorStateVerified)
+		require.NoError(ts.T(), f.SetSecret(key.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+		require.NoError(ts.T(), ts.API.db.Create(f))
+		keys = append(keys, key)
+		factors = append(factors, f)
+	}
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	verifyAny := func(code string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"code": code,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/verify_any", token, buffer)
+	}
+
+	// a code is only accepted for factors with an open challenge
+	code, err := totp.GenerateCode(keys[1].Secret(), time.Now().UTC())
+	require.NoError(ts.T(), err)
+	w := verifyAny(code)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFAChallengeExpired, data.ErrorCode)
+
+	challengeIDs := make([]uuid.UUID, 0, len(factors))
+	for _, f := range factors {
+		w = performChallengeFlow(ts, f.ID, token)
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		challengeIDs = append(challengeIDs, challengeResp.ID)
+	}
+
+	// a code matching neither factor counts as a failed attempt on both
+	w = verifyAny("000000")
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	for _, f := range factors {
+		factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), 1, factor.FailedAttempts)
+	}
+
+	// a code of the second factor verifies that factor and its challenge
+	w = verifyAny(code)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	tokenResp := AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&tokenResp))
+	require.NotEmpty(ts.T(), tokenResp.Token)
+
+	session, err := models.FindSessionByID(ts.API.db, ts.TestSession.ID, false)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), session.IsAAL2())
+	require.Equal(ts.T(), factors[1].ID, *session.FactorID)
+
+	second, err := models.FindFactorByFactorID(ts.API.db, factors[1].ID)
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), second.LastUsedAt)
+	require.Equal(ts.T(), 0, second.FailedAttempts)
+
+	challenge, err := models.FindChallengeByID(ts.API.db, challengeIDs[1])
+	require.NoError(ts.T(), err)
+	require.NotNil(ts.T(), challenge.VerifiedAt)
+
+	// the same code cannot be used again
+	w = verifyAny(code)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+}
+
+func (ts *MFATestSuite) TestVerifyAnyFactorSkipsLockedFactors() {
+	factors := make([]*models.Factor, 0, 2)
+	for _, name := range []string{"first", "second"} {
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      ts.TestDomain,
+			AccountName: ts.TestEmail,
+		})
+		require.NoError(ts.T(), err)
+		f := models.NewFactor(ts.TestUser, name, models.TOTP, models.FactorStateVerified)
+		require.NoError(ts.T(), f.SetSecret(key.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+		require.NoError(ts.T(), ts.API.db.Create(f))
+		factors = append(factors, f)
+	}
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	for _, f := range factors {
+		performChallengeFlow(ts, f.ID, token)
+	}
+
+	verifyAny := func() *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"code": "000000",
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/verify_any", token, buffer)
+	}
+	lock := func(f *models.Factor) {
+		require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET failed_attempts = 1, locked_until = ? WHERE id = ?", time.Now().Add(time.Hour), f.ID).Exec())
+	}
+	failedAttempts := func(f *models.Factor) int {
+		factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+		require.NoError(ts.T(), err)
+		return factor.FailedAttempts
+	}
+
+	// a failure is not counted against a factor that is already locked
+	lock(factors[0])
+	w := verifyAny()
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	require.Equal(ts.T(), 1, failedAttempts(factors[0]))
+	require.Equal(ts.T(), 1, failedAttempts(factors[1]))
+
+	// once every factor is locked the client is told when to retry
+	lock(factors[1])
+	w = verifyAny()
+	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(ts.T(), w.Header().Get("Retry-After"))
+	data := HTTPError{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFAFactorLocked, data.ErrorCode)
+	require.Equal(ts.T(), 1, failedAttempts(factors[0]))
+	require.Equal(ts.T(), 1, failedAttempts(factors[1]))
+}
+
+func (ts *MFATestSuite) TestVerifyFactorLockout() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	maxAttempts := ts.API.config.MFA.MaxVerifyAttempts
+	for i := 0; i <= maxAttempts; i++ {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         "000000",
+		}))
+		w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+
+		var resp struct {
+			ErrorCode         string     `json:"error_code"`
+			AttemptsRemaining *int       `json:"attempts_remaining"`
+			LockedUntil       *time.Time `json:"locked_until"`
+		}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&resp))
+		switch {
+		case i < maxAttempts-1:
+			require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+			require.Equal(ts.T(), string(ErrorCodeMFAVerificationFailed), resp.ErrorCode)
+			require.NotNil(ts.T(), resp.AttemptsRemaining)
+			require.Equal(ts.T(), maxAttempts-i-1, *resp.AttemptsRemaining)
+			require.Nil(ts.T(), resp.LockedUntil)
+		case i == maxAttempts-1:
+			// the final failed attempt locks the factor
+			require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+			require.Equal(ts.T(), string(ErrorCodeMFAFactorLocked), resp.ErrorCode)
+			require.NotNil(ts.T(), resp.AttemptsRemaining)
+			require.Equal(ts.T(), 0, *resp.AttemptsRemaining)
+			require.NotNil(ts.T(), resp.LockedUntil)
+			require.True(ts.T(), resp.LockedUntil.After(time.Now()))
+		default:
+			require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+			require.Equal(ts.T(), string(ErrorCodeMFAFactorLocked), resp.ErrorCode)
+			require.NotNil(ts.T(), resp.LockedUntil)
+
+			// Retry-After is the remaining lockout in whole seconds
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			require.NoError(ts.T(), err)
+			remaining := time.Until(*resp.LockedUntil)
+			require.InDelta(ts.T(), remaining.Seconds(), float64(retryAfter), 1)
+		}
+	}
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), factor.IsLocked())
+	require.Equal(ts.T(), maxAttempts, factor.FailedAttempts)
+
+	// a correct code is refused as well while the factor is locked
+	w = performVerifyFlow(ts, challengeResp.ID, f.ID, token, false)
+	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+}
+
+func (ts *MFATestSuite) TestVerifyFactorLockoutBackoff() {
+	defer func(base, backoffCap time.Duration) {
+		ts.API.config.MFA.LockoutBackoffBase = base
+		ts.API.config.MFA.LockoutBackoffCap = backoffCap
+	}(ts.API.config.MFA.LockoutBackoffBase, ts.API.config.MFA.LockoutBackoffCap)
+	ts.API.config.MFA.LockoutBackoffBase = time.Minute
+	ts.API.config.MFA.LockoutBackoffCap = 4 * time.Minute
+
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	failVerify := func() {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         "000000",
+		}))
+		w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+		require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	}
+	expireLock := func() {
+		factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+		require.NoError(ts.T(), err)
+		past := time.Now().Add(-time.Second)
+		factor.LockedUntil = &past
+		require.NoError(ts.T(), ts.API.db.UpdateOnly(factor, "locked_until"))
+	}
+	requireLockedFor := func(expected time.Duration, level int) {
+		factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+		require.NoError(ts.T(), err)
+		require.True(ts.T(), factor.IsLocked())
+		require.InDelta(ts.T(), expected.Seconds(), time.Until(*factor.LockedUntil).Seconds(), 5)
+		require.Equal(ts.T(), level, factor.LockoutLevel)
+	}
+
+	// the first lockout happens once the attempt threshold is reached
+	for i := 0; i < ts.API.config.MFA.MaxVerifyAttempts; i++ {
+		failVerify()
+	}
+	requireLockedFor(time.Minute, 1)
+
+	// every further failure doubles the lock duration up to the cap
+	for _, step := range []struct {
+		duration time.Duration
+		level    int
+	}{
+		{2 * time.Minute, 2},
+		{4 * time.Minute, 2},
+		{4 * time.Minute, 2},
+	} {
+		expireLock()
+		failVerify()
+		requireLockedFor(step.duration, step.level)
+	}
+
+	// a successful verification resets the backoff
+	expireLock()
+	performVerifyFlow(ts, challengeResp.ID, f.ID, token, true)
+	factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 0, factor.LockoutLevel)
+	require.Nil(ts.T(), factor.LockedUntil)
+}
+
+// factorLockedMailer records factor locked notifications instead of sending
+// them
+type factorLockedMailer struct {
+	mail.Mailer
+	factors []*models.Factor
+}
+
+func (m *factorLockedMailer) FactorLockedMail(r *http.Request, user *models.User, factor *models.Factor) error {
+	m.factors = append(m.factors, factor)
+	return nil
+}
+
+func (ts *MFATestSuite) TestNotifyOnLockout() {
+	defer func(notify bool) {
+		ts.API.config.MFA.NotifyOnLockout = notify
+		ts.API.overrideMailer = nil
+	}(ts.API.config.MFA.NotifyOnLockout)
+	ts.API.config.MFA.NotifyOnLockout = true
+	mailer := &factorLockedMailer{}
+	ts.API.overrideMailer = mailer
+
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	maxAttempts := ts.API.config.MFA.MaxVerifyAttempts
+	for i := 0; i < maxAttempts+3; i++ {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         "000000",
+		}))
+		ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+
+		// only the attempt that locks the factor sends an email, not the
+		// ones made while it is locked
+		if i < maxAttempts-1 {
+			require.Empty(ts.T(), mailer.factors)
+		} else {
+			require.Len(ts.T(), mailer.factors, 1)
+		}
+	}
+	require.Equal(ts.T(), f.ID, mailer.factors[0].ID)
+	require.NotNil(ts.T(), mailer.factors[0].LockedUntil)
+}
+
+func (ts *MFATestSuite) TestVerifyFactorAuditLog() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"code":         "000000",
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", enrollResp.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+
+	cases := []struct {
+		action  models.AuditAction
+		outcome string
+	}{
+		{action: models.VerifyFactorAction, outcome: models.AuditOutcomeFailure},
+		{action: models.FactorVerifiedAction, outcome: models.AuditOutcomeSuccess},
+	}
+	for _, c := range cases {
+		logs, err := models.FindAuditLogEntries(ts.API.db, []string{"action"}, string(c.action), nil)
+		require.NoError(ts.T(), err)
+		require.Len(ts.T(), logs, 1)
+
+		traits, ok := logs[0].Payload["traits"].(map[string]interface{})
+		require.True(ts.T(), ok)
+		require.Equal(ts.T(), enrollResp.ID.String(), traits["factor_id"])
+		require.Equal(ts.T(), models.TOTP, traits["factor_type"])
+		require.Equal(ts.T(), c.outcome, traits["outcome"])
+	}
+}
+
+func (ts *MFATestSuite) TestTOTPParameters() {
+	ts.API.config.MFA.TOTPAlgorithm = "SHA256"
+	ts.API.config.MFA.TOTPDigits = 8
+	defer func() {
+		ts.API.config.MFA.TOTPAlgorithm = "SHA1"
+		ts.API.config.MFA.TOTPDigits = 6
+	}()
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	uri, err := url.Parse(enrollResp.TOTP.URI)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), "SHA256", uri.Query().Get("algorithm"))
+	require.Equal(ts.T(), "8", uri.Query().Get("digits"))
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), "SHA256", *factor.TOTPAlgorithm)
+	require.Equal(ts.T(), 8, *factor.TOTPDigits)
+	require.Equal(ts.T(), 30, *factor.TOTPPeriod)
+
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	// a code generated with the default parameters is rejected
+	code, err := totp.GenerateCode(enrollResp.TOTP.Secret, time.Now().UTC())
+	require.NoError(ts.T(), err)
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"code":         code,
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", enrollResp.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+
+	performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+}
+
+func (ts *MFATestSuite) TestTOTPPeriodPerInstance() {
+	other, otherConfig, err := setupAPIForTestWithCallback(func(config *conf.GlobalConfiguration, conn *storage.Connection) {
+		if config != nil {
+			config.MFA.TOTPPeriod = 60
+		}
+	})
+	require.NoError(ts.T(), err)
+	defer other.db.Close()
+	require.EqualValues(ts.T(), 60, otherConfig.MFA.TOTPPeriod)
+
+	serve := func(api *API, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(body))
+		req := httptest.NewRequest(http.MethodPost, path, &buffer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		api.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code, w.Body.String())
+		return w
+	}
+	enroll := func(api *API, token, friendlyName string) uuid.UUID {
+		w := serve(api, "http://localhost/factors/", token, EnrollFactorParams{FriendlyName: friendlyName, FactorType: models.TOTP})
+		enrollResp := EnrollFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+		return enrollResp.ID
+	}
+	verify := func(api *API, token string, factorID uuid.UUID) string {
+		w := serve(api, fmt.Sprintf("http://localhost/factors/%s/challenge", factorID), token, map[string]interface{}{})
+		challengeResp := ChallengeFactorResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+		w = serve(api, fmt.Sprintf("http://localhost/factors/%s/verify", factorID), token, map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         currentTOTPCode(ts, factorID),
+		})
+		tokenResp := AccessTokenResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&tokenResp))
+		return tokenResp.Token
+	}
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	defaultFactorID := enroll(ts.API, token, "default_period")
+	otherFactorID := enroll(other, token, "other_period")
+
+	for factorID, period := range map[uuid.UUID]int{defaultFactorID: 30, otherFactorID: 60} {
+		factor, err := models.FindFactorByFactorID(ts.API.db, factorID)
+		require.NoError(ts.T(), err)
+		require.Equal(ts.T(), period, *factor.TOTPPeriod)
+	}
+
+	// each factor is verified with the period it was enrolled with, whichever
+	// instance handles the verification
+	token = verify(other, token, defaultFactorID)
+	verify(ts.API, token, otherFactorID)
+}
+
+func (ts *MFATestSuite) TestEnrollFactorDeviceMetadata() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	enroll := func(deviceName, platform string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(EnrollFactorParams{
+			FactorType: models.TOTP,
+			DeviceName: deviceName,
+			Platform:   platform,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/", token, buffer)
+	}
+
+	w := enroll(strings.Repeat("a", maxFactorMetadataLength+1), "")
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = enroll(" Pixel 7\n", "android\x00")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	var buffer bytes.Buffer
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/factors/", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	factors := []models.Factor{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factors))
+
+	var enrolled *models.Factor
+	for i := range factors {
+		if factors[i].ID == enrollResp.ID {
+			enrolled = &factors[i]
+		}
+	}
+	require.NotNil(ts.T(), enrolled)
+	require.NotNil(ts.T(), enrolled.DeviceName)
+	require.Equal(ts.T(), "Pixel 7", *enrolled.DeviceName)
+	require.NotNil(ts.T(), enrolled.Platform)
+	require.Equal(ts.T(), "android", *enrolled.Platform)
+}
+
+func (ts *MFATestSuite) TestStepUpChallenge() {
+	defer func(rotation bool, interval int) {
+		ts.API.config.Security.RefreshTokenRotationEnabled = rotation
+		ts.API.config.Security.RefreshTokenReuseInterval = interval
+	}(ts.API.config.Security.RefreshTokenRotationEnabled, ts.API.config.Security.RefreshTokenReuseInterval)
+	ts.API.config.Security.RefreshTokenRotationEnabled = true
+	ts.API.config.Security.RefreshTokenReuseInterval = 0
+
+	oldRefreshToken, err := models.FindTokenBySessionID(ts.API.db, &ts.TestSession.ID)
+	require.NoError(ts.T(), err)
+
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.SetSecret(ts.TestOTPKey.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(&f, "secret"))
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/challenge?purpose=unknown", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/challenge?purpose=%s", f.ID, models.ChallengePurposeStepUp), token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	w = performVerifyFlow(ts, challengeResp.ID, f.ID, token, true)
+	stepUpResp := StepUpTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&stepUpResp))
+	require.Equal(ts.T(), ts.Config.MFA.StepUpTokenExp, stepUpResp.ExpiresIn)
+
+	claims := &StepUpTokenClaims{}
+	_, err = jwt.ParseWithClaims(stepUpResp.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.ChallengePurposeStepUp, claims.Purpose)
+	require.Equal(ts.T(), jwt.ClaimStrings{stepUpTokenAudience}, claims.Audience)
+	require.Equal(ts.T(), f.ID.String(), claims.FactorID)
+	require.Equal(ts.T(), ts.TestSession.ID.String(), claims.SessionId)
+	lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time)
+	require.Equal(ts.T(), time.Duration(ts.Config.MFA.StepUpTokenExp)*time.Second, lifetime)
+	require.NotEqual(ts.T(), time.Duration(ts.Config.JWT.Exp)*time.Second, lifetime)
+
+	// the step up token is not an access token
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user", stepUpResp.Token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+	// the session's tokens are rotated and reflect the upgraded AAL
+	require.NotNil(ts.T(), stepUpResp.Session)
+	require.NotEmpty(ts.T(), stepUpResp.Session.Token)
+	require.NotEmpty(ts.T(), stepUpResp.Session.RefreshToken)
+	require.NotEqual(ts.T(), oldRefreshToken.Token, stepUpResp.Session.RefreshToken)
+	session, err := models.FindSessionByID(ts.API.db, ts.TestSession.ID, false)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), session.IsAAL2())
+	accessClaims := &AccessTokenClaims{}
+	_, err = jwt.ParseWithClaims(stepUpResp.Session.Token, accessClaims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ts.Config.JWT.Secret), nil
+	})
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.AAL2.String(), accessClaims.AuthenticatorAssuranceLevel)
+	require.Equal(ts.T(), ts.TestSession.ID.String(), accessClaims.SessionId)
+
+	// the previous refresh token can no longer be used
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"refresh_token": oldRefreshToken.Token,
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+}
+
+func (ts *MFATestSuite) TestChallengeForceReauth() {
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.SetSecret(ts.TestOTPKey.Secret(), ts.Config.Security.DBEncryption.Encrypt, ts.Config.Security.DBEncryption.EncryptionKeyID, ts.Config.Security.DBEncryption.EncryptionKey))
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(&f, "secret"))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	opts := totpValidateOpts(&f, 0)
+
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/challenge?force_reauth=maybe", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	cases := []struct {
+		desc         string
+		query        string
+		expectedCode int
+	}{
+		{
+			desc:         "Code from before a force_reauth challenge",
+			query:        "?force_reauth=true",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			desc:         "Code from before a regular challenge",
+			query:        "",
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/challenge%s", f.ID, c.query), token, buffer)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+			challengeResp := ChallengeFactorResponse{}
+			require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+			challenge, err := models.FindChallengeByID(ts.API.db, challengeResp.ID)
+			require.NoError(ts.T(), err)
+
+			// a code from the time step before the challenge was created
+			code, err := totp.GenerateCodeCustom(ts.TestOTPKey.Secret(), challenge.CreatedAt.Add(-time.Duration(opts.Period)*time.Second), opts)
+			require.NoError(ts.T(), err)
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+				"challenge_id": challenge.ID,
+				"code":         code,
+			}))
+			w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+		})
+	}
+}
+
+// fakeVerifier accepts a fixed code and records how it was used
+type fakeVerifier struct {
+	challenges []uuid.UUID
+	saved      bool
+}
+
+func (v *fakeVerifier) Challenge(ctx context.Context, factor *models.Factor, challenge *models.Challenge) error {
+	v.challenges = append(v.challenges, challenge.ID)
+	return nil
+}
+
+func (v *fakeVerifier) Verify(ctx context.Context, factor *models.Factor, challenge *models.Challenge, params *VerifyFactorParams) (*FactorVerification, error) {
+	if params.Code != "fake-code" {
+		return &FactorVerification{Message: "Invalid fake code entered", Err: errors.New("wrong code")}, nil
+	}
+	return &FactorVerification{
+		Valid: true,
+		Save: func(tx *storage.Connection) error {
+			v.saved = true
+			return nil
+		},
+	}, nil
+}
+
+func (ts *MFATestSuite) TestFactorVerifier() {
+	verifier := &fakeVerifier{}
+	defer func(newVerifier func(a *API, db *storage.Connection) FactorVerifier) {
+		factorVerifiers[models.TOTP] = newVerifier
+	}(factorVerifiers[models.TOTP])
+	factorVerifiers[models.TOTP] = func(a *API, db *storage.Connection) FactorVerifier {
+		return verifier
+	}
+
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	w := performChallengeFlow(ts, f.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	require.Equal(ts.T(), []uuid.UUID{challengeResp.ID}, verifier.challenges)
+
+	verify := func(code string) *httptest.ResponseRecorder {
+		var buffer bytes.Buffer
+		require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+			"challenge_id": challengeResp.ID,
+			"code":         code,
+		}))
+		return ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", f.ID), token, buffer)
+	}
+
+	w = verify("wrong-code")
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), "Invalid fake code entered", data.Message)
+	require.False(ts.T(), verifier.saved)
+
+	w = verify("fake-code")
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	require.True(ts.T(), verifier.saved)
+	factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+	require.NoError(ts.T(), err)
+	require.True(ts.T(), factor.IsVerified())
+}
 
-			ts.API.handler.ServeHTTP(w, req)
-			require.Equal(ts.T(), v.expectedHTTPCode, w.Code)
+func (ts *MFATestSuite) TestUpdateFactor() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	performEnrollFlow(ts, token, "iPhone", models.TOTP, ts.TestDomain, http.StatusOK)
 
-			if v.expectedHTTPCode == http.StatusOK {
-				// Ensure alternate session has been deleted
-				_, err = models.FindSessionByID(ts.API.db, ts.TestSecondarySession.ID, false)
-				require.EqualError(ts.T(), err, models.SessionNotFoundError{}.Error())
-			}
-			if !v.validChallenge {
-				// Ensure invalid challenges are deleted
-				_, err := models.FindChallengeByID(ts.API.db, c.ID)
-				require.EqualError(ts.T(), err, models.ChallengeNotFoundError{}.Error())
+	cases := []struct {
+		desc         string
+		friendlyName string
+		expectedCode int
+	}{
+		{
+			desc:         "Rename factor",
+			friendlyName: "Work laptop",
+			expectedCode: http.StatusOK,
+		},
+		{
+			desc:         "Empty friendly name",
+			friendlyName: "  ",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "Friendly name too long",
+			friendlyName: strings.Repeat("a", maxFriendlyNameLength+1),
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			desc:         "Friendly name used by another factor",
+			friendlyName: "iPhone",
+			expectedCode: http.StatusConflict,
+		},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(UpdateFactorParams{FriendlyName: c.friendlyName}))
+			w := ServeAuthenticatedRequest(ts, http.MethodPatch, fmt.Sprintf("/factors/%s", f.ID), token, buffer)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+
+			if c.expectedCode == http.StatusOK {
+				factor := models.Factor{}
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&factor))
+				require.Equal(ts.T(), c.friendlyName, factor.FriendlyName)
 			}
 		})
 	}
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), "Work laptop", factor.FriendlyName)
+}
+
+func (ts *MFATestSuite) TestGetFactor() {
+	f := ts.TestUser.Factors[0]
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	// an unverified factor is a pending enrollment that expires
+	w := ServeAuthenticatedRequest(ts, http.MethodGet, fmt.Sprintf("/factors/%s", f.ID), token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	var pending map[string]interface{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&pending))
+	require.Equal(ts.T(), f.ID.String(), pending["id"])
+	require.Equal(ts.T(), models.FactorStateUnverified.String(), pending["status"])
+	require.NotEmpty(ts.T(), pending["expires_at"])
+	expiresIn := pending["expires_in"].(float64)
+	require.LessOrEqual(ts.T(), expiresIn, ts.Config.MFA.EnrollmentExpiry.Seconds())
+	require.Greater(ts.T(), expiresIn, ts.Config.MFA.EnrollmentExpiry.Seconds()-60)
+
+	// verified factors no longer expire
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, fmt.Sprintf("/factors/%s", f.ID), token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	var verified map[string]interface{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&verified))
+	require.Equal(ts.T(), models.FactorStateVerified.String(), verified["status"])
+	require.NotContains(ts.T(), verified, "expires_at")
+	require.NotContains(ts.T(), verified, "expires_in")
+
+	otherUser, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherUser))
+	otherFactor := models.NewFactor(otherUser, "other_factor", models.TOTP, models.FactorStateUnverified)
+	require.NoError(ts.T(), ts.API.db.Create(otherFactor))
+
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, fmt.Sprintf("/factors/%s", otherFactor.ID), token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
 }
 
 func (ts *MFATestSuite) TestUnenrollVerifiedFactor() {
@@ -367,13 +3301,182 @@ func (ts *MFATestSuite) TestUnenrollUnverifiedFactor() {
 
 	_, err := models.FindFactorByFactorID(ts.API.db, f.ID)
 	require.EqualError(ts.T(), err, models.FactorNotFoundError{}.Error())
+
+	// the factor is soft deleted and only listed when asked for
+	factors, err := models.FindFactorsByUserID(ts.API.db, ts.TestUser.ID, models.FactorFilter{}, nil)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), factors)
+	factors, err = models.FindFactorsByUserID(ts.API.db, ts.TestUser.ID, models.FactorFilter{IncludeDeleted: true}, nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), factors, 1)
+	require.Equal(ts.T(), f.ID, factors[0].ID)
+	require.NotNil(ts.T(), factors[0].DeletedAt)
+
 	session, _ := models.FindSessionByID(ts.API.db, ts.TestSecondarySession.ID, false)
 	require.Equal(ts.T(), models.AAL1.String(), session.GetAAL())
 	require.Nil(ts.T(), session.FactorID)
 
 }
 
+func (ts *MFATestSuite) TestUnenrollFactorOwnedByAnotherUser() {
+	otherUser, err := models.NewUser("", "other@example.com", "password", ts.Config.JWT.Aud, nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.API.db.Create(otherUser))
+	otherFactor := models.NewFactor(otherUser, "other_factor", models.TOTP, models.FactorStateUnverified)
+	require.NoError(ts.T(), ts.API.db.Create(otherFactor))
+
+	var buffer bytes.Buffer
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := ServeAuthenticatedRequest(ts, http.MethodDelete, fmt.Sprintf("/factors/%s", otherFactor.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+	_, err = models.FindFactorByFactorID(ts.API.db, otherFactor.ID)
+	require.NoError(ts.T(), err)
+}
+
+func (ts *MFATestSuite) TestUnenrollLastVerifiedFactor() {
+	ts.API.config.MFA.MinVerifiedFactors = 1
+	defer func() {
+		ts.API.config.MFA.MinVerifiedFactors = 0
+	}()
+
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	require.NoError(ts.T(), ts.TestSession.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &f.ID))
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	var buffer bytes.Buffer
+	w := ServeAuthenticatedRequest(ts, http.MethodDelete, fmt.Sprintf("/factors/%s", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusBadRequest, w.Code)
+
+	w = ServeAuthenticatedRequest(ts, http.MethodDelete, fmt.Sprintf("/factors/%s?force=true", f.ID), token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	_, err := models.FindFactorByFactorID(ts.API.db, f.ID)
+	require.EqualError(ts.T(), err, models.FactorNotFoundError{}.Error())
+}
+
+func (ts *MFATestSuite) TestVerifyFirstFactorRequiresRecoveryCodes() {
+	ts.API.config.MFA.MinRecoveryCodes = ts.API.config.MFA.RecoveryCodeCount
+	defer func() {
+		ts.API.config.MFA.MinRecoveryCodes = 0
+	}()
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	w = performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, false)
+	require.Equal(ts.T(), http.StatusUnprocessableEntity, w.Code)
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFARecoveryCodesRequired, data.ErrorCode)
+
+	factor, err := models.FindFactorByFactorID(ts.API.db, enrollResp.ID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), factor.IsVerified())
+
+	var buffer bytes.Buffer
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+}
+
 // Integration Tests
+func (ts *MFATestSuite) TestMFAEnforcement() {
+	defer func() {
+		ts.API.config.MFA.Enforcement = conf.MFAEnforcementOptional
+		ts.API.config.MFA.EnforcementRoles = nil
+	}()
+
+	ts.TestUser.Role = "staff"
+	require.NoError(ts.T(), ts.API.db.UpdateOnly(ts.TestUser, "role"))
+	aal1Token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	require.NoError(ts.T(), ts.TestSession.UpdateAALAndAssociatedFactor(ts.API.db, models.AAL2, &f.ID))
+	aal2Token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	cases := []struct {
+		desc         string
+		enforcement  string
+		roles        []string
+		token        string
+		expectedCode int
+	}{
+		{desc: "Optional with AAL1", enforcement: conf.MFAEnforcementOptional, token: aal1Token, expectedCode: http.StatusOK},
+		{desc: "Required with AAL1", enforcement: conf.MFAEnforcementRequired, token: aal1Token, expectedCode: http.StatusForbidden},
+		{desc: "Required with AAL2", enforcement: conf.MFAEnforcementRequired, token: aal2Token, expectedCode: http.StatusOK},
+		{desc: "Required for user role with AAL1", enforcement: conf.MFAEnforcementRequiredForRoles, roles: []string{"staff"}, token: aal1Token, expectedCode: http.StatusForbidden},
+		{desc: "Required for user role with AAL2", enforcement: conf.MFAEnforcementRequiredForRoles, roles: []string{"staff"}, token: aal2Token, expectedCode: http.StatusOK},
+		{desc: "Required for other role with AAL1", enforcement: conf.MFAEnforcementRequiredForRoles, roles: []string{"admin"}, token: aal1Token, expectedCode: http.StatusOK},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			ts.API.config.MFA.Enforcement = c.enforcement
+			ts.API.config.MFA.EnforcementRoles = c.roles
+
+			var buffer bytes.Buffer
+			w := ServeAuthenticatedRequest(ts, http.MethodGet, "/user", c.token, buffer)
+			require.Equal(ts.T(), c.expectedCode, w.Code)
+			if c.expectedCode == http.StatusForbidden {
+				var data HTTPError
+				require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+				require.Equal(ts.T(), ErrorCodeMFARequired, data.ErrorCode)
+			}
+
+			// factor endpoints stay reachable so that users can complete MFA
+			w = ServeAuthenticatedRequest(ts, http.MethodGet, "/factors", c.token, buffer)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+		})
+	}
+}
+
+func (ts *MFATestSuite) TestMFAEnforcementNewFactorGracePeriod() {
+	defer func() {
+		ts.API.config.MFA.Enforcement = conf.MFAEnforcementOptional
+		ts.API.config.MFA.NewFactorGracePeriod = 0
+	}()
+	ts.API.config.MFA.Enforcement = conf.MFAEnforcementRequiredForEnrolled
+	ts.API.config.MFA.NewFactorGracePeriod = time.Hour
+
+	f := ts.TestUser.Factors[0]
+	require.NoError(ts.T(), f.UpdateStatus(ts.API.db, models.FactorStateVerified))
+	require.NotNil(ts.T(), f.VerifiedAt)
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+
+	ts.Run("Within grace period", func() {
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "/user", token, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+	})
+
+	ts.Run("After grace period", func() {
+		verifiedAt := time.Now().Add(-2 * time.Hour)
+		require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET verified_at = ? WHERE id = ?", verifiedAt, f.ID).Exec())
+
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "/user", token, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusForbidden, w.Code)
+		var data HTTPError
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		require.Equal(ts.T(), ErrorCodeMFARequired, data.ErrorCode)
+	})
+
+	ts.Run("Without grace period", func() {
+		ts.API.config.MFA.NewFactorGracePeriod = 0
+		require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET verified_at = now() WHERE id = ?", f.ID).Exec())
+
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "/user", token, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusForbidden, w.Code)
+	})
+}
+
 func (ts *MFATestSuite) TestSessionsMaintainAALOnRefresh() {
 	ts.Config.Security.RefreshTokenRotationEnabled = true
 	resp := performTestSignupAndVerify(ts, ts.TestEmail, ts.TestPassword, true /* <- requireStatusOK */)
@@ -433,6 +3536,296 @@ func (ts *MFATestSuite) TestMFAFollowedByPasswordSignIn() {
 	require.True(ts.T(), session.IsAAL2())
 }
 
+func (ts *MFATestSuite) TestPartialSessionAfterPasswordSignIn() {
+	ts.API.config.MFA.Enforcement = conf.MFAEnforcementRequiredForEnrolled
+	defer func() {
+		ts.API.config.MFA.Enforcement = conf.MFAEnforcementOptional
+	}()
+
+	resp := performTestSignupAndVerify(ts, ts.TestEmail, ts.TestPassword, true /* <- requireStatusOK */)
+	accessTokenResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(resp.Body).Decode(&accessTokenResp))
+	user, err := models.FindUserByID(ts.API.db, accessTokenResp.User.ID)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), user.Factors, 1)
+	factorID := user.Factors[0].ID
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    ts.TestEmail,
+		"password": ts.TestPassword,
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	partial := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&partial))
+	require.True(ts.T(), partial.MFARequired)
+	require.Equal(ts.T(), []uuid.UUID{factorID}, partial.FactorIDs)
+
+	// the partial session can only be used for the MFA endpoints
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user", partial.Token, buffer)
+	require.Equal(ts.T(), http.StatusForbidden, w.Code)
+	var data HTTPError
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+	require.Equal(ts.T(), ErrorCodeMFARequired, data.ErrorCode)
+
+	w = performChallengeFlow(ts, factorID, partial.Token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	// the signup flow already used the code of the current time step
+	require.NoError(ts.T(), ts.API.db.RawQuery("UPDATE auth.mfa_factors SET last_totp_step = NULL WHERE id = ?", factorID).Exec())
+	w = performVerifyFlow(ts, challengeResp.ID, factorID, partial.Token, true)
+	upgraded := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&upgraded))
+	require.False(ts.T(), upgraded.MFARequired)
+
+	w = ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user", upgraded.Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+}
+
+func (ts *MFATestSuite) TestTrustedDeviceSkipsMFA() {
+	ts.API.config.MFA.Enforcement = conf.MFAEnforcementRequiredForEnrolled
+	ts.API.config.MFA.TrustedDeviceDuration = time.Hour
+	defer func() {
+		ts.API.config.MFA.Enforcement = conf.MFAEnforcementOptional
+		ts.API.config.MFA.TrustedDeviceDuration = 0
+		ts.API.overrideTime = nil
+	}()
+
+	signUpResp, deviceCookie := signUpAndTrustDevice(ts, ts.TestEmail, ts.TestPassword)
+	require.True(ts.T(), deviceCookie.HttpOnly)
+
+	ts.Run("Device token is not an access token", func() {
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user", deviceCookie.Value, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusForbidden, w.Code)
+
+		devices := []models.TrustedDevice{}
+		require.NoError(ts.T(), ts.API.db.Where("user_id = ?", signUpResp.User.ID).All(&devices))
+		require.Len(ts.T(), devices, 1)
+		require.NotEqual(ts.T(), deviceCookie.Value, devices[0].TokenHash)
+	})
+
+	ts.Run("Trusted device skips the challenge", func() {
+		data := signInWithDevice(ts, ts.TestEmail, ts.TestPassword, deviceCookie)
+		require.False(ts.T(), data.MFARequired)
+
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, "http://localhost/user", data.Token, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		userResp := UserResponse{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&userResp))
+		require.Equal(ts.T(), models.AAL2.String(), userResp.AAL)
+	})
+
+	ts.Run("Sign in without the device token requires MFA", func() {
+		data := signInWithDevice(ts, ts.TestEmail, ts.TestPassword, nil)
+		require.True(ts.T(), data.MFARequired)
+	})
+
+	ts.Run("Expired device token requires MFA", func() {
+		ts.API.overrideTime = func() time.Time {
+			return time.Now().Add(2 * time.Hour)
+		}
+		defer func() {
+			ts.API.overrideTime = nil
+		}()
+
+		data := signInWithDevice(ts, ts.TestEmail, ts.TestPassword, deviceCookie)
+		require.True(ts.T(), data.MFARequired)
+	})
+
+	ts.Run("Deleted device requires MFA", func() {
+		require.NoError(ts.T(), models.DeleteTrustedDevicesByUserID(ts.API.db, signUpResp.User.ID))
+
+		data := signInWithDevice(ts, ts.TestEmail, ts.TestPassword, deviceCookie)
+		require.True(ts.T(), data.MFARequired)
+	})
+}
+
+func (ts *MFATestSuite) TestRevokeTrustedDevices() {
+	ts.API.config.MFA.Enforcement = conf.MFAEnforcementRequiredForEnrolled
+	ts.API.config.MFA.TrustedDeviceDuration = time.Hour
+	defer func() {
+		ts.API.config.MFA.Enforcement = conf.MFAEnforcementOptional
+		ts.API.config.MFA.TrustedDeviceDuration = 0
+	}()
+
+	signUpResp, deviceCookie := signUpAndTrustDevice(ts, ts.TestEmail, ts.TestPassword)
+	require.False(ts.T(), signInWithDevice(ts, ts.TestEmail, ts.TestPassword, deviceCookie).MFARequired)
+
+	adminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		Role: "supabase_admin",
+	}).SignedString([]byte(ts.API.config.JWT.Secret))
+	require.NoError(ts.T(), err)
+
+	w := ServeAuthenticatedRequest(ts, http.MethodDelete, fmt.Sprintf("/admin/mfa/%s/trusted_devices", signUpResp.User.ID), adminToken, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	user, err := models.FindUserByID(ts.API.db, signUpResp.User.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, user.TrustedDeviceVersion)
+
+	// the previously trusted device has to complete MFA again
+	data := signInWithDevice(ts, ts.TestEmail, ts.TestPassword, deviceCookie)
+	require.True(ts.T(), data.MFARequired)
+}
+
+func (ts *MFATestSuite) TestAdminUsedRecoveryCodes() {
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes", token, bytes.Buffer{})
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+	codesResp := RecoveryCodesResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&codesResp))
+
+	adminToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &AccessTokenClaims{
+		Role: "supabase_admin",
+	}).SignedString([]byte(ts.API.config.JWT.Secret))
+	require.NoError(ts.T(), err)
+	report := func() (UsedRecoveryCodesResponse, string) {
+		w := ServeAuthenticatedRequest(ts, http.MethodGet, fmt.Sprintf("/admin/mfa/%s/recovery_codes/used", ts.TestUser.ID), adminToken, bytes.Buffer{})
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+		body := w.Body.String()
+		resp := UsedRecoveryCodesResponse{}
+		require.NoError(ts.T(), json.Unmarshal([]byte(body), &resp))
+		return resp, body
+	}
+
+	resp, _ := report()
+	require.Empty(ts.T(), resp.RecoveryCodes)
+	require.Nil(ts.T(), resp.LastUsedAt)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"recovery_code": codesResp.RecoveryCodes[0],
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, "http://localhost/factors/recovery_codes/verify", token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	resp, body := report()
+	require.Len(ts.T(), resp.RecoveryCodes, 1)
+	used := resp.RecoveryCodes[0]
+	require.WithinDuration(ts.T(), time.Now(), used.VerifiedAt, 5*time.Second)
+	require.NotNil(ts.T(), used.IP)
+	require.Equal(ts.T(), "192.0.2.1", *used.IP)
+	require.NotNil(ts.T(), resp.LastUsedAt)
+	require.True(ts.T(), resp.LastUsedAt.Equal(used.VerifiedAt))
+	for _, code := range codesResp.RecoveryCodes {
+		require.NotContains(ts.T(), body, code)
+	}
+}
+
+// signUpAndTrustDevice signs up a user, verifies a new TOTP factor with
+// trust_device set and returns the trusted device cookie
+func signUpAndTrustDevice(ts *MFATestSuite, email, password string) (AccessTokenResponse, *http.Cookie) {
+	signUpResp := signUp(ts, email, password)
+	w := performEnrollFlow(ts, signUpResp.Token, "", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+	w = performChallengeFlow(ts, enrollResp.ID, signUpResp.Token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+
+	code := currentTOTPCode(ts, enrollResp.ID)
+
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"challenge_id": challengeResp.ID,
+		"code":         code,
+		"trust_device": true,
+	}))
+	w = ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("/factors/%s/verify", enrollResp.ID), signUpResp.Token, buffer)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == ts.API.config.Cookie.Key+"-"+trustedDeviceCookieName {
+			return signUpResp, c
+		}
+	}
+	require.Fail(ts.T(), "trusted device cookie not set")
+	return signUpResp, nil
+}
+
+// signInWithDevice signs in with the password, presenting the trusted device
+// cookie if it is set
+func signInWithDevice(ts *MFATestSuite, email, password string, cookie *http.Cookie) *AccessTokenResponse {
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"email":    email,
+		"password": password,
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=password", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	data := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(data))
+	return data
+}
+
+func (ts *MFATestSuite) TestAALClaim() {
+	signUpResp := signUp(ts, ts.TestEmail, ts.TestPassword)
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/factors", nil)
+	ctx, err := ts.API.parseJWTClaims(signUpResp.Token, req)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.AAL1.String(), getClaims(ctx).AuthenticatorAssuranceLevel)
+
+	resp := performEnrollAndVerify(ts, signUpResp.Token, true /* <- requireStatusOK */)
+	verifyResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(resp.Body).Decode(verifyResp))
+
+	ctx, err = ts.API.parseJWTClaims(verifyResp.Token, req)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), models.AAL2.String(), getClaims(ctx).AuthenticatorAssuranceLevel)
+}
+
+func (ts *MFATestSuite) TestAMRClaim() {
+	ts.Config.Security.RefreshTokenRotationEnabled = true
+	resp := performTestSignupAndVerify(ts, ts.TestEmail, ts.TestPassword, true /* <- requireStatusOK */)
+	verifyResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(resp.Body).Decode(verifyResp))
+
+	amrMethods := func(token string) []string {
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/factors", nil)
+		ctx, err := ts.API.parseJWTClaims(token, req)
+		require.NoError(ts.T(), err)
+
+		methods := []string{}
+		for _, entry := range getClaims(ctx).AuthenticationMethodReference {
+			require.NotZero(ts.T(), entry.Timestamp)
+			methods = append(methods, entry.Method)
+		}
+		return methods
+	}
+
+	expected := []string{models.PasswordGrant.String(), models.TOTPSignIn.String()}
+	require.ElementsMatch(ts.T(), expected, amrMethods(verifyResp.Token))
+
+	// the methods are stored on the session so a refreshed token keeps them
+	var buffer bytes.Buffer
+	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
+		"refresh_token": verifyResp.RefreshToken,
+	}))
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/token?grant_type=refresh_token", &buffer)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ts.API.handler.ServeHTTP(w, req)
+	require.Equal(ts.T(), http.StatusOK, w.Code)
+
+	refreshResp := &AccessTokenResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(refreshResp))
+	require.ElementsMatch(ts.T(), expected, amrMethods(refreshResp.Token))
+}
+
 func signUp(ts *MFATestSuite, email, password string) (signUpResp AccessTokenResponse) {
 	ts.API.config.Mailer.Autoconfirm = true
 	var buffer bytes.Buffer
@@ -496,7 +3889,7 @@ func performVerifyFlow(ts *MFATestSuite, challengeID, factorID uuid.UUID, token
 		totpSecret = string(secret)
 	}
 
-	code, err := totp.GenerateCode(totpSecret, time.Now().UTC())
+	code, err := totp.GenerateCodeCustom(totpSecret, time.Now().UTC(), totpValidateOpts(factor, 0))
 	require.NoError(ts.T(), err)
 
 	require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]interface{}{
@@ -512,6 +3905,23 @@ func performVerifyFlow(ts *MFATestSuite, challengeID, factorID uuid.UUID, token
 	return y
 }
 
+// currentTOTPCode returns the code of the TOTP factor for the current time
+func currentTOTPCode(ts *MFATestSuite, factorID uuid.UUID) string {
+	factor, err := models.FindFactorByFactorID(ts.API.db, factorID)
+	require.NoError(ts.T(), err)
+
+	secret := factor.Secret
+	if es := crypto.ParseEncryptedString(factor.Secret); es != nil {
+		decrypted, err := es.Decrypt(factor.ID.String(), ts.API.config.Security.DBEncryption.DecryptionKeys)
+		require.NoError(ts.T(), err)
+		secret = string(decrypted)
+	}
+
+	code, err := totp.GenerateCodeCustom(secret, time.Now().UTC(), totpValidateOpts(factor, 0))
+	require.NoError(ts.T(), err)
+	return code
+}
+
 func performChallengeFlow(ts *MFATestSuite, factorID uuid.UUID, token string) *httptest.ResponseRecorder {
 	var buffer bytes.Buffer
 	w := ServeAuthenticatedRequest(ts, http.MethodPost, fmt.Sprintf("http://localhost/factors/%s/challenge", factorID), token, buffer)
@@ -673,7 +4083,7 @@ func cleanupHook(ts *MFATestSuite, hookName string) {
 // FindFactorsByUser returns all factors belonging to a user ordered by timestamp. Don't use this outside of tests.
 func FindFactorsByUser(tx *storage.Connection, user *models.User) ([]*models.Factor, error) {
 	factors := []*models.Factor{}
-	if err := tx.Q().Where("user_id = ?", user.ID).Order("created_at asc").All(&factors); err != nil {
+	if err := tx.Q().Where("user_id = ? and deleted_at is null", user.ID).Order("created_at asc").All(&factors); err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
 			return factors, nil
 		}
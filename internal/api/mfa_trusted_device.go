@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// trustedDeviceCookieName is appended to the cookie key to name the cookie
+// holding the trusted device token
+const trustedDeviceCookieName = "mfa-device"
+
+// issueTrustedDevice records the device the request was made from as trusted
+// and returns it along with its token. The token is only handed to the client
+// by setTrustedDeviceCookie once the transaction is committed.
+func (a *API) issueTrustedDevice(r *http.Request, tx *storage.Connection, user *models.User, factor *models.Factor) (*models.TrustedDevice, string, error) {
+	config := a.config
+
+	device, token := models.NewTrustedDevice(user, factor, r.UserAgent(), config.MFA.TrustedDeviceDuration)
+	if err := tx.Create(device); err != nil {
+		return nil, "", internalServerError("Database error creating trusted device").WithInternalError(err)
+	}
+	return device, token, nil
+}
+
+// setTrustedDeviceCookie sets the cookie that lets the trusted device skip
+// the MFA challenge on later sign ins
+func (a *API) setTrustedDeviceCookie(w http.ResponseWriter, device *models.TrustedDevice, token string) {
+	config := a.config
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.Cookie.Key + "-" + trustedDeviceCookieName,
+		Value:    token,
+		Expires:  device.ExpiresAt,
+		MaxAge:   int(config.MFA.TrustedDeviceDuration.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		Path:     "/",
+		Domain:   config.Cookie.Domain,
+	})
+}
+
+// findTrustedDevice returns the trusted device of the user the request was
+// made from, or nil when the request carries no valid trusted device token
+func (a *API) findTrustedDevice(r *http.Request, conn *storage.Connection, user *models.User) (*models.TrustedDevice, error) {
+	config := a.config
+	if config.MFA.TrustedDeviceDuration <= 0 {
+		return nil, nil
+	}
+
+	cookie, err := r.Cookie(config.Cookie.Key + "-" + trustedDeviceCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+
+	device, err := models.FindTrustedDeviceByToken(conn, user.ID, cookie.Value)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			// the device was revoked or the token is not the user's
+			return nil, nil
+		}
+		return nil, internalServerError("Database error finding trusted device").WithInternalError(err)
+	}
+	if device.Version != user.TrustedDeviceVersion {
+		// all of the user's trusted devices were revoked
+		return nil, nil
+	}
+	if device.IsExpired(a.Now()) {
+		return nil, nil
+	}
+	return device, nil
+}
+
+// trustSessionDevice upgrades a new session to AAL2 in place of the MFA
+// challenge its trusted device skipped
+func (a *API) trustSessionDevice(tx *storage.Connection, sessionID uuid.UUID) error {
+	if err := models.AddClaimToSession(tx, sessionID, models.TrustedDeviceSignIn); err != nil {
+		return err
+	}
+	session, err := models.FindSessionByID(tx, sessionID, false)
+	if err != nil {
+		return err
+	}
+	return session.UpdateAALAndAssociatedFactor(tx, models.AAL2, nil)
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/supabase/auth/internal/metering"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// VerificationTokenResponse is returned by VerifyFactor in place of a session
+// when a verification token was requested
+type VerificationTokenResponse struct {
+	VerificationToken string `json:"verification_token"`
+	ExpiresIn         int    `json:"expires_in"`
+	ExpiresAt         int64  `json:"expires_at"`
+}
+
+// MFAVerificationTokenGrantParams are the parameters the
+// MFAVerificationTokenGrant method accepts
+type MFAVerificationTokenGrantParams struct {
+	VerificationToken string `json:"verification_token"`
+}
+
+// issueVerificationToken stores a single use token that upgrades the session
+// with the verified factor when it is exchanged
+func (a *API) issueVerificationToken(tx *storage.Connection, user *models.User, session *models.Session, factor *models.Factor) (*VerificationTokenResponse, error) {
+	ttl := a.config.MFA.VerificationTokenExpiry
+	record, token := models.NewMFAVerificationToken(user, session, factor, ttl)
+	if err := tx.Create(record); err != nil {
+		return nil, internalServerError("Database error creating verification token").WithInternalError(err)
+	}
+	return &VerificationTokenResponse{
+		VerificationToken: token,
+		ExpiresIn:         int(ttl / time.Second),
+		ExpiresAt:         record.ExpiresAt.Unix(),
+	}, nil
+}
+
+// MFAVerificationTokenGrant exchanges a verification token returned by
+// VerifyFactor for the tokens of the session upgraded by the verification
+func (a *API) MFAVerificationTokenGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	db := a.db.WithContext(ctx)
+	config := a.config
+
+	params := &MFAVerificationTokenGrantParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+	if params.VerificationToken == "" {
+		return oauthError("invalid_request", "verification_token is required")
+	}
+
+	var user *models.User
+	var token *AccessTokenResponse
+	err := db.Transaction(func(tx *storage.Connection) error {
+		verificationToken, terr := models.ConsumeMFAVerificationToken(tx, params.VerificationToken)
+		if models.IsNotFoundError(terr) {
+			return oauthError("invalid_grant", "Invalid verification token: not found or already used")
+		} else if terr != nil {
+			return terr
+		}
+		if verificationToken.IsExpired(a.Now()) {
+			return oauthError("invalid_grant", "Invalid verification token: expired")
+		}
+
+		user, terr = models.FindUserByID(tx, verificationToken.UserID)
+		if terr != nil {
+			return terr
+		}
+		factor, terr := models.FindFactorByFactorID(tx, verificationToken.FactorID)
+		if models.IsNotFoundError(terr) {
+			return oauthError("invalid_grant", "Invalid verification token: factor was deleted")
+		} else if terr != nil {
+			return terr
+		}
+
+		token, terr = a.upgradeMFASession(r, tx, user, verificationToken.SessionID, factor.AuthenticationMethod(), models.GrantParams{
+			FactorID: &factor.ID,
+		})
+		if terr != nil {
+			return terr
+		}
+		if terr = a.setCookieTokens(config, token, false, w); terr != nil {
+			return internalServerError("Failed to set JWT cookie. %s", terr)
+		}
+		if terr = models.InvalidateSessionsWithAALLessThan(tx, user.ID, models.AAL2.String()); terr != nil {
+			return internalServerError("Failed to update sessions. %s", terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	metering.RecordLogin(string(models.MFACodeLoginAction), user.ID)
+	return sendJSON(w, http.StatusOK, token)
+}
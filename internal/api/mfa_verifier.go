@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+	"github.com/supabase/auth/internal/utilities"
+)
+
+// FactorVerifier implements the parts of challenging and verifying a factor
+// that depend on its type. Supporting a new factor type means registering a
+// verifier for it in factorVerifiers.
+type FactorVerifier interface {
+	// Challenge sets up the factor type specific parts of a new challenge,
+	// such as sending a code, before it is saved
+	Challenge(ctx context.Context, factor *models.Factor, challenge *models.Challenge) error
+
+	// Verify checks the client's response to the challenge. Returned errors
+	// reject the request as is, without counting as a failed attempt.
+	Verify(ctx context.Context, factor *models.Factor, challenge *models.Challenge, params *VerifyFactorParams) (*FactorVerification, error)
+}
+
+// FactorVerification is the outcome of checking a response to a challenge
+type FactorVerification struct {
+	Valid bool
+
+	// Message is returned to the client when the response is invalid, and
+	// Err holds the reason
+	Message string
+	Err     error
+
+	// Pending is set when the response was valid but another one is
+	// required before the factor is verified
+	Pending bool
+
+	// Save, if set, persists the factor type specific state of a valid
+	// response. It is called in the transaction that verifies the challenge,
+	// or on its own for pending verifications.
+	Save func(tx *storage.Connection) error
+}
+
+// factorVerifiers builds the verifier of each supported factor type
+var factorVerifiers = map[string]func(a *API, db *storage.Connection) FactorVerifier{
+	models.TOTP: func(a *API, db *storage.Connection) FactorVerifier {
+		return &TOTPVerifier{api: a, db: db}
+	},
+	models.SMS: func(a *API, db *storage.Connection) FactorVerifier {
+		return &SMSVerifier{api: a}
+	},
+	models.WebAuthn: func(a *API, db *storage.Connection) FactorVerifier {
+		return &WebAuthnVerifier{api: a}
+	},
+}
+
+// factorVerifier returns the verifier registered for the factor's type
+func (a *API) factorVerifier(db *storage.Connection, factor *models.Factor) (FactorVerifier, error) {
+	newVerifier, ok := factorVerifiers[factor.FactorType]
+	if !ok {
+		return nil, unprocessableEntityError(ErrorCodeMFAUnsupportedFactorType, "Unsupported factor type %q", factor.FactorType)
+	}
+	return newVerifier(a, db), nil
+}
+
+// TOTPVerifier verifies codes of time-based one-time password factors
+type TOTPVerifier struct {
+	api *API
+	db  *storage.Connection
+}
+
+func (v *TOTPVerifier) Challenge(ctx context.Context, factor *models.Factor, challenge *models.Challenge) error {
+	return nil
+}
+
+func (v *TOTPVerifier) Verify(ctx context.Context, factor *models.Factor, challenge *models.Challenge, params *VerifyFactorParams) (*FactorVerification, error) {
+	config := v.api.config
+
+	secret, shouldReEncrypt, err := factor.GetSecret(config.Security.DBEncryption.DecryptionKeys, config.Security.DBEncryption.Encrypt, config.Security.DBEncryption.EncryptionKeyID)
+	if err != nil {
+		return nil, internalServerError("Database error verifying MFA TOTP secret").WithInternalError(err)
+	}
+	if shouldReEncrypt && config.Security.DBEncryption.Encrypt {
+		if err := factor.SetSecret(secret, true, config.Security.DBEncryption.EncryptionKeyID, config.Security.DBEncryption.EncryptionKey); err != nil {
+			return nil, err
+		}
+		if err := v.db.UpdateOnly(factor, "secret"); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	opts := totpValidateOpts(factor, config.MFA.TOTPSkew)
+	valid, verr := totp.ValidateCustom(params.Code, secret, now, opts)
+	if !valid {
+		return &FactorVerification{Message: "Invalid TOTP code entered", Err: verr}, nil
+	}
+
+	totpStep, _ := matchTOTPStep(params.Code, secret, now, opts)
+	if factor.LastTOTPStep != nil && totpStep <= *factor.LastTOTPStep {
+		return nil, httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "TOTP code has already been used")
+	}
+	if challenge.ForceReauth && totpStep < challenge.CreatedAt.Unix()/int64(opts.Period) {
+		return nil, httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "TOTP code was generated before the challenge was created")
+	}
+	if challenge.FirstTOTPStep != nil && totpStep != *challenge.FirstTOTPStep+1 {
+		return nil, httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "TOTP code must be from the time step following the first code")
+	}
+
+	if config.MFA.RequireDoubleVerifyOnEnroll && !factor.IsVerified() && challenge.FirstTOTPStep == nil {
+		// a new factor is only verified once a code from the next time step
+		// is submitted against the same challenge, proving the clocks agree
+		return &FactorVerification{
+			Valid:   true,
+			Pending: true,
+			Save: func(tx *storage.Connection) error {
+				return challenge.RecordFirstTOTPStep(tx, totpStep)
+			},
+		}, nil
+	}
+
+	return &FactorVerification{
+		Valid: true,
+		Save: func(tx *storage.Connection) error {
+			if err := factor.UpdateLastTOTPStep(tx, totpStep, totpSkew(totpStep, now, opts)); err != nil {
+				if _, ok := err.(models.TOTPStepAlreadyUsedError); ok {
+					return httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "TOTP code has already been used")
+				}
+				return err
+			}
+			return nil
+		},
+	}, nil
+}
+
+// SMSVerifier sends and verifies codes of phone factors
+type SMSVerifier struct {
+	api *API
+}
+
+func (v *SMSVerifier) Challenge(ctx context.Context, factor *models.Factor, challenge *models.Challenge) error {
+	return v.api.sendSMSChallenge(factor, challenge)
+}
+
+func (v *SMSVerifier) Verify(ctx context.Context, factor *models.Factor, challenge *models.Challenge, params *VerifyFactorParams) (*FactorVerification, error) {
+	if err := verifySMSCode(factor, challenge, params.Code); err != nil {
+		return &FactorVerification{Message: "Invalid SMS code entered", Err: err}, nil
+	}
+	return &FactorVerification{Valid: true}, nil
+}
+
+// WebAuthnVerifier verifies authenticator responses of webauthn factors
+type WebAuthnVerifier struct {
+	api *API
+}
+
+func (v *WebAuthnVerifier) Challenge(ctx context.Context, factor *models.Factor, challenge *models.Challenge) error {
+	webAuthnChallenge, err := generateWebAuthnChallenge()
+	if err != nil {
+		return internalServerError("Error generating WebAuthn challenge").WithInternalError(err)
+	}
+	challenge.WebAuthnChallenge = &webAuthnChallenge
+	return nil
+}
+
+func (v *WebAuthnVerifier) Verify(ctx context.Context, factor *models.Factor, challenge *models.Challenge, params *VerifyFactorParams) (*FactorVerification, error) {
+	credentialID, credentialPublicKey, signCount, err := v.api.verifyWebAuthnResponse(factor, challenge, params.WebAuthn)
+	if err != nil {
+		return &FactorVerification{Message: "Invalid WebAuthn response", Err: err}, nil
+	}
+	return &FactorVerification{
+		Valid: true,
+		Save: func(tx *storage.Connection) error {
+			// the credential is registered by the verification of a newly
+			// enrolled factor, later verifications only advance its counter
+			if factor.IsVerified() {
+				if err := factor.UpdateWebAuthnSignCount(tx, signCount); err != nil {
+					if _, ok := err.(models.WebAuthnSignCountError); ok {
+						return httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "WebAuthn signature counter did not increase")
+					}
+					return err
+				}
+				return nil
+			}
+			if err := factor.UpdateWebAuthnCredential(tx, credentialID, credentialPublicKey, signCount); err != nil {
+				pgErr := utilities.NewPostgresError(err)
+				if pgErr.IsUniqueConstraintViolated() {
+					return unprocessableEntityError(ErrorCodeMFAVerificationFailed, "WebAuthn credential is already registered")
+				}
+				return err
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/supabase/auth/internal/metering"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/storage"
+	"github.com/supabase/auth/internal/utilities"
+)
+
+type VerifyAnyFactorParams struct {
+	Code string `json:"code"`
+}
+
+// verifyAnyCandidate is a factor the code of a VerifyAnyFactor request is
+// checked against, together with the open challenge it is verified with
+type verifyAnyCandidate struct {
+	factor    *models.Factor
+	challenge *models.Challenge
+}
+
+// VerifyAnyFactor checks a TOTP code against all of the user's verified TOTP
+// factors, for clients that do not know which factor a code belongs to. Only
+// factors that are not locked and have an open challenge, which passes the
+// same checks as in VerifyFactor, are considered. A match verifies the
+// challenge and upgrades the session to AAL2 as if the factor had been
+// verified.
+func (a *API) VerifyAnyFactor(w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	ctx := r.Context()
+	user := getUser(ctx)
+	session := getSession(ctx)
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	if session == nil || user == nil {
+		return internalServerError("A valid session and a registered user are required to verify a factor")
+	}
+
+	params := &VerifyAnyFactorParams{}
+	if err := retrieveRequestParams(r, params); err != nil {
+		return err
+	}
+	if params.Code == "" {
+		return badRequestError(ErrorCodeValidationFailed, "code is required")
+	}
+
+	factors, err := models.FindFactorsByUserID(db, user.ID, models.FactorFilter{
+		Status:     models.FactorStateVerified.String(),
+		FactorType: models.TOTP,
+	}, nil)
+	if err != nil {
+		return internalServerError("Database error finding factors").WithInternalError(err)
+	}
+
+	candidates, err := a.verifyAnyCandidates(r, db, factors)
+	if err != nil {
+		return err
+	}
+
+	// every candidate is checked, without stopping at a match, so that timing
+	// reveals neither how many factors the user has nor which one matched
+	now := time.Now().UTC()
+	var matched *verifyAnyCandidate
+	var matchedStep int64
+	for _, candidate := range candidates {
+		factor := candidate.factor
+		secret, _, err := factor.GetSecret(config.Security.DBEncryption.DecryptionKeys, config.Security.DBEncryption.Encrypt, config.Security.DBEncryption.EncryptionKeyID)
+		if err != nil {
+			return internalServerError("Database error verifying MFA TOTP secret").WithInternalError(err)
+		}
+		opts := totpValidateOpts(factor, config.MFA.TOTPSkew)
+		step, ok := matchTOTPStep(params.Code, secret, now, opts)
+		replayed := factor.LastTOTPStep != nil && step <= *factor.LastTOTPStep
+		stale := candidate.challenge.ForceReauth && step < candidate.challenge.CreatedAt.Unix()/int64(opts.Period)
+		if ok && !replayed && !stale && matched == nil {
+			matched = candidate
+			matchedStep = step
+		}
+	}
+
+	if matched == nil {
+		// count the failure against every candidate, as the code was tried
+		// against all of them
+		var locked []*models.Factor
+		err := db.Transaction(func(tx *storage.Connection) error {
+			for _, candidate := range candidates {
+				newlyLocked, terr := candidate.factor.RecordFailedAttempt(tx, config.MFA.MaxVerifyAttempts, config.MFA.VerifyAttemptWindow, config.MFA.LockoutBackoffBase, config.MFA.LockoutBackoffCap)
+				if terr != nil {
+					return internalServerError("Database error recording failed verification attempt").WithInternalError(terr)
+				}
+				if newlyLocked {
+					locked = append(locked, candidate.factor)
+				}
+			}
+			return models.NewAuditLogEntry(r, tx, user, models.VerifyFactorAction, r.RemoteAddr, map[string]interface{}{
+				"factor_type": models.TOTP,
+				"outcome":     models.AuditOutcomeFailure,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, factor := range locked {
+			a.notifyFactorLocked(r, user, factor)
+		}
+		recordMFAVerify(ctx, models.TOTP, false, start)
+		if len(locked) == len(candidates) {
+			return allFactorsLockedError(locked)
+		}
+		return unprocessableEntityError(ErrorCodeMFAVerificationFailed, "Invalid TOTP code entered")
+	}
+
+	if err := a.runMFAVerificationAttemptHook(r, db, user, matched.factor, true); err != nil {
+		return err
+	}
+
+	factor, challenge := matched.factor, matched.challenge
+	var token *AccessTokenResponse
+	err = db.Transaction(func(tx *storage.Connection) error {
+		var terr error
+		if terr = models.NewAuditLogEntry(r, tx, user, models.FactorVerifiedAction, r.RemoteAddr, map[string]interface{}{
+			"factor_id":    factor.ID,
+			"factor_type":  factor.FactorType,
+			"challenge_id": challenge.ID,
+			"outcome":      models.AuditOutcomeSuccess,
+		}); terr != nil {
+			return terr
+		}
+		if terr = challenge.Verify(tx); terr != nil {
+			if _, ok := terr.(models.ChallengeAlreadyVerifiedError); ok {
+				return httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "MFA challenge %v has already been verified", challenge.ID)
+			}
+			return terr
+		}
+		// older challenges of the factor can no longer be verified
+		if terr = models.DeleteOpenChallengesByFactorID(tx, factor.ID); terr != nil {
+			return terr
+		}
+		if terr = factor.UpdateLastUsedAt(tx); terr != nil {
+			return terr
+		}
+		if terr = factor.UpdateLastTOTPStep(tx, matchedStep, totpSkew(matchedStep, now, totpValidateOpts(factor, config.MFA.TOTPSkew))); terr != nil {
+			if _, ok := terr.(models.TOTPStepAlreadyUsedError); ok {
+				return httpError(http.StatusUnauthorized, ErrorCodeMFAVerificationFailed, "TOTP code has already been used")
+			}
+			return terr
+		}
+		if factor.FailedAttempts > 0 {
+			if terr = factor.ResetFailedAttempts(tx); terr != nil {
+				return terr
+			}
+		}
+		user, terr = models.FindUserByID(tx, user.ID)
+		if terr != nil {
+			return terr
+		}
+		token, terr = a.updateMFASessionAndClaims(r, tx, user, factor.AuthenticationMethod(), models.GrantParams{
+			FactorID: &factor.ID,
+		})
+		if terr != nil {
+			return terr
+		}
+		if terr = a.setCookieTokens(config, token, false, w); terr != nil {
+			return internalServerError("Failed to set JWT cookie. %s", terr)
+		}
+		if terr = models.InvalidateSessionsWithAALLessThan(tx, user.ID, models.AAL2.String()); terr != nil {
+			return internalServerError("Failed to update sessions. %s", terr)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	recordMFAVerify(ctx, models.TOTP, true, start)
+	metering.RecordLogin(string(models.MFACodeLoginAction), user.ID)
+
+	return sendJSON(w, http.StatusOK, token)
+}
+
+// verifyAnyCandidates returns the factors a VerifyAnyFactor code is checked
+// against with their latest open challenge. Locked factors and factors
+// without a challenge that passes the checks of VerifyFactor are skipped. If
+// every factor is locked an error with the earliest unlock time is returned.
+func (a *API) verifyAnyCandidates(r *http.Request, db *storage.Connection, factors []*models.Factor) ([]*verifyAnyCandidate, error) {
+	config := a.config
+	currentIP := utilities.GetIPAddress(r)
+
+	var candidates []*verifyAnyCandidate
+	var locked []*models.Factor
+	for _, factor := range factors {
+		if factor.IsLocked() {
+			locked = append(locked, factor)
+			continue
+		}
+		challenge, err := models.FindLatestOpenChallengeByFactorID(db, factor.ID)
+		if err != nil {
+			if models.IsNotFoundError(err) {
+				continue
+			}
+			return nil, internalServerError("Database error finding Challenge").WithInternalError(err)
+		}
+		if challenge.IsStepUp() || challenge.IPAddress != currentIP {
+			continue
+		}
+		if config.MFA.BindChallengeToClient && !challenge.IsBoundToClient(r.UserAgent()) {
+			continue
+		}
+		if challenge.HasExpired(config.MFA.ChallengeExpiryDuration) {
+			continue
+		}
+		candidates = append(candidates, &verifyAnyCandidate{factor: factor, challenge: challenge})
+	}
+
+	if len(factors) > 0 && len(locked) == len(factors) {
+		return nil, allFactorsLockedError(locked)
+	}
+	if len(candidates) == 0 {
+		return nil, unprocessableEntityError(ErrorCodeMFAChallengeExpired, "No open MFA challenge found, create a challenge for the factor before verifying")
+	}
+	return candidates, nil
+}
+
+// allFactorsLockedError returns the error for a request whose factors are all
+// locked, telling the client to retry once the first of them is unlocked
+func allFactorsLockedError(factors []*models.Factor) *MFAVerificationError {
+	var lockedUntil *time.Time
+	for _, factor := range factors {
+		if factor.LockedUntil != nil && (lockedUntil == nil || factor.LockedUntil.Before(*lockedUntil)) {
+			lockedUntil = factor.LockedUntil
+		}
+	}
+	return &MFAVerificationError{
+		HTTPError:   tooManyRequestsError(ErrorCodeMFAFactorLocked, "Too many failed verification attempts, try again later"),
+		LockedUntil: lockedUntil,
+	}
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/models"
+)
+
+const webAuthnChallengeLength = 32
+
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PublicKeyCredentialCreationOptions is passed to navigator.credentials.create()
+// in the browser. Binary fields are base64url encoded.
+type PublicKeyCredentialCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// PublicKeyCredentialRequestOptions is passed to navigator.credentials.get()
+// in the browser. Binary fields are base64url encoded.
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type WebAuthnObject struct {
+	ChallengeID               uuid.UUID                           `json:"challenge_id"`
+	CredentialCreationOptions *PublicKeyCredentialCreationOptions `json:"credential_creation_options,omitempty"`
+	CredentialRequestOptions  *PublicKeyCredentialRequestOptions  `json:"credential_request_options,omitempty"`
+}
+
+// WebAuthnVerifyParams carries the authenticator response. Registration
+// responses set AttestationObject, assertion responses set AuthenticatorData
+// and Signature. All fields are base64url encoded.
+type WebAuthnVerifyParams struct {
+	CredentialID      string `json:"credential_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AttestationObject string `json:"attestation_object"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+}
+
+func generateWebAuthnChallenge() (string, error) {
+	b := make([]byte, webAuthnChallengeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeWebAuthnBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// newWebAuthnObject builds the options the browser needs to respond to the
+// challenge: creation options while the factor is still unverified and
+// request options once a credential has been registered.
+func (a *API) newWebAuthnObject(user *models.User, factor *models.Factor, challenge *models.Challenge) *WebAuthnObject {
+	config := a.config
+	timeout := int64(config.MFA.ChallengeExpiryDuration * 1000)
+
+	var credentials []WebAuthnCredentialDescriptor
+	for _, f := range user.Factors {
+		if f.FactorType == models.WebAuthn && f.WebAuthnCredentialID != nil {
+			credentials = append(credentials, WebAuthnCredentialDescriptor{
+				Type: "public-key",
+				ID:   *f.WebAuthnCredentialID,
+			})
+		}
+	}
+
+	object := &WebAuthnObject{
+		ChallengeID: challenge.ID,
+	}
+
+	if factor.IsVerified() {
+		allow := []WebAuthnCredentialDescriptor{}
+		if factor.WebAuthnCredentialID != nil {
+			allow = append(allow, WebAuthnCredentialDescriptor{
+				Type: "public-key",
+				ID:   *factor.WebAuthnCredentialID,
+			})
+		}
+		object.CredentialRequestOptions = &PublicKeyCredentialRequestOptions{
+			Challenge:        *challenge.WebAuthnChallenge,
+			Timeout:          timeout,
+			RPID:             config.MFA.WebAuthn.RPID,
+			AllowCredentials: allow,
+			UserVerification: "preferred",
+		}
+		return object
+	}
+
+	name := user.GetEmail()
+	if name == "" {
+		name = user.GetPhone()
+	}
+	if credentials == nil {
+		credentials = []WebAuthnCredentialDescriptor{}
+	}
+
+	object.CredentialCreationOptions = &PublicKeyCredentialCreationOptions{
+		Challenge: *challenge.WebAuthnChallenge,
+		RP: WebAuthnRelyingParty{
+			ID:   config.MFA.WebAuthn.RPID,
+			Name: config.MFA.WebAuthn.RPDisplayName,
+		},
+		User: WebAuthnUserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(user.ID.Bytes()),
+			Name:        name,
+			DisplayName: name,
+		},
+		PubKeyCredParams: []WebAuthnCredentialParameter{
+			{Type: "public-key", Alg: crypto.COSEAlgorithmES256},
+			{Type: "public-key", Alg: crypto.COSEAlgorithmEdDSA},
+			{Type: "public-key", Alg: crypto.COSEAlgorithmRS256},
+		},
+		Timeout:            timeout,
+		ExcludeCredentials: credentials,
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:      "discouraged",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}
+	return object
+}
+
+// verifyWebAuthnResponse validates a registration response for unverified
+// factors or an assertion for verified factors. On success the base64url
+// encoded credential ID and COSE public key are returned together with the
+// signature counter reported by the authenticator.
+func (a *API) verifyWebAuthnResponse(factor *models.Factor, challenge *models.Challenge, params *WebAuthnVerifyParams) (string, string, uint32, error) {
+	config := a.config
+
+	if params == nil {
+		return "", "", 0, errors.New("webauthn response is required")
+	}
+	if challenge.WebAuthnChallenge == nil {
+		return "", "", 0, errors.New("challenge was not issued for a webauthn factor")
+	}
+
+	clientDataJSON, err := decodeWebAuthnBase64(params.ClientDataJSON)
+	if err != nil {
+		return "", "", 0, errors.Wrap(err, "invalid client_data_json")
+	}
+	clientData, err := crypto.ParseWebAuthnClientData(clientDataJSON)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	expectedType := "webauthn.get"
+	if !factor.IsVerified() {
+		expectedType = "webauthn.create"
+	}
+	if clientData.Type != expectedType {
+		return "", "", 0, errors.Errorf("unexpected client data type %q", clientData.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(*challenge.WebAuthnChallenge)) != 1 {
+		return "", "", 0, errors.New("challenge mismatch")
+	}
+
+	originAllowed := false
+	for _, origin := range config.MFA.WebAuthn.RPOrigins {
+		if clientData.Origin == origin {
+			originAllowed = true
+			break
+		}
+	}
+	if !originAllowed {
+		return "", "", 0, errors.Errorf("origin %q is not allowed", clientData.Origin)
+	}
+
+	var authData *crypto.WebAuthnAuthenticatorData
+	var rawAuthData []byte
+	if factor.IsVerified() {
+		rawAuthData, err = decodeWebAuthnBase64(params.AuthenticatorData)
+		if err != nil {
+			return "", "", 0, errors.Wrap(err, "invalid authenticator_data")
+		}
+		authData, err = crypto.ParseWebAuthnAuthenticatorData(rawAuthData)
+	} else {
+		attestationObject, derr := decodeWebAuthnBase64(params.AttestationObject)
+		if derr != nil {
+			return "", "", 0, errors.Wrap(derr, "invalid attestation_object")
+		}
+		authData, err = crypto.ParseWebAuthnAttestationObject(attestationObject)
+	}
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(config.MFA.WebAuthn.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return "", "", 0, errors.New("relying party ID mismatch")
+	}
+	if !authData.HasFlag(crypto.WebAuthnFlagUserPresent) {
+		return "", "", 0, errors.New("user presence flag not set")
+	}
+
+	if !factor.IsVerified() {
+		if len(authData.CredentialID) == 0 || len(authData.CredentialPublicKey) == 0 {
+			return "", "", 0, errors.New("attested credential data is missing")
+		}
+		if _, _, err := crypto.ParseCOSEPublicKey(authData.CredentialPublicKey); err != nil {
+			return "", "", 0, err
+		}
+		return base64.RawURLEncoding.EncodeToString(authData.CredentialID), base64.RawURLEncoding.EncodeToString(authData.CredentialPublicKey), authData.SignCount, nil
+	}
+
+	if factor.WebAuthnCredentialID == nil || factor.WebAuthnPublicKey == nil {
+		return "", "", 0, errors.New("factor has no registered credential")
+	}
+	if params.CredentialID != "" && strings.TrimRight(params.CredentialID, "=") != *factor.WebAuthnCredentialID {
+		return "", "", 0, errors.New("credential does not belong to factor")
+	}
+
+	publicKey, err := decodeWebAuthnBase64(*factor.WebAuthnPublicKey)
+	if err != nil {
+		return "", "", 0, err
+	}
+	signature, err := decodeWebAuthnBase64(params.Signature)
+	if err != nil {
+		return "", "", 0, errors.Wrap(err, "invalid signature")
+	}
+	if err := crypto.VerifyWebAuthnSignature(publicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		return "", "", 0, err
+	}
+	if err := crypto.VerifyWebAuthnSignCount(uint32(factor.WebAuthnSignCount), authData.SignCount); err != nil {
+		return "", "", 0, err
+	}
+
+	return *factor.WebAuthnCredentialID, *factor.WebAuthnPublicKey, authData.SignCount, nil
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/supabase/auth/internal/conf"
+	"github.com/supabase/auth/internal/models"
+	"github.com/supabase/auth/internal/observability"
+)
+
+// MFA lifecycle events delivered to the webhook
+const (
+	MFAEventFactorEnrolled       = "factor.enrolled"
+	MFAEventFactorVerified       = "factor.verified"
+	MFAEventFactorDeleted        = "factor.deleted"
+	MFAEventRecoveryCodeConsumed = "recovery_code.consumed"
+)
+
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// webhookRetryBackoff is the delay before the first retry of a failed
+// delivery, it doubles with every further attempt
+var webhookRetryBackoff = HTTPHookBackoffDuration
+
+// MFAEventPayload is the JSON body posted to the webhook for MFA events
+type MFAEventPayload struct {
+	ID         uuid.UUID  `json:"id"`
+	Event      string     `json:"event"`
+	UserID     uuid.UUID  `json:"user_id"`
+	FactorID   *uuid.UUID `json:"factor_id,omitempty"`
+	FactorType string     `json:"factor_type,omitempty"`
+	Timestamp  int64      `json:"timestamp"`
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 over the timestamp
+// and the payload, joined by a dot.
+func signWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// triggerMFAEvent delivers an MFA event to the webhook in the background, if
+// MFA events are enabled. It must only be called once the change the event
+// describes has been committed.
+func (a *API) triggerMFAEvent(r *http.Request, event string, user *models.User, factor *models.Factor) {
+	config := a.config.Webhook
+	if !config.MFAEvents {
+		return
+	}
+
+	payload := &MFAEventPayload{
+		ID:        uuid.Must(uuid.NewV4()),
+		Event:     event,
+		UserID:    user.ID,
+		Timestamp: time.Now().Unix(),
+	}
+	if factor != nil {
+		payload.FactorID = &factor.ID
+		payload.FactorType = factor.FactorType
+	}
+
+	log := observability.GetLogEntry(r).Entry.WithFields(logrus.Fields{
+		"component": "mfa_webhook",
+		"event":     event,
+		"event_id":  payload.ID,
+	})
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.WithError(err).Error("failed to encode webhook payload")
+		return
+	}
+
+	cleanupWaitGroup.Add(1)
+	go func() {
+		defer cleanupWaitGroup.Done()
+
+		if err := deliverWebhook(context.Background(), config, body); err != nil {
+			log.WithError(err).Error("failed to deliver webhook")
+		}
+	}()
+}
+
+// deliverWebhook posts the payload to the webhook, retrying with an
+// exponential backoff up to the configured number of retries.
+func deliverWebhook(ctx context.Context, config conf.WebhookConfiguration, body []byte) error {
+	timeout := DefaultHTTPHookTimeout
+	if config.TimeoutSec > 0 {
+		timeout = time.Duration(config.TimeoutSec) * time.Second
+	}
+	client := http.Client{
+		Timeout: timeout,
+	}
+
+	backoff := webhookRetryBackoff
+	var err error
+	for attempt := 0; attempt <= config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if err = postWebhook(ctx, &client, config, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func postWebhook(ctx context.Context, client *http.Client, config conf.WebhookConfiguration, body []byte) error {
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, signWebhookPayload(config.Secret, timestamp, body))
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", rsp.StatusCode)
+	}
+	return nil
+}
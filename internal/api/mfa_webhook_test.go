@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/supabase/auth/internal/conf"
+	"github.com/supabase/auth/internal/models"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookServer(t *testing.T, failures int32) (*httptest.Server, chan receivedWebhook) {
+	received := make(chan receivedWebhook, 10)
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received <- receivedWebhook{header: r.Header, body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return server, received
+}
+
+func receiveWebhook(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	select {
+	case webhook := <-received:
+		return webhook
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "webhook was not delivered")
+	}
+	return receivedWebhook{}
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	defer func(backoff time.Duration) {
+		webhookRetryBackoff = backoff
+	}(webhookRetryBackoff)
+	webhookRetryBackoff = 10 * time.Millisecond
+
+	server, received := newWebhookServer(t, 2)
+	defer server.Close()
+
+	config := conf.WebhookConfiguration{
+		URL:     server.URL,
+		Secret:  "webhooksecret",
+		Retries: 2,
+	}
+	body := []byte(`{"event":"factor.enrolled"}`)
+	require.NoError(t, deliverWebhook(context.Background(), config, body))
+
+	webhook := receiveWebhook(t, received)
+	require.Equal(t, body, webhook.body)
+
+	failing, _ := newWebhookServer(t, 3)
+	defer failing.Close()
+	config.URL = failing.URL
+	require.Error(t, deliverWebhook(context.Background(), config, body))
+}
+
+func (ts *MFATestSuite) TestMFAEventWebhook() {
+	server, received := newWebhookServer(ts.T(), 0)
+	defer server.Close()
+
+	ts.API.config.Webhook = conf.WebhookConfiguration{
+		URL:       server.URL,
+		Secret:    "webhooksecret",
+		MFAEvents: true,
+	}
+	defer func() {
+		ts.API.config.Webhook = conf.WebhookConfiguration{}
+	}()
+
+	token := ts.generateAAL1Token(ts.TestUser, &ts.TestSession.ID)
+	w := performEnrollFlow(ts, token, "webhook_factor", models.TOTP, ts.TestDomain, http.StatusOK)
+	enrollResp := EnrollFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&enrollResp))
+
+	webhook := receiveWebhook(ts.T(), received)
+	require.Equal(ts.T(), "application/json", webhook.header.Get("Content-Type"))
+
+	timestamp, err := strconv.ParseInt(webhook.header.Get(WebhookTimestampHeader), 10, 64)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), signWebhookPayload("webhooksecret", timestamp, webhook.body), webhook.header.Get(WebhookSignatureHeader))
+	require.NotEqual(ts.T(), signWebhookPayload("othersecret", timestamp, webhook.body), webhook.header.Get(WebhookSignatureHeader))
+
+	var payload MFAEventPayload
+	require.NoError(ts.T(), json.Unmarshal(webhook.body, &payload))
+	require.Equal(ts.T(), MFAEventFactorEnrolled, payload.Event)
+	require.Equal(ts.T(), ts.TestUser.ID, payload.UserID)
+	require.NotNil(ts.T(), payload.FactorID)
+	require.Equal(ts.T(), enrollResp.ID, *payload.FactorID)
+	require.Equal(ts.T(), models.TOTP, payload.FactorType)
+	require.NotEmpty(ts.T(), payload.ID)
+
+	w = performChallengeFlow(ts, enrollResp.ID, token)
+	challengeResp := ChallengeFactorResponse{}
+	require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&challengeResp))
+	performVerifyFlow(ts, challengeResp.ID, enrollResp.ID, token, true)
+
+	webhook = receiveWebhook(ts.T(), received)
+	require.NoError(ts.T(), json.Unmarshal(webhook.body, &payload))
+	require.Equal(ts.T(), MFAEventFactorVerified, payload.Event)
+	require.Equal(ts.T(), enrollResp.ID, *payload.FactorID)
+}
@@ -70,6 +70,8 @@ func (a *API) limitHandler(lmt *limiter.Limiter) middlewareHandler {
 			} else {
 				err := tollbooth.LimitByKeys(lmt, []string{key})
 				if err != nil {
+					// the limiter refills one request every 1/max seconds
+					setRetryAfter(w, time.Duration(float64(time.Second)/lmt.GetMax()))
 					return c, tooManyRequestsError(ErrorCodeOverRequestRateLimit, "Request rate limit reached")
 				}
 			}
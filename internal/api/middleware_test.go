@@ -389,6 +389,8 @@ func (ts *MiddlewareTestSuite) TestLimitHandler() {
 	w := httptest.NewRecorder()
 	ts.API.limitHandler(lmt).handler(okHandler).ServeHTTP(w, req)
 	require.Equal(ts.T(), http.StatusTooManyRequests, w.Code)
+	// the limiter allows another request every 200ms
+	require.Equal(ts.T(), "1", w.Header().Get("Retry-After"))
 }
 
 func (ts *MiddlewareTestSuite) TestLimitHandlerWithSharedLimiter() {
@@ -29,10 +29,12 @@ type TestSmsProvider struct {
 	mock.Mock
 
 	SentMessages int
+	LastOTP      string
 }
 
 func (t *TestSmsProvider) SendMessage(phone, message, channel, otp string) (string, error) {
 	t.SentMessages += 1
+	t.LastOTP = otp
 	return "", nil
 }
 
@@ -34,6 +34,12 @@ type AccessTokenClaims struct {
 	AuthenticationMethodReference []models.AMREntry      `json:"amr,omitempty"`
 	SessionId                     string                 `json:"session_id,omitempty"`
 	IsAnonymous                   bool                   `json:"is_anonymous"`
+	// MFAVerifiedAt is when a factor was last verified in the session, in
+	// UNIX seconds
+	MFAVerifiedAt *int64 `json:"mfa_verified_at,omitempty"`
+	// Purpose is never set on access tokens. It marks other tokens signed
+	// with the JWT secret, which are refused as bearer tokens.
+	Purpose string `json:"purpose,omitempty"`
 }
 
 // AccessTokenResponse represents an OAuth2 success response
@@ -47,6 +53,12 @@ type AccessTokenResponse struct {
 	ProviderAccessToken  string             `json:"provider_token,omitempty"`
 	ProviderRefreshToken string             `json:"provider_refresh_token,omitempty"`
 	WeakPassword         *WeakPasswordError `json:"weak_password,omitempty"`
+
+	// MFARequired is set on password logins whose session has to be
+	// upgraded to AAL2 by verifying one of FactorIDs before it can be used
+	// outside of the MFA endpoints.
+	MFARequired bool        `json:"mfa_required,omitempty"`
+	FactorIDs   []uuid.UUID `json:"factor_ids,omitempty"`
 }
 
 // AsRedirectURL encodes the AccessTokenResponse as a redirect URL that
@@ -90,6 +102,8 @@ func (a *API) Token(w http.ResponseWriter, r *http.Request) error {
 		return a.IdTokenGrant(ctx, w, r)
 	case "pkce":
 		return a.PKCE(ctx, w, r)
+	case "mfa_verification_token":
+		return a.MFAVerificationTokenGrant(ctx, w, r)
 	default:
 		return oauthError("unsupported_grant_type", "")
 	}
@@ -208,12 +222,22 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 		return oauthError("invalid_grant", "Phone not confirmed")
 	}
 
+	trustedDevice, err := a.findTrustedDevice(r, db, user)
+	if err != nil {
+		return err
+	}
+	loginTraits := map[string]interface{}{
+		"provider": provider,
+	}
+	if trustedDevice != nil {
+		grantParams.TrustedDeviceID = &trustedDevice.ID
+		loginTraits["trusted_device_id"] = trustedDevice.ID
+	}
+
 	var token *AccessTokenResponse
 	err = db.Transaction(func(tx *storage.Connection) error {
 		var terr error
-		if terr = models.NewAuditLogEntry(r, tx, user, models.LoginAction, "", map[string]interface{}{
-			"provider": provider,
-		}); terr != nil {
+		if terr = models.NewAuditLogEntry(r, tx, user, models.LoginAction, "", loginTraits); terr != nil {
 			return terr
 		}
 		token, terr = a.issueRefreshToken(r, tx, user, models.PasswordGrant, grantParams)
@@ -231,6 +255,15 @@ func (a *API) ResourceOwnerPasswordGrant(ctx context.Context, w http.ResponseWri
 	}
 
 	token.WeakPassword = weakPasswordError
+	if trustedDevice == nil && (user.MFARequired || config.MFA.IsRequiredFor(user.Role, user.HasVerifiedFactor())) {
+		token.MFARequired = true
+		token.FactorIDs = []uuid.UUID{}
+		for _, factor := range user.Factors {
+			if factor.IsVerified() {
+				token.FactorIDs = append(token.FactorIDs, factor.ID)
+			}
+		}
+	}
 
 	metering.RecordLogin("password", user.ID)
 	return sendJSON(w, http.StatusOK, token)
@@ -344,6 +377,13 @@ func (a *API) generateAccessToken(r *http.Request, tx *storage.Connection, user
 		AuthenticationMethodReference: amr,
 		IsAnonymous:                   user.IsAnonymous,
 	}
+	// lets resource servers require a recent verification of their own
+	if verifiedAt := session.LastMFAVerifiedAt(); verifiedAt != nil {
+		if authenticationMethod != models.TokenRefresh || !config.MFA.ClearVerifiedAtOnRefresh {
+			ts := verifiedAt.Unix()
+			claims.MFAVerifiedAt = &ts
+		}
+	}
 
 	var token *jwt.Token
 	if config.Hook.CustomAccessToken.Enabled {
@@ -405,6 +445,11 @@ func (a *API) issueRefreshToken(r *http.Request, conn *storage.Connection, user
 		if terr != nil {
 			return terr
 		}
+		if grantParams.TrustedDeviceID != nil {
+			if terr = a.trustSessionDevice(tx, *refreshToken.SessionId); terr != nil {
+				return terr
+			}
+		}
 
 		tokenString, expiresAt, terr = a.generateAccessToken(r, tx, user, refreshToken.SessionId, authenticationMethod)
 		if terr != nil {
@@ -432,18 +477,23 @@ func (a *API) issueRefreshToken(r *http.Request, conn *storage.Connection, user
 }
 
 func (a *API) updateMFASessionAndClaims(r *http.Request, tx *storage.Connection, user *models.User, authenticationMethod models.AuthenticationMethod, grantParams models.GrantParams) (*AccessTokenResponse, error) {
-	ctx := r.Context()
-	config := a.config
-	var tokenString string
-	var expiresAt int64
-	var refreshToken *models.RefreshToken
-	currentClaims := getClaims(ctx)
+	currentClaims := getClaims(r.Context())
 	sessionId, err := uuid.FromString(currentClaims.SessionId)
 	if err != nil {
 		return nil, internalServerError("Cannot read SessionId claim as UUID").WithInternalError(err)
 	}
+	return a.upgradeMFASession(r, tx, user, sessionId, authenticationMethod, grantParams)
+}
+
+// upgradeMFASession adds the MFA claim to the session, rotates its refresh
+// token and issues an access token with the resulting AAL
+func (a *API) upgradeMFASession(r *http.Request, tx *storage.Connection, user *models.User, sessionId uuid.UUID, authenticationMethod models.AuthenticationMethod, grantParams models.GrantParams) (*AccessTokenResponse, error) {
+	config := a.config
+	var tokenString string
+	var expiresAt int64
+	var refreshToken *models.RefreshToken
 
-	err = tx.Transaction(func(tx *storage.Connection) error {
+	err := tx.Transaction(func(tx *storage.Connection) error {
 		if terr := models.AddClaimToSession(tx, sessionId, authenticationMethod); terr != nil {
 			return terr
 		}
@@ -472,7 +522,7 @@ func (a *API) updateMFASessionAndClaims(r *http.Request, tx *storage.Connection,
 			return err
 		}
 
-		tokenString, expiresAt, terr = a.generateAccessToken(r, tx, user, &session.ID, models.TOTPSignIn)
+		tokenString, expiresAt, terr = a.generateAccessToken(r, tx, user, &session.ID, authenticationMethod)
 		if terr != nil {
 			httpErr, ok := terr.(*HTTPError)
 			if ok {
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/gofrs/uuid"
 	"github.com/supabase/auth/internal/api/sms_provider"
 	"github.com/supabase/auth/internal/models"
@@ -72,7 +73,142 @@ func (a *API) UserGet(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	user := getUser(ctx)
-	return sendJSON(w, http.StatusOK, user)
+	return sendJSON(w, http.StatusOK, newUserResponse(user, claims))
+}
+
+// UserResponse is the user's profile with their MFA status, so clients can
+// show it without listing the factors
+type UserResponse struct {
+	*models.User
+	MFAEnabled bool   `json:"mfa_enabled"`
+	AAL        string `json:"aal,omitempty"`
+}
+
+func newUserResponse(user *models.User, claims *AccessTokenClaims) *UserResponse {
+	resp := &UserResponse{
+		User:       user,
+		MFAEnabled: user.HasVerifiedFactor(),
+	}
+	if claims != nil {
+		resp.AAL = claims.AuthenticatorAssuranceLevel
+	}
+	return resp
+}
+
+// UserSession describes one of the user's active sessions
+type UserSession struct {
+	ID         uuid.UUID `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	IP         *string   `json:"ip,omitempty"`
+	UserAgent  *string   `json:"user_agent,omitempty"`
+	AAL        string    `json:"aal"`
+	Current    bool      `json:"current"`
+}
+
+// UserSessionsResponse lists the user's active sessions
+type UserSessionsResponse struct {
+	Sessions []UserSession `json:"sessions"`
+}
+
+// UserSessions lists the user's active sessions together with the assurance
+// level each has reached, so that users can see which sessions completed MFA
+func (a *API) UserSessions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	currentSession := getSession(ctx)
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	sessions, err := models.FindAllSessionsForUser(db, user.ID, false)
+	if err != nil {
+		return internalServerError("Database error finding sessions").WithInternalError(err)
+	}
+
+	now := time.Now()
+	response := &UserSessionsResponse{
+		Sessions: []UserSession{},
+	}
+	for _, session := range sessions {
+		if session.CheckValidity(now, nil, config.Sessions.Timebox, config.Sessions.InactivityTimeout) != models.SessionValid {
+			continue
+		}
+		aal := session.GetAAL()
+		if aal == "" {
+			aal = models.AAL1.String()
+		}
+		response.Sessions = append(response.Sessions, UserSession{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastRefreshedAt(nil),
+			IP:         session.IP,
+			UserAgent:  session.UserAgent,
+			AAL:        aal,
+			Current:    currentSession != nil && currentSession.ID == session.ID,
+		})
+	}
+
+	return sendJSON(w, http.StatusOK, response)
+}
+
+// UserRevokeSession revokes one of the user's sessions together with its
+// refresh tokens
+func (a *API) UserRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user := getUser(ctx)
+	currentSession := getSession(ctx)
+	config := a.config
+	db := a.db.WithContext(ctx)
+
+	sessionID, err := uuid.FromString(chi.URLParam(r, "session_id"))
+	if err != nil {
+		return notFoundError(ErrorCodeValidationFailed, "session_id must be an UUID")
+	}
+
+	err = db.Transaction(func(tx *storage.Connection) error {
+		session, terr := models.FindSessionByID(tx, sessionID, false)
+		if terr != nil {
+			if models.IsNotFoundError(terr) {
+				return notFoundError(ErrorCodeSessionNotFound, "Session not found")
+			}
+			return internalServerError("Database error finding session").WithInternalError(terr)
+		}
+		// sessions of other users are reported as missing so that their ids
+		// cannot be probed
+		if session.UserID != user.ID {
+			return notFoundError(ErrorCodeSessionNotFound, "Session not found")
+		}
+		if terr := models.NewAuditLogEntry(r, tx, user, models.LogoutAction, r.RemoteAddr, map[string]interface{}{
+			"session_id": session.ID,
+		}); terr != nil {
+			return terr
+		}
+		// refresh tokens are deleted together with the session
+		return models.LogoutSession(tx, session.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if currentSession != nil && currentSession.ID == sessionID {
+		a.clearCookieTokens(config, w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// isPasswordRecovery reports whether the session was established through a
+// password recovery link
+func isPasswordRecovery(claims *AccessTokenClaims) bool {
+	if claims == nil {
+		return false
+	}
+	for _, entry := range claims.AuthenticationMethodReference {
+		if entry.Method == models.Recovery.String() {
+			return true
+		}
+	}
+	return false
 }
 
 // UserUpdate updates fields on a user
@@ -187,6 +323,14 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 				return internalServerError("Error during password storage").WithInternalError(terr)
 			}
 
+			// codes that leaked along with the forgotten password must not
+			// outlive its reset
+			if isPasswordRecovery(getClaims(ctx)) {
+				if terr = models.InvalidateRecoveryCodesByUser(tx, user); terr != nil {
+					return internalServerError("Error invalidating recovery codes").WithInternalError(terr)
+				}
+			}
+
 			if terr := models.NewAuditLogEntry(r, tx, user, models.UserUpdatePasswordAction, "", nil); terr != nil {
 				return terr
 			}
@@ -254,5 +398,5 @@ func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	return sendJSON(w, http.StatusOK, user)
+	return sendJSON(w, http.StatusOK, newUserResponse(user, getClaims(ctx)))
 }
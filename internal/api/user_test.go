@@ -79,6 +79,40 @@ func (ts *UserTestSuite) TestUserGet() {
 	require.Equal(ts.T(), http.StatusOK, w.Code)
 }
 
+func (ts *UserTestSuite) TestUserGetMFAStatus() {
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err, "Error finding user")
+
+	getUser := func() map[string]interface{} {
+		token := ts.generateAccessTokenAndSession(u)
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/user", nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		ts.API.handler.ServeHTTP(w, req)
+		require.Equal(ts.T(), http.StatusOK, w.Code)
+
+		var data map[string]interface{}
+		require.NoError(ts.T(), json.NewDecoder(w.Body).Decode(&data))
+		return data
+	}
+
+	data := getUser()
+	require.Equal(ts.T(), false, data["mfa_enabled"])
+	require.Equal(ts.T(), models.AAL1.String(), data["aal"])
+
+	factor := models.NewFactor(u, "totp", models.TOTP, models.FactorStateVerified)
+	require.NoError(ts.T(), ts.API.db.Create(factor))
+
+	data = getUser()
+	require.Equal(ts.T(), true, data["mfa_enabled"])
+	require.Equal(ts.T(), u.ID.String(), data["id"])
+
+	// unenrolled factors no longer count
+	require.NoError(ts.T(), factor.SoftDelete(ts.API.db))
+	data = getUser()
+	require.Equal(ts.T(), false, data["mfa_enabled"])
+}
+
 func (ts *UserTestSuite) TestUserUpdateEmail() {
 	cases := []struct {
 		desc                       string
@@ -318,6 +352,51 @@ func (ts *UserTestSuite) TestUserUpdatePassword() {
 	}
 }
 
+func (ts *UserTestSuite) TestUserUpdatePasswordInvalidatesRecoveryCodes() {
+	ts.Config.Security.UpdatePasswordRequireReauthentication = false
+	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
+	require.NoError(ts.T(), err)
+
+	cases := []struct {
+		desc        string
+		amr         models.AuthenticationMethod
+		invalidated bool
+	}{
+		{desc: "Password change", amr: models.PasswordGrant, invalidated: false},
+		{desc: "Password reset through recovery", amr: models.Recovery, invalidated: true},
+	}
+	for _, c := range cases {
+		ts.Run(c.desc, func() {
+			require.NoError(ts.T(), models.InvalidateRecoveryCodesByUser(ts.API.db, u))
+			code := models.NewRecoveryCode(u, uuid.Must(uuid.NewV4()), "abcde12345")
+			require.NoError(ts.T(), ts.API.db.Create(code))
+
+			session, err := models.NewSession(u.ID, nil)
+			require.NoError(ts.T(), err)
+			require.NoError(ts.T(), ts.API.db.Create(session))
+			require.NoError(ts.T(), models.AddClaimToSession(ts.API.db, session.ID, c.amr))
+			token := ts.generateToken(u, &session.ID)
+
+			var buffer bytes.Buffer
+			require.NoError(ts.T(), json.NewEncoder(&buffer).Encode(map[string]string{"password": "newpassword" + c.amr.String()}))
+			req := httptest.NewRequest(http.MethodPut, "http://localhost/user", &buffer)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			w := httptest.NewRecorder()
+			ts.API.handler.ServeHTTP(w, req)
+			require.Equal(ts.T(), http.StatusOK, w.Code)
+
+			codes, err := models.FindValidRecoveryCodesByUser(ts.API.db, u)
+			require.NoError(ts.T(), err)
+			if c.invalidated {
+				require.Empty(ts.T(), codes)
+			} else {
+				require.Len(ts.T(), codes, 1)
+			}
+		})
+	}
+}
+
 func (ts *UserTestSuite) TestUserUpdatePasswordNoReauthenticationRequired() {
 	u, err := models.FindUserByEmailAndAudience(ts.API.db, "test@example.com", ts.Config.JWT.Aud)
 	require.NoError(ts.T(), err)
@@ -18,9 +18,16 @@ import (
 )
 
 const defaultMinPasswordLength int = 6
-const defaultChallengeExpiryDuration float64 = 300
-const defaultFactorExpiryDuration time.Duration = 300 * time.Second
+const defaultEnrollmentExpiry time.Duration = 24 * time.Hour
 const defaultFlowStateExpiryDuration time.Duration = 300 * time.Second
+const defaultQRCodeSize int = 200
+const defaultSecretChunkSize int = 4
+const defaultVerificationTokenExpiry time.Duration = 60 * time.Second
+const defaultDisableReauthWindow time.Duration = 5 * time.Minute
+const defaultChallengeRateLimitWindow time.Duration = time.Hour
+const defaultLockoutBackoffCap time.Duration = 24 * time.Hour
+const defaultStepUpTokenExp int = 300
+const defaultMaxFactorsPerPage uint64 = 50
 
 // See: https://www.postgresql.org/docs/7.0/syntax525.htm
 var postgresNamesRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,62}$`)
@@ -102,14 +109,212 @@ type JWTConfiguration struct {
 	KeyID            string   `json:"key_id" split_words:"true"`
 }
 
+// MFA enforcement modes, see MFAConfiguration.Enforcement.
+const (
+	MFAEnforcementOptional         = "optional"
+	MFAEnforcementRequired         = "required"
+	MFAEnforcementRequiredForRoles = "required_for_roles"
+
+	// MFAEnforcementRequiredForEnrolled requires MFA from users that have
+	// a verified factor, their password logins only yield a partial session
+	MFAEnforcementRequiredForEnrolled = "required_for_enrolled"
+)
+
+// UUID versions of MFA challenge ids, see MFAConfiguration.ChallengeIDVersion.
+// Version 7 ids are ordered by creation time, which keeps inserts into the
+// challenges primary key index local on busy instances.
+const (
+	MFAChallengeIDVersion4 = "v4"
+	MFAChallengeIDVersion7 = "v7"
+)
+
 // MFAConfiguration holds all the MFA related Configuration
 type MFAConfiguration struct {
-	Enabled                     bool          `default:"false"`
+	Enabled                     bool          `default:"true"`
 	ChallengeExpiryDuration     float64       `json:"challenge_expiry_duration" default:"300" split_words:"true"`
-	FactorExpiryDuration        time.Duration `json:"factor_expiry_duration" default:"300s" split_words:"true"`
+	ChallengeRefreshGracePeriod float64       `json:"challenge_refresh_grace_period" default:"60" split_words:"true"`
+	MaxChallengeRefreshes       int           `json:"max_challenge_refreshes" split_words:"true" default:"3"`
+	MaxOpenChallenges           int           `json:"max_open_challenges" split_words:"true" default:"5"`
+	ChallengeRateLimitPerUser   int           `json:"challenge_rate_limit_per_user" split_words:"true" default:"0"`
+	ChallengeRateLimitWindow    time.Duration `json:"challenge_rate_limit_window" split_words:"true" default:"1h"`
+	ChallengeIDVersion          string        `json:"challenge_id_version" split_words:"true" default:"v4"`
+	BindChallengeToClient       bool          `json:"bind_challenge_to_client" split_words:"true" default:"false"`
+	ChallengeVerifiedOnly       bool          `json:"challenge_verified_only" split_words:"true" default:"false"`
+	FactorDeleteRevokesSessions bool          `json:"factor_delete_revokes_sessions" split_words:"true" default:"false"`
+	EnrollIdempotencyKeyTTL     time.Duration `json:"enroll_idempotency_key_ttl" split_words:"true" default:"24h"`
+	EnrollmentExpiry            time.Duration `json:"enrollment_expiry" split_words:"true"`
+	// Deprecated: FactorExpiryDuration is only read as a fallback for
+	// EnrollmentExpiry, which replaces it
+	FactorExpiryDuration        time.Duration `json:"factor_expiry_duration" split_words:"true"`
 	RateLimitChallengeAndVerify float64       `split_words:"true" default:"15"`
 	MaxEnrolledFactors          float64       `split_words:"true" default:"10"`
 	MaxVerifiedFactors          int           `split_words:"true" default:"10"`
+	MaxFactorsPerPage           uint64        `json:"max_factors_per_page" split_words:"true" default:"50"`
+	MinVerifiedFactors          int           `json:"min_verified_factors" split_words:"true" default:"0"`
+	MinRecoveryCodes            int           `json:"min_recovery_codes" split_words:"true" default:"0"`
+	LowRecoveryCodeThreshold    int           `json:"low_recovery_code_threshold" split_words:"true" default:"3"`
+	RecoveryCodeLength          int           `json:"recovery_code_length" split_words:"true" default:"10"`
+	RecoveryCodeCount           int           `json:"recovery_code_count" split_words:"true" default:"8"`
+	RecoveryCodeAlphabet        string        `json:"recovery_code_alphabet" split_words:"true"`
+	TOTPSkew                    uint          `json:"totp_skew" split_words:"true" default:"1"`
+	RequireDoubleVerifyOnEnroll bool          `json:"require_double_verify_on_enroll" split_words:"true" default:"false"`
+	TOTPAlgorithm               string        `json:"totp_algorithm" split_words:"true" default:"SHA1"`
+	TOTPDigits                  int           `json:"totp_digits" split_words:"true" default:"6"`
+	TOTPPeriod                  uint          `json:"totp_period" split_words:"true" default:"30"`
+	SecretSize                  uint          `json:"secret_size" split_words:"true" default:"20"`
+	Issuer                      string        `json:"issuer"`
+	QRCodeSize                  int           `json:"qr_code_size" split_words:"true" default:"200"`
+	SecretChunkSize             int           `json:"secret_chunk_size" split_words:"true" default:"4"`
+	MaxVerifyAttempts           int           `json:"max_verify_attempts" split_words:"true" default:"5"`
+	VerifyAttemptWindow         time.Duration `json:"verify_attempt_window" split_words:"true" default:"5m"`
+	LockoutBackoffBase          time.Duration `json:"lockout_backoff_base" split_words:"true" default:"0"`
+	LockoutBackoffCap           time.Duration `json:"lockout_backoff_cap" split_words:"true" default:"0"`
+	VerifyResponseJitter        time.Duration `json:"verify_response_jitter" split_words:"true" default:"0"`
+	StepUpTokenExp              int           `json:"step_up_token_exp" split_words:"true" default:"300"`
+	ClearVerifiedAtOnRefresh    bool          `json:"clear_verified_at_on_refresh" split_words:"true" default:"false"`
+	VerificationTokenExpiry     time.Duration `json:"verification_token_expiry" split_words:"true" default:"60s"`
+	DisableReauthWindow         time.Duration `json:"disable_reauth_window" split_words:"true" default:"5m"`
+	NotifyOnEnroll              bool          `json:"notify_on_enroll" split_words:"true" default:"false"`
+	NotifyOnLockout             bool          `json:"notify_on_lockout" split_words:"true" default:"false"`
+	Enforcement                 string        `json:"enforcement" default:"optional"`
+	EnforcementRoles            []string      `json:"enforcement_roles" split_words:"true"`
+	NewFactorGracePeriod        time.Duration `json:"new_factor_grace_period" split_words:"true" default:"0"`
+	TrustedDeviceDuration       time.Duration `json:"trusted_device_duration" split_words:"true" default:"0"`
+
+	WebAuthn WebAuthnConfiguration `json:"web_authn" split_words:"true"`
+}
+
+// Bounds of the length and number of generated recovery codes
+const (
+	minRecoveryCodeLength = 8
+	maxRecoveryCodeLength = 32
+	minRecoveryCodeCount  = 4
+	maxRecoveryCodeCount  = 20
+
+	// minRecoveryCodeAlphabetSize keeps configured alphabets from weakening
+	// codes of the minimum length too much
+	minRecoveryCodeAlphabetSize = 16
+)
+
+// Bounds in seconds of how long an MFA challenge can be verified for
+const (
+	minChallengeExpiryDuration float64 = 30
+	maxChallengeExpiryDuration float64 = 24 * 60 * 60
+)
+
+// minTOTPSecretSize and maxTOTPSecretSize bound the size in bytes of generated
+// TOTP secrets, RFC 4226 requires at least 128 bits
+const (
+	minTOTPSecretSize uint = 16
+	maxTOTPSecretSize uint = 64
+)
+
+func (c *MFAConfiguration) Validate() error {
+	if c.ChallengeExpiryDuration < minChallengeExpiryDuration || c.ChallengeExpiryDuration > maxChallengeExpiryDuration {
+		return fmt.Errorf("conf: MFA challenge expiry duration must be between %v and %v seconds, got %v", minChallengeExpiryDuration, maxChallengeExpiryDuration, c.ChallengeExpiryDuration)
+	}
+	switch c.TOTPAlgorithm {
+	case "SHA1", "SHA256", "SHA512":
+	default:
+		return fmt.Errorf("conf: MFA TOTP algorithm must be one of SHA1, SHA256 or SHA512, got %q", c.TOTPAlgorithm)
+	}
+	if c.TOTPDigits != 6 && c.TOTPDigits != 8 {
+		return fmt.Errorf("conf: MFA TOTP digits must be 6 or 8, got %d", c.TOTPDigits)
+	}
+	if c.TOTPPeriod == 0 {
+		return errors.New("conf: MFA TOTP period must be greater than 0")
+	}
+	if c.SecretSize < minTOTPSecretSize || c.SecretSize > maxTOTPSecretSize {
+		return fmt.Errorf("conf: MFA secret size must be between %d and %d bytes, got %d", minTOTPSecretSize, maxTOTPSecretSize, c.SecretSize)
+	}
+	if c.RecoveryCodeLength < minRecoveryCodeLength || c.RecoveryCodeLength > maxRecoveryCodeLength {
+		return fmt.Errorf("conf: MFA recovery code length must be between %d and %d, got %d", minRecoveryCodeLength, maxRecoveryCodeLength, c.RecoveryCodeLength)
+	}
+	if c.RecoveryCodeCount < minRecoveryCodeCount || c.RecoveryCodeCount > maxRecoveryCodeCount {
+		return fmt.Errorf("conf: MFA recovery code count must be between %d and %d, got %d", minRecoveryCodeCount, maxRecoveryCodeCount, c.RecoveryCodeCount)
+	}
+	if c.RecoveryCodeAlphabet != "" {
+		seen := make(map[rune]bool, len(c.RecoveryCodeAlphabet))
+		for _, ch := range c.RecoveryCodeAlphabet {
+			// submitted codes are lowercased before they are compared
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= '0' && ch <= '9') {
+				return fmt.Errorf("conf: MFA recovery code alphabet may only contain lowercase letters and digits, got %q", ch)
+			}
+			if seen[ch] {
+				return fmt.Errorf("conf: MFA recovery code alphabet contains %q more than once", ch)
+			}
+			seen[ch] = true
+		}
+		if len(seen) < minRecoveryCodeAlphabetSize {
+			return fmt.Errorf("conf: MFA recovery code alphabet must have at least %d characters, got %d", minRecoveryCodeAlphabetSize, len(seen))
+		}
+	}
+	if c.MinRecoveryCodes > c.RecoveryCodeCount {
+		return fmt.Errorf("conf: MFA min recovery codes must not exceed the recovery code count of %d", c.RecoveryCodeCount)
+	}
+	if c.MaxOpenChallenges < 1 {
+		return fmt.Errorf("conf: MFA max open challenges must be at least 1, got %d", c.MaxOpenChallenges)
+	}
+	if c.ChallengeRateLimitPerUser < 0 {
+		return fmt.Errorf("conf: MFA challenge rate limit per user must not be negative, got %d", c.ChallengeRateLimitPerUser)
+	}
+	if c.NewFactorGracePeriod < 0 {
+		return errors.New("conf: MFA new factor grace period must not be negative")
+	}
+	if c.TrustedDeviceDuration < 0 {
+		return errors.New("conf: MFA trusted device duration must not be negative")
+	}
+	if c.VerifyResponseJitter < 0 {
+		return errors.New("conf: MFA verify response jitter must not be negative")
+	}
+	if c.LockoutBackoffBase < 0 || c.LockoutBackoffCap < 0 {
+		return errors.New("conf: MFA lockout backoff base and cap must not be negative")
+	}
+	if c.LockoutBackoffBase > 0 && c.LockoutBackoffCap > 0 && c.LockoutBackoffCap < c.LockoutBackoffBase {
+		return errors.New("conf: MFA lockout backoff cap must not be shorter than the base")
+	}
+	switch c.ChallengeIDVersion {
+	case "", MFAChallengeIDVersion4, MFAChallengeIDVersion7:
+	default:
+		return fmt.Errorf("conf: MFA challenge id version must be v4 or v7, got %q", c.ChallengeIDVersion)
+	}
+	switch c.Enforcement {
+	case "", MFAEnforcementOptional, MFAEnforcementRequired, MFAEnforcementRequiredForEnrolled:
+	case MFAEnforcementRequiredForRoles:
+		if len(c.EnforcementRoles) == 0 {
+			return errors.New("conf: MFA enforcement roles must be set when enforcement is required_for_roles")
+		}
+	default:
+		return fmt.Errorf("conf: MFA enforcement must be one of optional, required, required_for_roles or required_for_enrolled, got %q", c.Enforcement)
+	}
+	return nil
+}
+
+// IsRequiredFor reports whether a user with the provided role, that may or
+// may not have a verified factor, must complete MFA before using protected
+// endpoints.
+func (c *MFAConfiguration) IsRequiredFor(role string, hasVerifiedFactor bool) bool {
+	switch c.Enforcement {
+	case MFAEnforcementRequired:
+		return true
+	case MFAEnforcementRequiredForEnrolled:
+		return hasVerifiedFactor
+	case MFAEnforcementRequiredForRoles:
+		for _, r := range c.EnforcementRoles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebAuthnConfiguration holds the relying party settings used for WebAuthn
+// factors. When left empty they are derived from the site URL.
+type WebAuthnConfiguration struct {
+	RPID          string   `json:"rp_id" envconfig:"RP_ID"`
+	RPDisplayName string   `json:"rp_display_name" envconfig:"RP_DISPLAY_NAME"`
+	RPOrigins     []string `json:"rp_origins" envconfig:"RP_ORIGINS"`
 }
 
 type APIConfiguration struct {
@@ -242,8 +447,42 @@ type GlobalConfiguration struct {
 		Domain   string `json:"domain"`
 		Duration int    `json:"duration"`
 	} `json:"cookies"`
-	SAML SAMLConfiguration `json:"saml"`
-	CORS CORSConfiguration `json:"cors"`
+	SAML    SAMLConfiguration    `json:"saml"`
+	CORS    CORSConfiguration    `json:"cors"`
+	Webhook WebhookConfiguration `json:"webhook"`
+}
+
+// WebhookConfiguration holds the configuration of the outgoing event webhook.
+// Payloads are signed with an HMAC-SHA256 of the secret.
+type WebhookConfiguration struct {
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	Retries    int    `json:"retries" default:"3"`
+	TimeoutSec int    `json:"timeout_sec" split_words:"true" default:"5"`
+	MFAEvents  bool   `json:"mfa_events" split_words:"true" default:"false"`
+}
+
+func (w *WebhookConfiguration) Validate() error {
+	if !w.MFAEvents {
+		return nil
+	}
+	if w.URL == "" {
+		return errors.New("conf: webhook URL must be set when MFA events are enabled")
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("conf: webhook URL is invalid: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("conf: webhook URL must use http or https, got %q", u.Scheme)
+	}
+	if w.Secret == "" {
+		return errors.New("conf: webhook secret must be set when MFA events are enabled")
+	}
+	if w.Retries < 0 {
+		return errors.New("conf: webhook retries must not be negative")
+	}
+	return nil
 }
 
 type CORSConfiguration struct {
@@ -278,6 +517,8 @@ type EmailContentConfiguration struct {
 	EmailChange      string `json:"email_change" split_words:"true"`
 	MagicLink        string `json:"magic_link" split_words:"true"`
 	Reauthentication string `json:"reauthentication"`
+	FactorEnrolled   string `json:"factor_enrolled" split_words:"true"`
+	FactorLocked     string `json:"factor_locked" split_words:"true"`
 }
 
 type ProviderConfiguration struct {
@@ -793,11 +1034,50 @@ func (config *GlobalConfiguration) ApplyDefaults() error {
 	if config.Password.MinLength < defaultMinPasswordLength {
 		config.Password.MinLength = defaultMinPasswordLength
 	}
-	if config.MFA.ChallengeExpiryDuration < defaultChallengeExpiryDuration {
-		config.MFA.ChallengeExpiryDuration = defaultChallengeExpiryDuration
+	if config.MFA.EnrollmentExpiry <= 0 {
+		if config.MFA.FactorExpiryDuration > 0 {
+			config.MFA.EnrollmentExpiry = config.MFA.FactorExpiryDuration
+		} else {
+			config.MFA.EnrollmentExpiry = defaultEnrollmentExpiry
+		}
+	}
+	if config.MFA.QRCodeSize <= 0 {
+		config.MFA.QRCodeSize = defaultQRCodeSize
+	}
+	if config.MFA.SecretChunkSize <= 0 {
+		config.MFA.SecretChunkSize = defaultSecretChunkSize
+	}
+	if config.MFA.StepUpTokenExp <= 0 {
+		config.MFA.StepUpTokenExp = defaultStepUpTokenExp
+	}
+	if config.MFA.VerificationTokenExpiry <= 0 {
+		config.MFA.VerificationTokenExpiry = defaultVerificationTokenExpiry
+	}
+	if config.MFA.DisableReauthWindow <= 0 {
+		config.MFA.DisableReauthWindow = defaultDisableReauthWindow
+	}
+	if config.MFA.ChallengeRateLimitWindow <= 0 {
+		config.MFA.ChallengeRateLimitWindow = defaultChallengeRateLimitWindow
+	}
+	if config.MFA.LockoutBackoffBase > 0 && config.MFA.LockoutBackoffCap <= 0 {
+		config.MFA.LockoutBackoffCap = defaultLockoutBackoffCap
+	}
+	if config.MFA.MaxFactorsPerPage == 0 {
+		config.MFA.MaxFactorsPerPage = defaultMaxFactorsPerPage
+	}
+	config.MFA.TOTPAlgorithm = strings.ToUpper(config.MFA.TOTPAlgorithm)
+	if config.MFA.WebAuthn.RPID == "" || len(config.MFA.WebAuthn.RPOrigins) == 0 {
+		if u, err := url.ParseRequestURI(config.SiteURL); err == nil {
+			if config.MFA.WebAuthn.RPID == "" {
+				config.MFA.WebAuthn.RPID = u.Hostname()
+			}
+			if len(config.MFA.WebAuthn.RPOrigins) == 0 {
+				config.MFA.WebAuthn.RPOrigins = []string{u.Scheme + "://" + u.Host}
+			}
+		}
 	}
-	if config.MFA.FactorExpiryDuration < defaultFactorExpiryDuration {
-		config.MFA.FactorExpiryDuration = defaultFactorExpiryDuration
+	if config.MFA.WebAuthn.RPDisplayName == "" {
+		config.MFA.WebAuthn.RPDisplayName = config.MFA.WebAuthn.RPID
 	}
 	if config.External.FlowStateExpiryDuration < defaultFlowStateExpiryDuration {
 		config.External.FlowStateExpiryDuration = defaultFlowStateExpiryDuration
@@ -824,6 +1104,8 @@ func (c *GlobalConfiguration) Validate() error {
 		&c.Security,
 		&c.Sessions,
 		&c.Hook,
+		&c.MFA,
+		&c.Webhook,
 	}
 
 	for _, validatable := range validatables {
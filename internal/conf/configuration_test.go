@@ -3,6 +3,7 @@ package conf
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -211,3 +212,176 @@ func TestValidateExtensibilityPointSecrets(t *testing.T) {
 	}
 
 }
+
+func TestValidateMFATOTPParameters(t *testing.T) {
+	cases := []struct {
+		desc        string
+		algorithm   string
+		digits      int
+		period      uint
+		secretSize  uint
+		expectError bool
+	}{
+		{desc: "Defaults", algorithm: "SHA1", digits: 6, period: 30, secretSize: 20, expectError: false},
+		{desc: "SHA256 with 8 digits", algorithm: "SHA256", digits: 8, period: 30, secretSize: 20, expectError: false},
+		{desc: "SHA512 with 60 second period", algorithm: "SHA512", digits: 6, period: 60, secretSize: 20, expectError: false},
+		{desc: "32 byte secret", algorithm: "SHA1", digits: 6, period: 30, secretSize: 32, expectError: false},
+		{desc: "Unsupported algorithm", algorithm: "MD5", digits: 6, period: 30, secretSize: 20, expectError: true},
+		{desc: "Unsupported digit count", algorithm: "SHA1", digits: 7, period: 30, secretSize: 20, expectError: true},
+		{desc: "Zero period", algorithm: "SHA1", digits: 6, period: 0, secretSize: 20, expectError: true},
+		{desc: "Secret too short", algorithm: "SHA1", digits: 6, period: 30, secretSize: 10, expectError: true},
+		{desc: "Secret too long", algorithm: "SHA1", digits: 6, period: 30, secretSize: 128, expectError: true},
+	}
+
+	for _, tc := range cases {
+		c := MFAConfiguration{ChallengeExpiryDuration: 300, TOTPAlgorithm: tc.algorithm, TOTPDigits: tc.digits, TOTPPeriod: tc.period, SecretSize: tc.secretSize, RecoveryCodeLength: 10, RecoveryCodeCount: 8, MaxOpenChallenges: 5}
+		err := c.Validate()
+		if tc.expectError {
+			require.Error(t, err, tc.desc)
+		} else {
+			require.NoError(t, err, tc.desc)
+		}
+	}
+}
+
+func TestValidateMFARecoveryCodes(t *testing.T) {
+	cases := []struct {
+		desc        string
+		length      int
+		count       int
+		minCodes    int
+		alphabet    string
+		expectError bool
+	}{
+		{desc: "Defaults", length: 10, count: 8},
+		{desc: "Longest and most codes", length: 32, count: 20},
+		{desc: "Shortest and fewest codes", length: 8, count: 4, minCodes: 4},
+		{desc: "Too short", length: 7, count: 8, expectError: true},
+		{desc: "Too long", length: 33, count: 8, expectError: true},
+		{desc: "Too few", length: 10, count: 3, expectError: true},
+		{desc: "Too many", length: 10, count: 21, expectError: true},
+		{desc: "Fewer codes than required", length: 10, count: 4, minCodes: 5, expectError: true},
+		{desc: "Crockford alphabet", length: 10, count: 8, alphabet: "0123456789abcdefghjkmnpqrstvwxyz"},
+		{desc: "Uppercase alphabet", length: 10, count: 8, alphabet: "0123456789ABCDEFGHJKMNPQRSTVWXYZ", expectError: true},
+		{desc: "Alphabet with repeated characters", length: 10, count: 8, alphabet: "0123456789abcdefa", expectError: true},
+		{desc: "Alphabet too small", length: 10, count: 8, alphabet: "0123456789", expectError: true},
+	}
+
+	for _, tc := range cases {
+		c := MFAConfiguration{
+			ChallengeExpiryDuration: 300,
+			TOTPAlgorithm:           "SHA1",
+			TOTPDigits:              6,
+			TOTPPeriod:              30,
+			SecretSize:              20,
+			RecoveryCodeLength:      tc.length,
+			RecoveryCodeCount:       tc.count,
+			MinRecoveryCodes:        tc.minCodes,
+			RecoveryCodeAlphabet:    tc.alphabet,
+			MaxOpenChallenges:       5,
+		}
+		err := c.Validate()
+		if tc.expectError {
+			require.Error(t, err, tc.desc)
+		} else {
+			require.NoError(t, err, tc.desc)
+		}
+	}
+}
+
+func TestMFAEnforcement(t *testing.T) {
+	cases := []struct {
+		desc        string
+		enforcement string
+		roles       []string
+		role        string
+		enrolled    bool
+		expectError bool
+		required    bool
+	}{
+		{desc: "Unset", enforcement: "", role: "authenticated", required: false},
+		{desc: "Optional", enforcement: MFAEnforcementOptional, role: "authenticated", required: false},
+		{desc: "Required", enforcement: MFAEnforcementRequired, role: "authenticated", required: true},
+		{desc: "Required for matching role", enforcement: MFAEnforcementRequiredForRoles, roles: []string{"staff"}, role: "staff", required: true},
+		{desc: "Required for other role", enforcement: MFAEnforcementRequiredForRoles, roles: []string{"staff"}, role: "authenticated", required: false},
+		{desc: "Required for roles without roles", enforcement: MFAEnforcementRequiredForRoles, expectError: true},
+		{desc: "Required for enrolled user", enforcement: MFAEnforcementRequiredForEnrolled, role: "authenticated", enrolled: true, required: true},
+		{desc: "Required for enrolled without factor", enforcement: MFAEnforcementRequiredForEnrolled, role: "authenticated", enrolled: false, required: false},
+		{desc: "Unsupported mode", enforcement: "always", expectError: true},
+	}
+
+	for _, tc := range cases {
+		c := MFAConfiguration{
+			ChallengeExpiryDuration: 300,
+			TOTPAlgorithm:           "SHA1",
+			TOTPDigits:              6,
+			TOTPPeriod:              30,
+			SecretSize:              20,
+			RecoveryCodeLength:      10,
+			RecoveryCodeCount:       8,
+			MaxOpenChallenges:       5,
+			Enforcement:             tc.enforcement,
+			EnforcementRoles:        tc.roles,
+		}
+		err := c.Validate()
+		if tc.expectError {
+			require.Error(t, err, tc.desc)
+			continue
+		}
+		require.NoError(t, err, tc.desc)
+		require.Equal(t, tc.required, c.IsRequiredFor(tc.role, tc.enrolled), tc.desc)
+	}
+}
+
+func TestValidateMFAChallengeExpiryDuration(t *testing.T) {
+	cases := []struct {
+		desc        string
+		duration    float64
+		expectError bool
+	}{
+		{desc: "Default", duration: 300},
+		{desc: "Minimum", duration: 30},
+		{desc: "Maximum", duration: 86400},
+		{desc: "Zero", duration: 0, expectError: true},
+		{desc: "Negative", duration: -300, expectError: true},
+		{desc: "Below minimum", duration: 29, expectError: true},
+		{desc: "Above maximum", duration: 86401, expectError: true},
+	}
+
+	for _, tc := range cases {
+		c := MFAConfiguration{
+			ChallengeExpiryDuration: tc.duration,
+			TOTPAlgorithm:           "SHA1",
+			TOTPDigits:              6,
+			TOTPPeriod:              30,
+			SecretSize:              20,
+			RecoveryCodeLength:      10,
+			RecoveryCodeCount:       8,
+			MaxOpenChallenges:       5,
+		}
+		err := c.Validate()
+		if tc.expectError {
+			require.Error(t, err, tc.desc)
+		} else {
+			require.NoError(t, err, tc.desc)
+		}
+	}
+}
+
+func TestMFAEnrollmentExpiryFallback(t *testing.T) {
+	config := &GlobalConfiguration{}
+	require.NoError(t, config.ApplyDefaults())
+	require.Equal(t, defaultEnrollmentExpiry, config.MFA.EnrollmentExpiry)
+
+	// the deprecated setting is used when the new one is not set
+	config = &GlobalConfiguration{}
+	config.MFA.FactorExpiryDuration = 10 * time.Minute
+	require.NoError(t, config.ApplyDefaults())
+	require.Equal(t, 10*time.Minute, config.MFA.EnrollmentExpiry)
+
+	config = &GlobalConfiguration{}
+	config.MFA.FactorExpiryDuration = 10 * time.Minute
+	config.MFA.EnrollmentExpiry = time.Hour
+	require.NoError(t, config.ApplyDefaults())
+	require.Equal(t, time.Hour, config.MFA.EnrollmentExpiry)
+}
@@ -3,8 +3,10 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -47,6 +49,43 @@ func GenerateOtp(digits int) (string, error) {
 	otp := fmt.Sprintf(expr, val.String())
 	return otp, nil
 }
+
+// DefaultRecoveryCodeAlphabet is used to generate recovery codes unless
+// another alphabet is configured
+const DefaultRecoveryCodeAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// CrockfordRecoveryCodeAlphabet is Crockford's base32 alphabet in lowercase.
+// It leaves out i, l, o and u so that codes cannot be misread.
+const CrockfordRecoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// GenerateRecoveryCode generates a random recovery code of the given length
+// from the characters of the alphabet, or of DefaultRecoveryCodeAlphabet if
+// the alphabet is empty
+func GenerateRecoveryCode(length int, alphabet string) (string, error) {
+	if alphabet == "" {
+		alphabet = DefaultRecoveryCodeAlphabet
+	}
+	max := big.NewInt(int64(len(alphabet)))
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.WithMessage(err, "Error generating recovery code")
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// ConstantTimeEqual reports whether a and b are equal. Both values are hashed
+// before comparing so that, unlike subtle.ConstantTimeCompare, the time taken
+// does not reveal whether their lengths differ.
+func ConstantTimeEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
 func GenerateTokenHash(emailOrPhone, otp string) string {
 	return fmt.Sprintf("%x", sha256.Sum224([]byte(emailOrPhone+otp)))
 }
@@ -207,3 +246,35 @@ func NewEncryptedString(id string, data []byte, keyID string, keyBase64URL strin
 
 	return &es, nil
 }
+
+// GenerateHMAC signs data with HMAC-SHA256 using a key derived from the
+// encryption key and the ID of the object being signed, in the same way the
+// symmetric key of an EncryptedString is derived.
+func GenerateHMAC(id, keyID, keyBase64URL string, data []byte) ([]byte, error) {
+	key, err := deriveSymmetricKey(id, keyID, keyBase64URL)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil), nil
+}
+
+// VerifyHMAC checks in constant time that signature is the HMAC of data
+// generated by GenerateHMAC with the decryption key named keyID.
+func VerifyHMAC(id, keyID string, decryptionKeys map[string]string, data, signature []byte) (bool, error) {
+	decryptionKey := decryptionKeys[keyID]
+
+	if decryptionKey == "" {
+		return false, fmt.Errorf("crypto: decryption key with name %q does not exist", keyID)
+	}
+
+	expected, err := GenerateHMAC(id, keyID, decryptionKey, data)
+	if err != nil {
+		return false, err
+	}
+
+	return hmac.Equal(expected, signature), nil
+}
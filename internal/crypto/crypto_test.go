@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/gofrs/uuid"
@@ -32,3 +33,75 @@ func TestEncryptedString(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("data"), decrypted)
 }
+
+func TestHMAC(t *testing.T) {
+	id := uuid.Must(uuid.NewV4()).String()
+	keys := map[string]string{
+		"key-id": "pwFoiPyybQMqNmYVN0gUnpbfpGQV2sDv9vp0ZAxi_Y4",
+	}
+
+	signature, err := GenerateHMAC(id, "key-id", keys["key-id"], []byte("data"))
+	assert.NoError(t, err)
+	assert.Len(t, signature, 32)
+
+	valid, err := VerifyHMAC(id, "key-id", keys, []byte("data"), signature)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = VerifyHMAC(id, "key-id", keys, []byte("other data"), signature)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	// the key is bound to the ID of the signed object
+	valid, err = VerifyHMAC(uuid.Must(uuid.NewV4()).String(), "key-id", keys, []byte("data"), signature)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	_, err = VerifyHMAC(id, "unknown-key-id", keys, []byte("data"), signature)
+	assert.Error(t, err)
+}
+
+func TestConstantTimeEqual(t *testing.T) {
+	assert.True(t, ConstantTimeEqual("abcdefghij", "abcdefghij"))
+	assert.False(t, ConstantTimeEqual("abcdefghij", "abcdefghik"))
+	assert.False(t, ConstantTimeEqual("abcdefghij", "abcdefghi"))
+	assert.False(t, ConstantTimeEqual("abcdefghij", ""))
+}
+
+func TestGenerateRecoveryCode(t *testing.T) {
+	for _, alphabet := range []string{"", CrockfordRecoveryCodeAlphabet} {
+		allowed := alphabet
+		if allowed == "" {
+			allowed = DefaultRecoveryCodeAlphabet
+		}
+		for i := 0; i < 100; i++ {
+			code, err := GenerateRecoveryCode(16, alphabet)
+			assert.NoError(t, err)
+			assert.Len(t, code, 16)
+			assert.Empty(t, strings.Trim(code, allowed))
+		}
+	}
+}
+
+// BenchmarkConstantTimeEqual documents that comparing against a candidate of
+// a different length takes as long as comparing against one of the same
+// length, as both sides are hashed to a fixed size first.
+func BenchmarkConstantTimeEqual(b *testing.B) {
+	code := "abcdefghij"
+	candidates := map[string]string{
+		"same length":   "abcdefghik",
+		"shorter":       "a",
+		"longer":        strings.Repeat("a", 20),
+		"equal":         code,
+		"empty":         "",
+		"prefix":        "abcde",
+		"longer prefix": code + "k",
+	}
+	for name, candidate := range candidates {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ConstantTimeEqual(code, candidate)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// WebAuthn authenticator data flags, see
+// https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+const (
+	WebAuthnFlagUserPresent        byte = 0x01
+	WebAuthnFlagUserVerified       byte = 0x04
+	WebAuthnFlagAttestedCredential byte = 0x40
+	WebAuthnFlagExtensionData      byte = 0x80
+)
+
+// COSE algorithm identifiers supported for WebAuthn credentials.
+const (
+	COSEAlgorithmES256 int64 = -7
+	COSEAlgorithmEdDSA int64 = -8
+	COSEAlgorithmRS256 int64 = -257
+)
+
+// minRSAKeyBits is the smallest RSA modulus accepted for RS256 credentials
+const minRSAKeyBits = 2048
+
+// WebAuthnClientData is the subset of the CollectedClientData dictionary
+// that a relying party needs to inspect.
+type WebAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// WebAuthnAuthenticatorData is a parsed authenticator data structure. The
+// credential fields are only populated when the attested credential data
+// flag is set, i.e. during registration.
+type WebAuthnAuthenticatorData struct {
+	RPIDHash            []byte
+	Flags               byte
+	SignCount           uint32
+	AAGUID              []byte
+	CredentialID        []byte
+	CredentialPublicKey []byte
+}
+
+// HasFlag reports whether the flag is set in the authenticator data.
+func (d *WebAuthnAuthenticatorData) HasFlag(flag byte) bool {
+	return d.Flags&flag == flag
+}
+
+// ParseWebAuthnClientData decodes the clientDataJSON sent by the browser.
+func ParseWebAuthnClientData(clientDataJSON []byte) (*WebAuthnClientData, error) {
+	var clientData WebAuthnClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return nil, errors.Wrap(err, "webauthn: unable to parse client data")
+	}
+
+	return &clientData, nil
+}
+
+// ParseWebAuthnAuthenticatorData parses the binary authenticator data
+// structure returned by an authenticator.
+func ParseWebAuthnAuthenticatorData(data []byte) (*WebAuthnAuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("webauthn: authenticator data is too short")
+	}
+
+	authData := &WebAuthnAuthenticatorData{
+		RPIDHash:  data[0:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if !authData.HasFlag(WebAuthnFlagAttestedCredential) {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("webauthn: attested credential data is too short")
+	}
+
+	authData.AAGUID = rest[0:16]
+	credentialIDLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+
+	if len(rest) < credentialIDLength {
+		return nil, errors.New("webauthn: credential id is truncated")
+	}
+
+	authData.CredentialID = rest[:credentialIDLength]
+	rest = rest[credentialIDLength:]
+
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "webauthn: unable to parse credential public key")
+	}
+
+	authData.CredentialPublicKey = rest[:n]
+
+	return authData, nil
+}
+
+// ParseWebAuthnAttestationObject extracts the authenticator data from a
+// CBOR-encoded attestation object. The attestation statement itself is not
+// verified, which is equivalent to requesting "none" attestation.
+func ParseWebAuthnAttestationObject(attestationObject []byte) (*WebAuthnAuthenticatorData, error) {
+	value, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, errors.Wrap(err, "webauthn: unable to parse attestation object")
+	}
+
+	object, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: attestation object is not a map")
+	}
+
+	data, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object is missing authData")
+	}
+
+	return ParseWebAuthnAuthenticatorData(data)
+}
+
+// VerifyWebAuthnSignature checks an assertion signature over the
+// authenticator data and the hash of the client data using the COSE-encoded
+// credential public key.
+func VerifyWebAuthnSignature(credentialPublicKey, authenticatorData, clientDataJSON, signature []byte) error {
+	publicKey, alg, err := ParseCOSEPublicKey(credentialPublicKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := make([]byte, 0, len(authenticatorData)+len(clientDataHash))
+	signed = append(signed, authenticatorData...)
+	signed = append(signed, clientDataHash[:]...)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("webauthn: invalid signature")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, gocrypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("webauthn: invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, signed, signature) {
+			return errors.New("webauthn: invalid signature")
+		}
+	default:
+		return errors.Errorf("webauthn: unsupported algorithm %d", alg)
+	}
+
+	return nil
+}
+
+// VerifyWebAuthnSignCount checks the signature counter of an assertion
+// against the last one stored for the credential. Authenticators without a
+// counter always report 0, otherwise the counter has to increase with every
+// assertion or the credential may have been cloned.
+func VerifyWebAuthnSignCount(stored, received uint32) error {
+	if stored == 0 && received == 0 {
+		return nil
+	}
+	if received <= stored {
+		return errors.New("webauthn: signature counter did not increase")
+	}
+
+	return nil
+}
+
+// ParseCOSEPublicKey converts a COSE_Key into a Go public key. Only the
+// algorithms advertised in the credential creation options are supported.
+func ParseCOSEPublicKey(coseKey []byte) (gocrypto.PublicKey, int64, error) {
+	value, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "webauthn: unable to parse COSE key")
+	}
+
+	key, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("webauthn: COSE key is not a map")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch alg {
+	case COSEAlgorithmES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, xok := key[int64(-2)].([]byte)
+		y, yok := key[int64(-3)].([]byte)
+		if kty != 2 || crv != 1 || !xok || !yok {
+			return nil, alg, errors.New("webauthn: malformed ES256 key")
+		}
+
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, alg, errors.New("webauthn: ES256 key is not on the P-256 curve")
+		}
+
+		return publicKey, alg, nil
+
+	case COSEAlgorithmRS256:
+		n, nok := key[int64(-1)].([]byte)
+		e, eok := key[int64(-2)].([]byte)
+		if kty != 3 || !nok || !eok || len(e) > 4 {
+			return nil, alg, errors.New("webauthn: malformed RS256 key")
+		}
+
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < minRSAKeyBits {
+			return nil, alg, errors.Errorf("webauthn: RS256 key must be at least %d bits", minRSAKeyBits)
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+
+		return &rsa.PublicKey{
+			N: modulus,
+			E: exponent,
+		}, alg, nil
+
+	case COSEAlgorithmEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, xok := key[int64(-2)].([]byte)
+		if kty != 1 || crv != 6 || !xok || len(x) != ed25519.PublicKeySize {
+			return nil, alg, errors.New("webauthn: malformed EdDSA key")
+		}
+
+		return ed25519.PublicKey(x), alg, nil
+	}
+
+	return nil, alg, errors.Errorf("webauthn: unsupported algorithm %d", alg)
+}
+
+// decodeCBOR decodes a single CBOR data item and returns it together with the
+// number of bytes consumed. It supports the subset of CBOR used by WebAuthn
+// attestation objects and COSE keys: integers, byte and text strings, arrays,
+// maps and the simple values false, true and null.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, int, error) {
+	if depth > 16 {
+		return nil, 0, errors.New("cbor: nesting too deep")
+	}
+
+	if len(data) < 1 {
+		return nil, 0, errors.New("cbor: unexpected end of data")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	offset := 1
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(data) < 2 {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		arg = uint64(data[1])
+		offset = 2
+	case info == 25:
+		if len(data) < 3 {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		arg = uint64(binary.BigEndian.Uint16(data[1:3]))
+		offset = 3
+	case info == 26:
+		if len(data) < 5 {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		arg = uint64(binary.BigEndian.Uint32(data[1:5]))
+		offset = 5
+	case info == 27:
+		if len(data) < 9 {
+			return nil, 0, errors.New("cbor: unexpected end of data")
+		}
+		arg = binary.BigEndian.Uint64(data[1:9])
+		offset = 9
+	default:
+		return nil, 0, errors.New("cbor: indefinite lengths are not supported")
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, 0, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), offset, nil
+
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, 0, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), offset, nil
+
+	case 2, 3:
+		if arg > uint64(len(data)-offset) {
+			return nil, 0, errors.New("cbor: string is truncated")
+		}
+		end := offset + int(arg)
+		if major == 2 {
+			return bytes.Clone(data[offset:end]), end, nil
+		}
+		return string(data[offset:end]), end, nil
+
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errors.New("cbor: array is truncated")
+		}
+		items := make([]interface{}, 0, int(arg))
+		for i := uint64(0); i < arg; i += 1 {
+			item, n, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset += n
+		}
+		return items, offset, nil
+
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errors.New("cbor: map is truncated")
+		}
+		items := make(map[interface{}]interface{}, int(arg))
+		for i := uint64(0); i < arg; i += 1 {
+			key, n, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errors.New("cbor: unsupported map key type")
+			}
+
+			value, n, err := decodeCBORItem(data[offset:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			offset += n
+
+			items[key] = value
+		}
+		return items, offset, nil
+
+	case 7:
+		switch info {
+		case 20:
+			return false, offset, nil
+		case 21:
+			return true, offset, nil
+		case 22:
+			return nil, offset, nil
+		}
+		return nil, 0, errors.New("cbor: unsupported simple value")
+	}
+
+	return nil, 0, errors.Errorf("cbor: unsupported major type %d", major)
+}
@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// encodeCBORHead is a minimal CBOR encoder used to build authenticator
+// responses in tests.
+func encodeCBORHead(major byte, arg int) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg < 256:
+		return []byte{major<<5 | 24, byte(arg)}
+	default:
+		return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+	}
+}
+
+func encodeCBORInt(v int) []byte {
+	if v < 0 {
+		return encodeCBORHead(1, -1-v)
+	}
+	return encodeCBORHead(0, v)
+}
+
+func encodeCBORBytes(b []byte) []byte {
+	return append(encodeCBORHead(2, len(b)), b...)
+}
+
+func encodeCBORText(s string) []byte {
+	return append(encodeCBORHead(3, len(s)), s...)
+}
+
+func encodeES256COSEKey(key *ecdsa.PublicKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+
+	out := encodeCBORHead(5, 5)
+	out = append(out, encodeCBORInt(1)...)
+	out = append(out, encodeCBORInt(2)...)
+	out = append(out, encodeCBORInt(3)...)
+	out = append(out, encodeCBORInt(-7)...)
+	out = append(out, encodeCBORInt(-1)...)
+	out = append(out, encodeCBORInt(1)...)
+	out = append(out, encodeCBORInt(-2)...)
+	out = append(out, encodeCBORBytes(x)...)
+	out = append(out, encodeCBORInt(-3)...)
+	out = append(out, encodeCBORBytes(y)...)
+	return out
+}
+
+func buildAuthenticatorData(rpID string, flags byte, signCount uint32, credentialID, coseKey []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, signCount)
+
+	if flags&WebAuthnFlagAttestedCredential != 0 {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(credentialID)))
+		data = append(data, credentialID...)
+		data = append(data, coseKey...)
+	}
+
+	return data
+}
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialID := []byte("test-credential-id")
+	coseKey := encodeES256COSEKey(&privateKey.PublicKey)
+
+	authData := buildAuthenticatorData("example.com", WebAuthnFlagUserPresent|WebAuthnFlagAttestedCredential, 0, credentialID, coseKey)
+
+	attestationObject := encodeCBORHead(5, 3)
+	attestationObject = append(attestationObject, encodeCBORText("fmt")...)
+	attestationObject = append(attestationObject, encodeCBORText("none")...)
+	attestationObject = append(attestationObject, encodeCBORText("attStmt")...)
+	attestationObject = append(attestationObject, encodeCBORHead(5, 0)...)
+	attestationObject = append(attestationObject, encodeCBORText("authData")...)
+	attestationObject = append(attestationObject, encodeCBORBytes(authData)...)
+
+	parsed, err := ParseWebAuthnAttestationObject(attestationObject)
+	require.NoError(t, err)
+
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+	require.Equal(t, rpIDHash[:], parsed.RPIDHash)
+	require.True(t, parsed.HasFlag(WebAuthnFlagUserPresent))
+	require.Equal(t, credentialID, parsed.CredentialID)
+	require.Equal(t, coseKey, parsed.CredentialPublicKey)
+
+	_, alg, err := ParseCOSEPublicKey(parsed.CredentialPublicKey)
+	require.NoError(t, err)
+	require.Equal(t, COSEAlgorithmES256, alg)
+
+	clientDataJSON := []byte(`{"type":"webauthn.get","challenge":"abc","origin":"https://example.com"}`)
+	clientData, err := ParseWebAuthnClientData(clientDataJSON)
+	require.NoError(t, err)
+	require.Equal(t, "webauthn.get", clientData.Type)
+	require.Equal(t, "abc", clientData.Challenge)
+
+	assertionAuthData := buildAuthenticatorData("example.com", WebAuthnFlagUserPresent, 1, nil, nil)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, assertionAuthData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+	require.NoError(t, err)
+
+	require.NoError(t, VerifyWebAuthnSignature(parsed.CredentialPublicKey, assertionAuthData, clientDataJSON, signature))
+
+	// tampering with the client data must invalidate the signature
+	require.Error(t, VerifyWebAuthnSignature(parsed.CredentialPublicKey, assertionAuthData, []byte(`{"type":"webauthn.get","challenge":"xyz","origin":"https://example.com"}`), signature))
+}
+
+func TestWebAuthnMalformedInput(t *testing.T) {
+	_, err := ParseWebAuthnAuthenticatorData([]byte{0x01, 0x02})
+	require.Error(t, err)
+
+	_, err = ParseWebAuthnAttestationObject([]byte{0xbf})
+	require.Error(t, err)
+
+	_, _, err = ParseCOSEPublicKey(encodeCBORHead(5, 0))
+	require.Error(t, err)
+}
+
+func TestVerifyWebAuthnSignCount(t *testing.T) {
+	require.NoError(t, VerifyWebAuthnSignCount(0, 0))
+	require.NoError(t, VerifyWebAuthnSignCount(0, 1))
+	require.NoError(t, VerifyWebAuthnSignCount(4, 5))
+
+	// a counter that does not increase may come from a cloned authenticator
+	require.Error(t, VerifyWebAuthnSignCount(5, 5))
+	require.Error(t, VerifyWebAuthnSignCount(5, 4))
+	require.Error(t, VerifyWebAuthnSignCount(5, 0))
+}
+
+func TestParseCOSEPublicKeyRSAKeySize(t *testing.T) {
+	encodeRS256COSEKey := func(bits int) []byte {
+		privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+		require.NoError(t, err)
+
+		out := encodeCBORHead(5, 4)
+		out = append(out, encodeCBORInt(1)...)
+		out = append(out, encodeCBORInt(3)...)
+		out = append(out, encodeCBORInt(3)...)
+		out = append(out, encodeCBORInt(-257)...)
+		out = append(out, encodeCBORInt(-1)...)
+		out = append(out, encodeCBORBytes(privateKey.N.Bytes())...)
+		out = append(out, encodeCBORInt(-2)...)
+		out = append(out, encodeCBORBytes(big.NewInt(int64(privateKey.E)).Bytes())...)
+		return out
+	}
+
+	_, alg, err := ParseCOSEPublicKey(encodeRS256COSEKey(2048))
+	require.NoError(t, err)
+	require.Equal(t, COSEAlgorithmRS256, alg)
+
+	_, _, err = ParseCOSEPublicKey(encodeRS256COSEKey(1024))
+	require.Error(t, err)
+}
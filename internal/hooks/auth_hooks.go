@@ -91,6 +91,9 @@ const MinimumViableTokenSchema = `{
     },
     "session_id": {
       "type": "string"
+    },
+    "mfa_verified_at": {
+      "type": "integer"
     }
   },
   "required": ["aud", "exp", "iat", "sub", "email", "phone", "role", "aal", "session_id"]
@@ -108,6 +111,9 @@ type AccessTokenClaims struct {
 	AuthenticationMethodReference []models.AMREntry      `json:"amr,omitempty"`
 	SessionId                     string                 `json:"session_id,omitempty"`
 	IsAnonymous                   bool                   `json:"is_anonymous"`
+	// MFAVerifiedAt is when a factor was last verified in the session, in
+	// UNIX seconds
+	MFAVerifiedAt *int64 `json:"mfa_verified_at,omitempty"`
 }
 
 type MFAVerificationAttemptInput struct {
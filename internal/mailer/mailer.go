@@ -22,6 +22,8 @@ type Mailer interface {
 	MagicLinkMail(r *http.Request, user *models.User, otp, referrerURL string, externalURL *url.URL) error
 	EmailChangeMail(r *http.Request, user *models.User, otpNew, otpCurrent, referrerURL string, externalURL *url.URL) error
 	ReauthenticateMail(r *http.Request, user *models.User, otp string) error
+	FactorEnrolledMail(r *http.Request, user *models.User, factor *models.Factor) error
+	FactorLockedMail(r *http.Request, user *models.User, factor *models.Factor) error
 	ValidateEmail(email string) error
 	GetEmailActionLink(user *models.User, actionType, referrerURL string, externalURL *url.URL) (string, error)
 }
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/badoux/checkmail"
 	"github.com/supabase/auth/internal/conf"
@@ -81,6 +82,16 @@ const defaultReauthenticateMail = `<h2>Confirm reauthentication</h2>
 
 <p>Enter the code: {{ .Token }}</p>`
 
+const defaultFactorEnrolledMail = `<h2>A new MFA factor was added</h2>
+
+<p>The {{ .FactorType }} factor "{{ .FriendlyName }}" was added to the account {{ .Email }} on {{ .EnrolledAt }}.</p>
+<p>If you did not add it, remove it and change your password.</p>`
+
+const defaultFactorLockedMail = `<h2>An MFA factor was locked</h2>
+
+<p>The {{ .FactorType }} factor "{{ .FriendlyName }}" of the account {{ .Email }} was locked for {{ .LockDuration }} after too many failed verification attempts. It can be used again after {{ .LockedUntil }}.</p>
+<p>If you did not try to sign in, someone else may know your password. Change it.</p>`
+
 // ValidateEmail returns nil if the email is valid,
 // otherwise an error indicating the reason it is invalid
 func (m TemplateMailer) ValidateEmail(email string) error {
@@ -166,6 +177,61 @@ func (m *TemplateMailer) ReauthenticateMail(r *http.Request, user *models.User,
 	)
 }
 
+// FactorEnrolledMail notifies a user that a new MFA factor was verified on
+// their account
+func (m *TemplateMailer) FactorEnrolledMail(r *http.Request, user *models.User, factor *models.Factor) error {
+	enrolledAt := time.Now()
+	if factor.VerifiedAt != nil {
+		enrolledAt = *factor.VerifiedAt
+	}
+
+	data := map[string]interface{}{
+		"SiteURL":      m.Config.SiteURL,
+		"Email":        user.Email,
+		"FactorID":     factor.ID,
+		"FactorType":   factor.FactorType,
+		"FriendlyName": factor.FriendlyName,
+		"EnrolledAt":   enrolledAt.UTC().Format(time.RFC1123),
+		"Data":         user.UserMetaData,
+	}
+
+	return m.Mailer.Mail(
+		user.GetEmail(),
+		withDefault(m.Config.Mailer.Subjects.FactorEnrolled, "A new MFA factor was added to your account"),
+		m.Config.Mailer.Templates.FactorEnrolled,
+		defaultFactorEnrolledMail,
+		data,
+	)
+}
+
+// FactorLockedMail notifies a user that one of their MFA factors was locked
+// after too many failed verification attempts
+func (m *TemplateMailer) FactorLockedMail(r *http.Request, user *models.User, factor *models.Factor) error {
+	lockedUntil := time.Now()
+	if factor.LockedUntil != nil {
+		lockedUntil = *factor.LockedUntil
+	}
+
+	data := map[string]interface{}{
+		"SiteURL":      m.Config.SiteURL,
+		"Email":        user.Email,
+		"FactorID":     factor.ID,
+		"FactorType":   factor.FactorType,
+		"FriendlyName": factor.FriendlyName,
+		"LockedUntil":  lockedUntil.UTC().Format(time.RFC1123),
+		"LockDuration": time.Until(lockedUntil).Round(time.Second).String(),
+		"Data":         user.UserMetaData,
+	}
+
+	return m.Mailer.Mail(
+		user.GetEmail(),
+		withDefault(m.Config.Mailer.Subjects.FactorLocked, "An MFA factor on your account was locked"),
+		m.Config.Mailer.Templates.FactorLocked,
+		defaultFactorLockedMail,
+		data,
+	)
+}
+
 // EmailChangeMail sends an email change confirmation mail to a user
 func (m *TemplateMailer) EmailChangeMail(r *http.Request, user *models.User, otpNew, otpCurrent, referrerURL string, externalURL *url.URL) error {
 	type Email struct {
@@ -36,9 +36,16 @@ const (
 	UnenrollFactorAction            AuditAction = "factor_unenrolled"
 	CreateChallengeAction           AuditAction = "challenge_created"
 	VerifyFactorAction              AuditAction = "verification_attempted"
+	FactorVerifiedAction            AuditAction = "factor_verified"
 	DeleteFactorAction              AuditAction = "factor_deleted"
 	DeleteRecoveryCodesAction       AuditAction = "recovery_codes_deleted"
+	VerifyRecoveryCodeAction        AuditAction = "recovery_code_verified"
 	UpdateFactorAction              AuditAction = "factor_updated"
+	ImportFactorAction              AuditAction = "factor_imported"
+	ResetMFAAction                  AuditAction = "mfa_reset_by_admin"
+	BulkUpdateMFAAction             AuditAction = "mfa_bulk_updated_by_admin"
+	RevokeTrustedDevicesAction      AuditAction = "trusted_devices_revoked_by_admin"
+	DisableMFAAction                AuditAction = "mfa_disabled"
 	MFACodeLoginAction              AuditAction = "mfa_code_login"
 	IdentityUnlinkAction            AuditAction = "identity_unlinked"
 
@@ -50,6 +57,13 @@ const (
 	recoveryCodes auditLogType = "recovery_codes"
 )
 
+// Outcomes recorded in the traits of audit log entries for actions that can
+// either succeed or fail, such as MFA verification attempts.
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
 var ActionLogTypeMap = map[AuditAction]auditLogType{
 	LoginAction:                     account,
 	LogoutAction:                    account,
@@ -69,10 +83,16 @@ var ActionLogTypeMap = map[AuditAction]auditLogType{
 	UnenrollFactorAction:            factor,
 	CreateChallengeAction:           factor,
 	VerifyFactorAction:              factor,
+	FactorVerifiedAction:            factor,
 	DeleteFactorAction:              factor,
 	UpdateFactorAction:              factor,
+	ImportFactorAction:              factor,
+	ResetMFAAction:                  factor,
+	BulkUpdateMFAAction:             team,
+	DisableMFAAction:                factor,
 	MFACodeLoginAction:              factor,
 	DeleteRecoveryCodesAction:       recoveryCodes,
+	VerifyRecoveryCodeAction:        recoveryCodes,
 }
 
 // AuditLogEntry is the database model for audit log entries.
@@ -1,11 +1,20 @@
 package models
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/conf"
 	"github.com/supabase/auth/internal/storage"
-	"time"
 )
 
 type Challenge struct {
@@ -15,6 +24,47 @@ type Challenge struct {
 	VerifiedAt *time.Time `json:"verified_at,omitempty" db:"verified_at"`
 	IPAddress  string     `json:"ip_address" db:"ip_address"`
 	Factor     *Factor    `json:"factor,omitempty" belongs_to:"factor"`
+
+	// WebAuthnChallenge is the base64url encoded random challenge that the
+	// authenticator has to sign for webauthn factors.
+	WebAuthnChallenge *string `json:"-" db:"web_authn_challenge"`
+
+	// OtpCode is the hash of the code sent for sms factors
+	OtpCode *string `json:"-" db:"otp_code"`
+
+	// Purpose is set when the challenge was issued for something other than
+	// raising the session's AAL, e.g. ChallengePurposeStepUp
+	Purpose *string `json:"purpose,omitempty" db:"purpose"`
+
+	// RefreshCount is the number of times the challenge chain this challenge
+	// belongs to has been refreshed
+	RefreshCount int `json:"refresh_count" db:"refresh_count"`
+
+	// UserAgentHash is the hex encoded SHA-256 hash of the user agent the
+	// challenge was created from, if it is bound to the client
+	UserAgentHash *string `json:"-" db:"user_agent_hash"`
+
+	// FirstTOTPStep is the time step of the first code accepted for the
+	// challenge when verifying a new factor requires two consecutive codes
+	FirstTOTPStep *int64 `json:"-" db:"first_totp_step"`
+
+	// ForceReauth challenges only accept TOTP codes from the time step the
+	// challenge was created in or later, so that a code entered before the
+	// challenge cannot satisfy it
+	ForceReauth bool `json:"force_reauth" db:"force_reauth"`
+}
+
+// ChallengePurposeStepUp challenges confirm a sensitive action in an existing
+// session and are exchanged for a short lived step up token
+const ChallengePurposeStepUp = "step_up"
+
+// IsValidChallengePurpose checks the purpose against the supported purposes
+func IsValidChallengePurpose(purpose string) bool {
+	switch purpose {
+	case ChallengePurposeStepUp:
+		return true
+	}
+	return false
 }
 
 func (Challenge) TableName() string {
@@ -23,7 +73,18 @@ func (Challenge) TableName() string {
 }
 
 func NewChallenge(factor *Factor, ipAddress string) *Challenge {
-	id := uuid.Must(uuid.NewV4())
+	return NewChallengeWithIDVersion(factor, ipAddress, conf.MFAChallengeIDVersion4)
+}
+
+// NewChallengeWithIDVersion creates a challenge whose id is a UUID of the
+// configured version, v7 ids increase monotonically
+func NewChallengeWithIDVersion(factor *Factor, ipAddress string, idVersion string) *Challenge {
+	var id uuid.UUID
+	if idVersion == conf.MFAChallengeIDVersion7 {
+		id = uuid.Must(challengeIDsV7.next(time.Now()))
+	} else {
+		id = uuid.Must(uuid.NewV4())
+	}
 
 	challenge := &Challenge{
 		ID:        id,
@@ -33,6 +94,43 @@ func NewChallenge(factor *Factor, ipAddress string) *Challenge {
 	return challenge
 }
 
+// challengeIDsV7 generates the version 7 challenge ids
+var challengeIDsV7 = &uuidV7Generator{}
+
+// uuidV7Generator generates version 7 UUIDs that increase monotonically. Ids
+// created in the same millisecond use the 12 bits following the version as a
+// counter (RFC 9562, section 6.2, method 1), which uuid.NewV7 leaves random.
+type uuidV7Generator struct {
+	mu      sync.Mutex
+	lastMs  int64
+	counter uint16
+}
+
+func (g *uuidV7Generator) next(now time.Time) (uuid.UUID, error) {
+	var u uuid.UUID
+	if _, err := rand.Read(u[8:]); err != nil {
+		return uuid.Nil, err
+	}
+
+	g.mu.Lock()
+	ms := now.UnixMilli()
+	if ms > g.lastMs {
+		g.lastMs = ms
+		g.counter = 0
+	} else if g.counter++; g.counter > 0xfff {
+		// the counter overflowed, borrow the next millisecond
+		g.lastMs++
+		g.counter = 0
+	}
+	ms, counter := g.lastMs, g.counter
+	g.mu.Unlock()
+
+	binary.BigEndian.PutUint64(u[0:8], uint64(ms)<<16|uint64(counter))
+	u.SetVersion(uuid.V7)
+	u.SetVariant(uuid.VariantRFC4122)
+	return u, nil
+}
+
 func FindChallengeByID(conn *storage.Connection, challengeID uuid.UUID) (*Challenge, error) {
 	var challenge Challenge
 	err := conn.Find(&challenge, challengeID)
@@ -44,17 +142,134 @@ func FindChallengeByID(conn *storage.Connection, challengeID uuid.UUID) (*Challe
 	return &challenge, nil
 }
 
-// Update the verification timestamp
+// FindLatestChallengeByFactorID returns the factor's most recent challenge
+func FindLatestChallengeByFactorID(conn *storage.Connection, factorID uuid.UUID) (*Challenge, error) {
+	var challenge Challenge
+	err := conn.Q().Where("factor_id = ?", factorID).Order("created_at desc").First(&challenge)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		return nil, ChallengeNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// FindLatestOpenChallengeByFactorID returns the factor's most recent
+// challenge that has not been verified yet
+func FindLatestOpenChallengeByFactorID(conn *storage.Connection, factorID uuid.UUID) (*Challenge, error) {
+	var challenge Challenge
+	err := conn.Q().Where("factor_id = ? AND verified_at IS NULL", factorID).Order("created_at desc").First(&challenge)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		return nil, ChallengeNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// Refresh returns a new challenge for the same factor and purpose that
+// replaces c, continuing its refresh chain
+func (c *Challenge) Refresh(factor *Factor, ipAddress string) *Challenge {
+	idVersion := conf.MFAChallengeIDVersion4
+	if c.ID.Version() == uuid.V7 {
+		idVersion = conf.MFAChallengeIDVersion7
+	}
+	challenge := NewChallengeWithIDVersion(factor, ipAddress, idVersion)
+	challenge.Purpose = c.Purpose
+	challenge.RefreshCount = c.RefreshCount + 1
+	challenge.ForceReauth = c.ForceReauth
+	return challenge
+}
+
+// BindToClient binds the challenge to the client's user agent
+func (c *Challenge) BindToClient(userAgent string) {
+	hash := hashUserAgent(userAgent)
+	c.UserAgentHash = &hash
+}
+
+// IsBoundToClient reports whether the challenge was bound to a client with
+// the same user agent
+func (c *Challenge) IsBoundToClient(userAgent string) bool {
+	return c.UserAgentHash != nil && subtle.ConstantTimeCompare([]byte(*c.UserAgentHash), []byte(hashUserAgent(userAgent))) == 1
+}
+
+func hashUserAgent(userAgent string) string {
+	hash := sha256.Sum256([]byte(userAgent))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *Challenge) IsStepUp() bool {
+	return c.Purpose != nil && *c.Purpose == ChallengePurposeStepUp
+}
+
+// Verify sets the verification timestamp unless the challenge has been
+// verified already. Of concurrent verifications of the same challenge only
+// one succeeds, the others return ChallengeAlreadyVerifiedError.
 func (c *Challenge) Verify(tx *storage.Connection) error {
 	now := time.Now()
+	count, err := tx.RawQuery("UPDATE "+(&pop.Model{Value: Challenge{}}).TableName()+" SET verified_at = ? WHERE id = ? AND verified_at IS NULL", now, c.ID).ExecWithCount()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ChallengeAlreadyVerifiedError{}
+	}
 	c.VerifiedAt = &now
-	return tx.UpdateOnly(c, "verified_at")
+	return nil
+}
+
+// RecordFirstTOTPStep stores the time step of the first of two consecutive
+// TOTP codes
+func (c *Challenge) RecordFirstTOTPStep(tx *storage.Connection, step int64) error {
+	c.FirstTOTPStep = &step
+	return tx.UpdateOnly(c, "first_totp_step")
 }
 
 func (c *Challenge) HasExpired(expiryDuration float64) bool {
 	return time.Now().After(c.GetExpiryTime(expiryDuration))
 }
 
+// IsWithinRefreshGracePeriod reports whether the challenge has not expired
+// for longer than the grace period, i.e. whether it can still be refreshed
+func (c *Challenge) IsWithinRefreshGracePeriod(expiryDuration, gracePeriod float64) bool {
+	return time.Now().Before(c.GetExpiryTime(expiryDuration + gracePeriod))
+}
+
 func (c *Challenge) GetExpiryTime(expiryDuration float64) time.Time {
 	return c.CreatedAt.Add(time.Second * time.Duration(expiryDuration))
 }
+
+func challengeExpiryCutoff(expiryDuration float64) time.Time {
+	return time.Now().Add(-time.Second * time.Duration(expiryDuration))
+}
+
+// CountExpiredChallenges returns the number of challenges that are older than
+// the challenge expiry duration
+func CountExpiredChallenges(tx *storage.Connection, expiryDuration float64) (int, error) {
+	return tx.Q().Where("created_at < ?", challengeExpiryCutoff(expiryDuration)).Count(&Challenge{})
+}
+
+// PruneOpenChallenges deletes the factor's oldest unverified challenges so
+// that at most limit of them remain
+func PruneOpenChallenges(tx *storage.Connection, factorID uuid.UUID, limit int) error {
+	challengeTable := (&pop.Model{Value: Challenge{}}).TableName()
+	return tx.RawQuery("DELETE FROM "+challengeTable+" WHERE factor_id = ? AND verified_at IS NULL AND id NOT IN (SELECT id FROM "+challengeTable+" WHERE factor_id = ? AND verified_at IS NULL ORDER BY created_at DESC LIMIT ?)", factorID, factorID, limit).Exec()
+}
+
+// DeleteOpenChallengesByFactorID deletes the factor's unverified challenges
+func DeleteOpenChallengesByFactorID(tx *storage.Connection, factorID uuid.UUID) error {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Challenge{}}).TableName()+" WHERE factor_id = ? AND verified_at IS NULL", factorID).Exec()
+}
+
+// DeleteChallengesByUserID deletes the challenges of all of the user's factors
+func DeleteChallengesByUserID(tx *storage.Connection, userID uuid.UUID) error {
+	challengeTable := (&pop.Model{Value: Challenge{}}).TableName()
+	factorTable := (&pop.Model{Value: Factor{}}).TableName()
+	return tx.RawQuery("DELETE FROM "+challengeTable+" WHERE factor_id IN (SELECT id FROM "+factorTable+" WHERE user_id = ?)", userID).Exec()
+}
+
+// DeleteExpiredChallenges deletes all challenges that are older than the
+// challenge expiry duration and returns the number of deleted rows
+func DeleteExpiredChallenges(tx *storage.Connection, expiryDuration float64) (int, error) {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Challenge{}}).TableName()+" WHERE created_at < ?", challengeExpiryCutoff(expiryDuration)).ExecWithCount()
+}
@@ -35,6 +35,20 @@ func NewCleanup(config *conf.GlobalConfiguration) *Cleanup {
 	tableFlowStates := FlowState{}.TableName()
 	tableMFAChallenges := Challenge{}.TableName()
 	tableMFAFactors := Factor{}.TableName()
+	tableMFAVerificationTokens := MFAVerificationToken{}.TableName()
+	tableMFAChallengeRequests := ChallengeRequest{}.TableName()
+
+	// unverified factors are pending enrollments that were never completed
+	enrollmentExpirySeconds := int(config.MFA.EnrollmentExpiry.Seconds())
+	if enrollmentExpirySeconds <= 0 {
+		enrollmentExpirySeconds = 24 * 60 * 60
+	}
+
+	// challenge requests only count while they are within the rate limit window
+	challengeRateLimitWindowSeconds := int(config.MFA.ChallengeRateLimitWindow.Seconds())
+	if challengeRateLimitWindowSeconds <= 0 {
+		challengeRateLimitWindowSeconds = 60 * 60
+	}
 
 	c := &Cleanup{}
 
@@ -52,7 +66,9 @@ func NewCleanup(config *conf.GlobalConfiguration) *Cleanup {
 		fmt.Sprintf("delete from %q where id in (select id from %q where created_at < now() - interval '24 hours' limit 100 for update skip locked);", tableRelayStates, tableRelayStates),
 		fmt.Sprintf("delete from %q where id in (select id from %q where created_at < now() - interval '24 hours' limit 100 for update skip locked);", tableFlowStates, tableFlowStates),
 		fmt.Sprintf("delete from %q where id in (select id from %q where created_at < now() - interval '24 hours' limit 100 for update skip locked);", tableMFAChallenges, tableMFAChallenges),
-		fmt.Sprintf("delete from %q where id in (select id from %q where created_at < now() - interval '24 hours' and status = 'unverified' limit 100 for update skip locked);", tableMFAFactors, tableMFAFactors),
+		fmt.Sprintf("delete from %q where id in (select id from %q where created_at < now() - interval '%d seconds' and status = 'unverified' and deleted_at is null limit 100 for update skip locked);", tableMFAFactors, tableMFAFactors, enrollmentExpirySeconds),
+		fmt.Sprintf("delete from %q where id in (select id from %q where expires_at < now() limit 100 for update skip locked);", tableMFAVerificationTokens, tableMFAVerificationTokens),
+		fmt.Sprintf("delete from %q where id in (select id from %q where created_at < now() - interval '%d seconds' limit 100 for update skip locked);", tableMFAChallengeRequests, tableMFAChallengeRequests, challengeRateLimitWindowSeconds),
 	)
 
 	if config.External.AnonymousUsers.Enabled {
@@ -49,6 +49,11 @@ func TruncateAll(conn *storage.Connection) error {
 			(&pop.Model{Value: SAMLRelayState{}}).TableName(),
 			(&pop.Model{Value: FlowState{}}).TableName(),
 			(&pop.Model{Value: OneTimeToken{}}).TableName(),
+			(&pop.Model{Value: RecoveryCode{}}).TableName(),
+			(&pop.Model{Value: EnrollIdempotencyKey{}}).TableName(),
+			(&pop.Model{Value: TrustedDevice{}}).TableName(),
+			(&pop.Model{Value: MFAVerificationToken{}}).TableName(),
+			(&pop.Model{Value: ChallengeRequest{}}).TableName(),
 		}
 
 		for _, tableName := range tables {
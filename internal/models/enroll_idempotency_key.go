@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// EnrollIdempotencyKey records the factor created by an enroll request that
+// carried an Idempotency-Key header, so that retries of the request return
+// the same factor.
+type EnrollIdempotencyKey struct {
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	Key       string    `json:"key" db:"key"`
+	FactorID  uuid.UUID `json:"factor_id" db:"factor_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func (EnrollIdempotencyKey) TableName() string {
+	tableName := "mfa_enroll_idempotency_keys"
+	return tableName
+}
+
+// SaveEnrollIdempotencyKey associates the key with the factor, replacing an
+// expired association of the same key
+func SaveEnrollIdempotencyKey(tx *storage.Connection, userID uuid.UUID, key string, factorID uuid.UUID) error {
+	return tx.RawQuery("INSERT INTO "+(&pop.Model{Value: EnrollIdempotencyKey{}}).TableName()+" (user_id, key, factor_id, created_at) VALUES (?, ?, ?, now()) ON CONFLICT (user_id, key) DO UPDATE SET factor_id = excluded.factor_id, created_at = excluded.created_at", userID, key, factorID).Exec()
+}
+
+// FindFactorByEnrollIdempotencyKey returns the factor that was created with
+// the key within the ttl
+func FindFactorByEnrollIdempotencyKey(tx *storage.Connection, userID uuid.UUID, key string, ttl time.Duration) (*Factor, error) {
+	var factor Factor
+	err := tx.RawQuery("SELECT f.* FROM "+(&pop.Model{Value: Factor{}}).TableName()+" f JOIN "+(&pop.Model{Value: EnrollIdempotencyKey{}}).TableName()+" k ON k.factor_id = f.id WHERE k.user_id = ? AND k.key = ? AND k.created_at > ? AND f.deleted_at IS NULL", userID, key, time.Now().Add(-ttl)).First(&factor)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		return nil, FactorNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &factor, nil
+}
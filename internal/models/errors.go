@@ -1,5 +1,7 @@
 package models
 
+import "fmt"
+
 // IsNotFoundError returns whether an error represents a "not found" error.
 func IsNotFoundError(err error) bool {
 	switch err.(type) {
@@ -27,6 +29,14 @@ func IsNotFoundError(err error) bool {
 		return true
 	case OneTimeTokenNotFoundError, *OneTimeTokenNotFoundError:
 		return true
+	case RecoveryCodeBatchNotFoundError, *RecoveryCodeBatchNotFoundError:
+		return true
+	case RecoveryCodeNotFoundError, *RecoveryCodeNotFoundError:
+		return true
+	case TrustedDeviceNotFoundError, *TrustedDeviceNotFoundError:
+		return true
+	case MFAVerificationTokenNotFoundError, *MFAVerificationTokenNotFoundError:
+		return true
 	}
 	return false
 }
@@ -86,6 +96,67 @@ func (e ChallengeNotFoundError) Error() string {
 	return "Challenge not found"
 }
 
+// ChallengeAlreadyVerifiedError represents when a concurrent request verified a challenge first.
+type ChallengeAlreadyVerifiedError struct{}
+
+func (e ChallengeAlreadyVerifiedError) Error() string {
+	return "Challenge already verified"
+}
+
+// TOTPStepAlreadyUsedError represents when a TOTP code of the same or a later
+// time step was accepted first, e.g. by a concurrent request.
+type TOTPStepAlreadyUsedError struct{}
+
+func (e TOTPStepAlreadyUsedError) Error() string {
+	return "TOTP time step already used"
+}
+
+// WebAuthnSignCountError represents when the signature counter of a WebAuthn
+// assertion is not greater than the stored one, e.g. because a concurrent
+// assertion was accepted first.
+type WebAuthnSignCountError struct{}
+
+func (e WebAuthnSignCountError) Error() string {
+	return "WebAuthn signature counter did not increase"
+}
+
+// RecoveryCodeNotFoundError represents when no valid recovery code matches.
+type RecoveryCodeNotFoundError struct{}
+
+func (e RecoveryCodeNotFoundError) Error() string {
+	return "Recovery code not found"
+}
+
+// RecoveryCodeBatchNotFoundError represents when a user has never generated recovery codes.
+type RecoveryCodeBatchNotFoundError struct{}
+
+func (e RecoveryCodeBatchNotFoundError) Error() string {
+	return "Recovery code batch not found"
+}
+
+// TrustedDeviceNotFoundError represents when a trusted device is not found.
+type TrustedDeviceNotFoundError struct{}
+
+func (e TrustedDeviceNotFoundError) Error() string {
+	return "Trusted device not found"
+}
+
+// MFAVerificationTokenNotFoundError represents when an MFA verification token is not found or was already used.
+type MFAVerificationTokenNotFoundError struct{}
+
+func (e MFAVerificationTokenNotFoundError) Error() string {
+	return "MFA verification token not found"
+}
+
+// UnsupportedFactorTypeError represents when a factor type is not supported.
+type UnsupportedFactorTypeError struct {
+	FactorType string
+}
+
+func (e UnsupportedFactorTypeError) Error() string {
+	return fmt.Sprintf("Factor type %q is not supported", e.FactorType)
+}
+
 // SSOProviderNotFoundError represents an error when a SSO Provider can't be
 // found.
 type SSOProviderNotFoundError struct{}
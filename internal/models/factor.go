@@ -30,7 +30,22 @@ func (factorState FactorState) String() string {
 	return ""
 }
 
-const TOTP = "totp"
+const (
+	TOTP     = "totp"
+	WebAuthn = "webauthn"
+	SMS      = "sms"
+)
+
+// ParseFactorType normalizes a factor type provided by a client and returns an
+// UnsupportedFactorTypeError if it is not one of TOTP, WebAuthn or SMS.
+func ParseFactorType(factorType string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(factorType))
+	switch normalized {
+	case TOTP, WebAuthn, SMS:
+		return normalized, nil
+	}
+	return "", UnsupportedFactorTypeError{FactorType: factorType}
+}
 
 type AuthenticationMethod int
 
@@ -47,6 +62,10 @@ const (
 	EmailChange
 	TokenRefresh
 	Anonymous
+	WebAuthnSignIn
+	RecoveryCodeSignIn
+	SMSSignIn
+	TrustedDeviceSignIn
 )
 
 func (authMethod AuthenticationMethod) String() string {
@@ -75,6 +94,14 @@ func (authMethod AuthenticationMethod) String() string {
 		return "token_refresh"
 	case Anonymous:
 		return "anonymous"
+	case WebAuthnSignIn:
+		return "webauthn"
+	case RecoveryCodeSignIn:
+		return "recovery_code"
+	case SMSSignIn:
+		return "sms"
+	case TrustedDeviceSignIn:
+		return "trusted_device"
 	}
 	return ""
 }
@@ -106,6 +133,14 @@ func ParseAuthenticationMethod(authMethod string) (AuthenticationMethod, error)
 		return EmailChange, nil
 	case "token_refresh":
 		return TokenRefresh, nil
+	case "webauthn":
+		return WebAuthnSignIn, nil
+	case "recovery_code":
+		return RecoveryCodeSignIn, nil
+	case "sms":
+		return SMSSignIn, nil
+	case "trusted_device":
+		return TrustedDeviceSignIn, nil
 	}
 	return 0, fmt.Errorf("unsupported authentication method %q", authMethod)
 }
@@ -121,6 +156,60 @@ type Factor struct {
 	Secret       string      `json:"-" db:"secret"`
 	FactorType   string      `json:"factor_type" db:"factor_type"`
 	Challenge    []Challenge `json:"-" has_many:"challenges"`
+	IsPrimary    bool        `json:"is_primary" db:"is_primary"`
+	// SortOrder is the position the user moved the factor to, factors
+	// without one are listed last
+	SortOrder *int `json:"sort_order,omitempty" db:"sort_order"`
+
+	FailedAttempts       int        `json:"-" db:"failed_attempts"`
+	FirstFailedAttemptAt *time.Time `json:"-" db:"first_failed_attempt_at"`
+	LockedUntil          *time.Time `json:"-" db:"locked_until"`
+	// LockoutLevel is the number of lockouts since the last successful
+	// verification, each one doubling the duration of the next when
+	// lockout backoff is enabled
+	LockoutLevel int `json:"-" db:"lockout_level"`
+
+	// LastTOTPStep is the time step of the last accepted TOTP code, codes
+	// from this or an earlier step are rejected.
+	LastTOTPStep *int64 `json:"-" db:"last_totp_step"`
+
+	// LastTOTPSkew is the number of time steps the last accepted TOTP code
+	// was ahead of (positive) or behind (negative) the server's clock
+	LastTOTPSkew *int `json:"-" db:"last_totp_skew"`
+
+	// TOTPAlgorithm, TOTPDigits and TOTPPeriod hold the parameters a TOTP
+	// factor was enrolled with. They are unset for factors enrolled before
+	// the parameters became configurable, which use SHA1, 6 digits and 30
+	// seconds.
+	TOTPAlgorithm *string `json:"-" db:"totp_algorithm"`
+	TOTPDigits    *int    `json:"-" db:"totp_digits"`
+	TOTPPeriod    *int    `json:"-" db:"totp_period"`
+
+	// WebAuthnCredentialID and WebAuthnPublicKey hold the base64url encoded
+	// credential ID and COSE public key of a registered WebAuthn
+	// authenticator. They are only set on verified webauthn factors.
+	// WebAuthnSignCount is the signature counter of the last assertion.
+	WebAuthnCredentialID *string `json:"-" db:"web_authn_credential_id"`
+	WebAuthnPublicKey    *string `json:"-" db:"web_authn_public_key"`
+	WebAuthnSignCount    int64   `json:"-" db:"web_authn_sign_count"`
+
+	// Phone is the number codes are sent to for sms factors
+	Phone *string `json:"phone,omitempty" db:"phone"`
+
+	// DeviceName and Platform are optional descriptions of the device the
+	// factor lives on, as supplied by the client on enrollment.
+	DeviceName *string `json:"device_name,omitempty" db:"device_name"`
+	Platform   *string `json:"platform,omitempty" db:"platform"`
+
+	// LastUsedAt is the time of the last successful verification
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+
+	// VerifiedAt is the time the factor was first verified
+	VerifiedAt *time.Time `json:"verified_at,omitempty" db:"verified_at"`
+
+	// DeletedAt is set once the factor is unenrolled. Deleted factors are
+	// retained but excluded from all lookups unless explicitly requested.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
 func (Factor) TableName() string {
@@ -138,9 +227,23 @@ func NewFactor(user *User, friendlyName string, factorType string, state FactorS
 		FriendlyName: friendlyName,
 		FactorType:   factorType,
 	}
+	if state == FactorStateVerified {
+		now := time.Now()
+		factor.VerifiedAt = &now
+	}
 	return factor
 }
 
+// SetDeviceMetadata sets the device name and platform, empty values are left unset
+func (f *Factor) SetDeviceMetadata(deviceName, platform string) {
+	if deviceName != "" {
+		f.DeviceName = &deviceName
+	}
+	if platform != "" {
+		f.Platform = &platform
+	}
+}
+
 func (f *Factor) SetSecret(secret string, encrypt bool, encryptionKeyID, encryptionKey string) error {
 	f.Secret = secret
 	if encrypt {
@@ -168,9 +271,87 @@ func (f *Factor) GetSecret(decryptionKeys map[string]string, encrypt bool, encry
 	return f.Secret, encrypt, nil
 }
 
+// EncryptPlaintextFactorSecrets encrypts all TOTP secrets that are still
+// stored in plaintext, e.g. ones created before database encryption was
+// enabled. It returns the number of factors that were updated.
+func EncryptPlaintextFactorSecrets(tx *storage.Connection, encryptionKeyID, encryptionKey string) (int, error) {
+	factors := []*Factor{}
+	if err := tx.RawQuery("SELECT * FROM "+(&pop.Model{Value: Factor{}}).TableName()+" WHERE factor_type = ? FOR UPDATE", TOTP).All(&factors); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, factor := range factors {
+		if factor.Secret == "" || crypto.ParseEncryptedString(factor.Secret) != nil {
+			continue
+		}
+		if err := factor.SetSecret(factor.Secret, true, encryptionKeyID, encryptionKey); err != nil {
+			return updated, err
+		}
+		if err := tx.UpdateOnly(factor, "secret", "updated_at"); err != nil {
+			return updated, err
+		}
+		updated += 1
+	}
+
+	return updated, nil
+}
+
 func FindFactorByFactorID(conn *storage.Connection, factorID uuid.UUID) (*Factor, error) {
 	var factor Factor
-	err := conn.Find(&factor, factorID)
+	err := conn.Q().Where("id = ? and deleted_at is null", factorID).First(&factor)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		return nil, FactorNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &factor, nil
+}
+
+// FactorFilter restricts the factors returned by FindFactorsByUserID. Empty
+// fields are not filtered on. Deleted factors are only returned if
+// IncludeDeleted is set.
+type FactorFilter struct {
+	Status         string
+	FactorType     string
+	IncludeDeleted bool
+}
+
+// FindFactorsByUserID returns the user's factors in the order the user chose,
+// factors without a sort order follow by creation time. If
+// pageParams is set only the requested page is returned and pageParams.Count
+// is set to the total number of matching factors.
+func FindFactorsByUserID(conn *storage.Connection, userID uuid.UUID, filter FactorFilter, pageParams *Pagination) ([]*Factor, error) {
+	factors := []*Factor{}
+	q := conn.Q().Where("user_id = ?", userID)
+	if filter.Status != "" {
+		q = q.Where("status = ?", filter.Status)
+	}
+	if filter.FactorType != "" {
+		q = q.Where("factor_type = ?", filter.FactorType)
+	}
+	if !filter.IncludeDeleted {
+		q = q.Where("deleted_at is null")
+	}
+	q = q.Order("sort_order asc nulls last, created_at asc")
+
+	var err error
+	if pageParams != nil {
+		err = q.Paginate(int(pageParams.Page), int(pageParams.PerPage)).All(&factors)
+		pageParams.Count = uint64(q.Paginator.TotalEntriesSize)
+	} else {
+		err = q.All(&factors)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Database error when finding MFA factors associated to user")
+	}
+	return factors, nil
+}
+
+// FindPrimaryFactorByUserID returns the factor the user has marked as their default.
+func FindPrimaryFactorByUserID(conn *storage.Connection, userID uuid.UUID) (*Factor, error) {
+	var factor Factor
+	err := conn.Q().Where("user_id = ? and is_primary = true and deleted_at is null", userID).First(&factor)
 	if err != nil && errors.Cause(err) == sql.ErrNoRows {
 		return nil, FactorNotFoundError{}
 	} else if err != nil {
@@ -196,9 +377,170 @@ func (f *Factor) UpdateFriendlyName(tx *storage.Connection, friendlyName string)
 // UpdateStatus modifies the factor status
 func (f *Factor) UpdateStatus(tx *storage.Connection, state FactorState) error {
 	f.Status = state.String()
+	if state == FactorStateVerified && f.VerifiedAt == nil {
+		now := time.Now()
+		f.VerifiedAt = &now
+		return tx.UpdateOnly(f, "status", "verified_at", "updated_at")
+	}
 	return tx.UpdateOnly(f, "status", "updated_at")
 }
 
+// UpdateWebAuthnCredential stores the credential registered by a WebAuthn authenticator
+func (f *Factor) UpdateWebAuthnCredential(tx *storage.Connection, credentialID, publicKey string, signCount uint32) error {
+	f.WebAuthnCredentialID = &credentialID
+	f.WebAuthnPublicKey = &publicKey
+	f.WebAuthnSignCount = int64(signCount)
+	return tx.UpdateOnly(f, "web_authn_credential_id", "web_authn_public_key", "web_authn_sign_count", "updated_at")
+}
+
+// UpdateWebAuthnSignCount stores the signature counter of an assertion. The
+// update only applies if the counter increased, or stays 0 for authenticators
+// without a counter, otherwise a concurrent assertion was accepted first and
+// WebAuthnSignCountError is returned.
+func (f *Factor) UpdateWebAuthnSignCount(tx *storage.Connection, signCount uint32) error {
+	count, err := tx.RawQuery("UPDATE "+(&pop.Model{Value: Factor{}}).TableName()+" SET web_authn_sign_count = ?, updated_at = now() WHERE id = ? AND (web_authn_sign_count < ? OR (web_authn_sign_count = 0 AND ? = 0))", int64(signCount), f.ID, int64(signCount), int64(signCount)).ExecWithCount()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return WebAuthnSignCountError{}
+	}
+	f.WebAuthnSignCount = int64(signCount)
+	return nil
+}
+
+// SetPrimary marks the factor as the user's primary factor and demotes any
+// previously primary factor. It must be called inside a transaction so that a
+// user never ends up with two primary factors.
+func (f *Factor) SetPrimary(tx *storage.Connection) error {
+	// lock the user's factors so that concurrent requests are serialized
+	if err := tx.RawQuery("SELECT id FROM "+(&pop.Model{Value: Factor{}}).TableName()+" WHERE user_id = ? FOR UPDATE", f.UserID).Exec(); err != nil {
+		return err
+	}
+	if err := tx.RawQuery("UPDATE "+(&pop.Model{Value: Factor{}}).TableName()+" SET is_primary = false, updated_at = now() WHERE user_id = ? AND id != ? AND is_primary = true", f.UserID, f.ID).Exec(); err != nil {
+		return err
+	}
+	f.IsPrimary = true
+	return tx.UpdateOnly(f, "is_primary", "updated_at")
+}
+
+// SetFactorOrder lists the user's factors in the order of factorIDs. Factors
+// missing from factorIDs are listed after them.
+func SetFactorOrder(tx *storage.Connection, userID uuid.UUID, factorIDs []uuid.UUID) error {
+	table := (&pop.Model{Value: Factor{}}).TableName()
+	// lock the user's factors so that concurrent requests are serialized
+	if err := tx.RawQuery("SELECT id FROM "+table+" WHERE user_id = ? FOR UPDATE", userID).Exec(); err != nil {
+		return err
+	}
+	if err := tx.RawQuery("UPDATE "+table+" SET sort_order = NULL WHERE user_id = ? AND sort_order IS NOT NULL", userID).Exec(); err != nil {
+		return err
+	}
+	for i, id := range factorIDs {
+		if err := tx.RawQuery("UPDATE "+table+" SET sort_order = ?, updated_at = now() WHERE user_id = ? AND id = ?", i+1, userID, id).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsLocked reports whether verification is refused due to too many failed attempts
+func (f *Factor) IsLocked() bool {
+	return f.LockedUntil != nil && time.Now().Before(*f.LockedUntil)
+}
+
+// RecordFailedAttempt counts a failed verification attempt. Once maxAttempts
+// failures happen within window the factor is locked for the window duration.
+// With a backoff base set the factor is instead locked for backoffBase,
+// doubled for every lockout since the last successful verification up to
+// backoffCap, and every further failure locks it again at the next level.
+// It reports whether this attempt locked a factor that was not locked before,
+// extending an existing lock does not count. The counter is read from the
+// locked factor row, so concurrent failures are all counted.
+func (f *Factor) RecordFailedAttempt(tx *storage.Connection, maxAttempts int, window, backoffBase, backoffCap time.Duration) (bool, error) {
+	var locked bool
+	err := tx.Transaction(func(tx *storage.Connection) error {
+		current := &Factor{}
+		if terr := tx.RawQuery("SELECT * FROM "+(&pop.Model{Value: Factor{}}).TableName()+" WHERE id = ? FOR UPDATE", f.ID).First(current); terr != nil {
+			return terr
+		}
+		f.FailedAttempts = current.FailedAttempts
+		f.FirstFailedAttemptAt = current.FirstFailedAttemptAt
+		f.LockedUntil = current.LockedUntil
+		f.LockoutLevel = current.LockoutLevel
+
+		wasLocked := f.IsLocked()
+		now := time.Now()
+		if f.FirstFailedAttemptAt == nil || now.Sub(*f.FirstFailedAttemptAt) > window {
+			f.FailedAttempts = 0
+			f.FirstFailedAttemptAt = &now
+		}
+		f.FailedAttempts += 1
+		escalated := backoffBase > 0 && f.LockoutLevel > 0
+		if maxAttempts > 0 && (f.FailedAttempts >= maxAttempts || escalated) {
+			duration := window
+			if backoffBase > 0 {
+				duration = lockoutBackoff(f.LockoutLevel, backoffBase, backoffCap)
+				if duration < backoffCap {
+					f.LockoutLevel += 1
+				}
+			}
+			lockedUntil := now.Add(duration)
+			f.LockedUntil = &lockedUntil
+		}
+		if terr := tx.UpdateOnly(f, "failed_attempts", "first_failed_attempt_at", "locked_until", "lockout_level", "updated_at"); terr != nil {
+			return terr
+		}
+		locked = !wasLocked && f.IsLocked()
+		return nil
+	})
+	return locked, err
+}
+
+// lockoutBackoff returns base doubled level times, capped at backoffCap
+func lockoutBackoff(level int, base, backoffCap time.Duration) time.Duration {
+	duration := base
+	for i := 0; i < level && duration < backoffCap; i++ {
+		duration *= 2
+	}
+	if duration > backoffCap {
+		return backoffCap
+	}
+	return duration
+}
+
+// ResetFailedAttempts clears the failed attempt counter after a successful verification
+func (f *Factor) ResetFailedAttempts(tx *storage.Connection) error {
+	f.FailedAttempts = 0
+	f.FirstFailedAttemptAt = nil
+	f.LockedUntil = nil
+	f.LockoutLevel = 0
+	return tx.UpdateOnly(f, "failed_attempts", "first_failed_attempt_at", "locked_until", "lockout_level", "updated_at")
+}
+
+// UpdateLastTOTPStep records the time step of an accepted TOTP code unless a
+// code of the same or a later step was accepted already. Of concurrent
+// verifications of the same code only one succeeds, the others return
+// TOTPStepAlreadyUsedError.
+func (f *Factor) UpdateLastTOTPStep(tx *storage.Connection, step int64, skew int) error {
+	count, err := tx.RawQuery("UPDATE "+(&pop.Model{Value: Factor{}}).TableName()+" SET last_totp_step = ?, last_totp_skew = ?, updated_at = now() WHERE id = ? AND (last_totp_step IS NULL OR last_totp_step < ?)", step, skew, f.ID, step).ExecWithCount()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return TOTPStepAlreadyUsedError{}
+	}
+	f.LastTOTPStep = &step
+	f.LastTOTPSkew = &skew
+	return nil
+}
+
+// UpdateLastUsedAt records a successful verification of the factor
+func (f *Factor) UpdateLastUsedAt(tx *storage.Connection) error {
+	now := time.Now()
+	f.LastUsedAt = &now
+	return tx.UpdateOnly(f, "last_used_at", "updated_at")
+}
+
 // UpdateFactorType modifies the factor type
 func (f *Factor) UpdateFactorType(tx *storage.Connection, factorType string) error {
 	f.FactorType = factorType
@@ -218,6 +560,19 @@ func (f *Factor) DowngradeSessionsToAAL1(tx *storage.Connection) error {
 	return updateFactorAssociatedSessions(tx, f.UserID, f.ID, AAL1.String())
 }
 
+// SoftDelete marks the factor as deleted. A deleted factor stops being the
+// user's primary factor.
+func (f *Factor) SoftDelete(tx *storage.Connection) error {
+	now := time.Now()
+	f.DeletedAt = &now
+	f.IsPrimary = false
+	return tx.UpdateOnly(f, "deleted_at", "is_primary", "updated_at")
+}
+
+func (f *Factor) IsDeleted() bool {
+	return f.DeletedAt != nil
+}
+
 func (f *Factor) IsOwnedBy(user *User) bool {
 	return f.UserID == user.ID
 }
@@ -226,6 +581,17 @@ func (f *Factor) IsVerified() bool {
 	return f.Status == FactorStateVerified.String()
 }
 
+// AuthenticationMethod returns the AMR method recorded when the factor is verified.
+func (f *Factor) AuthenticationMethod() AuthenticationMethod {
+	switch f.FactorType {
+	case WebAuthn:
+		return WebAuthnSignIn
+	case SMS:
+		return SMSSignIn
+	}
+	return TOTPSignIn
+}
+
 func DeleteFactorsByUserId(tx *storage.Connection, userId uuid.UUID) error {
 	if err := tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Factor{}}).TableName()+" WHERE user_id = ?", userId).Exec(); err != nil {
 		return err
@@ -233,6 +599,31 @@ func DeleteFactorsByUserId(tx *storage.Connection, userId uuid.UUID) error {
 	return nil
 }
 
+// SoftDeleteFactorsByUserID marks all of the user's factors as deleted
+func SoftDeleteFactorsByUserID(tx *storage.Connection, userID uuid.UUID) error {
+	return tx.RawQuery("UPDATE "+(&pop.Model{Value: Factor{}}).TableName()+" SET deleted_at = now(), is_primary = false, updated_at = now() WHERE user_id = ? AND deleted_at IS NULL", userID).Exec()
+}
+
+// EnrollmentExpiresAt returns when an unverified factor is pruned if it has
+// not been verified by then
+func (f *Factor) EnrollmentExpiresAt(enrollmentExpiry time.Duration) time.Time {
+	return f.CreatedAt.Add(enrollmentExpiry)
+}
+
+// CountExpiredEnrollments counts the unverified factors created longer ago
+// than the enrollment expiry. Unenrolled factors are kept for the record and
+// are not counted.
+func CountExpiredEnrollments(tx *storage.Connection, enrollmentExpiry time.Duration) (int, error) {
+	return tx.Q().Where("status = ? AND created_at < ? AND deleted_at IS NULL", FactorStateUnverified.String(), time.Now().Add(-enrollmentExpiry)).Count(&Factor{})
+}
+
+// DeleteExpiredEnrollments deletes the unverified factors created longer ago
+// than the enrollment expiry and returns the number of deleted rows.
+// Unenrolled factors are kept for the record.
+func DeleteExpiredEnrollments(tx *storage.Connection, enrollmentExpiry time.Duration) (int, error) {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Factor{}}).TableName()+" WHERE status = ? AND created_at < ? AND deleted_at IS NULL", FactorStateUnverified.String(), time.Now().Add(-enrollmentExpiry)).ExecWithCount()
+}
+
 func DeleteExpiredFactors(tx *storage.Connection, validityDuration time.Duration) error {
 	totalSeconds := int64(validityDuration / time.Second)
 	validityInterval := fmt.Sprintf("interval '%d seconds'", totalSeconds)
@@ -240,7 +631,7 @@ func DeleteExpiredFactors(tx *storage.Connection, validityDuration time.Duration
 	factorTable := (&pop.Model{Value: Factor{}}).TableName()
 	challengeTable := (&pop.Model{Value: Challenge{}}).TableName()
 
-	query := fmt.Sprintf(`delete from %q where status != 'verified' and not exists (select * from %q where %q.id = %q.factor_id ) and created_at + %s < current_timestamp;`, factorTable, challengeTable, factorTable, challengeTable, validityInterval)
+	query := fmt.Sprintf(`delete from %q where status != 'verified' and deleted_at is null and not exists (select * from %q where %q.id = %q.factor_id ) and created_at + %s < current_timestamp;`, factorTable, challengeTable, factorTable, challengeTable, validityInterval)
 	if err := tx.RawQuery(query).Exec(); err != nil {
 		return err
 	}
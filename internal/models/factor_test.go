@@ -1,8 +1,11 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/stretchr/testify/require"
@@ -72,3 +75,234 @@ func (ts *FactorTestSuite) TestEncodedFactorDoesNotLeakSecret() {
 	json.Unmarshal(encodedFactor, &decodedFactor)
 	require.Equal(ts.T(), decodedFactor.Secret, "")
 }
+
+func (ts *FactorTestSuite) TestEncryptPlaintextFactorSecrets() {
+	keyID := "abc"
+	key := "pwFoiPyybQMqNmYVN0gUnpbfpGQV2sDv9vp0ZAxi_Y4"
+
+	updated, err := EncryptPlaintextFactorSecrets(ts.db, keyID, key)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, updated)
+
+	factor, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.NoError(ts.T(), err)
+	require.NotEqual(ts.T(), "topsecret", factor.Secret)
+
+	secret, shouldReEncrypt, err := factor.GetSecret(map[string]string{keyID: key}, true, keyID)
+	require.NoError(ts.T(), err)
+	require.False(ts.T(), shouldReEncrypt)
+	require.Equal(ts.T(), "topsecret", secret)
+
+	// already encrypted secrets are left alone
+	updated, err = EncryptPlaintextFactorSecrets(ts.db, keyID, key)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 0, updated)
+}
+
+func (ts *FactorTestSuite) TestDeleteExpiredChallenges() {
+	expiryDuration := 300.0
+
+	expired := NewChallenge(ts.TestFactor, "127.0.0.1")
+	require.NoError(ts.T(), ts.db.Create(expired))
+	require.NoError(ts.T(), ts.db.RawQuery("UPDATE "+expired.TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-time.Hour), expired.ID).Exec())
+
+	active := NewChallenge(ts.TestFactor, "127.0.0.1")
+	require.NoError(ts.T(), ts.db.Create(active))
+
+	count, err := CountExpiredChallenges(ts.db, expiryDuration)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, count)
+
+	deleted, err := DeleteExpiredChallenges(ts.db, expiryDuration)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, deleted)
+
+	_, err = FindChallengeByID(ts.db, expired.ID)
+	require.EqualError(ts.T(), err, ChallengeNotFoundError{}.Error())
+	_, err = FindChallengeByID(ts.db, active.ID)
+	require.NoError(ts.T(), err)
+}
+
+func (ts *FactorTestSuite) TestDeleteExpiredEnrollments() {
+	enrollmentExpiry := time.Hour
+	user, err := FindUserByID(ts.db, ts.TestFactor.UserID)
+	require.NoError(ts.T(), err)
+
+	require.NoError(ts.T(), ts.db.RawQuery("UPDATE "+ts.TestFactor.TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-2*time.Hour), ts.TestFactor.ID).Exec())
+
+	pending := NewFactor(user, "pending", TOTP, FactorStateUnverified)
+	require.NoError(ts.T(), ts.db.Create(pending))
+
+	verified := NewFactor(user, "verified", TOTP, FactorStateVerified)
+	require.NoError(ts.T(), ts.db.Create(verified))
+	require.NoError(ts.T(), ts.db.RawQuery("UPDATE "+verified.TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-2*time.Hour), verified.ID).Exec())
+
+	// unenrolled factors are kept for the record
+	unenrolled := NewFactor(user, "unenrolled", TOTP, FactorStateUnverified)
+	require.NoError(ts.T(), ts.db.Create(unenrolled))
+	require.NoError(ts.T(), unenrolled.SoftDelete(ts.db))
+	require.NoError(ts.T(), ts.db.RawQuery("UPDATE "+unenrolled.TableName()+" SET created_at = ? WHERE id = ?", time.Now().Add(-2*time.Hour), unenrolled.ID).Exec())
+
+	count, err := CountExpiredEnrollments(ts.db, enrollmentExpiry)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, count)
+
+	deleted, err := DeleteExpiredEnrollments(ts.db, enrollmentExpiry)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, deleted)
+
+	_, err = FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.EqualError(ts.T(), err, FactorNotFoundError{}.Error())
+	_, err = FindFactorByFactorID(ts.db, pending.ID)
+	require.NoError(ts.T(), err)
+	_, err = FindFactorByFactorID(ts.db, verified.ID)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.Find(&Factor{}, unenrolled.ID))
+}
+
+func (ts *FactorTestSuite) TestRecordFailedAttemptCountsConcurrentFailures() {
+	maxAttempts := 3
+	window := time.Minute
+
+	// every copy is loaded before any failure is recorded, like concurrent
+	// verification requests
+	copies := make([]*Factor, maxAttempts)
+	for i := range copies {
+		factor, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+		require.NoError(ts.T(), err)
+		copies[i] = factor
+	}
+
+	errs := make([]error, len(copies))
+	var wg sync.WaitGroup
+	for i, factor := range copies {
+		wg.Add(1)
+		go func(i int, factor *Factor) {
+			defer wg.Done()
+			_, errs[i] = factor.RecordFailedAttempt(ts.db, maxAttempts, window, 0, 0)
+		}(i, factor)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(ts.T(), err)
+	}
+
+	factor, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), maxAttempts, factor.FailedAttempts)
+	require.True(ts.T(), factor.IsLocked())
+}
+
+func (ts *FactorTestSuite) TestUpdateLastTOTPStepRejectsReplay() {
+	stale, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.NoError(ts.T(), err)
+
+	require.NoError(ts.T(), ts.TestFactor.UpdateLastTOTPStep(ts.db, 10, 0))
+	require.Equal(ts.T(), int64(10), *ts.TestFactor.LastTOTPStep)
+
+	// a concurrent request that checked the step before it was recorded
+	require.Nil(ts.T(), stale.LastTOTPStep)
+	require.EqualError(ts.T(), stale.UpdateLastTOTPStep(ts.db, 10, 0), TOTPStepAlreadyUsedError{}.Error())
+	require.EqualError(ts.T(), stale.UpdateLastTOTPStep(ts.db, 9, 0), TOTPStepAlreadyUsedError{}.Error())
+
+	require.NoError(ts.T(), stale.UpdateLastTOTPStep(ts.db, 11, 1))
+	factor, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), int64(11), *factor.LastTOTPStep)
+	require.Equal(ts.T(), 1, *factor.LastTOTPSkew)
+}
+
+func (ts *FactorTestSuite) TestUpdateWebAuthnSignCount() {
+	// authenticators without a counter always report 0
+	require.NoError(ts.T(), ts.TestFactor.UpdateWebAuthnSignCount(ts.db, 0))
+	require.NoError(ts.T(), ts.TestFactor.UpdateWebAuthnSignCount(ts.db, 0))
+
+	stale, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.NoError(ts.T(), err)
+
+	require.NoError(ts.T(), ts.TestFactor.UpdateWebAuthnSignCount(ts.db, 5))
+	require.Equal(ts.T(), int64(5), ts.TestFactor.WebAuthnSignCount)
+
+	// a concurrent assertion with the same or a lower counter
+	require.EqualError(ts.T(), stale.UpdateWebAuthnSignCount(ts.db, 5), WebAuthnSignCountError{}.Error())
+	require.EqualError(ts.T(), stale.UpdateWebAuthnSignCount(ts.db, 0), WebAuthnSignCountError{}.Error())
+
+	require.NoError(ts.T(), stale.UpdateWebAuthnSignCount(ts.db, 6))
+	factor, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), int64(6), factor.WebAuthnSignCount)
+}
+
+func (ts *FactorTestSuite) TestChallengeIDVersion7() {
+	challenge := NewChallengeWithIDVersion(ts.TestFactor, "127.0.0.1", conf.MFAChallengeIDVersion7)
+	require.Equal(ts.T(), byte(uuid.V7), challenge.ID.Version())
+	require.NoError(ts.T(), ts.db.Create(challenge))
+
+	found, err := FindChallengeByID(ts.db, challenge.ID)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), challenge.ID, found.ID)
+
+	// refreshed challenges keep the id version
+	require.Equal(ts.T(), byte(uuid.V7), challenge.Refresh(ts.TestFactor, "127.0.0.1").ID.Version())
+	require.Equal(ts.T(), byte(uuid.V4), NewChallenge(ts.TestFactor, "127.0.0.1").Refresh(ts.TestFactor, "127.0.0.1").ID.Version())
+}
+
+func TestChallengeIDsV7AreMonotonic(t *testing.T) {
+	g := &uuidV7Generator{}
+	now := time.Now()
+
+	// more ids than the counter can hold in one millisecond
+	previous := uuid.Nil
+	for i := 0; i < 10000; i++ {
+		id, err := g.next(now)
+		require.NoError(t, err)
+		require.Equal(t, byte(uuid.V7), id.Version())
+		require.Equal(t, 1, bytes.Compare(id.Bytes(), previous.Bytes()), "id %d is not greater than the previous one", i)
+		previous = id
+	}
+
+	// a clock going backwards does not break the order
+	id, err := g.next(now.Add(-time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Compare(id.Bytes(), previous.Bytes()))
+}
+
+func (ts *FactorTestSuite) TestSoftDelete() {
+	require.NoError(ts.T(), ts.TestFactor.SetPrimary(ts.db))
+	require.NoError(ts.T(), ts.TestFactor.SoftDelete(ts.db))
+	require.True(ts.T(), ts.TestFactor.IsDeleted())
+	require.False(ts.T(), ts.TestFactor.IsPrimary)
+
+	_, err := FindFactorByFactorID(ts.db, ts.TestFactor.ID)
+	require.EqualError(ts.T(), err, FactorNotFoundError{}.Error())
+	_, err = FindPrimaryFactorByUserID(ts.db, ts.TestFactor.UserID)
+	require.EqualError(ts.T(), err, FactorNotFoundError{}.Error())
+
+	factors, err := FindFactorsByUserID(ts.db, ts.TestFactor.UserID, FactorFilter{}, nil)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), factors)
+
+	factors, err = FindFactorsByUserID(ts.db, ts.TestFactor.UserID, FactorFilter{IncludeDeleted: true}, nil)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), factors, 1)
+	require.Equal(ts.T(), ts.TestFactor.ID, factors[0].ID)
+	require.NotNil(ts.T(), factors[0].DeletedAt)
+
+	user, err := FindUserByID(ts.db, ts.TestFactor.UserID)
+	require.NoError(ts.T(), err)
+	require.Empty(ts.T(), user.Factors)
+
+	// the name of a deleted factor can be reused
+	replacement := NewFactor(user, ts.TestFactor.FriendlyName, TOTP, FactorStateUnverified)
+	require.NoError(ts.T(), ts.db.Create(replacement))
+}
+
+func TestParseFactorType(t *testing.T) {
+	for _, factorType := range []string{TOTP, WebAuthn, SMS, " TOTP "} {
+		_, err := ParseFactorType(factorType)
+		require.NoError(t, err, factorType)
+	}
+
+	_, err := ParseFactorType("magic")
+	require.ErrorIs(t, err, UnsupportedFactorTypeError{FactorType: "magic"})
+}
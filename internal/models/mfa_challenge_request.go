@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// ChallengeRequest records that a user created a challenge, so that challenge
+// creation can be rate limited per user across all of their factors
+type ChallengeRequest struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func (ChallengeRequest) TableName() string {
+	tableName := "mfa_challenge_requests"
+	return tableName
+}
+
+// RecordChallengeRequest counts a challenge created by the user against the
+// limit of challenges within the sliding window. When the limit is reached
+// nothing is recorded and the time the next challenge is allowed at is
+// returned instead.
+func RecordChallengeRequest(tx *storage.Connection, userID uuid.UUID, limit int, window time.Duration) (*time.Time, error) {
+	// lock the user so that concurrent requests are serialized
+	if err := tx.RawQuery("SELECT id FROM "+(&pop.Model{Value: User{}}).TableName()+" WHERE id = ? FOR UPDATE", userID).Exec(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	recent := []ChallengeRequest{}
+	if err := tx.Q().Where("user_id = ? AND created_at > ?", userID, now.Add(-window)).Order("created_at desc").Limit(limit).All(&recent); err != nil {
+		return nil, err
+	}
+	if len(recent) >= limit {
+		// the oldest of the counted requests has to leave the window first
+		allowedAt := recent[len(recent)-1].CreatedAt.Add(window)
+		return &allowedAt, nil
+	}
+
+	return nil, tx.Create(&ChallengeRequest{
+		ID:        uuid.Must(uuid.NewV4()),
+		UserID:    userID,
+		CreatedAt: now,
+	})
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"github.com/gobuffalo/pop/v6"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// MFAStats aggregates the MFA state of all users
+type MFAStats struct {
+	FactorsByType            map[string]int `json:"factors_by_type"`
+	FactorsByStatus          map[string]int `json:"factors_by_status"`
+	ActiveChallenges         int            `json:"active_challenges"`
+	OutstandingRecoveryCodes int            `json:"outstanding_recovery_codes"`
+
+	// TOTPSkews counts verified TOTP factors by the skew, in time steps, of
+	// their last accepted code. Factors that were not used since skews are
+	// recorded are not counted.
+	TOTPSkews map[string]int `json:"totp_skews"`
+}
+
+type mfaStatsGroupCount struct {
+	Key   string `db:"key"`
+	Count int    `db:"count"`
+}
+
+// GetMFAStats counts the factors that have not been deleted by type and by
+// status, the challenges that have neither expired nor been verified, and the
+// valid recovery codes that have not been used yet, and the distribution of
+// the last accepted TOTP skews
+func GetMFAStats(tx *storage.Connection, challengeExpiryDuration float64) (*MFAStats, error) {
+	factorTable := (&pop.Model{Value: Factor{}}).TableName()
+	stats := &MFAStats{
+		FactorsByType:   map[string]int{},
+		FactorsByStatus: map[string]int{},
+		TOTPSkews:       map[string]int{},
+	}
+
+	byType := []mfaStatsGroupCount{}
+	if err := tx.RawQuery("SELECT factor_type AS key, count(*) AS count FROM " + factorTable + " WHERE deleted_at IS NULL GROUP BY factor_type").All(&byType); err != nil {
+		return nil, err
+	}
+	for _, c := range byType {
+		stats.FactorsByType[c.Key] = c.Count
+	}
+
+	byStatus := []mfaStatsGroupCount{}
+	if err := tx.RawQuery("SELECT status AS key, count(*) AS count FROM " + factorTable + " WHERE deleted_at IS NULL GROUP BY status").All(&byStatus); err != nil {
+		return nil, err
+	}
+	for _, c := range byStatus {
+		stats.FactorsByStatus[c.Key] = c.Count
+	}
+
+	bySkew := []mfaStatsGroupCount{}
+	if err := tx.RawQuery("SELECT last_totp_skew::text AS key, count(*) AS count FROM "+factorTable+" WHERE deleted_at IS NULL AND factor_type = ? AND status = ? AND last_totp_skew IS NOT NULL GROUP BY last_totp_skew", TOTP, FactorStateVerified.String()).All(&bySkew); err != nil {
+		return nil, err
+	}
+	for _, c := range bySkew {
+		stats.TOTPSkews[c.Key] = c.Count
+	}
+
+	var err error
+	if stats.ActiveChallenges, err = tx.Q().Where("verified_at is null and created_at >= ?", challengeExpiryCutoff(challengeExpiryDuration)).Count(&Challenge{}); err != nil {
+		return nil, err
+	}
+	if stats.OutstandingRecoveryCodes, err = tx.Q().Where("valid = true and verified_at is null").Count(&RecoveryCode{}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// MFAVerificationToken is handed out instead of a session when a factor is
+// verified, so that a different service can exchange it for the upgraded
+// session. Only the hash of the token is stored.
+type MFAVerificationToken struct {
+	ID        uuid.UUID `json:"id" db:"id"`
+	TokenHash string    `json:"-" db:"token_hash"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id"`
+	SessionID uuid.UUID `json:"session_id" db:"session_id"`
+	FactorID  uuid.UUID `json:"factor_id" db:"factor_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+func (MFAVerificationToken) TableName() string {
+	tableName := "mfa_verification_tokens"
+	return tableName
+}
+
+// NewMFAVerificationToken creates a token for the session that verified the
+// factor, valid for ttl. It returns the plaintext token along with the record.
+func NewMFAVerificationToken(user *User, session *Session, factor *Factor, ttl time.Duration) (*MFAVerificationToken, string) {
+	token := crypto.SecureToken(32)
+	now := time.Now()
+	return &MFAVerificationToken{
+		ID:        uuid.Must(uuid.NewV4()),
+		TokenHash: hashMFAVerificationToken(token),
+		UserID:    user.ID,
+		SessionID: session.ID,
+		FactorID:  factor.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}, token
+}
+
+func hashMFAVerificationToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// IsExpired checks if the token can no longer be exchanged at now
+func (t *MFAVerificationToken) IsExpired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// ConsumeMFAVerificationToken finds the token and deletes it so that it can
+// be exchanged only once. Of concurrent consumptions of the same token only
+// one succeeds, the others return MFAVerificationTokenNotFoundError.
+func ConsumeMFAVerificationToken(tx *storage.Connection, token string) (*MFAVerificationToken, error) {
+	var t MFAVerificationToken
+	err := tx.Q().Where("token_hash = ?", hashMFAVerificationToken(token)).First(&t)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		return nil, MFAVerificationTokenNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	count, err := tx.RawQuery("DELETE FROM "+(&pop.Model{Value: MFAVerificationToken{}}).TableName()+" WHERE id = ?", t.ID).ExecWithCount()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, MFAVerificationTokenNotFoundError{}
+	}
+	return &t, nil
+}
@@ -0,0 +1,237 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// RecoveryCode is a single use code that can be used in place of an MFA
+// factor when the user no longer has access to it.
+type RecoveryCode struct {
+	ID     uuid.UUID `json:"id" db:"id"`
+	UserID uuid.UUID `json:"user_id" db:"user_id"`
+	// RecoveryCode holds the hex encoded SHA-256 hash of the code. Older
+	// codes may still be stored as a bcrypt or argon2 hash, or in plaintext.
+	RecoveryCode string     `json:"-" db:"recovery_code"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	VerifiedAt   *time.Time `json:"verified_at,omitempty" db:"verified_at"`
+	// VerifiedIP is the IP address the code was used from
+	VerifiedIP *string `json:"verified_ip,omitempty" db:"verified_ip"`
+	Valid      bool    `json:"valid" db:"valid"`
+	// BatchID is shared by all codes created by the same generation
+	BatchID uuid.UUID `json:"batch_id" db:"batch_id"`
+}
+
+// RecoveryCodeBatch is a set of recovery codes created by one generation
+type RecoveryCodeBatch struct {
+	ID        uuid.UUID `json:"id" db:"batch_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+func (RecoveryCode) TableName() string {
+	tableName := "mfa_recovery_codes"
+	return tableName
+}
+
+// hashRecoveryCode returns the hex encoded SHA-256 hash of a recovery code.
+// Codes are long random strings, so unlike passwords they need no slow hash,
+// and the hash can be looked up directly.
+func hashRecoveryCode(recoveryCode string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(recoveryCode)))
+}
+
+// NewRecoveryCode creates a recovery code of the batch that stores only a
+// hash of the code
+func NewRecoveryCode(user *User, batchID uuid.UUID, recoveryCode string) *RecoveryCode {
+	return &RecoveryCode{
+		ID:           uuid.Must(uuid.NewV4()),
+		UserID:       user.ID,
+		RecoveryCode: hashRecoveryCode(recoveryCode),
+		Valid:        true,
+		BatchID:      batchID,
+	}
+}
+
+// HashPlaintextRecoveryCodes hashes all recovery codes that are still stored
+// in plaintext. It returns the number of codes that were updated.
+func HashPlaintextRecoveryCodes(tx *storage.Connection) (int, error) {
+	codes := []*RecoveryCode{}
+	if err := tx.RawQuery("SELECT * FROM " + (&pop.Model{Value: RecoveryCode{}}).TableName() + " FOR UPDATE").All(&codes); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, code := range codes {
+		if code.IsHashed() {
+			continue
+		}
+		code.RecoveryCode = hashRecoveryCode(code.RecoveryCode)
+		if err := tx.UpdateOnly(code, "recovery_code"); err != nil {
+			return updated, err
+		}
+		updated += 1
+	}
+
+	return updated, nil
+}
+
+// FindValidRecoveryCodesByUser returns all of the user's recovery codes that
+// have not been used or invalidated yet.
+func FindValidRecoveryCodesByUser(tx *storage.Connection, user *User) ([]*RecoveryCode, error) {
+	recoveryCodes := []*RecoveryCode{}
+	if err := tx.Q().Where("user_id = ? and valid = true and verified_at is null", user.ID).Order("created_at asc").All(&recoveryCodes); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// FindUsedRecoveryCodesByUser returns the user's used recovery codes, most
+// recently used first. Used codes are kept until the cleanup command purges
+// them.
+func FindUsedRecoveryCodesByUser(tx *storage.Connection, user *User) ([]*RecoveryCode, error) {
+	recoveryCodes := []*RecoveryCode{}
+	if err := tx.Q().Where("user_id = ? and verified_at is not null", user.ID).Order("verified_at desc").All(&recoveryCodes); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// FindLatestRecoveryCodeBatch returns the batch of recovery codes the user
+// generated last, whether or not any of its codes are still valid
+func FindLatestRecoveryCodeBatch(tx *storage.Connection, user *User) (*RecoveryCodeBatch, error) {
+	batches := []*RecoveryCodeBatch{}
+	if err := tx.RawQuery("SELECT batch_id, min(created_at) AS created_at FROM "+(&pop.Model{Value: RecoveryCode{}}).TableName()+" WHERE user_id = ? GROUP BY batch_id ORDER BY created_at DESC LIMIT 1", user.ID).All(&batches); err != nil {
+		return nil, err
+	}
+	if len(batches) == 0 {
+		return nil, RecoveryCodeBatchNotFoundError{}
+	}
+	return batches[0], nil
+}
+
+// CountRecoveryCodesByUser returns the number of codes in the user's current
+// set of recovery codes and how many of them have been used.
+func CountRecoveryCodesByUser(tx *storage.Connection, user *User) (total int, used int, err error) {
+	total, err = tx.Q().Where("user_id = ? and valid = true", user.ID).Count(&RecoveryCode{})
+	if err != nil {
+		return 0, 0, err
+	}
+	used, err = tx.Q().Where("user_id = ? and valid = true and verified_at is not null", user.ID).Count(&RecoveryCode{})
+	if err != nil {
+		return 0, 0, err
+	}
+	return total, used, nil
+}
+
+// FindValidRecoveryCodeByUserForUpdate returns the user's valid recovery code
+// matching the candidate and locks it until the transaction ends, so that
+// concurrent requests cannot consume it twice. Codes stored as a SHA-256 hash
+// are looked up by their hash. Only codes stored in an older format are
+// compared one by one, and the matched one is locked after the comparison.
+func FindValidRecoveryCodeByUserForUpdate(ctx context.Context, tx *storage.Connection, user *User, candidate string) (*RecoveryCode, error) {
+	table := (&pop.Model{Value: RecoveryCode{}}).TableName()
+
+	code := &RecoveryCode{}
+	err := tx.RawQuery("SELECT * FROM "+table+" WHERE user_id = ? AND recovery_code = ? AND valid = true AND verified_at IS NULL LIMIT 1 FOR UPDATE", user.ID, hashRecoveryCode(candidate)).First(code)
+	if err == nil {
+		return code, nil
+	} else if errors.Cause(err) != sql.ErrNoRows {
+		return nil, err
+	}
+
+	legacy := []*RecoveryCode{}
+	if err := tx.RawQuery("SELECT * FROM "+table+" WHERE user_id = ? AND length(recovery_code) <> ? AND valid = true AND verified_at IS NULL", user.ID, sha256.Size*2).All(&legacy); err != nil {
+		return nil, err
+	}
+	// every code is compared, without stopping at a match, so that timing
+	// reveals neither whether nor which code matched
+	var matched *RecoveryCode
+	for _, code := range legacy {
+		if code.Matches(ctx, candidate) && matched == nil {
+			matched = code
+		}
+	}
+	if matched == nil {
+		return nil, RecoveryCodeNotFoundError{}
+	}
+
+	err = tx.RawQuery("SELECT * FROM "+table+" WHERE id = ? AND valid = true AND verified_at IS NULL FOR UPDATE", matched.ID).First(code)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		// consumed by a concurrent request after the comparison
+		return nil, RecoveryCodeNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// InvalidateRecoveryCodesByUser marks all of the user's unused recovery codes
+// as invalid, e.g. before a new set is generated.
+func InvalidateRecoveryCodesByUser(tx *storage.Connection, user *User) error {
+	return tx.RawQuery("UPDATE "+(&pop.Model{Value: RecoveryCode{}}).TableName()+" SET valid = false WHERE user_id = ? AND valid = true AND verified_at IS NULL", user.ID).Exec()
+}
+
+// DeleteRecoveryCodesByUser deletes all of the user's recovery codes
+func DeleteRecoveryCodesByUser(tx *storage.Connection, user *User) error {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: RecoveryCode{}}).TableName()+" WHERE user_id = ?", user.ID).Exec()
+}
+
+// CountUsedRecoveryCodes returns the number of recovery codes that were used
+// more than retention ago
+func CountUsedRecoveryCodes(tx *storage.Connection, retention time.Duration) (int, error) {
+	return tx.Q().Where("verified_at < ?", time.Now().Add(-retention)).Count(&RecoveryCode{})
+}
+
+// DeleteUsedRecoveryCodes deletes recovery codes that were used more than
+// retention ago and returns the number of deleted rows
+func DeleteUsedRecoveryCodes(tx *storage.Connection, retention time.Duration) (int, error) {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: RecoveryCode{}}).TableName()+" WHERE verified_at < ?", time.Now().Add(-retention)).ExecWithCount()
+}
+
+// Consume marks the recovery code as used from ipAddress
+func (r *RecoveryCode) Consume(tx *storage.Connection, ipAddress string) error {
+	now := time.Now()
+	r.VerifiedAt = &now
+	if ipAddress != "" {
+		r.VerifiedIP = &ipAddress
+	}
+	return tx.UpdateOnly(r, "verified_at", "verified_ip")
+}
+
+// IsHashed checks if the code is stored as a SHA-256, bcrypt or argon2 hash.
+// Plaintext codes are at most 32 characters long and never contain '$'.
+func (r *RecoveryCode) IsHashed() bool {
+	return len(r.RecoveryCode) == sha256.Size*2 || r.isPasswordHashed()
+}
+
+// isPasswordHashed checks if the code is stored as a bcrypt or argon2 hash,
+// as codes were before they were hashed with SHA-256
+func (r *RecoveryCode) isPasswordHashed() bool {
+	return strings.HasPrefix(r.RecoveryCode, "$")
+}
+
+// Matches checks the candidate against the stored code
+func (r *RecoveryCode) Matches(ctx context.Context, candidate string) bool {
+	switch {
+	case r.isPasswordHashed():
+		return crypto.CompareHashAndPassword(ctx, r.RecoveryCode, candidate) == nil
+	case r.IsHashed():
+		return crypto.ConstantTimeEqual(r.RecoveryCode, hashRecoveryCode(candidate))
+	default:
+		return crypto.ConstantTimeEqual(r.RecoveryCode, candidate)
+	}
+}
+
+func (r *RecoveryCode) IsValid() bool {
+	return r.Valid && r.VerifiedAt == nil
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/supabase/auth/internal/conf"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/storage"
+	"github.com/supabase/auth/internal/storage/test"
+)
+
+type RecoveryCodeTestSuite struct {
+	suite.Suite
+	db       *storage.Connection
+	TestUser *User
+}
+
+func TestRecoveryCode(t *testing.T) {
+	globalConfig, err := conf.LoadGlobal(modelsTestConfig)
+	require.NoError(t, err)
+	conn, err := test.SetupDBConnection(globalConfig)
+	require.NoError(t, err)
+	ts := &RecoveryCodeTestSuite{
+		db: conn,
+	}
+	defer ts.db.Close()
+	suite.Run(t, ts)
+}
+
+func (ts *RecoveryCodeTestSuite) SetupTest() {
+	TruncateAll(ts.db)
+	user, err := NewUser("", "agenericemail@gmail.com", "secret", "test", nil)
+	require.NoError(ts.T(), err)
+	require.NoError(ts.T(), ts.db.Create(user))
+	ts.TestUser = user
+}
+
+func (ts *RecoveryCodeTestSuite) TestNewRecoveryCodeStoresHash() {
+	ctx := context.Background()
+	code := NewRecoveryCode(ts.TestUser, uuid.Must(uuid.NewV4()), "abcdefghij")
+	require.NoError(ts.T(), ts.db.Create(code))
+
+	codes, err := FindValidRecoveryCodesByUser(ts.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, 1)
+	require.True(ts.T(), codes[0].IsHashed())
+	require.Len(ts.T(), codes[0].RecoveryCode, 64)
+	require.NotEqual(ts.T(), "abcdefghij", codes[0].RecoveryCode)
+	require.True(ts.T(), codes[0].Matches(ctx, "abcdefghij"))
+	require.False(ts.T(), codes[0].Matches(ctx, "abcdefghik"))
+}
+
+func (ts *RecoveryCodeTestSuite) TestHashPlaintextRecoveryCodes() {
+	ctx := context.Background()
+	plaintext := &RecoveryCode{
+		ID:           uuid.Must(uuid.NewV4()),
+		UserID:       ts.TestUser.ID,
+		RecoveryCode: "abcdefghij",
+		Valid:        true,
+	}
+	require.NoError(ts.T(), ts.db.Create(plaintext))
+	require.True(ts.T(), plaintext.Matches(ctx, "abcdefghij"))
+
+	updated, err := HashPlaintextRecoveryCodes(ts.db)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 1, updated)
+
+	codes, err := FindValidRecoveryCodesByUser(ts.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, 1)
+	require.True(ts.T(), codes[0].IsHashed())
+	require.True(ts.T(), codes[0].Matches(ctx, "abcdefghij"))
+
+	// already hashed codes are left alone
+	updated, err = HashPlaintextRecoveryCodes(ts.db)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), 0, updated)
+}
+
+func (ts *RecoveryCodeTestSuite) TestFindValidRecoveryCodeByUserForUpdate() {
+	ctx := context.Background()
+	code := NewRecoveryCode(ts.TestUser, uuid.Must(uuid.NewV4()), "abcdefghij")
+	require.NoError(ts.T(), ts.db.Create(code))
+
+	// codes hashed before SHA-256 was used are still found
+	legacyHash, err := crypto.GenerateFromPassword(ctx, "klmnopqrst")
+	require.NoError(ts.T(), err)
+	legacy := &RecoveryCode{
+		ID:           uuid.Must(uuid.NewV4()),
+		UserID:       ts.TestUser.ID,
+		RecoveryCode: legacyHash,
+		Valid:        true,
+		BatchID:      code.BatchID,
+	}
+	require.NoError(ts.T(), ts.db.Create(legacy))
+
+	found, err := FindValidRecoveryCodeByUserForUpdate(ctx, ts.db, ts.TestUser, "abcdefghij")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), code.ID, found.ID)
+
+	found, err = FindValidRecoveryCodeByUserForUpdate(ctx, ts.db, ts.TestUser, "klmnopqrst")
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), legacy.ID, found.ID)
+
+	_, err = FindValidRecoveryCodeByUserForUpdate(ctx, ts.db, ts.TestUser, "uvwxyz0123")
+	require.True(ts.T(), IsNotFoundError(err))
+
+	// used codes are not found again
+	require.NoError(ts.T(), found.Consume(ts.db, "127.0.0.1"))
+	_, err = FindValidRecoveryCodeByUserForUpdate(ctx, ts.db, ts.TestUser, "klmnopqrst")
+	require.True(ts.T(), IsNotFoundError(err))
+}
+
+func (ts *RecoveryCodeTestSuite) TestFindLatestRecoveryCodeBatch() {
+	_, err := FindLatestRecoveryCodeBatch(ts.db, ts.TestUser)
+	require.True(ts.T(), IsNotFoundError(err))
+
+	older := uuid.Must(uuid.NewV4())
+	latest := uuid.Must(uuid.NewV4())
+	for _, batchID := range []uuid.UUID{older, latest} {
+		for _, plaintext := range []string{"abcdefghij", "klmnopqrst"} {
+			code := NewRecoveryCode(ts.TestUser, batchID, plaintext)
+			require.NoError(ts.T(), ts.db.Create(code))
+		}
+		if batchID == older {
+			require.NoError(ts.T(), InvalidateRecoveryCodesByUser(ts.db, ts.TestUser))
+		}
+	}
+
+	batch, err := FindLatestRecoveryCodeBatch(ts.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Equal(ts.T(), latest, batch.ID)
+	require.False(ts.T(), batch.CreatedAt.IsZero())
+
+	codes, err := FindValidRecoveryCodesByUser(ts.db, ts.TestUser)
+	require.NoError(ts.T(), err)
+	require.Len(ts.T(), codes, 2)
+	for _, code := range codes {
+		require.Equal(ts.T(), latest, code.BatchID)
+	}
+}
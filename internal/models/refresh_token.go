@@ -41,6 +41,10 @@ func (RefreshToken) TableName() string {
 type GrantParams struct {
 	FactorID *uuid.UUID
 
+	// TrustedDeviceID is set when the sign in skips the MFA challenge
+	// because it was made from a trusted device
+	TrustedDeviceID *uuid.UUID
+
 	SessionNotAfter *time.Time
 	SessionTag      *string
 
@@ -272,6 +272,12 @@ func LogoutAllExceptMe(tx *storage.Connection, sessionId uuid.UUID, userID uuid.
 	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Session{}}).TableName()+" WHERE id != ? AND user_id = ?", sessionId, userID).Exec()
 }
 
+// LogoutSessionsByFactorID deletes the AAL2 sessions that were verified with
+// the factor
+func LogoutSessionsByFactorID(tx *storage.Connection, factorID uuid.UUID) error {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: Session{}}).TableName()+" WHERE factor_id = ? AND aal = ?", factorID, AAL2.String()).Exec()
+}
+
 func (s *Session) UpdateAALAndAssociatedFactor(tx *storage.Connection, aal AuthenticatorAssuranceLevel, factorID *uuid.UUID) error {
 	s.FactorID = factorID
 	aalAsString := aal.String()
@@ -282,7 +288,8 @@ func (s *Session) UpdateAALAndAssociatedFactor(tx *storage.Connection, aal Authe
 func (s *Session) CalculateAALAndAMR(user *User) (aal AuthenticatorAssuranceLevel, amr []AMREntry, err error) {
 	amr, aal = []AMREntry{}, AAL1
 	for _, claim := range s.AMRClaims {
-		if *claim.AuthenticationMethod == TOTPSignIn.String() {
+		switch claim.GetAuthenticationMethod() {
+		case TOTPSignIn.String(), WebAuthnSignIn.String(), SMSSignIn.String(), RecoveryCodeSignIn.String(), TrustedDeviceSignIn.String():
 			aal = AAL2
 		}
 		amr = append(amr, AMREntry{Method: claim.GetAuthenticationMethod(), Timestamp: claim.UpdatedAt.Unix()})
@@ -323,6 +330,23 @@ func (s *Session) CalculateAALAndAMR(user *User) (aal AuthenticatorAssuranceLeve
 	return aal, amr, nil
 }
 
+// LastMFAVerifiedAt returns when a factor or recovery code was last verified
+// in the session, or nil if none was. Trusted devices are not counted as they
+// skip the verification.
+func (s *Session) LastMFAVerifiedAt() *time.Time {
+	var last *time.Time
+	for i := range s.AMRClaims {
+		claim := &s.AMRClaims[i]
+		switch claim.GetAuthenticationMethod() {
+		case TOTPSignIn.String(), WebAuthnSignIn.String(), SMSSignIn.String(), RecoveryCodeSignIn.String():
+			if last == nil || claim.UpdatedAt.After(*last) {
+				last = &claim.UpdatedAt
+			}
+		}
+	}
+	return last
+}
+
 func (s *Session) GetAAL() string {
 	if s.AAL == nil {
 		return ""
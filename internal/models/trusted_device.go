@@ -0,0 +1,84 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/supabase/auth/internal/crypto"
+	"github.com/supabase/auth/internal/storage"
+)
+
+// TrustedDevice is a device on which the user completed MFA and asked not to
+// be challenged again until ExpiresAt. The device presents an opaque token of
+// which only the hash is stored, so deleting the record revokes the device.
+type TrustedDevice struct {
+	ID        uuid.UUID  `json:"id" db:"id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	UserID    uuid.UUID  `json:"user_id" db:"user_id"`
+	FactorID  *uuid.UUID `json:"factor_id" db:"factor_id"`
+	UserAgent *string    `json:"user_agent" db:"user_agent"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	// Version is the user's trusted device version when the device was
+	// trusted, bumping the user's version revokes the device
+	Version int `json:"-" db:"version"`
+}
+
+func (TrustedDevice) TableName() string {
+	tableName := "mfa_trusted_devices"
+	return tableName
+}
+
+// NewTrustedDevice creates a device of the user that is trusted for ttl after
+// verifying the factor. It returns the plaintext token along with the record.
+func NewTrustedDevice(user *User, factor *Factor, userAgent string, ttl time.Duration) (*TrustedDevice, string) {
+	token := crypto.SecureToken(32)
+	now := time.Now()
+	device := &TrustedDevice{
+		ID:        uuid.Must(uuid.NewV4()),
+		TokenHash: hashTrustedDeviceToken(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Version:   user.TrustedDeviceVersion,
+	}
+	if factor != nil {
+		device.FactorID = &factor.ID
+	}
+	if userAgent != "" {
+		device.UserAgent = &userAgent
+	}
+	return device, token
+}
+
+func hashTrustedDeviceToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// IsExpired checks if the device is no longer trusted at now
+func (d *TrustedDevice) IsExpired(now time.Time) bool {
+	return !now.Before(d.ExpiresAt)
+}
+
+// FindTrustedDeviceByToken returns the trusted device of the user that was
+// issued the token
+func FindTrustedDeviceByToken(conn *storage.Connection, userID uuid.UUID, token string) (*TrustedDevice, error) {
+	var device TrustedDevice
+	err := conn.Q().Where("token_hash = ? AND user_id = ?", hashTrustedDeviceToken(token), userID).First(&device)
+	if err != nil && errors.Cause(err) == sql.ErrNoRows {
+		return nil, TrustedDeviceNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// DeleteTrustedDevicesByUserID revokes all of the user's trusted devices
+func DeleteTrustedDevicesByUserID(tx *storage.Connection, userID uuid.UUID) error {
+	return tx.RawQuery("DELETE FROM "+(&pop.Model{Value: TrustedDevice{}}).TableName()+" WHERE user_id = ?", userID).Exec()
+}
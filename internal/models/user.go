@@ -69,6 +69,13 @@ type User struct {
 	DeletedAt   *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
 	IsAnonymous bool       `json:"is_anonymous" db:"is_anonymous"`
 
+	// MFARequired requires MFA from the user regardless of the configured
+	// enforcement mode
+	MFARequired bool `json:"mfa_required" db:"mfa_required"`
+	// TrustedDeviceVersion is recorded on trusted devices, devices of an
+	// older version are no longer trusted
+	TrustedDeviceVersion int `json:"-" db:"mfa_trusted_device_version"`
+
 	DONTUSEINSTANCEID uuid.UUID `json:"-" db:"instance_id"`
 }
 
@@ -177,6 +184,19 @@ func (u *User) BeforeSave(tx *pop.Connection) error {
 	return nil
 }
 
+// AfterEagerFind is invoked after the user's associations have been loaded,
+// it drops deleted factors which the association cannot filter out
+func (u *User) AfterEagerFind(tx *pop.Connection) error {
+	factors := u.Factors[:0]
+	for _, factor := range u.Factors {
+		if !factor.IsDeleted() {
+			factors = append(factors, factor)
+		}
+	}
+	u.Factors = factors
+	return nil
+}
+
 // IsConfirmed checks if a user has already been
 // registered and confirmed.
 func (u *User) IsConfirmed() bool {
@@ -601,6 +621,20 @@ func FindUserByID(tx *storage.Connection, id uuid.UUID) (*User, error) {
 	return findUser(tx, "instance_id = ? and id = ?", uuid.Nil, id)
 }
 
+// LockUserForUpdate locks the user's row until the end of the transaction,
+// waiting for any other transaction holding the lock. It serializes changes
+// that depend on the state of rows belonging to the user.
+func LockUserForUpdate(tx *storage.Connection, id uuid.UUID) error {
+	user := &User{}
+	if err := tx.RawQuery(fmt.Sprintf("SELECT id FROM %q WHERE id = ? LIMIT 1 FOR UPDATE;", user.TableName()), id).First(user); err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return UserNotFoundError{}
+		}
+		return err
+	}
+	return nil
+}
+
 // FindUserWithRefreshToken finds a user from the provided refresh token. If
 // forUpdate is set to true, then the SELECT statement used by the query has
 // the form SELECT ... FOR UPDATE SKIP LOCKED. This means that a FOR UPDATE
@@ -768,6 +802,52 @@ func (u *User) IsBanned() bool {
 	return time.Now().Before(*u.BannedUntil)
 }
 
+// SetMFARequiredByRole sets whether MFA is required on at most limit users of
+// the role that do not have the value yet and returns the number of updated
+// users. Calling it until it returns 0 updates all of them in batches.
+func SetMFARequiredByRole(tx *storage.Connection, role string, required bool, limit int) (int, error) {
+	userTable := (&pop.Model{Value: User{}}).TableName()
+	return tx.RawQuery("UPDATE "+userTable+" SET mfa_required = ?, updated_at = now() WHERE id IN (SELECT id FROM "+userTable+" WHERE instance_id = ? AND role = ? AND mfa_required != ? LIMIT ?)", required, uuid.Nil, role, required, limit).ExecWithCount()
+}
+
+// RevokeTrustedDevices bumps the user's trusted device version so that all
+// trusted device tokens issued so far require MFA again
+func (u *User) RevokeTrustedDevices(tx *storage.Connection) error {
+	if err := tx.RawQuery("UPDATE "+(&pop.Model{Value: User{}}).TableName()+" SET mfa_trusted_device_version = mfa_trusted_device_version + 1 WHERE id = ?", u.ID).Exec(); err != nil {
+		return err
+	}
+	u.TrustedDeviceVersion++
+	return nil
+}
+
+// HasVerifiedFactor checks if the user has at least one verified MFA factor
+// that has not been unenrolled
+func (u *User) HasVerifiedFactor() bool {
+	for _, factor := range u.Factors {
+		if factor.IsVerified() && !factor.IsDeleted() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOnlyNewVerifiedFactors reports whether the user has verified factors and
+// all of them were verified within the grace period
+func (u *User) HasOnlyNewVerifiedFactors(gracePeriod time.Duration) bool {
+	cutoff := time.Now().Add(-gracePeriod)
+	hasVerifiedFactor := false
+	for _, factor := range u.Factors {
+		if !factor.IsVerified() {
+			continue
+		}
+		if factor.VerifiedAt == nil || factor.VerifiedAt.Before(cutoff) {
+			return false
+		}
+		hasVerifiedFactor = true
+	}
+	return hasVerifiedFactor
+}
+
 func (u *User) UpdateBannedUntil(tx *storage.Connection) error {
 	return tx.UpdateOnly(u, "banned_until")
 }
@@ -34,6 +34,14 @@ func ObtainMetricCounter(name, desc string) metric.Int64Counter {
 	return counter
 }
 
+func ObtainMetricHistogram(name, desc, unit string) metric.Float64Histogram {
+	histogram, err := Meter("gotrue").Float64Histogram(name, metric.WithDescription(desc), metric.WithUnit(unit))
+	if err != nil {
+		panic(err)
+	}
+	return histogram
+}
+
 func enablePrometheusMetrics(ctx context.Context, mc *conf.MetricsConfig) error {
 	exporter, err := prometheus.New()
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"net/url"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/XSAM/otelsql"
@@ -21,6 +22,16 @@ type Connection struct {
 	*pop.Connection
 }
 
+// NormalizeDriver maps the names PostgreSQL goes by in connection URLs to
+// the postgres dialect, other drivers are returned as is
+func NormalizeDriver(driver string) string {
+	switch strings.ToLower(driver) {
+	case "postgres", "postgresql", "pgx":
+		return "postgres"
+	}
+	return driver
+}
+
 // Dial will connect to that storage engine
 func Dial(config *conf.GlobalConfiguration) (*Connection, error) {
 	if config.DB.Driver == "" && config.DB.URL != "" {
@@ -30,6 +41,7 @@ func Dial(config *conf.GlobalConfiguration) (*Connection, error) {
 		}
 		config.DB.Driver = u.Scheme
 	}
+	config.DB.Driver = NormalizeDriver(config.DB.Driver)
 
 	driver := ""
 	if config.DB.Driver != "postgres" {
@@ -29,6 +29,20 @@ func TestGetExcludedColumns_InvalidName(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestNormalizeDriver(t *testing.T) {
+	cases := map[string]string{
+		"postgres":   "postgres",
+		"postgresql": "postgres",
+		"pgx":        "postgres",
+		"PostgreSQL": "postgres",
+		"mysql":      "mysql",
+		"":           "",
+	}
+	for driver, expected := range cases {
+		require.Equal(t, expected, NormalizeDriver(driver), driver)
+	}
+}
+
 func TestTransaction(t *testing.T) {
 	apiTestConfig := "../../hack/test.env"
 	config, err := conf.LoadGlobal(apiTestConfig)
@@ -0,0 +1,12 @@
+-- add webauthn credential storage to mfa_factors and challenge storage to mfa_challenges
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists web_authn_credential_id text null,
+  add column if not exists web_authn_public_key text null;
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists web_authn_challenge text null;
+
+create unique index if not exists mfa_factors_web_authn_credential_id_idx
+  on {{ index .Options "Namespace" }}.mfa_factors (web_authn_credential_id)
+  where web_authn_credential_id is not null;
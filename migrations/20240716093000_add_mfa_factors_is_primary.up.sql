@@ -0,0 +1,8 @@
+-- add is_primary to mfa_factors so a user can pick a default factor
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists is_primary boolean not null default false;
+
+create unique index if not exists mfa_factors_user_id_is_primary_idx
+  on {{ index .Options "Namespace" }}.mfa_factors (user_id)
+  where is_primary;
@@ -0,0 +1,15 @@
+-- add mfa_recovery_codes table to store single use MFA recovery codes
+
+create table if not exists {{ index .Options "Namespace" }}.mfa_recovery_codes(
+  id uuid not null,
+  user_id uuid not null,
+  recovery_code text not null,
+  created_at timestamptz not null,
+  verified_at timestamptz null,
+  constraint mfa_recovery_codes_pkey primary key(id),
+  constraint mfa_recovery_codes_user_id_fkey foreign key(user_id) references {{ index .Options "Namespace" }}.users(id) on delete cascade
+);
+
+comment on table {{ index .Options "Namespace" }}.mfa_recovery_codes is 'Auth: Stores single use recovery codes for multi factor authentication.';
+
+create index if not exists mfa_recovery_codes_user_id_idx on {{ index .Options "Namespace" }}.mfa_recovery_codes (user_id) where verified_at is null;
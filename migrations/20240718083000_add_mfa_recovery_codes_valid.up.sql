@@ -0,0 +1,8 @@
+-- add valid to mfa_recovery_codes so regenerating codes invalidates the previous set
+
+alter table {{ index .Options "Namespace" }}.mfa_recovery_codes
+  add column if not exists valid boolean not null default true;
+
+drop index if exists {{ index .Options "Namespace" }}.mfa_recovery_codes_user_id_idx;
+
+create index if not exists mfa_recovery_codes_user_id_idx on {{ index .Options "Namespace" }}.mfa_recovery_codes (user_id) where valid and verified_at is null;
@@ -0,0 +1,6 @@
+-- add failed verification attempt tracking to mfa_factors
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists failed_attempts integer not null default 0,
+  add column if not exists first_failed_attempt_at timestamptz null,
+  add column if not exists locked_until timestamptz null;
@@ -0,0 +1,4 @@
+-- add last_totp_step to mfa_factors to prevent replaying an accepted TOTP code
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists last_totp_step bigint null;
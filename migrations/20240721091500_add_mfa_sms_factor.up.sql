@@ -0,0 +1,9 @@
+-- add sms factor type with phone storage on mfa_factors and code storage on mfa_challenges
+
+alter type {{ index .Options "Namespace" }}.factor_type add value if not exists 'sms';
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists phone text null;
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists otp_code text null;
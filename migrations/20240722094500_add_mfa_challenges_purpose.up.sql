@@ -0,0 +1,4 @@
+-- record what a challenge was issued for, e.g. step_up
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists purpose text null;
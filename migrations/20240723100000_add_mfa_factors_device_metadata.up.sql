@@ -0,0 +1,5 @@
+-- store optional device metadata supplied by the client on enrollment
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists device_name text null,
+  add column if not exists platform text null;
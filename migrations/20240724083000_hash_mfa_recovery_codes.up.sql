@@ -0,0 +1,4 @@
+-- recovery codes are now stored hashed, existing plaintext codes can be
+-- hashed with `gotrue mfa hash-recovery-codes`
+
+comment on column {{ index .Options "Namespace" }}.mfa_recovery_codes.recovery_code is 'Auth: Hash of the recovery code, never the plaintext code.';
@@ -0,0 +1,6 @@
+-- store the parameters totp factors were enrolled with, null means the defaults (SHA1, 6 digits, 30 seconds)
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists totp_algorithm text null,
+  add column if not exists totp_digits integer null,
+  add column if not exists totp_period integer null;
@@ -0,0 +1,5 @@
+-- count how often a challenge chain has been refreshed, so that the number of
+-- refreshes can be capped
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists refresh_count smallint not null default 0;
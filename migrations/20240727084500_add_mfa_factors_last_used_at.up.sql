@@ -0,0 +1,4 @@
+-- record when a factor was last successfully verified
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists last_used_at timestamptz null;
@@ -0,0 +1,16 @@
+-- soft delete mfa_factors so that records of removed factors are retained
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists deleted_at timestamptz null;
+
+-- deleted factors must not block enrolling a factor with the same name or
+-- re-registering the same webauthn authenticator
+drop index if exists {{ index .Options "Namespace" }}.mfa_factors_user_friendly_name_unique;
+create unique index if not exists mfa_factors_user_friendly_name_unique
+  on {{ index .Options "Namespace" }}.mfa_factors (friendly_name, user_id)
+  where trim(friendly_name) <> '' and deleted_at is null;
+
+drop index if exists {{ index .Options "Namespace" }}.mfa_factors_web_authn_credential_id_idx;
+create unique index if not exists mfa_factors_web_authn_credential_id_idx
+  on {{ index .Options "Namespace" }}.mfa_factors (web_authn_credential_id)
+  where web_authn_credential_id is not null and deleted_at is null;
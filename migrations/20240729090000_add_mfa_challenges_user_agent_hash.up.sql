@@ -0,0 +1,5 @@
+-- bind challenges to the user agent they were created from, in addition to
+-- the ip address
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists user_agent_hash text null;
@@ -0,0 +1,16 @@
+-- group the recovery codes created by one generation into a batch
+
+alter table {{ index .Options "Namespace" }}.mfa_recovery_codes
+  add column if not exists batch_id uuid null;
+
+-- codes generated before batches existed are grouped by the second they were
+-- created in, as all codes of a set are created together
+update {{ index .Options "Namespace" }}.mfa_recovery_codes
+  set batch_id = md5(user_id::text || date_trunc('second', created_at)::text)::uuid
+  where batch_id is null;
+
+alter table {{ index .Options "Namespace" }}.mfa_recovery_codes
+  alter column batch_id set not null;
+
+create index if not exists mfa_recovery_codes_user_id_batch_id_idx
+  on {{ index .Options "Namespace" }}.mfa_recovery_codes (user_id, batch_id);
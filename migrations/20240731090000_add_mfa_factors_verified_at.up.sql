@@ -0,0 +1,10 @@
+-- record when a factor was verified
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists verified_at timestamptz null;
+
+-- the time of verification of existing factors is unknown, their last update
+-- is the closest approximation
+update {{ index .Options "Namespace" }}.mfa_factors
+  set verified_at = updated_at
+  where status = 'verified' and verified_at is null;
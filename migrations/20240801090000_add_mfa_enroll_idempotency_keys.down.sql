@@ -0,0 +1 @@
+drop table if exists {{ index .Options "Namespace" }}.mfa_enroll_idempotency_keys;
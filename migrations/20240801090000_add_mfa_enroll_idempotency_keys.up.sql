@@ -0,0 +1,12 @@
+-- idempotency keys let clients retry enroll requests without creating
+-- duplicate factors
+
+create table if not exists {{ index .Options "Namespace" }}.mfa_enroll_idempotency_keys (
+  user_id uuid not null references {{ index .Options "Namespace" }}.users(id) on delete cascade,
+  key text not null,
+  factor_id uuid not null references {{ index .Options "Namespace" }}.mfa_factors(id) on delete cascade,
+  created_at timestamptz not null,
+  primary key (user_id, key)
+);
+
+comment on table {{ index .Options "Namespace" }}.mfa_enroll_idempotency_keys is 'auth: stores the factor created by an enroll request for its Idempotency-Key';
@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  drop column if exists first_totp_step;
@@ -0,0 +1,5 @@
+-- record the time step of the first code accepted for a challenge when two
+-- consecutive TOTP codes are required to verify a newly enrolled factor
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists first_totp_step bigint null;
@@ -0,0 +1,4 @@
+-- challenges that only accept codes generated after they were created
+
+alter table {{ index .Options "Namespace" }}.mfa_challenges
+  add column if not exists force_reauth boolean not null default false;
@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.users
+  drop column if exists mfa_required;
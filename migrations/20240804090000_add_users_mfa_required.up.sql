@@ -0,0 +1,5 @@
+-- require MFA from individual users, e.g. when an admin rolls it out to all
+-- users of a role
+
+alter table {{ index .Options "Namespace" }}.users
+  add column if not exists mfa_required boolean not null default false;
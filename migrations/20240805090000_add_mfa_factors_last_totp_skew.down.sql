@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  drop column if exists last_totp_skew;
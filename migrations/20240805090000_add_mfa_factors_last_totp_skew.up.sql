@@ -0,0 +1,5 @@
+-- record how many time steps the last accepted TOTP code was off by, to find
+-- users whose device clocks drift
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists last_totp_skew integer null;
@@ -0,0 +1 @@
+drop table if exists {{ index .Options "Namespace" }}.mfa_trusted_devices;
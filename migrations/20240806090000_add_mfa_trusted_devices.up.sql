@@ -0,0 +1,15 @@
+-- trusted devices let users skip the MFA challenge when signing in from a
+-- device that completed MFA recently
+
+create table if not exists {{ index .Options "Namespace" }}.mfa_trusted_devices (
+  id uuid not null primary key,
+  user_id uuid not null references {{ index .Options "Namespace" }}.users(id) on delete cascade,
+  factor_id uuid null references {{ index .Options "Namespace" }}.mfa_factors(id) on delete cascade,
+  user_agent text null,
+  created_at timestamptz not null,
+  expires_at timestamptz not null
+);
+
+create index if not exists mfa_trusted_devices_user_id_idx on {{ index .Options "Namespace" }}.mfa_trusted_devices (user_id);
+
+comment on table {{ index .Options "Namespace" }}.mfa_trusted_devices is 'auth: stores devices that may skip the MFA challenge until they expire or are revoked';
@@ -0,0 +1,4 @@
+-- bumping the version revokes every trusted device token issued to the user
+
+alter table {{ index .Options "Namespace" }}.users
+  add column if not exists mfa_trusted_device_version integer not null default 0;
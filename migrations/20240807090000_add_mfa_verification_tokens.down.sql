@@ -0,0 +1 @@
+drop table if exists {{ index .Options "Namespace" }}.mfa_verification_tokens;
@@ -0,0 +1,14 @@
+-- verification tokens let a verified MFA challenge be exchanged for a session
+-- in a separate request
+
+create table if not exists {{ index .Options "Namespace" }}.mfa_verification_tokens (
+  id uuid not null primary key,
+  token_hash text not null unique,
+  user_id uuid not null references {{ index .Options "Namespace" }}.users(id) on delete cascade,
+  session_id uuid not null references {{ index .Options "Namespace" }}.sessions(id) on delete cascade,
+  factor_id uuid not null references {{ index .Options "Namespace" }}.mfa_factors(id) on delete cascade,
+  created_at timestamptz not null,
+  expires_at timestamptz not null
+);
+
+comment on table {{ index .Options "Namespace" }}.mfa_verification_tokens is 'auth: stores hashes of single use tokens that exchange a verified MFA challenge for a session';
@@ -0,0 +1,5 @@
+-- let users choose the order their factors are listed in, factors without a
+-- sort order are listed after the ordered ones
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists sort_order integer null;
@@ -0,0 +1 @@
+drop table if exists {{ index .Options "Namespace" }}.mfa_challenge_requests;
@@ -0,0 +1,12 @@
+-- challenge requests record when a user created an MFA challenge, so that
+-- challenge creation can be rate limited per user across all of their factors
+
+create table if not exists {{ index .Options "Namespace" }}.mfa_challenge_requests (
+  id uuid not null primary key,
+  user_id uuid not null references {{ index .Options "Namespace" }}.users(id) on delete cascade,
+  created_at timestamptz not null
+);
+
+create index if not exists mfa_challenge_requests_user_id_created_at_idx on {{ index .Options "Namespace" }}.mfa_challenge_requests (user_id, created_at);
+
+comment on table {{ index .Options "Namespace" }}.mfa_challenge_requests is 'auth: stores recent MFA challenge creations for per user rate limiting';
@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.mfa_recovery_codes
+  drop column if exists verified_ip;
@@ -0,0 +1,4 @@
+-- record where a recovery code was used from, for reviewing incidents
+
+alter table {{ index .Options "Namespace" }}.mfa_recovery_codes
+  add column if not exists verified_ip inet null;
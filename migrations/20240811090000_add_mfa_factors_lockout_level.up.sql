@@ -0,0 +1,4 @@
+-- number of escalating lockouts since the last successful verification
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists lockout_level smallint not null default 0;
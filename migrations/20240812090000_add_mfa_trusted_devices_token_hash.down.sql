@@ -0,0 +1,3 @@
+alter table {{ index .Options "Namespace" }}.mfa_trusted_devices
+  drop column if exists version,
+  drop column if exists token_hash;
@@ -0,0 +1,6 @@
+-- trusted devices present an opaque token, only its hash is stored. Devices
+-- trusted before have no token hash and have to complete MFA again.
+
+alter table {{ index .Options "Namespace" }}.mfa_trusted_devices
+  add column if not exists token_hash text null unique,
+  add column if not exists version integer not null default 0;
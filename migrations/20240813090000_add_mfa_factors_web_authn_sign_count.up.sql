@@ -0,0 +1,4 @@
+-- store the signature counter of webauthn credentials to detect cloned authenticators
+
+alter table {{ index .Options "Namespace" }}.mfa_factors
+  add column if not exists web_authn_sign_count bigint not null default 0;
@@ -0,0 +1,2 @@
+alter table {{ index .Options "Namespace" }}.schema_migrations
+  drop column if exists applied_at;
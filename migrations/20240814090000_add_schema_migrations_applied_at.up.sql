@@ -0,0 +1,8 @@
+-- record when each migration was applied. Migrations applied before this one
+-- keep a null applied_at, as the time they ran is unknown
+
+alter table {{ index .Options "Namespace" }}.schema_migrations
+  add column if not exists applied_at timestamptz null;
+
+alter table {{ index .Options "Namespace" }}.schema_migrations
+  alter column applied_at set default now();